@@ -0,0 +1,325 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yigit-demirko/go-ledger/internal/auth"
+	"github.com/yigit-demirko/go-ledger/internal/ledger"
+	"github.com/yigit-demirko/go-ledger/internal/models"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// what we need to open another account
+type CreateAccountRequest struct {
+	Name     string             `json:"name" binding:"required"`
+	Currency money.Currency     `json:"currency"` // USD if not given
+	Kind     models.AccountKind `json:"kind"`     // SAVINGS if not given
+}
+
+// what we need to move money between two accounts of the same user
+type MoveRequest struct {
+	FromAccountID int64        `json:"from_account_id" binding:"required"`
+	ToAccountID   int64        `json:"to_account_id" binding:"required"`
+	Amount        money.Amount `json:"amount"` // must be more than zero, in the currency of both accounts
+	MovementDetails
+}
+
+// what we need to freeze or unfreeze an account
+type AccountStatusRequest struct {
+	Status models.AccountStatus `json:"status" binding:"required"` // ACTIVE, FROZEN_DEBIT or FROZEN_ALL
+	Reason string               `json:"reason" binding:"required"`
+}
+
+// what we need to close an account
+type CloseAccountRequest struct {
+	SweepToAccountID *int64 `json:"sweep_to_account_id"` // where what is left goes, not needed for an empty account
+	Reason           string `json:"reason" binding:"required"`
+}
+
+// CreateAccount opens another account for a user, like savings
+func CreateAccount(c *gin.Context) {
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var req CreateAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Currency == "" {
+		req.Currency = money.DefaultCurrency
+	}
+
+	account, err := ledger.OpenAccount(userID, req.Name, req.Currency, req.Kind)
+	if err != nil {
+		respondLedgerError(c, err, "Failed to create account")
+		return
+	}
+
+	c.JSON(http.StatusCreated, account)
+}
+
+// GetUserAccounts lists every account of a user
+func GetUserAccounts(c *gin.Context) {
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	user, err := models.GetUserByID(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get accounts"})
+		return
+	}
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, user.Accounts)
+}
+
+// GetAccount shows one account with what can be spent from it
+func GetAccount(c *gin.Context) {
+	account, ok := accessibleAccount(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"account":         account,
+		"pending_balance": account.PendingBalance(),
+		"available":       account.Available(),
+	})
+}
+
+// GetAccountTransactions shows the money movement history of one account
+func GetAccountTransactions(c *gin.Context) {
+	account, ok := accessibleAccount(c)
+	if !ok {
+		return
+	}
+
+	filter, limit, offset, ok := historyFilter(c)
+	if !ok {
+		return
+	}
+	filter.AccountID = &account.ID
+
+	transactions, err := models.GetTransactionsByUserID(*account.UserID, filter, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get transactions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, transactions)
+}
+
+// GetAccountHistoricalBalance shows what one account had at some time
+func GetAccountHistoricalBalance(c *gin.Context) {
+	account, ok := accessibleAccount(c)
+	if !ok {
+		return
+	}
+
+	respondBalanceAt(c, func(timestamp time.Time) (models.Balances, error) {
+		return models.GetAccountBalanceAtTime(account.ID, timestamp)
+	})
+}
+
+// InitializeAccountBalance lets admins ask to set the balance of one account, a second admin approves it
+func InitializeAccountBalance(c *gin.Context) {
+	accountID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+		return
+	}
+
+	var req struct {
+		Amount money.Amount `json:"amount"` // in the currency of the account
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if req.Amount.IsNegative() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Amount cannot be negative"})
+		return
+	}
+
+	// a second admin has to approve it before the difference is booked
+	claims := c.MustGet("user").(*auth.Claims)
+	approval, err := ledger.RequestAccountBalanceApproval(accountID, req.Amount, claims.UserID)
+	if err != nil {
+		respondLedgerError(c, err, "Failed to request balance approval")
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "Balance change needs approval", "approval": approval})
+}
+
+// MoveBetweenAccounts moves money between two accounts of the user in the URL
+func MoveBetweenAccounts(c *gin.Context) {
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var req MoveRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// an admin moving a user's money is recorded on the transaction
+	details := req.ledgerDetails()
+	claims := c.MustGet("user").(*auth.Claims)
+	if claims.UserID != userID {
+		callerID := claims.UserID
+		details.ActedBy = &callerID
+	}
+
+	result, err := ledger.Move(userID, req.FromAccountID, req.ToAccountID, req.Amount, details)
+	if err != nil {
+		respondLedgerError(c, err, "Failed to move money")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "Move successful",
+		"from_account": result.FromAccount,
+		"to_account":   result.ToAccount,
+		"transaction":  result.Transaction,
+	})
+}
+
+// SetAccountStatus freezes or unfreezes an account (admin only)
+func SetAccountStatus(c *gin.Context) {
+	accountID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+		return
+	}
+
+	var req AccountStatusRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	claims := c.MustGet("user").(*auth.Claims)
+	account, change, err := ledger.SetAccountStatus(ledger.StatusChange{
+		AccountID: accountID,
+		Status:    req.Status,
+		Reason:    req.Reason,
+		ChangedBy: claims.UserID,
+	})
+	if err != nil {
+		respondLedgerError(c, err, "Failed to change account status")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Account status updated",
+		"account": account,
+		"change":  change,
+	})
+}
+
+// CloseAccount closes an account for good, sweeping what is left on it first (admin only)
+func CloseAccount(c *gin.Context) {
+	accountID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+		return
+	}
+
+	var req CloseAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	claims := c.MustGet("user").(*auth.Claims)
+	result, err := ledger.CloseAccount(ledger.Closure{
+		AccountID:        accountID,
+		SweepToAccountID: req.SweepToAccountID,
+		Reason:           req.Reason,
+		ChangedBy:        claims.UserID,
+	})
+	if err != nil {
+		respondLedgerError(c, err, "Failed to close account")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Account closed",
+		"account": result.Account,
+		"change":  result.Change,
+		"sweep":   result.Sweep,
+	})
+}
+
+// GetAccountStatusHistory lists every freeze, unfreeze and closure of an account
+func GetAccountStatusHistory(c *gin.Context) {
+	account, ok := accessibleAccount(c)
+	if !ok {
+		return
+	}
+
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	offset, _ := strconv.Atoi(c.Query("offset"))
+	if limit <= 0 {
+		limit = defaultLimit
+	}
+	if offset < 0 {
+		offset = defaultOffset
+	}
+
+	changes, err := models.GetAccountStatusChanges(account.ID, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get status history"})
+		return
+	}
+
+	c.JSON(http.StatusOK, changes)
+}
+
+// accessibleAccount finds the user account in the URL if the caller may see it,
+// which is its owner or an admin; system accounts are only for the ledger itself
+// it answers the request itself and returns ok false otherwise
+func accessibleAccount(c *gin.Context) (*models.Account, bool) {
+	accountID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+		return nil, false
+	}
+
+	account, err := ledger.UserAccount(accountID)
+	if errors.Is(err, ledger.ErrAccountNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get account"})
+		return nil, false
+	}
+
+	claims := c.MustGet("user").(*auth.Claims)
+	if claims.Role != models.RoleAdmin && *account.UserID != claims.UserID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return nil, false
+	}
+
+	return account, true
+}
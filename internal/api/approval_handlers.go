@@ -0,0 +1,100 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yigit-demirko/go-ledger/internal/auth"
+	"github.com/yigit-demirko/go-ledger/internal/ledger"
+	"github.com/yigit-demirko/go-ledger/internal/models"
+)
+
+// what an admin can say when deciding an approval request, it is optional
+type ApprovalDecisionRequest struct {
+	Note string `json:"note"`
+}
+
+// GetApprovals lists approval requests, the pending ones if no status is given (admin only)
+func GetApprovals(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	offset, _ := strconv.Atoi(c.Query("offset"))
+	if limit <= 0 {
+		limit = defaultLimit
+	}
+	if offset < 0 {
+		offset = defaultOffset
+	}
+
+	status := models.ApprovalStatus(c.DefaultQuery("status", string(models.ApprovalStatusPending)))
+	requests, err := models.GetApprovalRequests(status, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get approval requests"})
+		return
+	}
+
+	c.JSON(http.StatusOK, requests)
+}
+
+// GetApproval shows one approval request to admins or whoever made it
+func GetApproval(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid approval request ID"})
+		return
+	}
+
+	request, err := models.GetApprovalRequestByID(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get approval request"})
+		return
+	}
+
+	claims := c.MustGet("user").(*auth.Claims)
+	if request == nil || (claims.Role != models.RoleAdmin && request.RequestedBy != claims.UserID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Approval request not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, request)
+}
+
+// ApproveRequest runs a pending request, only an admin who didn't make it can
+func ApproveRequest(c *gin.Context) {
+	decideApproval(c, ledger.ApproveRequest, "Request approved", "Failed to approve request")
+}
+
+// RejectRequest turns down a pending request, only an admin who didn't make it can
+func RejectRequest(c *gin.Context) {
+	decideApproval(c, ledger.RejectRequest, "Request rejected", "Failed to reject request")
+}
+
+// decideApproval runs decide on the approval request in the URL for the caller
+func decideApproval(c *gin.Context, decide func(id, approverID int64, note string) (*models.ApprovalRequest, error), message, fallback string) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid approval request ID"})
+		return
+	}
+
+	// the body is optional, a note just helps whoever looks at it later
+	var req ApprovalDecisionRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	claims := c.MustGet("user").(*auth.Claims)
+	request, err := decide(id, claims.UserID, req.Note)
+	if err != nil {
+		respondLedgerError(c, err, fallback)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":  message,
+		"approval": request,
+	})
+}
@@ -0,0 +1,309 @@
+package api
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yigit-demirko/go-ledger/internal/auth"
+	"github.com/yigit-demirko/go-ledger/internal/ledger"
+	"github.com/yigit-demirko/go-ledger/internal/models"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// the largest CSV file we read for a batch, a thousand lines fit easily
+const maxBatchFileBytes = 1 << 20
+
+// what we need to pay many recipients from one account
+type BatchTransferRequest struct {
+	FromUserID    *int64                     `json:"from_user_id"`    // the caller if not given, see transferSource
+	FromAccountID *int64                     `json:"from_account_id"` // an account of the sender, their default one if not given
+	Currency      money.Currency             `json:"currency"`        // USD if not given, for every line
+	Mode          models.BatchMode           `json:"mode"`            // ALL_OR_NOTHING if not given
+	Description   string                     `json:"description"`     // for lines that don't have their own
+	Lines         []BatchTransferLineRequest `json:"lines" binding:"required"`
+}
+
+// one recipient of a batch
+type BatchTransferLineRequest struct {
+	ToUserID    int64        `json:"to_user_id"`
+	ToAccountID *int64       `json:"to_account_id"`
+	Amount      money.Amount `json:"amount"`
+	MovementDetails
+}
+
+// CreateBatchTransfer pays many recipients from one account
+// the lines come as JSON, or as a CSV file in the body (text/csv) or uploaded
+// as "file" (multipart/form-data) with the other fields as query or form parameters
+func CreateBatchTransfer(c *gin.Context) {
+	var req BatchTransferRequest
+	var lines []ledger.BatchLine
+	var invalid []ledger.LineError
+
+	switch c.ContentType() {
+	case "text/csv", "multipart/form-data":
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBatchFileBytes)
+		var ok bool
+		if req, ok = batchOptions(c); !ok {
+			return
+		}
+		file, ok := batchFile(c)
+		if !ok {
+			return
+		}
+		defer file.Close()
+
+		var err error
+		lines, invalid, err = parseBatchCSV(file)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	default:
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		for i, line := range req.Lines {
+			lines = append(lines, ledger.BatchLine{
+				Line:    i + 1,
+				To:      ledger.Party{UserID: line.ToUserID, AccountID: line.ToAccountID},
+				Amount:  line.Amount,
+				Details: line.ledgerDetails(),
+			})
+		}
+	}
+
+	if len(invalid) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Some lines are invalid, nothing was sent", "lines": invalid})
+		return
+	}
+
+	fromUserID, actedBy, ok := transferSource(c, req.FromUserID)
+	if !ok {
+		return
+	}
+
+	if req.Currency == "" {
+		req.Currency = money.DefaultCurrency
+	}
+	if req.Mode == "" {
+		req.Mode = models.BatchModeAllOrNothing
+	}
+
+	claims := c.MustGet("user").(*auth.Claims)
+	batch, err := ledger.RunBatch(ledger.BatchRequest{
+		From:        ledger.Party{UserID: fromUserID, AccountID: req.FromAccountID},
+		Currency:    req.Currency,
+		Mode:        req.Mode,
+		Description: req.Description,
+		ActedBy:     actedBy,
+		CreatedBy:   claims.UserID,
+		Lines:       lines,
+	})
+	var validationErr *ledger.BatchValidationError
+	if errors.As(err, &validationErr) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Some lines are invalid, nothing was sent", "lines": validationErr.Lines})
+		return
+	}
+	if err != nil {
+		respondLedgerError(c, err, "Failed to run batch")
+		return
+	}
+
+	c.JSON(http.StatusCreated, batch)
+}
+
+// GetBatchTransfer shows a batch with the result of every line
+func GetBatchTransfer(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid batch ID"})
+		return
+	}
+
+	batch, err := models.GetBatchTransferByID(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get batch"})
+		return
+	}
+	if batch == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Batch not found"})
+		return
+	}
+
+	if !mayManageTransfer(c, batch.FromUserID, batch.CreatedBy) {
+		return
+	}
+
+	c.JSON(http.StatusOK, batch)
+}
+
+// GetUserBatchTransfers lists the batches paid from a user's money, without their lines
+func GetUserBatchTransfers(c *gin.Context) {
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	offset, _ := strconv.Atoi(c.Query("offset"))
+	if limit <= 0 {
+		limit = defaultLimit
+	}
+	if offset < 0 {
+		offset = defaultOffset
+	}
+
+	batches, err := models.GetBatchTransfersByUserID(userID, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get batches"})
+		return
+	}
+
+	c.JSON(http.StatusOK, batches)
+}
+
+// batchOptions reads the fields of a CSV batch from the form or the query
+// it answers the request itself and returns ok false when one is invalid
+func batchOptions(c *gin.Context) (BatchTransferRequest, bool) {
+	option := func(name string) string {
+		if value := c.PostForm(name); value != "" {
+			return value
+		}
+		return c.Query(name)
+	}
+
+	req := BatchTransferRequest{
+		Mode:        models.BatchMode(strings.ToUpper(option("mode"))),
+		Description: option("description"),
+	}
+	for name, id := range map[string]**int64{"from_user_id": &req.FromUserID, "from_account_id": &req.FromAccountID} {
+		if value := option(name); value != "" {
+			parsed, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + name})
+				return req, false
+			}
+			*id = &parsed
+		}
+	}
+	if value := option("currency"); value != "" {
+		currency, err := money.ParseCurrency(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return req, false
+		}
+		req.Currency = currency
+	}
+	return req, true
+}
+
+// batchFile opens the CSV of a batch, the body itself or the uploaded "file"
+// it answers the request itself and returns ok false when there is none
+func batchFile(c *gin.Context) (io.ReadCloser, bool) {
+	if c.ContentType() == "text/csv" {
+		return c.Request.Body, true
+	}
+
+	header, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload the CSV as \"file\""})
+		return nil, false
+	}
+	file, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read the uploaded file"})
+		return nil, false
+	}
+	return file, true
+}
+
+// parseBatchCSV reads the lines of a batch from a CSV file
+// the first row names the columns: to_user_id and amount are required,
+// to_account_id, description and client_reference are optional
+// rows that can't be read are returned as invalid, with their line in the file
+func parseBatchCSV(r io.Reader) ([]ledger.BatchLine, []ledger.LineError, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, errors.New("CSV must start with a header row like to_user_id,amount")
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch name {
+		case "to_user_id", "to_account_id", "amount", "description", "client_reference":
+			columns[name] = i
+		default:
+			return nil, nil, fmt.Errorf("unknown CSV column %q", name)
+		}
+	}
+	if _, ok := columns["to_user_id"]; !ok {
+		return nil, nil, errors.New("CSV needs a to_user_id column")
+	}
+	if _, ok := columns["amount"]; !ok {
+		return nil, nil, errors.New("CSV needs an amount column")
+	}
+
+	var lines []ledger.BatchLine
+	var invalid []ledger.LineError
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				return nil, nil, err
+			}
+			invalid = append(invalid, ledger.LineError{Line: parseErr.StartLine, Error: parseErr.Err.Error()})
+			continue
+		}
+		lineNumber, _ := reader.FieldPos(0)
+
+		field := func(name string) string {
+			if i, ok := columns[name]; ok {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		line := ledger.BatchLine{
+			Line: lineNumber,
+			Details: ledger.Details{
+				Description:     field("description"),
+				ClientReference: field("client_reference"),
+			},
+		}
+		if line.To.UserID, err = strconv.ParseInt(field("to_user_id"), 10, 64); err != nil {
+			invalid = append(invalid, ledger.LineError{Line: lineNumber, Error: "invalid to_user_id"})
+			continue
+		}
+		if value := field("to_account_id"); value != "" {
+			accountID, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				invalid = append(invalid, ledger.LineError{Line: lineNumber, Error: "invalid to_account_id"})
+				continue
+			}
+			line.To.AccountID = &accountID
+		}
+		if line.Amount, err = money.Parse(field("amount")); err != nil {
+			invalid = append(invalid, ledger.LineError{Line: lineNumber, Error: "invalid amount"})
+			continue
+		}
+
+		lines = append(lines, line)
+	}
+
+	return lines, invalid, nil
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yigit-demirko/go-ledger/internal/auth"
+	"github.com/yigit-demirko/go-ledger/internal/models"
+)
+
+// who should be able to send money for a user
+type DelegationRequest struct {
+	DelegateID int64 `json:"delegate_id" binding:"required"`
+}
+
+// CreateDelegation lets another user send money from a user's account (the user or an admin)
+func CreateDelegation(c *gin.Context) {
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var req DelegationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.DelegateID == userID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Users can already send their own money"})
+		return
+	}
+
+	claims := c.MustGet("user").(*auth.Claims)
+	delegation, err := models.CreateDelegation(userID, req.DelegateID, claims.UserID)
+	if errors.Is(err, models.ErrUserNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create delegation"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, delegation)
+}
+
+// GetDelegations lists who may send money for a user
+func GetDelegations(c *gin.Context) {
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	delegations, err := models.GetDelegationsByUserID(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get delegations"})
+		return
+	}
+
+	c.JSON(http.StatusOK, delegations)
+}
+
+// RevokeDelegation stops another user from sending money for a user (the user or an admin)
+func RevokeDelegation(c *gin.Context) {
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	delegateID, err := strconv.ParseInt(c.Param("delegate_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid delegate ID"})
+		return
+	}
+
+	delegation, err := models.RevokeDelegation(userID, delegateID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke delegation"})
+		return
+	}
+	if delegation == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Delegation not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, delegation)
+}
@@ -0,0 +1,206 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yigit-demirko/go-ledger/internal/auth"
+	"github.com/yigit-demirko/go-ledger/internal/ledger"
+	"github.com/yigit-demirko/go-ledger/internal/models"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// what we need to put a buyer's money in escrow for a seller
+type EscrowRequest struct {
+	FromUserID      *int64         `json:"from_user_id"`    // the buyer, the caller if not given, see transferSource
+	FromAccountID   *int64         `json:"from_account_id"` // an account of the buyer, their default one if not given
+	SellerID        int64          `json:"seller_id" binding:"required"`
+	SellerAccountID *int64         `json:"seller_account_id"` // an account of the seller, their default one if not given
+	Amount          money.Amount   `json:"amount"`
+	Currency        money.Currency `json:"currency"`     // USD if not given
+	RefundAfter     *time.Time     `json:"refund_after"` // RFC 3339, ESCROW_TTL from now if not given
+	MovementDetails
+}
+
+// what can be said when releasing or refunding an escrow, it is optional
+type SettleEscrowRequest struct {
+	Note string `json:"note"`
+}
+
+// CreateEscrow takes money from the buyer and keeps it in escrow for the seller
+func CreateEscrow(c *gin.Context) {
+	var req EscrowRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	buyerID, actedBy, ok := transferSource(c, req.FromUserID)
+	if !ok {
+		return
+	}
+
+	if req.Currency == "" {
+		req.Currency = money.DefaultCurrency
+	}
+
+	details := req.ledgerDetails()
+	details.ActedBy = actedBy
+	escrowReq := ledger.EscrowRequest{
+		Buyer:    ledger.Party{UserID: buyerID, AccountID: req.FromAccountID},
+		Seller:   ledger.Party{UserID: req.SellerID, AccountID: req.SellerAccountID},
+		Amount:   req.Amount,
+		Currency: req.Currency,
+		Details:  details,
+	}
+	if req.RefundAfter != nil {
+		escrowReq.RefundAfter = *req.RefundAfter
+	}
+	claims := c.MustGet("user").(*auth.Claims)
+	escrowReq.CreatedBy = claims.UserID
+
+	escrow, err := ledger.FundEscrow(escrowReq)
+	if err != nil {
+		respondLedgerError(c, err, "Failed to fund escrow")
+		return
+	}
+
+	c.JSON(http.StatusCreated, escrow)
+}
+
+// GetEscrow shows an escrow with everything that happened to it
+func GetEscrow(c *gin.Context) {
+	escrow, ok := visibleEscrow(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, escrow)
+}
+
+// ReleaseEscrow pays an escrow to the seller, the buyer confirming the trade or an admin can
+func ReleaseEscrow(c *gin.Context) {
+	settleEscrow(c, models.EscrowStatusReleased)
+}
+
+// RefundEscrow gives an escrow back to the buyer, the seller or an admin can
+// escrows nobody released are refunded by themselves after refund_after
+func RefundEscrow(c *gin.Context) {
+	settleEscrow(c, models.EscrowStatusRefunded)
+}
+
+// GetUserEscrows lists a user's escrows without their events
+// role=buyer shows the ones they paid into, seller the ones they get paid from
+func GetUserEscrows(c *gin.Context) {
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	role := models.EscrowRole(c.Query("role"))
+	if role != "" && role != models.EscrowRoleBuyer && role != models.EscrowRoleSeller {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be buyer or seller"})
+		return
+	}
+
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	offset, _ := strconv.Atoi(c.Query("offset"))
+	if limit <= 0 {
+		limit = defaultLimit
+	}
+	if offset < 0 {
+		offset = defaultOffset
+	}
+
+	status := models.EscrowStatus(c.Query("status"))
+	escrows, err := models.GetEscrowsByUserID(userID, role, status, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get escrows"})
+		return
+	}
+
+	c.JSON(http.StatusOK, escrows)
+}
+
+// settleEscrow releases (status RELEASED) or refunds the escrow in the URL
+// the buyer can only release and the seller can only refund, each giving the
+// money to the other side; admins can do both after a dispute
+func settleEscrow(c *gin.Context, status models.EscrowStatus) {
+	escrow, ok := visibleEscrow(c)
+	if !ok {
+		return
+	}
+
+	// the body is optional, a note just helps whoever looks at it later
+	var req SettleEscrowRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	claims := c.MustGet("user").(*auth.Claims)
+	var settled *models.Escrow
+	var err error
+	var message string
+	if status == models.EscrowStatusReleased {
+		reason := models.EscrowReasonBuyerConfirmed
+		if claims.UserID != escrow.BuyerID {
+			if claims.Role != models.RoleAdmin {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Only the buyer or an admin can release an escrow"})
+				return
+			}
+			reason = models.EscrowReasonAdminDecision
+		}
+		settled, err = ledger.ReleaseEscrow(escrow.ID, claims.UserID, reason, req.Note)
+		message = "Escrow released"
+	} else {
+		reason := models.EscrowReasonSellerRefunded
+		if claims.UserID != escrow.SellerID {
+			if claims.Role != models.RoleAdmin {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Only the seller or an admin can refund an escrow"})
+				return
+			}
+			reason = models.EscrowReasonAdminDecision
+		}
+		settled, err = ledger.RefundEscrow(escrow.ID, claims.UserID, reason, req.Note)
+		message = "Escrow refunded"
+	}
+	if err != nil {
+		respondLedgerError(c, err, "Failed to settle escrow")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": message,
+		"escrow":  settled,
+	})
+}
+
+// visibleEscrow finds the escrow in the URL if the caller is its buyer, its
+// seller or an admin; for anyone else it doesn't exist
+// it answers the request itself and returns ok false otherwise
+func visibleEscrow(c *gin.Context) (*models.Escrow, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid escrow ID"})
+		return nil, false
+	}
+
+	escrow, err := models.GetEscrowByID(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get escrow"})
+		return nil, false
+	}
+
+	claims := c.MustGet("user").(*auth.Claims)
+	if escrow == nil || (claims.Role != models.RoleAdmin && escrow.BuyerID != claims.UserID && escrow.SellerID != claims.UserID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Escrow not found"})
+		return nil, false
+	}
+	return escrow, true
+}
@@ -0,0 +1,176 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yigit-demirko/go-ledger/internal/auth"
+	"github.com/yigit-demirko/go-ledger/internal/fx"
+	"github.com/yigit-demirko/go-ledger/internal/ledger"
+	"github.com/yigit-demirko/go-ledger/internal/models"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// what we need to publish an exchange rate
+type PublishFXRateRequest struct {
+	BaseCurrency  money.Currency `json:"base_currency" binding:"required"`
+	QuoteCurrency money.Currency `json:"quote_currency" binding:"required"`
+	Rate          money.Rate     `json:"rate"`           // 1 base buys this much quote
+	SpreadBps     int64          `json:"spread_bps"`     // 0 if not given
+	EffectiveFrom *time.Time     `json:"effective_from"` // now if not given
+}
+
+// what we need to get a quote
+type FXQuoteRequest struct {
+	Amount       money.Amount   `json:"amount"` // in from_currency
+	FromCurrency money.Currency `json:"from_currency" binding:"required"`
+	ToCurrency   money.Currency `json:"to_currency" binding:"required"`
+}
+
+// what we need to send money in one currency and have it received in another
+// with a quote_id the amount and currencies come from the quote
+type ConvertTransferRequest struct {
+	FromUserID   *int64         `json:"from_user_id"` // the caller if not given, like a transfer
+	ToUserID     int64          `json:"to_user_id" binding:"required"`
+	QuoteID      *int64         `json:"quote_id"`
+	Amount       money.Amount   `json:"amount"`
+	FromCurrency money.Currency `json:"from_currency"`
+	ToCurrency   money.Currency `json:"to_currency"`
+	MovementDetails
+}
+
+// GetFXRates lists the rate of every currency pair, now or at the time in ?at=
+func GetFXRates(c *gin.Context) {
+	at := time.Now()
+	if atStr := c.Query("at"); atStr != "" {
+		parsed, err := time.Parse(time.RFC3339, atStr)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid at format"})
+			return
+		}
+		at = parsed
+	}
+
+	rates, err := models.GetEffectiveFXRates(at)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get rates"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"rates": rates, "at": at})
+}
+
+// PublishFXRate adds a rate for a currency pair (admin only)
+func PublishFXRate(c *gin.Context) {
+	var req PublishFXRateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	claims := c.MustGet("user").(*auth.Claims)
+	rate := models.FXRate{
+		BaseCurrency:  req.BaseCurrency,
+		QuoteCurrency: req.QuoteCurrency,
+		Rate:          req.Rate,
+		SpreadBps:     req.SpreadBps,
+		Source:        models.FXRateSourceAPI,
+		CreatedBy:     &claims.UserID,
+	}
+	if req.EffectiveFrom != nil {
+		rate.EffectiveFrom = *req.EffectiveFrom
+	}
+
+	created, err := fx.PublishRate(rate)
+	if err != nil {
+		respondLedgerError(c, err, "Failed to publish rate")
+		return
+	}
+
+	c.JSON(http.StatusCreated, created)
+}
+
+// ReloadFXRates loads the rates file again (admin only)
+func ReloadFXRates(c *gin.Context) {
+	loaded, err := fx.LoadRatesFromEnv()
+	if errors.Is(err, fx.ErrNoRatesFile) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load rates file: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Rates loaded", "loaded": loaded})
+}
+
+// CreateFXQuote prices a conversion and keeps that price for a short time
+func CreateFXQuote(c *gin.Context) {
+	var req FXQuoteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	claims := c.MustGet("user").(*auth.Claims)
+	quote, err := ledger.QuoteConversion(claims.UserID, req.Amount, req.FromCurrency, req.ToCurrency)
+	if err != nil {
+		respondLedgerError(c, err, "Failed to create quote")
+		return
+	}
+
+	c.JSON(http.StatusCreated, quote)
+}
+
+// ConvertTransfer sends money in one currency and has it received in another
+func ConvertTransfer(c *gin.Context) {
+	var req ConvertTransferRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	fromUserID, actedBy, ok := transferSource(c, req.FromUserID)
+	if !ok {
+		return
+	}
+	details := req.ledgerDetails()
+	details.ActedBy = actedBy
+
+	var result *ledger.ConversionResult
+	var err error
+	if req.QuoteID != nil {
+		// only the caller who asked for the quote can use it
+		claims := c.MustGet("user").(*auth.Claims)
+		result, err = ledger.ConvertWithQuote(fromUserID, req.ToUserID, *req.QuoteID, claims.UserID, details)
+	} else {
+		if req.FromCurrency == "" || req.ToCurrency == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from_currency and to_currency are required without a quote_id"})
+			return
+		}
+		result, err = ledger.Convert(fromUserID, req.ToUserID, req.Amount, req.FromCurrency, req.ToCurrency, details)
+	}
+	if err != nil {
+		respondLedgerError(c, err, "Failed to convert")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Conversion successful",
+		"from_user": gin.H{
+			"id":       fromUserID,
+			"balance":  result.FromAccount.Balance,
+			"currency": result.FromAccount.Currency,
+		},
+		"to_user": gin.H{
+			"id":       req.ToUserID,
+			"balance":  result.ToAccount.Balance,
+			"currency": result.ToAccount.Currency,
+		},
+		"transaction": result.Transaction,
+		"conversion":  result.Conversion,
+	})
+}
@@ -1,14 +1,17 @@
 package api
 
 import (
-	"database/sql"
+	"errors"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/yigit-demirko/go-ledger/internal/auth"
+	"github.com/yigit-demirko/go-ledger/internal/fx"
+	"github.com/yigit-demirko/go-ledger/internal/ledger"
 	"github.com/yigit-demirko/go-ledger/internal/models"
+	"github.com/yigit-demirko/go-ledger/internal/money"
 )
 
 // some default values we use
@@ -19,9 +22,9 @@ const (
 
 // what we need to make a new account
 type RegisterRequest struct {
-	Username string         `json:"username" binding:"required"`
-	Password string         `json:"password" binding:"required,min=6"`
-	Name     string         `json:"name" binding:"required"`
+	Username string          `json:"username" binding:"required"`
+	Password string          `json:"password" binding:"required,min=6"`
+	Name     string          `json:"name" binding:"required"`
 	Role     models.UserRole `json:"role,omitempty"`
 }
 
@@ -31,27 +34,72 @@ type LoginRequest struct {
 	Password string `json:"password" binding:"required"`
 }
 
+// what a client can save with a movement, all optional
+type MovementDetails struct {
+	Description     string          `json:"description"`
+	ClientReference string          `json:"client_reference"` // like an order id, history can be filtered by it
+	Metadata        models.Metadata `json:"metadata"`         // any JSON object, history can be filtered by its keys
+}
+
+func (d MovementDetails) ledgerDetails() ledger.Details {
+	return ledger.Details{
+		Description:     d.Description,
+		ClientReference: d.ClientReference,
+		Metadata:        d.Metadata,
+	}
+}
+
 // what we need to send money
 type TransferRequest struct {
-	FromUserID int64   `json:"from_user_id" binding:"required"`
-	ToUserID   int64   `json:"to_user_id" binding:"required"`
-	Amount     float64 `json:"amount" binding:"required,gt=0"`
+	FromUserID    *int64         `json:"from_user_id"`    // the caller if not given, see transferSource
+	FromAccountID *int64         `json:"from_account_id"` // an account of the sender, their default one if not given
+	ToUserID      int64          `json:"to_user_id" binding:"required"`
+	ToAccountID   *int64         `json:"to_account_id"` // an account of the receiver, their default one if not given
+	Amount        money.Amount   `json:"amount"`        // checked by the ledger, must be more than zero
+	Currency      money.Currency `json:"currency"`      // USD if not given, both accounts must use the same one
+	MovementDetails
+}
+
+// what we need to put money on or take money off a user's account
+type ExternalMovementRequest struct {
+	Amount            money.Amount   `json:"amount"`   // must be more than zero
+	Currency          money.Currency `json:"currency"` // USD if not given
+	ExternalReference string         `json:"external_reference" binding:"required"`
+	SourceSystem      string         `json:"source_system" binding:"required"`
+	Pending           bool           `json:"pending"` // PENDING until the other system confirms it
+	MovementDetails
+}
+
+// what we need to reverse a transaction, everything is optional
+type ReverseRequest struct {
+	Amount      *money.Amount `json:"amount"` // everything that is left if not given
+	Description string        `json:"description"`
+	Force       bool          `json:"force"` // admins only, reverse even if the recipient goes below zero
+}
+
+// why a pending transaction failed, optional
+type FailTransactionRequest struct {
+	Reason string `json:"reason"`
 }
 
 // what we need to see transaction history
 type TransactionHistoryRequest struct {
-	StartTime string `form:"start_time"`
-	EndTime   string `form:"end_time"`
-	Limit     int    `form:"limit"`
-	Offset    int    `form:"offset"`
+	StartTime       string                   `form:"start_time"`
+	EndTime         string                   `form:"end_time"`
+	Status          models.TransactionStatus `form:"status"`
+	ClientReference string                   `form:"client_reference"`
+	Limit           int                      `form:"limit"`
+	Offset          int                      `form:"offset"`
 }
 
 // what we need to check old balance
 type HistoricalBalanceRequest struct {
 	Timestamp string `form:"timestamp" binding:"required"`
+	Currency  string `form:"currency"` // only show this currency
 }
 
 // Register makes a new user account
+// SERVICE users move money in and out of the ledger, so only an admin can make them (CreateUser)
 func Register(c *gin.Context) {
 	var req RegisterRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -63,24 +111,17 @@ func Register(c *gin.Context) {
 	if req.Role == "" {
 		req.Role = models.RoleUser
 	}
-
-	// make sure role is valid
-	if req.Role != models.RoleUser && req.Role != models.RoleAdmin {
+	if !req.Role.Valid() {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role"})
 		return
 	}
-
-	// create login account
-	authUser, err := models.CreateAuthUser(req.Username, req.Password, req.Role)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+	if req.Role == models.RoleService {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only an admin can create SERVICE users"})
 		return
 	}
 
-	// create user profile
-	user, err := models.CreateUser(req.Name)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create ledger user"})
+	authUser, user, ok := registerUser(c, req)
+	if !ok {
 		return
 	}
 
@@ -102,6 +143,51 @@ func Register(c *gin.Context) {
 	})
 }
 
+// CreateUser lets an admin make a user with any role, like the login of a payment processor
+// unlike Register it gives no token, whoever gets the user logs in themselves
+func CreateUser(c *gin.Context) {
+	var req RegisterRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Role == "" {
+		req.Role = models.RoleUser
+	}
+	if !req.Role.Valid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role"})
+		return
+	}
+
+	authUser, user, ok := registerUser(c, req)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"id":       user.ID,
+		"name":     user.Name,
+		"username": authUser.Username,
+		"role":     authUser.Role,
+	})
+}
+
+// registerUser creates the login and the user profile together
+// it answers the request itself and returns ok false if that fails
+func registerUser(c *gin.Context, req RegisterRequest) (*models.AuthUser, *models.User, bool) {
+	authUser, user, err := models.Register(req.Username, req.Password, req.Name, req.Role)
+	if errors.Is(err, models.ErrUsernameTaken) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Username is already taken"})
+		return nil, nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+		return nil, nil, false
+	}
+	return authUser, user, true
+}
+
 // Login checks password and gives a token
 func Login(c *gin.Context) {
 	var req LoginRequest
@@ -112,14 +198,14 @@ func Login(c *gin.Context) {
 
 	// find the user
 	authUser, err := models.GetAuthUserByUsername(req.Username)
-	if err == sql.ErrNoRows {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
-		return
-	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
 		return
 	}
+	if authUser == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		return
+	}
 
 	// check if password is right
 	if !authUser.ValidatePassword(req.Password) {
@@ -137,7 +223,7 @@ func Login(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
 		"token": token,
 		"user": gin.H{
-			"id":       authUser.ID,
+			"id":       authUser.UserID,
 			"username": authUser.Username,
 			"role":     authUser.Role,
 		},
@@ -184,75 +270,193 @@ func TransferCredits(c *gin.Context) {
 		return
 	}
 
-	// check if sender has enough money
-	fromUser, err := models.GetUserWithBalance(req.FromUserID, req.Amount)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get source user"})
-		return
-	}
-	if fromUser == nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Source user not found or insufficient balance"})
+	fromUserID, actedBy, ok := transferSource(c, req.FromUserID)
+	if !ok {
 		return
 	}
 
-	// check if receiver exists
-	toUser, err := models.GetUserByID(req.ToUserID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get destination user"})
-		return
-	}
-	if toUser == nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Destination user not found"})
-		return
+	if req.Currency == "" {
+		req.Currency = money.DefaultCurrency
 	}
 
-	// take money from sender
-	if err := fromUser.UpdateBalance(-req.Amount); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update source user balance"})
-		return
-	}
+	details := req.ledgerDetails()
+	details.ActedBy = actedBy
 
-	// give money to receiver
-	if err := toUser.UpdateBalance(req.Amount); err != nil {
-		// if this fails, give money back to sender
-		_ = fromUser.UpdateBalance(req.Amount)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update destination user balance"})
+	// big transfers wait for a second person, see ApproveRequest
+	if ledger.NeedsApproval(req.Amount, req.Currency) {
+		claims := c.MustGet("user").(*auth.Claims)
+		approval, err := ledger.RequestTransferApproval(
+			ledger.Party{UserID: fromUserID, AccountID: req.FromAccountID},
+			ledger.Party{UserID: req.ToUserID, AccountID: req.ToAccountID},
+			req.Amount, req.Currency, details, claims.UserID,
+		)
+		if err != nil {
+			respondLedgerError(c, err, "Failed to request transfer approval")
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"message": "Transfer needs approval", "approval": approval})
 		return
 	}
 
-	// save the transfer in history
-	fromUserID := req.FromUserID
-	toUserID := req.ToUserID
-	transaction, err := models.CreateTransaction(&fromUserID, &toUserID, req.Amount, models.TransactionTypeTransfer)
+	// move the money and log it all at once
+	result, err := ledger.Transfer(
+		ledger.Party{UserID: fromUserID, AccountID: req.FromAccountID},
+		ledger.Party{UserID: req.ToUserID, AccountID: req.ToAccountID},
+		req.Amount, req.Currency, details,
+	)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"message": "Transfer successful but failed to log transaction",
-			"from_user": gin.H{
-				"id":      fromUser.ID,
-				"balance": fromUser.Balance,
-			},
-			"to_user": gin.H{
-				"id":      toUser.ID,
-				"balance": toUser.Balance,
-			},
-		})
+		respondLedgerError(c, err, "Failed to transfer credits")
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Transfer successful",
 		"from_user": gin.H{
-			"id":      fromUser.ID,
-			"balance": fromUser.Balance,
+			"id":         fromUserID,
+			"account_id": result.FromAccount.ID,
+			"balance":    result.FromAccount.Balance,
+			"available":  result.FromAccount.Available(),
+			"currency":   result.FromAccount.Currency,
 		},
 		"to_user": gin.H{
-			"id":      toUser.ID,
-			"balance": toUser.Balance,
+			"id":         req.ToUserID,
+			"account_id": result.ToAccount.ID,
+			"balance":    result.ToAccount.Balance,
+			"available":  result.ToAccount.Available(),
+			"currency":   result.ToAccount.Currency,
 		},
-		"transaction": transaction,
+		"transaction": result.Transaction,
 	})
 }
 
+// transferSource works out whose money a transfer spends: the caller's own,
+// unless they name another user, which only admins and that user's delegates
+// can do; actedBy is the caller for those, so the transaction records who did it
+// it answers the request itself and returns ok false when the caller isn't allowed
+func transferSource(c *gin.Context, requested *int64) (fromUserID int64, actedBy *int64, ok bool) {
+	claims := c.MustGet("user").(*auth.Claims)
+	if requested == nil || *requested == claims.UserID {
+		return claims.UserID, nil, true
+	}
+
+	if claims.Role != models.RoleAdmin {
+		delegate, err := models.IsDelegate(*requested, claims.UserID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check permissions"})
+			return 0, nil, false
+		}
+		if !delegate {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You can only send money from your own account"})
+			return 0, nil, false
+		}
+	}
+
+	callerID := claims.UserID
+	return *requested, &callerID, true
+}
+
+// respondLedgerError turns an error from the ledger into the right HTTP answer
+// anything we don't know about is a server error with the given message
+func respondLedgerError(c *gin.Context, err error, fallback string) {
+	switch {
+	case errors.Is(err, models.ErrInsufficientBalance):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Source user not found or insufficient balance"})
+	case errors.Is(err, models.ErrUserNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+	case errors.Is(err, ledger.ErrQuoteNotFound),
+		errors.Is(err, ledger.ErrAccountNotFound),
+		errors.Is(err, ledger.ErrScheduledTransferNotFound),
+		errors.Is(err, ledger.ErrStandingOrderNotFound),
+		errors.Is(err, ledger.ErrApprovalNotFound),
+		errors.Is(err, ledger.ErrPaymentRequestNotFound),
+		errors.Is(err, ledger.ErrEscrowNotFound),
+		errors.Is(err, ledger.ErrTransactionNotFound),
+		errors.Is(err, ledger.ErrHoldNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, ledger.ErrSelfApproval):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, fx.ErrRateExists),
+		errors.Is(err, models.ErrDuplicateReference),
+		errors.Is(err, ledger.ErrHoldNotActive),
+		errors.Is(err, models.ErrInvalidTransition),
+		errors.Is(err, models.ErrAccountFrozen),
+		errors.Is(err, models.ErrAccountClosed),
+		errors.Is(err, ledger.ErrAccountInUse),
+		errors.Is(err, ledger.ErrAccountOwes),
+		errors.Is(err, ledger.ErrAccountNotEmpty),
+		errors.Is(err, ledger.ErrNotScheduled),
+		errors.Is(err, ledger.ErrStandingOrderNotActive),
+		errors.Is(err, ledger.ErrStandingOrderNotPaused),
+		errors.Is(err, ledger.ErrStandingOrderEnded),
+		errors.Is(err, ledger.ErrApprovalNotPending),
+		errors.Is(err, ledger.ErrApprovalExpired),
+		errors.Is(err, ledger.ErrPaymentRequestNotPending),
+		errors.Is(err, ledger.ErrPaymentRequestExpired),
+		errors.Is(err, ledger.ErrEscrowNotFunded),
+		errors.Is(err, ledger.ErrNoLongerAllowed),
+		errors.Is(err, ledger.ErrHoldExpired):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, ledger.ErrSameUser),
+		errors.Is(err, ledger.ErrSameAccount),
+		errors.Is(err, ledger.ErrInvalidAccountName),
+		errors.Is(err, ledger.ErrInvalidAccountKind),
+		errors.Is(err, ledger.ErrInvalidAccountStatus),
+		errors.Is(err, ledger.ErrMissingStatusReason),
+		errors.Is(err, ledger.ErrInvalidExecuteAt),
+		errors.Is(err, ledger.ErrInvalidStartAt),
+		errors.Is(err, ledger.ErrBatchEmpty),
+		errors.Is(err, ledger.ErrBatchTooLarge),
+		errors.Is(err, ledger.ErrInvalidBatchMode),
+		errors.Is(err, ledger.ErrBatchNeedsApproval),
+		errors.Is(err, ledger.ErrSplitNoDebits),
+		errors.Is(err, ledger.ErrSplitNoCredits),
+		errors.Is(err, ledger.ErrSplitTooManyLegs),
+		errors.Is(err, ledger.ErrSplitUnbalanced),
+		errors.Is(err, ledger.ErrSplitLegAmount),
+		errors.Is(err, ledger.ErrSplitSharesBothSides),
+		errors.Is(err, ledger.ErrShareTooSmall),
+		errors.Is(err, ledger.ErrSplitSameAccount),
+		errors.Is(err, ledger.ErrNeedsApproval),
+		errors.Is(err, ledger.ErrSplitNeedsApproval),
+		errors.Is(err, ledger.ErrRequestNeedsApproval),
+		errors.Is(err, ledger.ErrEscrowNeedsApproval),
+		errors.Is(err, ledger.ErrInvalidRefundAfter),
+		errors.Is(err, ledger.ErrInvalidFailurePolicy),
+		errors.Is(err, ledger.ErrInvalidFrequency),
+		errors.Is(err, ledger.ErrInvalidInterval),
+		errors.Is(err, ledger.ErrInvalidCron),
+		errors.Is(err, ledger.ErrCronNotAllowed),
+		errors.Is(err, ledger.ErrInvalidEnd),
+		errors.Is(err, ledger.ErrNoOccurrences),
+		errors.Is(err, ledger.ErrInvalidAmount),
+		errors.Is(err, ledger.ErrCurrencyMismatch),
+		errors.Is(err, ledger.ErrMissingReference),
+		errors.Is(err, ledger.ErrNotReversible),
+		errors.Is(err, ledger.ErrNotPosted),
+		errors.Is(err, ledger.ErrAlreadyReversed),
+		errors.Is(err, ledger.ErrReversalTooLarge),
+		errors.Is(err, ledger.ErrReversalNoFunds),
+		errors.Is(err, ledger.ErrCaptureTooLarge),
+		errors.Is(err, ledger.ErrNoRecipient),
+		errors.Is(err, ledger.ErrInvalidExpiresAt),
+		errors.Is(err, ledger.ErrInvalidLimit),
+		errors.Is(err, ledger.ErrInvalidInterest),
+		errors.Is(err, ledger.ErrClientReferenceTooLong),
+		errors.Is(err, ledger.ErrMetadataTooLarge),
+		errors.Is(err, money.ErrTooPrecise),
+		errors.Is(err, money.ErrOutOfRange),
+		errors.Is(err, money.ErrUnknownCurrency),
+		errors.Is(err, fx.ErrNoRate),
+		errors.Is(err, fx.ErrSameCurrency),
+		errors.Is(err, fx.ErrAmountTooSmall),
+		errors.Is(err, fx.ErrInvalidSpread),
+		errors.Is(err, fx.ErrMissingRate):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+	}
+}
+
 // GetUserTransactions shows money movement history
 func GetUserTransactions(c *gin.Context) {
 	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
@@ -261,10 +465,27 @@ func GetUserTransactions(c *gin.Context) {
 		return
 	}
 
+	filter, limit, offset, ok := historyFilter(c)
+	if !ok {
+		return
+	}
+
+	transactions, err := models.GetTransactionsByUserID(userID, filter, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get transactions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, transactions)
+}
+
+// historyFilter reads the history filters and the page from the query string
+// it answers the request itself and returns ok false when they are wrong
+func historyFilter(c *gin.Context) (filter models.TransactionFilter, limit, offset int, ok bool) {
 	var req TransactionHistoryRequest
 	if err := c.ShouldBindQuery(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
+		return filter, 0, 0, false
 	}
 
 	// use default values if not specified
@@ -275,36 +496,30 @@ func GetUserTransactions(c *gin.Context) {
 		req.Offset = defaultOffset
 	}
 
-	var transactions []models.Transaction
-	if req.StartTime != "" && req.EndTime != "" {
-		// if dates given, find transactions between those dates
+	// metadata filters look like ?metadata[order_id]=42
+	filter = models.TransactionFilter{
+		Status:          req.Status,
+		ClientReference: req.ClientReference,
+		Metadata:        c.QueryMap("metadata"),
+	}
+	if req.StartTime != "" {
 		startTime, err := time.Parse(time.RFC3339, req.StartTime)
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid start_time format"})
-			return
+			return filter, 0, 0, false
 		}
-
+		filter.StartTime = &startTime
+	}
+	if req.EndTime != "" {
 		endTime, err := time.Parse(time.RFC3339, req.EndTime)
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid end_time format"})
-			return
-		}
-
-		transactions, err = models.GetUserTransactionsInTimeRange(userID, startTime, endTime, req.Limit, req.Offset)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get transactions"})
-			return
-		}
-	} else {
-		// if no dates, just get recent transactions
-		transactions, err = models.GetTransactionsByUserID(userID, req.Limit, req.Offset)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get transactions"})
-			return
+			return filter, 0, 0, false
 		}
+		filter.EndTime = &endTime
 	}
 
-	c.JSON(http.StatusOK, transactions)
+	return filter, req.Limit, req.Offset, true
 }
 
 func GetHistoricalBalance(c *gin.Context) {
@@ -314,6 +529,14 @@ func GetHistoricalBalance(c *gin.Context) {
 		return
 	}
 
+	respondBalanceAt(c, func(timestamp time.Time) (models.Balances, error) {
+		return models.GetBalanceAtTime(userID, timestamp)
+	})
+}
+
+// respondBalanceAt answers a historical balance request with what balancesAt
+// finds at the timestamp in the query string
+func respondBalanceAt(c *gin.Context, balancesAt func(time.Time) (models.Balances, error)) {
 	var req HistoricalBalanceRequest
 	if err := c.ShouldBindQuery(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -326,14 +549,24 @@ func GetHistoricalBalance(c *gin.Context) {
 		return
 	}
 
-	balance, err := models.GetBalanceAtTime(userID, timestamp)
+	balances, err := balancesAt(timestamp)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get historical balance"})
 		return
 	}
 
+	// only keep one currency if the caller asked for it
+	if req.Currency != "" {
+		currency, err := money.ParseCurrency(req.Currency)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid currency"})
+			return
+		}
+		balances = models.Balances{currency: balances[currency].Add(currency.Zero())}
+	}
+
 	c.JSON(http.StatusOK, models.BalanceWithTimestamp{
-		Balance:   balance,
+		Balances:  balances,
 		Timestamp: timestamp,
 	})
 }
@@ -341,7 +574,7 @@ func GetHistoricalBalance(c *gin.Context) {
 func ChangePassword(c *gin.Context) {
 	var req struct {
 		CurrentPassword string `json:"current_password" binding:"required"`
-		NewPassword    string `json:"new_password" binding:"required,min=6"`
+		NewPassword     string `json:"new_password" binding:"required,min=6"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -362,6 +595,10 @@ func ChangePassword(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
 		return
 	}
+	if authUser == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
 
 	if !authUser.ValidatePassword(req.CurrentPassword) {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid current password"})
@@ -384,10 +621,10 @@ func HealthCheck(c *gin.Context) {
 	})
 }
 
-// InitializeBalance lets admins set a user's initial balance
+// InitializeBalance lets admins ask to set a user's balance, a second admin approves it
 func InitializeBalance(c *gin.Context) {
 	// get user ID from URL
-	userID, err := strconv.Atoi(c.Param("id"))
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
 		return
@@ -395,18 +632,210 @@ func InitializeBalance(c *gin.Context) {
 
 	// get amount from request body
 	var req struct {
-		Amount float64 `json:"amount" binding:"required"`
+		Amount   money.Amount   `json:"amount"`
+		Currency money.Currency `json:"currency"` // USD if not given
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
 		return
 	}
+	if req.Amount.IsNegative() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Amount cannot be negative"})
+		return
+	}
+
+	if req.Currency == "" {
+		req.Currency = money.DefaultCurrency
+	}
+
+	// a second admin has to approve it before the difference is booked
+	claims := c.MustGet("user").(*auth.Claims)
+	approval, err := ledger.RequestBalanceApproval(userID, req.Amount, req.Currency, claims.UserID)
+	if err != nil {
+		respondLedgerError(c, err, "Failed to request balance approval")
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "Balance change needs approval", "approval": approval})
+}
+
+// Deposit puts money from outside the ledger on a user's account (admin or service only)
+func Deposit(c *gin.Context) {
+	moveExternal(c, ledger.Deposit, "Deposit successful", "Failed to deposit")
+}
+
+// Withdraw takes money off a user's account and out of the ledger (admin or service only)
+func Withdraw(c *gin.Context) {
+	moveExternal(c, ledger.Withdraw, "Withdrawal successful", "Failed to withdraw")
+}
+
+// moveExternal runs a deposit or withdrawal for the user in the URL
+func moveExternal(c *gin.Context, move func(int64, money.Amount, money.Currency, ledger.External) (*ledger.MovementResult, error), message, fallback string) {
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var req ExternalMovementRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	// initialize balance
-	if err := models.InitializeUserBalance(userID, req.Amount); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if req.Currency == "" {
+		req.Currency = money.DefaultCurrency
+	}
+
+	result, err := move(userID, req.Amount, req.Currency, ledger.External{
+		Reference: req.ExternalReference,
+		Source:    req.SourceSystem,
+		Pending:   req.Pending,
+		Details:   req.ledgerDetails(),
+	})
+	if err != nil {
+		respondLedgerError(c, err, fallback)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Balance initialized successfully"})
+	c.JSON(http.StatusCreated, gin.H{
+		"message":         message,
+		"balance":         result.Account.Balance,
+		"pending_balance": result.Account.PendingBalance(),
+		"available":       result.Account.Available(),
+		"currency":        result.Account.Currency,
+		"transaction":     result.Transaction,
+	})
+}
+
+// ReverseTransaction gives back all or part of a transaction
+// admins can reverse anything, users only what they received (a refund)
+func ReverseTransaction(c *gin.Context) {
+	transactionID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid transaction ID"})
+		return
+	}
+
+	var req ReverseRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	original, err := models.GetTransactionByID(transactionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get transaction"})
+		return
+	}
+	if original == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transaction not found"})
+		return
+	}
+
+	claims := c.MustGet("user").(*auth.Claims)
+	isAdmin := claims.Role == models.RoleAdmin
+	if !isAdmin && (original.ToUserID == nil || *original.ToUserID != claims.UserID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return
+	}
+	if req.Force && !isAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can force a reversal"})
+		return
+	}
+
+	result, err := ledger.Reverse(ledger.Reversal{
+		TransactionID: transactionID,
+		Amount:        req.Amount,
+		Description:   req.Description,
+		Force:         req.Force,
+	})
+	if err != nil {
+		respondLedgerError(c, err, "Failed to reverse transaction")
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":     "Transaction reversed",
+		"transaction": result.Reversal,
+		"original":    result.Original,
+	})
+}
+
+// PostPendingTransaction moves the money of a pending transaction for real (admins or services)
+func PostPendingTransaction(c *gin.Context) {
+	transactionID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid transaction ID"})
+		return
+	}
+
+	transaction, err := ledger.PostPending(transactionID)
+	if err != nil {
+		respondLedgerError(c, err, "Failed to post transaction")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":     "Transaction posted",
+		"transaction": transaction,
+	})
+}
+
+// FailPendingTransaction gives back what a pending transaction put aside (admins or services)
+func FailPendingTransaction(c *gin.Context) {
+	transactionID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid transaction ID"})
+		return
+	}
+
+	var req FailTransactionRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	transaction, err := ledger.FailPending(transactionID, req.Reason)
+	if err != nil {
+		respondLedgerError(c, err, "Failed to mark transaction as failed")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":     "Transaction failed",
+		"transaction": transaction,
+	})
+}
+
+// GetCheckpointMismatches lists balance checkpoints that no longer match their postings (admin only)
+func GetCheckpointMismatches(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	offset, _ := strconv.Atoi(c.Query("offset"))
+	if limit <= 0 {
+		limit = defaultLimit
+	}
+	if offset < 0 {
+		offset = defaultOffset
+	}
+
+	checkpoints, err := models.GetMismatchedCheckpoints(limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get checkpoints"})
+		return
+	}
+
+	mismatches := make([]gin.H, 0, len(checkpoints))
+	for _, checkpoint := range checkpoints {
+		mismatches = append(mismatches, gin.H{
+			"checkpoint": checkpoint,
+			"delta":      checkpoint.Delta(),
+		})
+	}
+
+	c.JSON(http.StatusOK, mismatches)
 }
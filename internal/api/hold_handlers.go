@@ -0,0 +1,174 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yigit-demirko/go-ledger/internal/ledger"
+	"github.com/yigit-demirko/go-ledger/internal/models"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// what we need to reserve money
+type CreateHoldRequest struct {
+	Amount          money.Amount   `json:"amount"`            // must be more than zero
+	Currency        money.Currency `json:"currency"`          // USD if not given
+	RecipientUserID *int64         `json:"recipient_user_id"` // who gets the money on capture
+	Description     string         `json:"description"`
+	ExpiresAt       *time.Time     `json:"expires_at"` // HOLD_TTL from now if not given
+}
+
+// what we need to capture a hold, everything is optional
+type CaptureHoldRequest struct {
+	Amount      *money.Amount `json:"amount"`     // the whole hold if not given
+	ToUserID    *int64        `json:"to_user_id"` // the hold's recipient if not given
+	Description string        `json:"description"`
+}
+
+// what we need to list holds
+type HoldListRequest struct {
+	Status string `form:"status"`
+	Limit  int    `form:"limit"`
+	Offset int    `form:"offset"`
+}
+
+// CreateHold reserves money on a user's account
+func CreateHold(c *gin.Context) {
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var req CreateHoldRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Currency == "" {
+		req.Currency = money.DefaultCurrency
+	}
+
+	holdReq := ledger.HoldRequest{
+		UserID:          userID,
+		RecipientUserID: req.RecipientUserID,
+		Amount:          req.Amount,
+		Currency:        req.Currency,
+		Description:     req.Description,
+	}
+	if req.ExpiresAt != nil {
+		holdReq.ExpiresAt = *req.ExpiresAt
+	}
+
+	hold, err := ledger.PlaceHold(holdReq)
+	if err != nil {
+		respondLedgerError(c, err, "Failed to create hold")
+		return
+	}
+
+	c.JSON(http.StatusCreated, hold)
+}
+
+// GetUserHolds lists the holds on a user's money
+func GetUserHolds(c *gin.Context) {
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var req HoldListRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// use default values if not specified
+	if req.Limit <= 0 {
+		req.Limit = defaultLimit
+	}
+	if req.Offset < 0 {
+		req.Offset = defaultOffset
+	}
+
+	holds, err := models.GetHoldsByUserID(userID, models.HoldStatus(req.Status), req.Limit, req.Offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get holds"})
+		return
+	}
+
+	c.JSON(http.StatusOK, holds)
+}
+
+// GetHold shows one hold (admin or service only)
+func GetHold(c *gin.Context) {
+	holdID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid hold ID"})
+		return
+	}
+
+	hold, err := models.GetHoldByID(holdID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get hold"})
+		return
+	}
+	if hold == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Hold not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, hold)
+}
+
+// CaptureHold pays out all or part of a hold (admin or service only)
+func CaptureHold(c *gin.Context) {
+	holdID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid hold ID"})
+		return
+	}
+
+	var req CaptureHoldRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	result, err := ledger.CaptureHold(holdID, req.Amount, req.ToUserID, req.Description)
+	if err != nil {
+		respondLedgerError(c, err, "Failed to capture hold")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":     "Hold captured",
+		"hold":        result.Hold,
+		"transaction": result.Transaction,
+	})
+}
+
+// VoidHold cancels a hold and releases its money (admin or service only)
+func VoidHold(c *gin.Context) {
+	holdID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid hold ID"})
+		return
+	}
+
+	hold, err := ledger.VoidHold(holdID)
+	if err != nil {
+		respondLedgerError(c, err, "Failed to void hold")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Hold voided",
+		"hold":    hold,
+	})
+}
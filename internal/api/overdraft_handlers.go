@@ -0,0 +1,85 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yigit-demirko/go-ledger/internal/auth"
+	"github.com/yigit-demirko/go-ledger/internal/ledger"
+	"github.com/yigit-demirko/go-ledger/internal/models"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// what we need to change a credit line
+type OverdraftRequest struct {
+	Limit       money.Amount   `json:"limit"`                  // 0 ends the credit line
+	Currency    money.Currency `json:"currency"`               // USD if not given
+	InterestBps int64          `json:"overdraft_interest_bps"` // yearly, 0 if not given
+	Reason      string         `json:"reason" binding:"required"`
+}
+
+// SetOverdraftLimit changes how far below zero a user can go (admin only)
+func SetOverdraftLimit(c *gin.Context) {
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var req OverdraftRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Currency == "" {
+		req.Currency = money.DefaultCurrency
+	}
+
+	claims := c.MustGet("user").(*auth.Claims)
+	account, change, err := ledger.SetOverdraftLimit(ledger.OverdraftChange{
+		UserID:      userID,
+		Currency:    req.Currency,
+		Limit:       req.Limit,
+		InterestBps: req.InterestBps,
+		Reason:      req.Reason,
+		ChangedBy:   claims.UserID,
+	})
+	if err != nil {
+		respondLedgerError(c, err, "Failed to set overdraft limit")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Overdraft limit updated",
+		"account": account,
+		"change":  change,
+	})
+}
+
+// GetOverdraftHistory lists every change to a user's credit lines
+func GetOverdraftHistory(c *gin.Context) {
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	offset, _ := strconv.Atoi(c.Query("offset"))
+	if limit <= 0 {
+		limit = defaultLimit
+	}
+	if offset < 0 {
+		offset = defaultOffset
+	}
+
+	changes, err := models.GetOverdraftLimitChanges(userID, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get overdraft history"})
+		return
+	}
+
+	c.JSON(http.StatusOK, changes)
+}
@@ -0,0 +1,236 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yigit-demirko/go-ledger/internal/auth"
+	"github.com/yigit-demirko/go-ledger/internal/ledger"
+	"github.com/yigit-demirko/go-ledger/internal/models"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// what we need to ask someone for money
+type PaymentRequestRequest struct {
+	PayerID     int64          `json:"payer_id" binding:"required"`
+	ToAccountID *int64         `json:"to_account_id"` // an account of the requester, their default one if not given
+	Amount      money.Amount   `json:"amount"`        // checked by the ledger, must be more than zero
+	Currency    money.Currency `json:"currency"`      // USD if not given
+	Note        string         `json:"note"`
+}
+
+// what the payer can say when accepting a request, it is optional
+type AcceptPaymentRequestRequest struct {
+	FromAccountID *int64 `json:"from_account_id"` // an account of the payer, their default one if not given
+}
+
+// what the payer can say when declining a request, it is optional
+type DeclinePaymentRequestRequest struct {
+	Reason string `json:"reason"`
+}
+
+// RequestPayment asks another user to pay the caller
+func RequestPayment(c *gin.Context) {
+	var req PaymentRequestRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Currency == "" {
+		req.Currency = money.DefaultCurrency
+	}
+
+	claims := c.MustGet("user").(*auth.Claims)
+	request, err := ledger.RequestPayment(ledger.PaymentRequestInput{
+		Requester: ledger.Party{UserID: claims.UserID, AccountID: req.ToAccountID},
+		PayerID:   req.PayerID,
+		Amount:    req.Amount,
+		Currency:  req.Currency,
+		Note:      req.Note,
+	})
+	if err != nil {
+		respondLedgerError(c, err, "Failed to request payment")
+		return
+	}
+
+	c.JSON(http.StatusCreated, request)
+}
+
+// GetPaymentRequest shows one payment request to both sides of it and to admins
+func GetPaymentRequest(c *gin.Context) {
+	request, ok := visiblePaymentRequest(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, request)
+}
+
+// AcceptPaymentRequest pays a pending request, only the payer or an admin can
+func AcceptPaymentRequest(c *gin.Context) {
+	request, ok := visiblePaymentRequest(c)
+	if !ok {
+		return
+	}
+
+	// the body is optional, without it the payer's default account pays
+	var req AcceptPaymentRequestRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	actedBy, ok := actingPayer(c, request)
+	if !ok {
+		return
+	}
+
+	claims := c.MustGet("user").(*auth.Claims)
+	accepted, err := ledger.AcceptPaymentRequest(request.ID, req.FromAccountID, claims.UserID, actedBy)
+	if err != nil {
+		respondLedgerError(c, err, "Failed to accept payment request")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":         "Payment request accepted",
+		"payment_request": accepted,
+	})
+}
+
+// DeclinePaymentRequest turns down a pending request, only the payer or an admin can
+func DeclinePaymentRequest(c *gin.Context) {
+	request, ok := visiblePaymentRequest(c)
+	if !ok {
+		return
+	}
+
+	// the body is optional, a reason just tells the requester why
+	var req DeclinePaymentRequestRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if _, ok := actingPayer(c, request); !ok {
+		return
+	}
+
+	claims := c.MustGet("user").(*auth.Claims)
+	declined, err := ledger.DeclinePaymentRequest(request.ID, claims.UserID, req.Reason)
+	if err != nil {
+		respondLedgerError(c, err, "Failed to decline payment request")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":         "Payment request declined",
+		"payment_request": declined,
+	})
+}
+
+// CancelPaymentRequest takes back a pending request, only the requester or an admin can
+func CancelPaymentRequest(c *gin.Context) {
+	request, ok := visiblePaymentRequest(c)
+	if !ok {
+		return
+	}
+
+	claims := c.MustGet("user").(*auth.Claims)
+	if claims.Role != models.RoleAdmin && request.RequesterID != claims.UserID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the requester can cancel a payment request"})
+		return
+	}
+
+	cancelled, err := ledger.CancelPaymentRequest(request.ID, claims.UserID)
+	if err != nil {
+		respondLedgerError(c, err, "Failed to cancel payment request")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":         "Payment request cancelled",
+		"payment_request": cancelled,
+	})
+}
+
+// GetUserPaymentRequests lists a user's payment requests
+// direction=incoming shows what they are asked to pay, outgoing what they asked for
+func GetUserPaymentRequests(c *gin.Context) {
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	direction := models.PaymentRequestDirection(c.Query("direction"))
+	if direction != "" && direction != models.PaymentRequestsIncoming && direction != models.PaymentRequestsOutgoing {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "direction must be incoming or outgoing"})
+		return
+	}
+
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	offset, _ := strconv.Atoi(c.Query("offset"))
+	if limit <= 0 {
+		limit = defaultLimit
+	}
+	if offset < 0 {
+		offset = defaultOffset
+	}
+
+	status := models.PaymentRequestStatus(c.Query("status"))
+	requests, err := models.GetPaymentRequestsByUserID(userID, direction, status, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get payment requests"})
+		return
+	}
+
+	c.JSON(http.StatusOK, requests)
+}
+
+// actingPayer checks the caller may answer a request for its payer: the payer
+// or an admin, not a delegate, who could otherwise pay a request they made
+// themselves; actedBy is the admin, so the transaction records who did it
+// it answers the request itself and returns ok false otherwise
+func actingPayer(c *gin.Context, request *models.PaymentRequest) (actedBy *int64, ok bool) {
+	claims := c.MustGet("user").(*auth.Claims)
+	if request.PayerID == claims.UserID {
+		return nil, true
+	}
+	if claims.Role != models.RoleAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the payer can answer a payment request"})
+		return nil, false
+	}
+	callerID := claims.UserID
+	return &callerID, true
+}
+
+// visiblePaymentRequest finds the payment request in the URL if the caller is
+// its requester, its payer or an admin; for anyone else it doesn't exist
+// it answers the request itself and returns ok false otherwise
+func visiblePaymentRequest(c *gin.Context) (*models.PaymentRequest, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payment request ID"})
+		return nil, false
+	}
+
+	request, err := models.GetPaymentRequestByID(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get payment request"})
+		return nil, false
+	}
+
+	claims := c.MustGet("user").(*auth.Claims)
+	if request == nil || (claims.Role != models.RoleAdmin && request.RequesterID != claims.UserID && request.PayerID != claims.UserID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Payment request not found"})
+		return nil, false
+	}
+	return request, true
+}
@@ -1,6 +1,8 @@
 package api
 
 import (
+	"expvar"
+
 	"github.com/gin-gonic/gin"
 	"github.com/yigit-demirko/go-ledger/internal/middleware"
 	"github.com/yigit-demirko/go-ledger/internal/models"
@@ -24,6 +26,9 @@ func SetupRouter(r *gin.Engine) {
 		protected := v1.Group("")
 		protected.Use(middleware.AuthMiddleware())
 		{
+			// retries of money-moving requests with the same Idempotency-Key only run once
+			idempotent := middleware.Idempotency(middleware.IdempotencyTTL())
+
 			// stuff about users
 			users := protected.Group("/users")
 			{
@@ -39,11 +44,151 @@ func SetupRouter(r *gin.Engine) {
 				users.POST("/change-password", ChangePassword)
 
 				// only admins can initialize balance
-				users.POST("/:id/initialize-balance", middleware.RequireRole(models.RoleAdmin), InitializeBalance)
+				users.POST("/:id/initialize-balance", middleware.RequireRole(models.RoleAdmin), idempotent, InitializeBalance)
+
+				// users reserve their own money for a checkout
+				users.POST("/:id/holds", middleware.RequireOwnershipOrAdmin(), idempotent, CreateHold)
+				users.GET("/:id/holds", middleware.RequireOwnershipOrAdmin(), GetUserHolds)
+
+				// users can keep more than one account, like savings next to everyday money
+				users.POST("/:id/accounts", middleware.RequireOwnershipOrAdmin(), CreateAccount)
+				users.GET("/:id/accounts", middleware.RequireOwnershipOrAdmin(), GetUserAccounts)
+				users.POST("/:id/moves", middleware.RequireOwnershipOrAdmin(), idempotent, MoveBetweenAccounts)
+
+				// transfers waiting to run later
+				users.GET("/:id/scheduled-transfers", middleware.RequireOwnershipOrAdmin(), GetUserScheduledTransfers)
+				users.GET("/:id/standing-orders", middleware.RequireOwnershipOrAdmin(), GetUserStandingOrders)
+				users.GET("/:id/batch-transfers", middleware.RequireOwnershipOrAdmin(), GetUserBatchTransfers)
+
+				// money the user asked for, or was asked to pay
+				users.GET("/:id/payment-requests", middleware.RequireOwnershipOrAdmin(), GetUserPaymentRequests)
+
+				// money the user parked for a trade, as buyer or seller
+				users.GET("/:id/escrows", middleware.RequireOwnershipOrAdmin(), GetUserEscrows)
+
+				// credit lines, only admins can change them
+				users.PUT("/:id/overdraft", middleware.RequireRole(models.RoleAdmin), SetOverdraftLimit)
+				users.GET("/:id/overdraft/history", middleware.RequireOwnershipOrAdmin(), GetOverdraftHistory)
+
+				// who may send money for a user besides themselves and admins
+				users.POST("/:id/delegates", middleware.RequireOwnershipOrAdmin(), CreateDelegation)
+				users.GET("/:id/delegates", middleware.RequireOwnershipOrAdmin(), GetDelegations)
+				users.DELETE("/:id/delegates/:delegate_id", middleware.RequireOwnershipOrAdmin(), RevokeDelegation)
+
+				// money coming in from or going out to other systems (admins or services)
+				users.POST("/:id/deposits", middleware.RequireRole(models.RoleService), idempotent, Deposit)
+				users.POST("/:id/withdrawals", middleware.RequireRole(models.RoleService), idempotent, Withdraw)
+			}
+
+			// one account of a user, its owner or admins can see it
+			accounts := protected.Group("/accounts")
+			{
+				accounts.GET("/:id", GetAccount)
+				accounts.GET("/:id/transactions", GetAccountTransactions)
+				accounts.GET("/:id/balance/historical", GetAccountHistoricalBalance)
+				accounts.GET("/:id/status/history", GetAccountStatusHistory)
+
+				// only admins can initialize balance
+				accounts.POST("/:id/initialize-balance", middleware.RequireRole(models.RoleAdmin), idempotent, InitializeAccountBalance)
+
+				// admins stop a compromised or disputed account from moving money, or close it
+				accounts.PUT("/:id/status", middleware.RequireRole(models.RoleAdmin), SetAccountStatus)
+				accounts.POST("/:id/close", middleware.RequireRole(models.RoleAdmin), idempotent, CloseAccount)
+			}
+
+			// anyone logged in can send their own money (or money they were delegated)
+			protected.POST("/transfer", idempotent, TransferCredits)
+			protected.POST("/transfer/convert", idempotent, ConvertTransfer)
+			protected.POST("/transfer/split", idempotent, SplitTransfer)
+
+			// many recipients paid from one account at once, like payroll
+			protected.POST("/batch-transfers", idempotent, CreateBatchTransfer)
+			protected.GET("/batch-transfers/:id", GetBatchTransfer)
+
+			// transfers that run by themselves later, the sender (or whoever may send for them) manages them
+			scheduled := protected.Group("/scheduled-transfers")
+			{
+				scheduled.POST("", idempotent, ScheduleTransfer)
+				scheduled.GET("/:id", GetScheduledTransfer)
+				scheduled.PATCH("/:id", UpdateScheduledTransfer)
+				scheduled.POST("/:id/cancel", CancelScheduledTransfer)
+			}
+
+			// transfers that run again and again, managed like scheduled transfers
+			standingOrders := protected.Group("/standing-orders")
+			{
+				standingOrders.POST("", idempotent, CreateStandingOrder)
+				standingOrders.GET("/:id", GetStandingOrder)
+				standingOrders.GET("/:id/runs", GetStandingOrderRuns)
+				standingOrders.POST("/:id/pause", PauseStandingOrder)
+				standingOrders.POST("/:id/resume", ResumeStandingOrder)
+				standingOrders.POST("/:id/cancel", CancelStandingOrder)
+			}
+
+			// users ask each other for money, the payer accepts or declines
+			paymentRequests := protected.Group("/payment-requests")
+			{
+				paymentRequests.POST("", idempotent, RequestPayment)
+				paymentRequests.GET("/:id", GetPaymentRequest)
+				paymentRequests.POST("/:id/accept", idempotent, AcceptPaymentRequest)
+				paymentRequests.POST("/:id/decline", DeclinePaymentRequest)
+				paymentRequests.POST("/:id/cancel", CancelPaymentRequest)
+			}
+
+			// money parked for a trade until the buyer releases it, the seller refunds it or its time runs out
+			escrows := protected.Group("/escrows")
+			{
+				escrows.POST("", idempotent, CreateEscrow)
+				escrows.GET("/:id", GetEscrow)
+				escrows.POST("/:id/release", idempotent, ReleaseEscrow)
+				escrows.POST("/:id/refund", idempotent, RefundEscrow)
+			}
+
+			// the checkout system captures or voids holds (admins or services)
+			holds := protected.Group("/holds")
+			holds.Use(middleware.RequireRole(models.RoleService))
+			{
+				holds.GET("/:id", GetHold)
+				holds.POST("/:id/capture", idempotent, CaptureHold)
+				holds.POST("/:id/void", idempotent, VoidHold)
 			}
 
-			// anyone logged in can send money
-			v1.POST("/transfer", TransferCredits)
+			// refunds and corrections
+			protected.POST("/transactions/:id/reverse", idempotent, ReverseTransaction)
+
+			// the other system says if a pending deposit or withdrawal went through (admins or services)
+			protected.POST("/transactions/:id/post", middleware.RequireRole(models.RoleService), PostPendingTransaction)
+			protected.POST("/transactions/:id/fail", middleware.RequireRole(models.RoleService), FailPendingTransaction)
+
+			// big transfers and balance changes wait here for a second admin
+			approvals := protected.Group("/approvals")
+			{
+				approvals.GET("", middleware.RequireRole(models.RoleAdmin), GetApprovals)
+				approvals.GET("/:id", GetApproval)
+				approvals.POST("/:id/approve", middleware.RequireRole(models.RoleAdmin), ApproveRequest)
+				approvals.POST("/:id/reject", middleware.RequireRole(models.RoleAdmin), RejectRequest)
+			}
+
+			// checks on the books and SERVICE users, who can't sign up themselves (admins only)
+			admin := protected.Group("/admin")
+			admin.Use(middleware.RequireRole(models.RoleAdmin))
+			{
+				admin.POST("/users", CreateUser)
+				admin.GET("/checkpoints/mismatches", GetCheckpointMismatches)
+				// results of the last ledger check, among other server numbers
+				admin.GET("/metrics", gin.WrapH(expvar.Handler()))
+			}
+
+			// exchange rates and quotes
+			fxRoutes := protected.Group("/fx")
+			{
+				fxRoutes.GET("/rates", GetFXRates)
+				fxRoutes.POST("/quotes", CreateFXQuote)
+
+				// only admins can publish rates
+				fxRoutes.POST("/rates", middleware.RequireRole(models.RoleAdmin), PublishFXRate)
+				fxRoutes.POST("/rates/reload", middleware.RequireRole(models.RoleAdmin), ReloadFXRates)
+			}
 		}
 	}
-} 
\ No newline at end of file
+}
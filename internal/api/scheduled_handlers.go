@@ -0,0 +1,199 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yigit-demirko/go-ledger/internal/auth"
+	"github.com/yigit-demirko/go-ledger/internal/ledger"
+	"github.com/yigit-demirko/go-ledger/internal/models"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// what we need to send money later, like a transfer with a time
+type ScheduleTransferRequest struct {
+	TransferRequest
+	ExecuteAt time.Time `json:"execute_at" binding:"required"` // RFC 3339, must be in the future
+}
+
+// what can be changed about a scheduled transfer, everything is optional
+type UpdateScheduledTransferRequest struct {
+	Amount          *money.Amount   `json:"amount"`
+	ExecuteAt       *time.Time      `json:"execute_at"`
+	Description     *string         `json:"description"`
+	ClientReference *string         `json:"client_reference"`
+	Metadata        models.Metadata `json:"metadata"`
+}
+
+// ScheduleTransfer saves a transfer that runs by itself at execute_at
+func ScheduleTransfer(c *gin.Context) {
+	var req ScheduleTransferRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	fromUserID, actedBy, ok := transferSource(c, req.FromUserID)
+	if !ok {
+		return
+	}
+
+	if req.Currency == "" {
+		req.Currency = money.DefaultCurrency
+	}
+
+	details := req.ledgerDetails()
+	details.ActedBy = actedBy
+	claims := c.MustGet("user").(*auth.Claims)
+	transfer, err := ledger.ScheduleTransfer(ledger.ScheduledTransferRequest{
+		From:      ledger.Party{UserID: fromUserID, AccountID: req.FromAccountID},
+		To:        ledger.Party{UserID: req.ToUserID, AccountID: req.ToAccountID},
+		Amount:    req.Amount,
+		Currency:  req.Currency,
+		ExecuteAt: req.ExecuteAt,
+		Details:   details,
+		CreatedBy: claims.UserID,
+	})
+	if err != nil {
+		respondLedgerError(c, err, "Failed to schedule transfer")
+		return
+	}
+
+	c.JSON(http.StatusCreated, transfer)
+}
+
+// GetScheduledTransfer shows one scheduled transfer and how it went
+func GetScheduledTransfer(c *gin.Context) {
+	transfer, ok := accessibleScheduledTransfer(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, transfer)
+}
+
+// UpdateScheduledTransfer changes a scheduled transfer that didn't run yet
+func UpdateScheduledTransfer(c *gin.Context) {
+	transfer, ok := accessibleScheduledTransfer(c)
+	if !ok {
+		return
+	}
+
+	var req UpdateScheduledTransferRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	updated, err := ledger.UpdateScheduledTransfer(transfer.ID, ledger.ScheduledTransferChange{
+		Amount:          req.Amount,
+		ExecuteAt:       req.ExecuteAt,
+		Description:     req.Description,
+		ClientReference: req.ClientReference,
+		Metadata:        req.Metadata,
+	})
+	if err != nil {
+		respondLedgerError(c, err, "Failed to update scheduled transfer")
+		return
+	}
+
+	c.JSON(http.StatusOK, updated)
+}
+
+// CancelScheduledTransfer calls off a scheduled transfer that didn't run yet
+func CancelScheduledTransfer(c *gin.Context) {
+	transfer, ok := accessibleScheduledTransfer(c)
+	if !ok {
+		return
+	}
+
+	cancelled, err := ledger.CancelScheduledTransfer(transfer.ID)
+	if err != nil {
+		respondLedgerError(c, err, "Failed to cancel scheduled transfer")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":            "Scheduled transfer cancelled",
+		"scheduled_transfer": cancelled,
+	})
+}
+
+// GetUserScheduledTransfers lists the scheduled transfers paid from a user's money
+func GetUserScheduledTransfers(c *gin.Context) {
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	offset, _ := strconv.Atoi(c.Query("offset"))
+	if limit <= 0 {
+		limit = defaultLimit
+	}
+	if offset < 0 {
+		offset = defaultOffset
+	}
+
+	status := models.ScheduledTransferStatus(c.Query("status"))
+	transfers, err := models.GetScheduledTransfersByUserID(userID, status, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get scheduled transfers"})
+		return
+	}
+
+	c.JSON(http.StatusOK, transfers)
+}
+
+// accessibleScheduledTransfer finds the scheduled transfer in the URL if the
+// caller may see and change it, see mayManageTransfer
+// it answers the request itself and returns ok false otherwise
+func accessibleScheduledTransfer(c *gin.Context) (*models.ScheduledTransfer, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid scheduled transfer ID"})
+		return nil, false
+	}
+
+	transfer, err := models.GetScheduledTransferByID(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get scheduled transfer"})
+		return nil, false
+	}
+	if transfer == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Scheduled transfer not found"})
+		return nil, false
+	}
+
+	if !mayManageTransfer(c, transfer.FromUserID, transfer.CreatedBy) {
+		return nil, false
+	}
+	return transfer, true
+}
+
+// mayManageTransfer checks the caller may see and change a transfer set up to
+// run later: the sender, an admin, or the delegate who set it up as long as
+// they still are one
+// it answers the request itself and returns false otherwise
+func mayManageTransfer(c *gin.Context, fromUserID, createdBy int64) bool {
+	claims := c.MustGet("user").(*auth.Claims)
+	if claims.Role == models.RoleAdmin || fromUserID == claims.UserID {
+		return true
+	}
+	if createdBy == claims.UserID {
+		delegate, err := models.IsDelegate(fromUserID, claims.UserID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check permissions"})
+			return false
+		}
+		if delegate {
+			return true
+		}
+	}
+
+	c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+	return false
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yigit-demirko/go-ledger/internal/ledger"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// what we need to split one payment between several senders and receivers
+type SplitTransferRequest struct {
+	Currency money.Currency    `json:"currency"` // USD if not given, every account must use it
+	Debits   []SplitLegRequest `json:"debits" binding:"required"`
+	Credits  []SplitLegRequest `json:"credits" binding:"required"`
+	MovementDetails
+}
+
+// one sender or receiver of a split transfer, with an amount or a share
+type SplitLegRequest struct {
+	UserID    *int64       `json:"user_id"`    // for debits the caller if not given, see transferSource
+	AccountID *int64       `json:"account_id"` // an account of the user, their default one if not given
+	Amount    money.Amount `json:"amount"`
+	Share     int64        `json:"share"` // instead of an amount, a part of what the other side pays or gets
+}
+
+// SplitTransfer moves one payment from every debit leg to every credit leg,
+// like a buyer paying a seller, a platform fee and tax at once
+func SplitTransfer(c *gin.Context) {
+	var req SplitTransferRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Currency == "" {
+		req.Currency = money.DefaultCurrency
+	}
+
+	details := req.ledgerDetails()
+
+	// the caller has to be allowed to send the money of every debit leg
+	var debits []ledger.SplitLeg
+	for _, leg := range req.Debits {
+		userID, actedBy, ok := transferSource(c, leg.UserID)
+		if !ok {
+			return
+		}
+		if actedBy != nil {
+			details.ActedBy = actedBy
+		}
+		debits = append(debits, ledger.SplitLeg{
+			Party:  ledger.Party{UserID: userID, AccountID: leg.AccountID},
+			Amount: leg.Amount,
+			Share:  leg.Share,
+		})
+	}
+
+	var credits []ledger.SplitLeg
+	for _, leg := range req.Credits {
+		if leg.UserID == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Every credit leg needs a user_id"})
+			return
+		}
+		credits = append(credits, ledger.SplitLeg{
+			Party:  ledger.Party{UserID: *leg.UserID, AccountID: leg.AccountID},
+			Amount: leg.Amount,
+			Share:  leg.Share,
+		})
+	}
+
+	result, err := ledger.SplitTransfer(ledger.SplitRequest{
+		Currency: req.Currency,
+		Debits:   debits,
+		Credits:  credits,
+		Details:  details,
+	})
+	if err != nil {
+		respondLedgerError(c, err, "Failed to split transfer")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":     "Split transfer successful",
+		"debits":      splitLegResults(result.Debits),
+		"credits":     splitLegResults(result.Credits),
+		"transaction": result.Transaction,
+	})
+}
+
+// splitLegResults shows each leg the way TransferCredits shows its two sides
+func splitLegResults(legs []ledger.SplitLegResult) []gin.H {
+	results := make([]gin.H, 0, len(legs))
+	for _, leg := range legs {
+		results = append(results, gin.H{
+			"id":         leg.UserID,
+			"account_id": leg.Account.ID,
+			"amount":     leg.Amount,
+			"balance":    leg.Account.Balance,
+			"available":  leg.Account.Available(),
+			"currency":   leg.Account.Currency,
+		})
+	}
+	return results
+}
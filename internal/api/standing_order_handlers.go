@@ -0,0 +1,190 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yigit-demirko/go-ledger/internal/auth"
+	"github.com/yigit-demirko/go-ledger/internal/ledger"
+	"github.com/yigit-demirko/go-ledger/internal/models"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// what we need to send the same transfer again and again
+type StandingOrderRequest struct {
+	TransferRequest
+	Frequency           models.Frequency     `json:"frequency" binding:"required"` // DAILY, WEEKLY, MONTHLY or CRON
+	Interval            int                  `json:"interval"`                     // every how many days, weeks or months, 1 if not given
+	Cron                string               `json:"cron"`                         // like "0 9 1 * *", only for CRON
+	StartAt             time.Time            `json:"start_at"`                     // now if not given
+	EndAt               *time.Time           `json:"end_at"`
+	MaxOccurrences      *int                 `json:"max_occurrences"`
+	OnInsufficientFunds models.FailurePolicy `json:"on_insufficient_funds"` // SKIP if not given
+}
+
+// CreateStandingOrder sets up a transfer that runs on a schedule until it ends or is cancelled
+func CreateStandingOrder(c *gin.Context) {
+	var req StandingOrderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	fromUserID, actedBy, ok := transferSource(c, req.FromUserID)
+	if !ok {
+		return
+	}
+
+	if req.Currency == "" {
+		req.Currency = money.DefaultCurrency
+	}
+
+	details := req.ledgerDetails()
+	details.ActedBy = actedBy
+	claims := c.MustGet("user").(*auth.Claims)
+	order, err := ledger.CreateStandingOrder(ledger.StandingOrderRequest{
+		From:                ledger.Party{UserID: fromUserID, AccountID: req.FromAccountID},
+		To:                  ledger.Party{UserID: req.ToUserID, AccountID: req.ToAccountID},
+		Amount:              req.Amount,
+		Currency:            req.Currency,
+		Details:             details,
+		CreatedBy:           claims.UserID,
+		Frequency:           req.Frequency,
+		Interval:            req.Interval,
+		Cron:                req.Cron,
+		StartAt:             req.StartAt,
+		EndAt:               req.EndAt,
+		MaxOccurrences:      req.MaxOccurrences,
+		OnInsufficientFunds: req.OnInsufficientFunds,
+	})
+	if err != nil {
+		respondLedgerError(c, err, "Failed to create standing order")
+		return
+	}
+
+	c.JSON(http.StatusCreated, order)
+}
+
+// GetStandingOrder shows one standing order and when it runs next
+func GetStandingOrder(c *gin.Context) {
+	order, ok := accessibleStandingOrder(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, order)
+}
+
+// GetStandingOrderRuns lists every try of a standing order with the transfer it made
+func GetStandingOrderRuns(c *gin.Context) {
+	order, ok := accessibleStandingOrder(c)
+	if !ok {
+		return
+	}
+
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	offset, _ := strconv.Atoi(c.Query("offset"))
+	if limit <= 0 {
+		limit = defaultLimit
+	}
+	if offset < 0 {
+		offset = defaultOffset
+	}
+
+	runs, err := models.GetStandingOrderRuns(order.ID, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get standing order runs"})
+		return
+	}
+
+	c.JSON(http.StatusOK, runs)
+}
+
+// PauseStandingOrder stops a standing order from running until it is resumed
+func PauseStandingOrder(c *gin.Context) {
+	changeStandingOrder(c, ledger.PauseStandingOrder, "Standing order paused", "Failed to pause standing order")
+}
+
+// ResumeStandingOrder lets a paused standing order run again
+func ResumeStandingOrder(c *gin.Context) {
+	changeStandingOrder(c, ledger.ResumeStandingOrder, "Standing order resumed", "Failed to resume standing order")
+}
+
+// CancelStandingOrder stops a standing order for good
+func CancelStandingOrder(c *gin.Context) {
+	changeStandingOrder(c, ledger.CancelStandingOrder, "Standing order cancelled", "Failed to cancel standing order")
+}
+
+// GetUserStandingOrders lists the standing orders paid from a user's money
+func GetUserStandingOrders(c *gin.Context) {
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	offset, _ := strconv.Atoi(c.Query("offset"))
+	if limit <= 0 {
+		limit = defaultLimit
+	}
+	if offset < 0 {
+		offset = defaultOffset
+	}
+
+	status := models.StandingOrderStatus(c.Query("status"))
+	orders, err := models.GetStandingOrdersByUserID(userID, status, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get standing orders"})
+		return
+	}
+
+	c.JSON(http.StatusOK, orders)
+}
+
+// changeStandingOrder runs change on the standing order in the URL and answers with the result
+func changeStandingOrder(c *gin.Context, change func(id int64) (*models.StandingOrder, error), message, fallback string) {
+	order, ok := accessibleStandingOrder(c)
+	if !ok {
+		return
+	}
+
+	changed, err := change(order.ID)
+	if err != nil {
+		respondLedgerError(c, err, fallback)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":        message,
+		"standing_order": changed,
+	})
+}
+
+// accessibleStandingOrder finds the standing order in the URL if the caller
+// may see and change it, see mayManageTransfer
+// it answers the request itself and returns ok false otherwise
+func accessibleStandingOrder(c *gin.Context) (*models.StandingOrder, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid standing order ID"})
+		return nil, false
+	}
+
+	order, err := models.GetStandingOrderByID(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get standing order"})
+		return nil, false
+	}
+	if order == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Standing order not found"})
+		return nil, false
+	}
+
+	if !mayManageTransfer(c, order.FromUserID, order.CreatedBy) {
+		return nil, false
+	}
+	return order, true
+}
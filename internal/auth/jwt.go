@@ -10,9 +10,10 @@ import (
 )
 
 type Claims struct {
-	UserID   int64          `json:"user_id"`
-	Username string         `json:"username"`
-	Role     models.UserRole `json:"role"`
+	UserID     int64           `json:"user_id"`      // the ledger user, what /users/:id means
+	AuthUserID int64           `json:"auth_user_id"` // the login
+	Username   string          `json:"username"`
+	Role       models.UserRole `json:"role"`
 	jwt.RegisteredClaims
 }
 
@@ -26,9 +27,10 @@ func GenerateToken(user *models.AuthUser) (string, error) {
 
 	// Create claims
 	claims := Claims{
-		UserID:   user.ID,
-		Username: user.Username,
-		Role:     user.Role,
+		UserID:     user.UserID,
+		AuthUserID: user.ID,
+		Username:   user.Username,
+		Role:       user.Role,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)), // Token expires in 24 hours
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
@@ -75,4 +77,4 @@ func ValidateToken(tokenString string) (*Claims, error) {
 	}
 
 	return nil, fmt.Errorf("invalid token")
-} 
\ No newline at end of file
+}
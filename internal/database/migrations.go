@@ -1,8 +1,12 @@
 package database
 
-import "context"
+import (
+	"context"
+	"log"
+)
 
 // CreateTables creates all necessary database tables
+// every query is safe to run again, so this also upgrades older databases
 func CreateTables() error {
 	queries := []string{
 		`CREATE TABLE IF NOT EXISTS auth_users (
@@ -16,22 +20,485 @@ func CreateTables() error {
 		`CREATE TABLE IF NOT EXISTS users (
 			id SERIAL PRIMARY KEY,
 			name VARCHAR(255) NOT NULL,
-			balance DECIMAL(15,2) NOT NULL DEFAULT 0.00,
 			auth_user_id INTEGER REFERENCES auth_users(id),
 			created_at TIMESTAMP NOT NULL,
 			updated_at TIMESTAMP NOT NULL
 		)`,
+		// a transaction is the header of a journal entry, the money is in its postings
 		`CREATE TABLE IF NOT EXISTS transactions (
 			id SERIAL PRIMARY KEY,
 			from_user_id INTEGER REFERENCES users(id),
 			to_user_id INTEGER REFERENCES users(id),
-			amount DECIMAL(15,2) NOT NULL,
+			amount DECIMAL(18,3) NOT NULL,
+			currency CHAR(3) NOT NULL DEFAULT 'USD',
 			transaction_type VARCHAR(50) NOT NULL,
 			description TEXT,
 			created_at TIMESTAMP NOT NULL
 		)`,
 		`CREATE INDEX IF NOT EXISTS idx_transactions_user_id ON transactions(from_user_id, to_user_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_transactions_created_at ON transactions(created_at)`,
+		// user accounts hold user money, system accounts (with a code) are the ledger's own books
+		// there is one account per user (or system code) and currency
+		// amounts keep 3 decimal places, enough for every currency we support
+		`CREATE TABLE IF NOT EXISTS accounts (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER REFERENCES users(id),
+			code VARCHAR(50),
+			name VARCHAR(255) NOT NULL,
+			account_type VARCHAR(50) NOT NULL,
+			currency CHAR(3) NOT NULL DEFAULT 'USD',
+			balance DECIMAL(18,3) NOT NULL DEFAULT 0,
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL,
+			CHECK ((account_type = 'SYSTEM') = (code IS NOT NULL))
+		)`,
+		`CREATE TABLE IF NOT EXISTS postings (
+			id SERIAL PRIMARY KEY,
+			transaction_id INTEGER NOT NULL REFERENCES transactions(id),
+			account_id INTEGER NOT NULL REFERENCES accounts(id),
+			amount DECIMAL(18,3) NOT NULL CHECK (amount <> 0),
+			currency CHAR(3) NOT NULL DEFAULT 'USD',
+			created_at TIMESTAMP NOT NULL
+		)`,
+		// databases from before currencies: everything they have is USD
+		`ALTER TABLE transactions ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'USD'`,
+		`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'USD'`,
+		`ALTER TABLE postings ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'USD'`,
+		`ALTER TABLE accounts DROP CONSTRAINT IF EXISTS accounts_code_key`,
+		`DROP INDEX IF EXISTS idx_accounts_user_id`,
+		widenAmountColumns,
+		// a user can have many accounts in a currency, one of them is the default
+		// the accounts from before that were all the only one, so the default
+		`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS is_default BOOLEAN NOT NULL DEFAULT true`,
+		`ALTER TABLE accounts ALTER COLUMN is_default SET DEFAULT false`,
+		`DROP INDEX IF EXISTS idx_accounts_user_currency`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_accounts_user_default ON accounts(user_id, currency) WHERE is_default`,
+		`CREATE INDEX IF NOT EXISTS idx_accounts_owner ON accounts(user_id)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_accounts_code_currency ON accounts(code, currency)`,
+		`CREATE INDEX IF NOT EXISTS idx_postings_transaction_id ON postings(transaction_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_postings_account_id ON postings(account_id, created_at)`,
+		// system accounts for other currencies are opened when they are first needed
+		`INSERT INTO accounts (code, name, account_type, currency, created_at, updated_at) VALUES
+			('CASH_IN', 'Cash in', 'SYSTEM', 'USD', NOW(), NOW()),
+			('CASH_OUT', 'Cash out', 'SYSTEM', 'USD', NOW(), NOW()),
+			('FEES', 'Fees', 'SYSTEM', 'USD', NOW(), NOW()),
+			('EQUITY', 'Equity', 'SYSTEM', 'USD', NOW(), NOW())
+		ON CONFLICT (code, currency) DO NOTHING`,
+		migrateToPostings,
+		// postgres itself refuses to commit an entry whose postings don't add up to zero in every currency
+		`CREATE OR REPLACE FUNCTION check_entry_balanced() RETURNS trigger AS $$
+		BEGIN
+			IF (SELECT COUNT(*) FROM postings WHERE transaction_id = NEW.transaction_id) < 2 THEN
+				RAISE EXCEPTION 'journal entry % has less than two postings', NEW.transaction_id;
+			END IF;
+			IF EXISTS (
+				SELECT 1 FROM postings WHERE transaction_id = NEW.transaction_id
+				GROUP BY currency HAVING SUM(amount) <> 0
+			) THEN
+				RAISE EXCEPTION 'journal entry % is not balanced', NEW.transaction_id;
+			END IF;
+			RETURN NULL;
+		END
+		$$ LANGUAGE plpgsql`,
+		`DROP TRIGGER IF EXISTS postings_balanced ON postings`,
+		`CREATE CONSTRAINT TRIGGER postings_balanced
+			AFTER INSERT OR UPDATE ON postings
+			DEFERRABLE INITIALLY DEFERRED
+			FOR EACH ROW EXECUTE FUNCTION check_entry_balanced()`,
+		// user_id is the caller from the token, keys are only unique per caller
+		`CREATE TABLE IF NOT EXISTS idempotency_keys (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			idem_key VARCHAR(255) NOT NULL,
+			request_hash VARCHAR(64) NOT NULL,
+			status VARCHAR(20) NOT NULL,
+			response_code INTEGER,
+			response_body BYTEA,
+			created_at TIMESTAMP NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			UNIQUE (user_id, idem_key)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires_at ON idempotency_keys(expires_at)`,
+		// rates are never changed, a new rate for a pair replaces the old one from its effective time
+		`CREATE TABLE IF NOT EXISTS fx_rates (
+			id SERIAL PRIMARY KEY,
+			base_currency CHAR(3) NOT NULL,
+			quote_currency CHAR(3) NOT NULL,
+			rate DECIMAL(20,8) NOT NULL CHECK (rate > 0),
+			spread_bps INTEGER NOT NULL DEFAULT 0 CHECK (spread_bps >= 0 AND spread_bps < 10000),
+			effective_from TIMESTAMP NOT NULL,
+			source VARCHAR(20) NOT NULL,
+			created_by INTEGER,
+			created_at TIMESTAMP NOT NULL,
+			UNIQUE (base_currency, quote_currency, effective_from)
+		)`,
+		// created_by is the caller from the token, only they can use the quote
+		`CREATE TABLE IF NOT EXISTS fx_quotes (
+			id SERIAL PRIMARY KEY,
+			created_by INTEGER NOT NULL,
+			rate_id INTEGER NOT NULL REFERENCES fx_rates(id),
+			base_currency CHAR(3) NOT NULL,
+			quote_currency CHAR(3) NOT NULL,
+			mid_rate DECIMAL(20,8) NOT NULL,
+			customer_rate DECIMAL(20,8) NOT NULL,
+			spread_bps INTEGER NOT NULL,
+			source_amount DECIMAL(18,3) NOT NULL,
+			target_amount DECIMAL(18,3) NOT NULL,
+			spread_amount DECIMAL(18,3) NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			used_at TIMESTAMP,
+			created_at TIMESTAMP NOT NULL
+		)`,
+		// the price every conversion was made at, one row per conversion transaction
+		`CREATE TABLE IF NOT EXISTS fx_conversions (
+			transaction_id INTEGER PRIMARY KEY REFERENCES transactions(id),
+			quote_id INTEGER UNIQUE REFERENCES fx_quotes(id),
+			rate_id INTEGER NOT NULL REFERENCES fx_rates(id),
+			base_currency CHAR(3) NOT NULL,
+			quote_currency CHAR(3) NOT NULL,
+			mid_rate DECIMAL(20,8) NOT NULL,
+			customer_rate DECIMAL(20,8) NOT NULL,
+			spread_bps INTEGER NOT NULL,
+			source_amount DECIMAL(18,3) NOT NULL,
+			target_amount DECIMAL(18,3) NOT NULL,
+			spread_amount DECIMAL(18,3) NOT NULL,
+			created_at TIMESTAMP NOT NULL
+		)`,
+		// deposits and withdrawals say which payment in which outside system they were
+		`ALTER TABLE transactions ADD COLUMN IF NOT EXISTS external_reference VARCHAR(255)`,
+		`ALTER TABLE transactions ADD COLUMN IF NOT EXISTS source_system VARCHAR(100)`,
+		// reversals point at the transaction they give back
+		`ALTER TABLE transactions ADD COLUMN IF NOT EXISTS reverses_transaction_id INTEGER REFERENCES transactions(id)`,
+		`CREATE INDEX IF NOT EXISTS idx_transactions_reverses ON transactions(reverses_transaction_id)`,
+		// what active holds reserved on each account, kept next to the balance so
+		// checking the available balance is one row like checking the balance
+		`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS held DECIMAL(18,3) NOT NULL DEFAULT 0 CHECK (held >= 0)`,
+		`CREATE TABLE IF NOT EXISTS holds (
+			id SERIAL PRIMARY KEY,
+			account_id INTEGER NOT NULL REFERENCES accounts(id),
+			user_id INTEGER NOT NULL REFERENCES users(id),
+			recipient_user_id INTEGER REFERENCES users(id),
+			amount DECIMAL(18,3) NOT NULL CHECK (amount > 0),
+			captured_amount DECIMAL(18,3),
+			currency CHAR(3) NOT NULL,
+			status VARCHAR(20) NOT NULL,
+			description TEXT,
+			transaction_id INTEGER REFERENCES transactions(id),
+			expires_at TIMESTAMP NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_holds_user_id ON holds(user_id, created_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_holds_active_expires_at ON holds(expires_at) WHERE status = 'ACTIVE'`,
+		// credit lines: how far below zero an account may go, and the yearly interest it pays when it does
+		`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS overdraft_limit DECIMAL(18,3) NOT NULL DEFAULT 0 CHECK (overdraft_limit >= 0)`,
+		`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS overdraft_interest_bps INTEGER NOT NULL DEFAULT 0 CHECK (overdraft_interest_bps >= 0)`,
+		`CREATE TABLE IF NOT EXISTS overdraft_limit_changes (
+			id SERIAL PRIMARY KEY,
+			account_id INTEGER NOT NULL REFERENCES accounts(id),
+			user_id INTEGER NOT NULL REFERENCES users(id),
+			currency CHAR(3) NOT NULL,
+			old_limit DECIMAL(18,3) NOT NULL,
+			new_limit DECIMAL(18,3) NOT NULL,
+			old_interest_bps INTEGER NOT NULL,
+			new_interest_bps INTEGER NOT NULL,
+			reason TEXT,
+			changed_by INTEGER NOT NULL,
+			created_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_overdraft_limit_changes_user_id ON overdraft_limit_changes(user_id, created_at)`,
+		// one row per account and day that interest was worked out for, so it is never charged twice
+		`CREATE TABLE IF NOT EXISTS overdraft_accruals (
+			account_id INTEGER NOT NULL REFERENCES accounts(id),
+			accrual_date DATE NOT NULL,
+			transaction_id INTEGER REFERENCES transactions(id),
+			created_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (account_id, accrual_date)
+		)`,
+		// the balance of an account from all of its postings before as_of, kept by a background job
+		`CREATE TABLE IF NOT EXISTS balance_checkpoints (
+			account_id INTEGER NOT NULL REFERENCES accounts(id),
+			as_of TIMESTAMP NOT NULL,
+			balance DECIMAL(18,3) NOT NULL,
+			posting_count BIGINT NOT NULL,
+			verified_at TIMESTAMP,
+			mismatch_at TIMESTAMP,
+			expected_balance DECIMAL(18,3),
+			expected_posting_count BIGINT,
+			created_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (account_id, as_of)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_balance_checkpoints_verified_at ON balance_checkpoints(verified_at NULLS FIRST, as_of)`,
+		// what the client tells about a movement: its own reference and any JSON object it likes
+		`ALTER TABLE transactions ADD COLUMN IF NOT EXISTS client_reference VARCHAR(255)`,
+		`ALTER TABLE transactions ADD COLUMN IF NOT EXISTS metadata JSONB NOT NULL DEFAULT '{}'`,
+		`CREATE INDEX IF NOT EXISTS idx_transactions_client_reference ON transactions(client_reference)
+			WHERE client_reference IS NOT NULL`,
+		// transactions go PENDING -> POSTED or FAILED, and POSTED -> REVERSED
+		// everything booked before statuses existed was posted when it was made
+		`ALTER TABLE transactions ADD COLUMN IF NOT EXISTS status VARCHAR(20) NOT NULL DEFAULT 'POSTED'
+			CHECK (status IN ('PENDING', 'POSTED', 'FAILED', 'REVERSED'))`,
+		`ALTER TABLE transactions ADD COLUMN IF NOT EXISTS posted_at TIMESTAMP`,
+		`ALTER TABLE transactions ADD COLUMN IF NOT EXISTS failed_at TIMESTAMP`,
+		`ALTER TABLE transactions ADD COLUMN IF NOT EXISTS reversed_at TIMESTAMP`,
+		`ALTER TABLE transactions ADD COLUMN IF NOT EXISTS failure_reason TEXT`,
+		`UPDATE transactions SET posted_at = created_at WHERE posted_at IS NULL AND status IN ('POSTED', 'REVERSED')`,
+		`UPDATE transactions t SET status = 'REVERSED', reversed_at = r.last_at
+			FROM (
+				SELECT reverses_transaction_id AS id, SUM(amount) AS amount, MAX(created_at) AS last_at
+				FROM transactions WHERE reverses_transaction_id IS NOT NULL
+				GROUP BY reverses_transaction_id
+			) r
+			WHERE t.id = r.id AND t.status = 'POSTED' AND r.amount >= t.amount`,
+		`CREATE INDEX IF NOT EXISTS idx_transactions_pending ON transactions(created_at) WHERE status = 'PENDING'`,
+		// a failed deposit or withdrawal doesn't use up its external reference
+		`DROP INDEX IF EXISTS idx_transactions_external_reference`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_transactions_external_reference_live
+			ON transactions(source_system, external_reference)
+			WHERE external_reference IS NOT NULL AND status <> 'FAILED'`,
+		// the postings a pending transaction will write once it is posted, failed ones keep them as a record
+		`CREATE TABLE IF NOT EXISTS pending_postings (
+			id SERIAL PRIMARY KEY,
+			transaction_id INTEGER NOT NULL REFERENCES transactions(id),
+			account_id INTEGER NOT NULL REFERENCES accounts(id),
+			amount DECIMAL(18,3) NOT NULL,
+			currency CHAR(3) NOT NULL,
+			created_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_pending_postings_transaction_id ON pending_postings(transaction_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_pending_postings_account_id ON pending_postings(account_id)`,
+		// money in flight on each account: pending_out can't be spent, pending_in can't be spent yet
+		`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS pending_in DECIMAL(18,3) NOT NULL DEFAULT 0 CHECK (pending_in >= 0)`,
+		`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS pending_out DECIMAL(18,3) NOT NULL DEFAULT 0 CHECK (pending_out >= 0)`,
+		// who may send money from someone else's account, and who did
+		`CREATE TABLE IF NOT EXISTS delegations (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id),
+			delegate_id INTEGER NOT NULL REFERENCES users(id),
+			created_by INTEGER NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			revoked_at TIMESTAMP,
+			CHECK (user_id <> delegate_id)
+		)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_delegations_active ON delegations(user_id, delegate_id) WHERE revoked_at IS NULL`,
+		`ALTER TABLE transactions ADD COLUMN IF NOT EXISTS acted_by INTEGER`,
+		// every login has one ledger user, linked by users.auth_user_id
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_users_auth_user_id ON users(auth_user_id)`,
+		// users registered before the link was saved: registering made the login
+		// and then the user, so a login is only linked to the user with its id if
+		// it is also the last login made before that user; when the two ids drifted
+		// apart (or registrations ran at the same time) nothing is guessed, the
+		// user stays unlinked and reportUnlinkedUsers lists it
+		`UPDATE users u SET auth_user_id = a.id
+			FROM auth_users a
+			WHERE u.auth_user_id IS NULL
+			AND a.id = u.id
+			AND a.created_at <= u.created_at
+			AND NOT EXISTS (SELECT 1 FROM auth_users b WHERE b.id <> a.id AND b.created_at >= a.created_at AND b.created_at <= u.created_at)
+			AND NOT EXISTS (SELECT 1 FROM users o WHERE o.auth_user_id = a.id)`,
+		// logins whose ledger user was never made (registration failed half way) get one,
+		// but only once every old user is linked: until then a login without a user
+		// might be the owner of one of them
+		`INSERT INTO users (name, auth_user_id, created_at, updated_at)
+			SELECT a.username, a.id, a.created_at, a.updated_at FROM auth_users a
+			WHERE NOT EXISTS (SELECT 1 FROM users u WHERE u.auth_user_id = a.id)
+			AND NOT EXISTS (SELECT 1 FROM users u WHERE u.auth_user_id IS NULL)`,
+		// what a user keeps each of their accounts for, system accounts have none
+		`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS kind VARCHAR(20)`,
+		`UPDATE accounts SET kind = 'SPENDING' WHERE kind IS NULL AND account_type = 'USER'`,
+		// admins can freeze an account or close it for good
+		`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS status VARCHAR(20) NOT NULL DEFAULT 'ACTIVE'
+			CHECK (status IN ('ACTIVE', 'FROZEN_DEBIT', 'FROZEN_ALL', 'CLOSED'))`,
+		`CREATE TABLE IF NOT EXISTS account_status_changes (
+			id SERIAL PRIMARY KEY,
+			account_id INTEGER NOT NULL REFERENCES accounts(id),
+			old_status VARCHAR(20) NOT NULL,
+			new_status VARCHAR(20) NOT NULL,
+			reason TEXT NOT NULL,
+			sweep_transaction_id INTEGER REFERENCES transactions(id),
+			changed_by INTEGER NOT NULL,
+			created_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_account_status_changes_account_id ON account_status_changes(account_id, created_at)`,
+		// transfers a user set up to run later, picked up by a background job
+		`CREATE TABLE IF NOT EXISTS scheduled_transfers (
+			id SERIAL PRIMARY KEY,
+			from_user_id INTEGER NOT NULL REFERENCES users(id),
+			from_account_id INTEGER REFERENCES accounts(id),
+			to_user_id INTEGER NOT NULL REFERENCES users(id),
+			to_account_id INTEGER REFERENCES accounts(id),
+			amount DECIMAL(18,3) NOT NULL,
+			currency CHAR(3) NOT NULL,
+			description TEXT,
+			client_reference VARCHAR(255),
+			metadata JSONB NOT NULL DEFAULT '{}',
+			acted_by INTEGER,
+			created_by INTEGER NOT NULL,
+			execute_at TIMESTAMP NOT NULL,
+			next_attempt_at TIMESTAMP NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			status VARCHAR(20) NOT NULL CHECK (status IN ('SCHEDULED', 'EXECUTED', 'FAILED', 'CANCELLED')),
+			failure_reason TEXT,
+			transaction_id INTEGER REFERENCES transactions(id),
+			executed_at TIMESTAMP,
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_scheduled_transfers_due ON scheduled_transfers(next_attempt_at) WHERE status = 'SCHEDULED'`,
+		`CREATE INDEX IF NOT EXISTS idx_scheduled_transfers_from_user_id ON scheduled_transfers(from_user_id, execute_at)`,
+		`CREATE TABLE IF NOT EXISTS standing_orders (
+			id SERIAL PRIMARY KEY,
+			from_user_id INTEGER NOT NULL REFERENCES users(id),
+			from_account_id INTEGER REFERENCES accounts(id),
+			to_user_id INTEGER NOT NULL REFERENCES users(id),
+			to_account_id INTEGER REFERENCES accounts(id),
+			amount DECIMAL(18,3) NOT NULL,
+			currency CHAR(3) NOT NULL,
+			description TEXT,
+			client_reference VARCHAR(255),
+			metadata JSONB NOT NULL DEFAULT '{}',
+			acted_by INTEGER,
+			created_by INTEGER NOT NULL,
+			frequency VARCHAR(20) NOT NULL CHECK (frequency IN ('DAILY', 'WEEKLY', 'MONTHLY', 'CRON')),
+			interval_count INTEGER NOT NULL DEFAULT 1,
+			cron VARCHAR(100),
+			start_at TIMESTAMP NOT NULL,
+			end_at TIMESTAMP,
+			max_occurrences INTEGER,
+			on_insufficient_funds VARCHAR(20) NOT NULL CHECK (on_insufficient_funds IN ('SKIP', 'RETRY')),
+			status VARCHAR(20) NOT NULL CHECK (status IN ('ACTIVE', 'PAUSED', 'COMPLETED', 'CANCELLED', 'FAILED')),
+			occurrences INTEGER NOT NULL DEFAULT 0,
+			next_run_at TIMESTAMP,
+			next_attempt_at TIMESTAMP,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			failure_reason TEXT,
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_standing_orders_due ON standing_orders(next_attempt_at) WHERE status = 'ACTIVE'`,
+		`CREATE INDEX IF NOT EXISTS idx_standing_orders_from_user_id ON standing_orders(from_user_id, created_at)`,
+		`CREATE TABLE IF NOT EXISTS standing_order_runs (
+			id SERIAL PRIMARY KEY,
+			standing_order_id INTEGER NOT NULL REFERENCES standing_orders(id),
+			occurrence INTEGER NOT NULL,
+			scheduled_for TIMESTAMP NOT NULL,
+			attempt INTEGER NOT NULL,
+			status VARCHAR(20) NOT NULL CHECK (status IN ('EXECUTED', 'RETRYING', 'SKIPPED', 'FAILED')),
+			transaction_id INTEGER REFERENCES transactions(id),
+			failure_reason TEXT,
+			created_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_standing_order_runs_order_id ON standing_order_runs(standing_order_id, created_at)`,
+		`CREATE TABLE IF NOT EXISTS approval_requests (
+			id SERIAL PRIMARY KEY,
+			operation VARCHAR(20) NOT NULL CHECK (operation IN ('TRANSFER', 'SET_BALANCE')),
+			payload JSONB NOT NULL,
+			amount DECIMAL(18,3) NOT NULL,
+			currency CHAR(3) NOT NULL,
+			requested_by INTEGER NOT NULL,
+			status VARCHAR(20) NOT NULL CHECK (status IN ('PENDING', 'APPROVED', 'REJECTED', 'EXPIRED')),
+			decided_by INTEGER,
+			decision_note TEXT,
+			transaction_id INTEGER REFERENCES transactions(id),
+			expires_at TIMESTAMP NOT NULL,
+			decided_at TIMESTAMP,
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_approval_requests_pending ON approval_requests(created_at) WHERE status = 'PENDING'`,
+		`CREATE TABLE IF NOT EXISTS batch_transfers (
+			id SERIAL PRIMARY KEY,
+			from_user_id INTEGER NOT NULL REFERENCES users(id),
+			from_account_id INTEGER REFERENCES accounts(id),
+			currency CHAR(3) NOT NULL,
+			mode VARCHAR(20) NOT NULL CHECK (mode IN ('ALL_OR_NOTHING', 'BEST_EFFORT')),
+			status VARCHAR(20) NOT NULL CHECK (status IN ('COMPLETED', 'PARTIAL', 'FAILED')),
+			description TEXT,
+			acted_by INTEGER,
+			created_by INTEGER NOT NULL,
+			total_amount DECIMAL(18,3) NOT NULL,
+			paid_amount DECIMAL(18,3) NOT NULL,
+			line_count INTEGER NOT NULL,
+			succeeded_count INTEGER NOT NULL,
+			failed_count INTEGER NOT NULL,
+			created_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_batch_transfers_from_user_id ON batch_transfers(from_user_id, created_at)`,
+		`CREATE TABLE IF NOT EXISTS batch_transfer_lines (
+			id SERIAL PRIMARY KEY,
+			batch_id INTEGER NOT NULL REFERENCES batch_transfers(id),
+			line INTEGER NOT NULL,
+			to_user_id INTEGER NOT NULL REFERENCES users(id),
+			to_account_id INTEGER REFERENCES accounts(id),
+			amount DECIMAL(18,3) NOT NULL,
+			description TEXT,
+			client_reference VARCHAR(255),
+			metadata JSONB NOT NULL DEFAULT '{}',
+			status VARCHAR(20) NOT NULL CHECK (status IN ('SUCCEEDED', 'FAILED', 'ROLLED_BACK')),
+			transaction_id INTEGER REFERENCES transactions(id),
+			error TEXT
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_batch_transfer_lines_batch_id ON batch_transfer_lines(batch_id, line)`,
+		`CREATE TABLE IF NOT EXISTS payment_requests (
+			id SERIAL PRIMARY KEY,
+			requester_id INTEGER NOT NULL REFERENCES users(id),
+			requester_account_id INTEGER REFERENCES accounts(id),
+			payer_id INTEGER NOT NULL REFERENCES users(id),
+			payer_account_id INTEGER REFERENCES accounts(id),
+			amount DECIMAL(18,3) NOT NULL,
+			currency CHAR(3) NOT NULL,
+			note TEXT,
+			status VARCHAR(20) NOT NULL CHECK (status IN ('PENDING', 'ACCEPTED', 'DECLINED', 'CANCELLED', 'EXPIRED')),
+			decline_reason TEXT,
+			decided_by INTEGER,
+			transaction_id INTEGER REFERENCES transactions(id),
+			expires_at TIMESTAMP NOT NULL,
+			accepted_at TIMESTAMP,
+			declined_at TIMESTAMP,
+			cancelled_at TIMESTAMP,
+			expired_at TIMESTAMP,
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_payment_requests_payer_id ON payment_requests(payer_id, created_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_payment_requests_requester_id ON payment_requests(requester_id, created_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_payment_requests_pending ON payment_requests(expires_at) WHERE status = 'PENDING'`,
+		`CREATE TABLE IF NOT EXISTS escrows (
+			id SERIAL PRIMARY KEY,
+			buyer_id INTEGER NOT NULL REFERENCES users(id),
+			buyer_account_id INTEGER NOT NULL REFERENCES accounts(id),
+			seller_id INTEGER NOT NULL REFERENCES users(id),
+			seller_account_id INTEGER REFERENCES accounts(id),
+			amount DECIMAL(18,3) NOT NULL,
+			currency CHAR(3) NOT NULL,
+			description TEXT,
+			status VARCHAR(20) NOT NULL CHECK (status IN ('FUNDED', 'RELEASED', 'REFUNDED')),
+			refund_after TIMESTAMP NOT NULL,
+			acted_by INTEGER,
+			created_by INTEGER NOT NULL,
+			fund_transaction_id INTEGER REFERENCES transactions(id),
+			settle_transaction_id INTEGER REFERENCES transactions(id),
+			settled_by INTEGER,
+			settle_reason VARCHAR(20),
+			settled_at TIMESTAMP,
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_escrows_due ON escrows(refund_after) WHERE status = 'FUNDED'`,
+		`CREATE INDEX IF NOT EXISTS idx_escrows_buyer_id ON escrows(buyer_id, created_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_escrows_seller_id ON escrows(seller_id, created_at)`,
+		// who funded, released or refunded an escrow, and why
+		`CREATE TABLE IF NOT EXISTS escrow_events (
+			id SERIAL PRIMARY KEY,
+			escrow_id INTEGER NOT NULL REFERENCES escrows(id),
+			status VARCHAR(20) NOT NULL,
+			reason VARCHAR(20),
+			note TEXT,
+			actor_id INTEGER,
+			transaction_id INTEGER NOT NULL REFERENCES transactions(id),
+			created_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_escrow_events_escrow_id ON escrow_events(escrow_id, created_at)`,
 	}
 
 	for _, query := range queries {
@@ -41,5 +508,111 @@ func CreateTables() error {
 		}
 	}
 
-	return nil
-} 
\ No newline at end of file
+	return reportUnlinkedUsers()
+}
+
+// reportUnlinkedUsers logs the old users the migration couldn't link to a login
+// someone has to link them by hand, like
+//
+//	UPDATE users SET auth_user_id = <login id> WHERE id = <user id>
+//
+// until then those logins can't sign in, so nobody sees another person's money
+func reportUnlinkedUsers() error {
+	rows, err := GetPool().Query(
+		context.Background(),
+		`SELECT id, name FROM users WHERE auth_user_id IS NULL ORDER BY id`,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return err
+		}
+		log.Printf("Warning: user %d (%s) isn't linked to a login, link it by hand", id, name)
+	}
+	return rows.Err()
+}
+
+// migrateToPostings moves databases from before the journal to the new tables
+// it only does something while users still has its old balance column:
+//   - every user gets an account holding their current balance
+//   - every old from/to row becomes two postings, deposits come from CASH_IN
+//     and withdrawals go to CASH_OUT
+//   - the old initialize-balance overwrote balances instead of adding to them,
+//     so whatever the history doesn't explain is booked against EQUITY
+const migrateToPostings = `DO $$
+DECLARE
+	r RECORD;
+	entry_id INTEGER;
+	equity_id INTEGER;
+BEGIN
+	IF NOT EXISTS (
+		SELECT 1 FROM information_schema.columns
+		WHERE table_name = 'users' AND column_name = 'balance'
+	) THEN
+		RETURN;
+	END IF;
+
+	INSERT INTO accounts (user_id, name, account_type, currency, balance, is_default, created_at, updated_at)
+	SELECT id, name, 'USER', 'USD', balance, true, created_at, updated_at FROM users
+	ON CONFLICT (user_id, currency) WHERE is_default DO NOTHING;
+
+	INSERT INTO postings (transaction_id, account_id, amount, created_at)
+	SELECT t.id, COALESCE(fa.id, (SELECT id FROM accounts WHERE code = 'CASH_IN' AND currency = 'USD')), -t.amount, t.created_at
+	FROM transactions t LEFT JOIN accounts fa ON fa.user_id = t.from_user_id
+	WHERE t.amount <> 0
+	UNION ALL
+	SELECT t.id, COALESCE(ta.id, (SELECT id FROM accounts WHERE code = 'CASH_OUT' AND currency = 'USD')), t.amount, t.created_at
+	FROM transactions t LEFT JOIN accounts ta ON ta.user_id = t.to_user_id
+	WHERE t.amount <> 0;
+
+	SELECT id INTO equity_id FROM accounts WHERE code = 'EQUITY' AND currency = 'USD';
+	FOR r IN
+		SELECT a.id AS account_id, a.user_id, a.balance - COALESCE(SUM(p.amount), 0) AS delta
+		FROM accounts a LEFT JOIN postings p ON p.account_id = a.id
+		WHERE a.account_type = 'USER'
+		GROUP BY a.id, a.user_id, a.balance
+		HAVING a.balance - COALESCE(SUM(p.amount), 0) <> 0
+	LOOP
+		INSERT INTO transactions (from_user_id, to_user_id, amount, transaction_type, description, created_at)
+		VALUES (
+			CASE WHEN r.delta < 0 THEN r.user_id END,
+			CASE WHEN r.delta > 0 THEN r.user_id END,
+			ABS(r.delta), 'ADJUSTMENT', 'Opening balance from migration', NOW()
+		)
+		RETURNING id INTO entry_id;
+
+		INSERT INTO postings (transaction_id, account_id, amount, created_at) VALUES
+			(entry_id, r.account_id, r.delta, NOW()),
+			(entry_id, equity_id, -r.delta, NOW());
+	END LOOP;
+
+	UPDATE accounts a
+	SET balance = COALESCE((SELECT SUM(p.amount) FROM postings p WHERE p.account_id = a.id), 0),
+		updated_at = NOW()
+	WHERE a.account_type = 'SYSTEM';
+
+	ALTER TABLE users DROP COLUMN balance;
+END
+$$`
+
+// widenAmountColumns gives money columns a third decimal place for currencies like BHD
+// it only changes columns that don't have it yet, so restarts don't rewrite the tables
+const widenAmountColumns = `DO $$
+DECLARE
+	c RECORD;
+BEGIN
+	FOR c IN
+		SELECT table_name, column_name FROM information_schema.columns
+		WHERE (table_name, column_name) IN (('transactions', 'amount'), ('accounts', 'balance'), ('postings', 'amount'))
+		AND numeric_scale <> 3
+	LOOP
+		EXECUTE format('ALTER TABLE %I ALTER COLUMN %I TYPE DECIMAL(18,3)', c.table_name, c.column_name);
+	END LOOP;
+END
+$$`
@@ -2,11 +2,15 @@ package database
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -18,6 +22,16 @@ var (
 	ctx = context.Background()
 )
 
+// how many times we try again when postgres says two transactions got in each other's way
+const maxTransactionRetries = 5
+
+// Querier is anything we can run queries on, the pool or an open transaction
+type Querier interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
 // Config has all the database settings we need
 type Config struct {
 	Host     string // where the database is running
@@ -124,6 +138,16 @@ func CloseDB() {
 // RunInTransaction makes sure database operations happen together
 // if something fails, everything gets undone
 func RunInTransaction(fn func(pgx.Tx) error) error {
+	return runInTransaction(pgx.TxOptions{}, fn)
+}
+
+// RunInSnapshot runs read-only queries that all see the database as it was
+// when the first one started, even while other transactions keep committing
+func RunInSnapshot(fn func(pgx.Tx) error) error {
+	return runInTransaction(pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly}, fn)
+}
+
+func runInTransaction(opts pgx.TxOptions, fn func(pgx.Tx) error) error {
 	// get a connection to use
 	conn, err := pool.Acquire(ctx)
 	if err != nil {
@@ -132,7 +156,7 @@ func RunInTransaction(fn func(pgx.Tx) error) error {
 	defer conn.Release()
 
 	// start the transaction
-	tx, err := conn.Begin(ctx)
+	tx, err := conn.BeginTx(ctx, opts)
 	if err != nil {
 		return fmt.Errorf("failed to begin transaction: %v", err)
 	}
@@ -151,15 +175,61 @@ func RunInTransaction(fn func(pgx.Tx) error) error {
 	if err := fn(tx); err != nil {
 		// if there's an error, undo everything
 		if rbErr := tx.Rollback(ctx); rbErr != nil {
-			return fmt.Errorf("error rolling back transaction: %v (original error: %v)", rbErr, err)
+			return fmt.Errorf("error rolling back transaction: %v (original error: %w)", rbErr, err)
 		}
 		return err
 	}
 
 	// if everything worked, save all changes
 	if err := tx.Commit(ctx); err != nil {
-		return fmt.Errorf("error committing transaction: %v", err)
+		return fmt.Errorf("error committing transaction: %w", err)
 	}
 
 	return nil
-} 
\ No newline at end of file
+}
+
+// RunInTransactionWithRetry works like RunInTransaction but starts over
+// when postgres aborts us because of a serialization failure or a deadlock.
+// fn can run more than once, so it must not keep state between tries.
+func RunInTransactionWithRetry(fn func(pgx.Tx) error) error {
+	var err error
+	for attempt := 0; attempt < maxTransactionRetries; attempt++ {
+		err = RunInTransaction(fn)
+		if !IsRetryable(err) {
+			return err
+		}
+
+		// wait a little longer each time so the other transaction can finish
+		log.Printf("Retrying transaction after conflict (attempt %d): %v", attempt+1, err)
+		time.Sleep(time.Duration(attempt+1) * 10 * time.Millisecond)
+	}
+	return err
+}
+
+// IsRetryable tells if an error means the transaction can simply be tried again
+func IsRetryable(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	// 40001 = serialization_failure, 40P01 = deadlock_detected
+	return pgErr.Code == "40001" || pgErr.Code == "40P01"
+}
+
+// RunInSavepoint runs fn inside tx, but if fn fails only what fn did is undone
+// and tx can go on, like to write down why it failed
+func RunInSavepoint(tx pgx.Tx, fn func(pgx.Tx) error) error {
+	savepoint, err := tx.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create savepoint: %v", err)
+	}
+
+	if err := fn(savepoint); err != nil {
+		if rbErr := savepoint.Rollback(ctx); rbErr != nil {
+			return fmt.Errorf("error rolling back to savepoint: %v (original error: %w)", rbErr, err)
+		}
+		return err
+	}
+
+	return savepoint.Commit(ctx)
+}
@@ -0,0 +1,130 @@
+package fx
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/yigit-demirko/go-ledger/internal/database"
+	"github.com/yigit-demirko/go-ledger/internal/models"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// LoadRatesFromEnv loads the rates file named in FX_RATES_FILE
+func LoadRatesFromEnv() (int, error) {
+	path := os.Getenv("FX_RATES_FILE")
+	if path == "" {
+		return 0, ErrNoRatesFile
+	}
+	return LoadRatesFile(path)
+}
+
+// LoadRatesFile loads rates from a CSV file and returns how many were new
+// the first line names the columns: base,quote,rate,effective_from and
+// optionally spread_bps, effective_from is RFC3339 like 2024-01-02T00:00:00Z
+// every line is checked before anything is saved, and rates that were
+// already loaded are skipped, so the same file can be loaded again
+func LoadRatesFile(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	rates, err := readRates(file)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", path, err)
+	}
+
+	loaded := 0
+	err = database.RunInTransaction(func(tx pgx.Tx) error {
+		loaded = 0
+		for _, rate := range rates {
+			created, err := models.CreateFXRate(tx, rate)
+			if err != nil {
+				return err
+			}
+			if created != nil {
+				loaded++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return loaded, nil
+}
+
+// readRates reads and checks every line of a rates file
+func readRates(r io.Reader) ([]models.FXRate, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+
+	// find where each column is, so they can come in any order
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"base", "quote", "rate", "effective_from"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("header is missing the %q column", name)
+		}
+	}
+	field := func(record []string, name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	var rates []models.FXRate
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		rate := models.FXRate{Source: models.FXRateSourceFile}
+		if rate.BaseCurrency, err = money.ParseCurrency(field(record, "base")); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if rate.QuoteCurrency, err = money.ParseCurrency(field(record, "quote")); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if rate.Rate, err = money.ParseRate(field(record, "rate")); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if rate.EffectiveFrom, err = time.Parse(time.RFC3339, field(record, "effective_from")); err != nil {
+			return nil, fmt.Errorf("line %d: invalid effective_from: %w", line, err)
+		}
+		if spread := field(record, "spread_bps"); spread != "" {
+			if rate.SpreadBps, err = strconv.ParseInt(spread, 10, 64); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, ErrInvalidSpread)
+			}
+		}
+		if err := checkRate(&rate); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		rates = append(rates, rate)
+	}
+
+	return rates, nil
+}
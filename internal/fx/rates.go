@@ -0,0 +1,156 @@
+package fx
+
+import (
+	"errors"
+	"log"
+	"os"
+	"time"
+
+	"github.com/yigit-demirko/go-ledger/internal/database"
+	"github.com/yigit-demirko/go-ledger/internal/models"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// error messages callers can check for
+var (
+	ErrNoRate         = errors.New("no exchange rate for this currency pair")
+	ErrSameCurrency   = errors.New("currencies must be different")
+	ErrInvalidSpread  = errors.New("spread_bps must be between 0 and 9999")
+	ErrRateExists     = errors.New("a rate for this pair and effective time already exists")
+	ErrAmountTooSmall = errors.New("amount is too small to convert")
+	ErrMissingRate    = errors.New("rate is required")
+	ErrNoRatesFile    = errors.New("FX_RATES_FILE is not set")
+)
+
+const (
+	maxSpreadBps    = 9999             // a spread of 100% would leave the receiver nothing
+	defaultQuoteTTL = 30 * time.Second // long enough to show the price and confirm it
+)
+
+// QuoteTTL reads how long a quote can be used from FX_QUOTE_TTL (like "30s")
+func QuoteTTL() time.Duration {
+	if ttlStr := os.Getenv("FX_QUOTE_TTL"); ttlStr != "" {
+		if ttl, err := time.ParseDuration(ttlStr); err == nil && ttl > 0 {
+			return ttl
+		}
+		log.Printf("Warning: invalid FX_QUOTE_TTL %q, using %s", ttlStr, defaultQuoteTTL)
+	}
+	return defaultQuoteTTL
+}
+
+// PublishRate checks a new rate and saves it
+// rates without an effective time apply from now on
+func PublishRate(rate models.FXRate) (*models.FXRate, error) {
+	if err := checkRate(&rate); err != nil {
+		return nil, err
+	}
+	if rate.Source == "" {
+		rate.Source = models.FXRateSourceAPI
+	}
+
+	created, err := models.CreateFXRate(database.GetPool(), rate)
+	if err != nil {
+		return nil, err
+	}
+	if created == nil {
+		return nil, ErrRateExists
+	}
+	return created, nil
+}
+
+// checkRate makes sure a rate can be saved
+func checkRate(rate *models.FXRate) error {
+	if !rate.BaseCurrency.Valid() || !rate.QuoteCurrency.Valid() {
+		return money.ErrUnknownCurrency
+	}
+	if rate.BaseCurrency == rate.QuoteCurrency {
+		return ErrSameCurrency
+	}
+	if rate.Rate.IsZero() {
+		return ErrMissingRate
+	}
+	if rate.SpreadBps < 0 || rate.SpreadBps > maxSpreadBps {
+		return ErrInvalidSpread
+	}
+	if rate.EffectiveFrom.IsZero() {
+		rate.EffectiveFrom = time.Now()
+	}
+	return nil
+}
+
+// FindRate finds the rate for turning base into quote at a time
+// if only the opposite pair was published we use its inverse, the returned
+// rate then still has the ID (and spread) of the row it came from
+func FindRate(q database.Querier, base, quote money.Currency, at time.Time) (*models.FXRate, error) {
+	rate, err := models.GetEffectiveFXRate(q, base, quote, at)
+	if err != nil || rate != nil {
+		return rate, err
+	}
+
+	opposite, err := models.GetEffectiveFXRate(q, quote, base, at)
+	if err != nil {
+		return nil, err
+	}
+	if opposite == nil {
+		return nil, ErrNoRate
+	}
+
+	inverse, err := opposite.Rate.Inverse()
+	if err != nil {
+		return nil, err
+	}
+	opposite.BaseCurrency, opposite.QuoteCurrency = base, quote
+	opposite.Rate = inverse
+	return opposite, nil
+}
+
+// Price works out what converting amount of base into quote gives at a time
+// the receiver gets the amount at the customer rate (the mid rate less the
+// spread), rounded down; the rest of what it is worth at the mid rate is our spread
+// amount must already be positive and written with the decimal places of base
+func Price(q database.Querier, base, quote money.Currency, amount money.Amount, at time.Time) (*models.FXPrice, error) {
+	if base == quote {
+		return nil, ErrSameCurrency
+	}
+	if !quote.Valid() {
+		return nil, money.ErrUnknownCurrency
+	}
+
+	rate, err := FindRate(q, base, quote, at)
+	if err != nil {
+		return nil, err
+	}
+
+	customerRate, err := rate.Rate.LessSpread(rate.SpreadBps)
+	if err != nil {
+		return nil, err
+	}
+
+	// what the amount is worth at the mid rate, and what the receiver gets
+	worth, err := rate.Rate.Convert(amount, quote, money.RoundHalfEven)
+	if err != nil {
+		return nil, err
+	}
+	received, err := customerRate.Convert(amount, quote, money.RoundDown)
+	if err != nil {
+		return nil, err
+	}
+	if !received.IsPositive() {
+		return nil, ErrAmountTooSmall
+	}
+
+	// the customer rate is lower and rounded down, so this is never negative
+	spread := worth.Sub(received)
+
+	return &models.FXPrice{
+		RateID:        rate.ID,
+		BaseCurrency:  base,
+		QuoteCurrency: quote,
+		MidRate:       rate.Rate,
+		CustomerRate:  customerRate,
+		SpreadBps:     rate.SpreadBps,
+		SourceAmount:  amount,
+		TargetAmount:  received,
+		SpreadAmount:  spread,
+	}, nil
+}
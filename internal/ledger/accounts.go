@@ -0,0 +1,133 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/yigit-demirko/go-ledger/internal/database"
+	"github.com/yigit-demirko/go-ledger/internal/models"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// longest name an account can have
+const maxAccountNameLength = 255
+
+// error messages for accounts that can't be opened or moves that can't be made
+var (
+	ErrInvalidAccountName = fmt.Errorf("account name is required and can't be longer than %d characters", maxAccountNameLength)
+	ErrInvalidAccountKind = errors.New("account kind must be SPENDING, SAVINGS or PROJECT")
+	ErrSameAccount        = errors.New("cannot move money to the same account")
+)
+
+// MoveResult has everything that changed after a move
+type MoveResult struct {
+	FromAccount *models.Account
+	ToAccount   *models.Account
+	Transaction *models.Transaction
+}
+
+// OpenAccount opens another account for a user, like savings next to their
+// everyday money; the default account of each currency is opened by itself
+// the first time money arrives, so this is only for the extra ones
+func OpenAccount(userID int64, name string, currency money.Currency, kind models.AccountKind) (*models.Account, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > maxAccountNameLength {
+		return nil, ErrInvalidAccountName
+	}
+	if !currency.Valid() {
+		return nil, money.ErrUnknownCurrency
+	}
+	if kind == "" {
+		kind = models.AccountKindSavings
+	}
+	if !kind.Valid() {
+		return nil, ErrInvalidAccountKind
+	}
+
+	return models.CreateUserAccount(userID, name, currency, kind)
+}
+
+// UserAccount finds an account that belongs to a user, the ledger's own
+// accounts are not found
+func UserAccount(accountID int64) (*models.Account, error) {
+	account, err := models.GetAccountByID(database.GetPool(), accountID)
+	if err != nil {
+		return nil, err
+	}
+	if account == nil || account.UserID == nil {
+		return nil, ErrAccountNotFound
+	}
+	return account, nil
+}
+
+// Move takes money from one account of a user and puts it in another of
+// their accounts in the same currency, as one journal entry
+// it can't overdraw the account it takes from, just like a transfer
+func Move(userID, fromAccountID, toAccountID int64, amount money.Amount, details Details) (*MoveResult, error) {
+	if fromAccountID == toAccountID {
+		return nil, ErrSameAccount
+	}
+	details, err := details.check()
+	if err != nil {
+		return nil, err
+	}
+
+	var result *MoveResult
+	err = database.RunInTransactionWithRetry(func(tx pgx.Tx) error {
+		from, err := ownedAccount(tx, userID, fromAccountID)
+		if err != nil {
+			return err
+		}
+		to, err := ownedAccount(tx, userID, toAccountID)
+		if err != nil {
+			return err
+		}
+		if from.Currency != to.Currency {
+			return ErrCurrencyMismatch
+		}
+		currency := from.Currency
+
+		amount, err := positiveAmount(amount, currency)
+		if err != nil {
+			return err
+		}
+
+		description := details.Description
+		if description == "" {
+			description = fmt.Sprintf("Move from %s to %s", from.Name, to.Name)
+		}
+
+		transaction, accounts, err := post(tx, Entry{
+			Type:            models.TransactionTypeMove,
+			FromUserID:      &userID,
+			ToUserID:        &userID,
+			Amount:          amount,
+			Currency:        currency,
+			Description:     description,
+			ClientReference: details.ClientReference,
+			Metadata:        details.Metadata,
+			ActedBy:         details.ActedBy,
+			Legs: []Leg{
+				{AccountID: from.ID, Amount: amount.Neg(), Currency: currency},
+				{AccountID: to.ID, Amount: amount, Currency: currency},
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		result = &MoveResult{
+			FromAccount: accounts[from.ID],
+			ToAccount:   accounts[to.ID],
+			Transaction: transaction,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
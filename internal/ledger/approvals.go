@@ -0,0 +1,248 @@
+package ledger
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/yigit-demirko/go-ledger/internal/database"
+	"github.com/yigit-demirko/go-ledger/internal/models"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// error messages for approvals
+var (
+	ErrApprovalNotFound   = errors.New("approval request not found")
+	ErrApprovalNotPending = errors.New("approval request was already approved, rejected or expired")
+	ErrApprovalExpired    = errors.New("approval request has expired")
+	ErrSelfApproval       = errors.New("approval requests must be decided by someone other than who made them")
+	ErrNeedsApproval      = errors.New("amount is above the approval threshold, send it as a single transfer so a second person can approve it")
+)
+
+const defaultApprovalTTL = 24 * time.Hour
+
+// ApprovalTTL reads how long an approval request waits for a decision, from APPROVAL_TTL (like "24h")
+func ApprovalTTL() time.Duration {
+	if ttlStr := os.Getenv("APPROVAL_TTL"); ttlStr != "" {
+		if ttl, err := time.ParseDuration(ttlStr); err == nil && ttl > 0 {
+			return ttl
+		}
+		log.Printf("Warning: invalid APPROVAL_TTL %q, using %s", ttlStr, defaultApprovalTTL)
+	}
+	return defaultApprovalTTL
+}
+
+// ApprovalThreshold reads from APPROVAL_THRESHOLDS (like "USD:10000,EUR:10000")
+// the amount above which a transfer in currency needs a second person
+// ok is false when transfers in currency never need one
+func ApprovalThreshold(currency money.Currency) (threshold money.Amount, ok bool) {
+	for _, part := range strings.Split(os.Getenv("APPROVAL_THRESHOLDS"), ",") {
+		code, amountStr, found := strings.Cut(strings.TrimSpace(part), ":")
+		if !found || money.Currency(strings.ToUpper(strings.TrimSpace(code))) != currency {
+			continue
+		}
+		amount, err := money.Parse(strings.TrimSpace(amountStr))
+		if err != nil || amount.IsNegative() {
+			log.Printf("Warning: invalid APPROVAL_THRESHOLDS entry %q, ignoring it", part)
+			return money.Amount{}, false
+		}
+		return amount, true
+	}
+	return money.Amount{}, false
+}
+
+// NeedsApproval checks if a transfer of amount is above the approval threshold of its currency
+func NeedsApproval(amount money.Amount, currency money.Currency) bool {
+	threshold, ok := ApprovalThreshold(currency)
+	return ok && amount.Cmp(threshold) > 0
+}
+
+// checkApproval refuses amounts above the approval threshold, every way of
+// sending money except an approved request goes through it, so none of them
+// can move a big amount without a second person
+func checkApproval(amount money.Amount, currency money.Currency) error {
+	if NeedsApproval(amount, currency) {
+		return ErrNeedsApproval
+	}
+	return nil
+}
+
+// RequestTransferApproval checks a transfer like Transfer does and saves it
+// as a pending approval request instead of running it
+func RequestTransferApproval(from, to Party, amount money.Amount, currency money.Currency, details Details, requestedBy int64) (*models.ApprovalRequest, error) {
+	amount, details, err := checkTransfer(from, to, amount, currency, details)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkParty(from, currency); err != nil {
+		return nil, err
+	}
+	if err := checkParty(to, currency); err != nil {
+		return nil, err
+	}
+
+	return models.CreateApprovalRequest(database.GetPool(), models.ApprovalRequest{
+		Operation: models.ApprovalOperationTransfer,
+		Payload: models.ApprovalPayload{
+			FromUserID:      &from.UserID,
+			FromAccountID:   from.AccountID,
+			ToUserID:        &to.UserID,
+			ToAccountID:     to.AccountID,
+			Description:     details.Description,
+			ClientReference: details.ClientReference,
+			Metadata:        details.Metadata,
+			ActedBy:         details.ActedBy,
+		},
+		Amount:      amount,
+		Currency:    currency,
+		RequestedBy: requestedBy,
+		ExpiresAt:   time.Now().Add(ApprovalTTL()),
+	})
+}
+
+// RequestBalanceApproval saves setting a user's default account in currency
+// to amount as a pending approval request, like InitializeBalance once approved
+func RequestBalanceApproval(userID int64, amount money.Amount, currency money.Currency, requestedBy int64) (*models.ApprovalRequest, error) {
+	amount, err := balanceAmount(amount, currency)
+	if err != nil {
+		return nil, err
+	}
+
+	return createBalanceApproval(models.ApprovalPayload{UserID: &userID}, amount, currency, requestedBy)
+}
+
+// RequestAccountBalanceApproval is RequestBalanceApproval for one account of a user
+func RequestAccountBalanceApproval(accountID int64, amount money.Amount, requestedBy int64) (*models.ApprovalRequest, error) {
+	account, err := UserAccount(accountID)
+	if err != nil {
+		return nil, err
+	}
+	amount, err = balanceAmount(amount, account.Currency)
+	if err != nil {
+		return nil, err
+	}
+
+	return createBalanceApproval(models.ApprovalPayload{AccountID: &accountID}, amount, account.Currency, requestedBy)
+}
+
+func createBalanceApproval(payload models.ApprovalPayload, amount money.Amount, currency money.Currency, requestedBy int64) (*models.ApprovalRequest, error) {
+	return models.CreateApprovalRequest(database.GetPool(), models.ApprovalRequest{
+		Operation:   models.ApprovalOperationSetBalance,
+		Payload:     payload,
+		Amount:      amount,
+		Currency:    currency,
+		RequestedBy: requestedBy,
+		ExpiresAt:   time.Now().Add(ApprovalTTL()),
+	})
+}
+
+// ApproveRequest runs a pending request and marks it approved, in one
+// database transaction: if the operation fails, like when the balance got too
+// low in the meantime, nothing changes and the request stays pending
+func ApproveRequest(id, approverID int64, note string) (*models.ApprovalRequest, error) {
+	var request *models.ApprovalRequest
+	err := database.RunInTransactionWithRetry(func(tx pgx.Tx) error {
+		var err error
+		request, err = pendingApproval(tx, id, approverID)
+		if err != nil {
+			return err
+		}
+
+		transaction, err := runApproved(tx, request)
+		if err != nil {
+			return err
+		}
+
+		var transactionID *int64
+		if transaction != nil {
+			transactionID = &transaction.ID
+		}
+		return request.Decide(tx, models.ApprovalStatusApproved, approverID, strings.TrimSpace(note), transactionID)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return request, nil
+}
+
+// RejectRequest turns down a pending request, nothing of it runs
+func RejectRequest(id, approverID int64, note string) (*models.ApprovalRequest, error) {
+	var request *models.ApprovalRequest
+	err := database.RunInTransactionWithRetry(func(tx pgx.Tx) error {
+		var err error
+		request, err = pendingApproval(tx, id, approverID)
+		if err != nil {
+			return err
+		}
+		return request.Decide(tx, models.ApprovalStatusRejected, approverID, strings.TrimSpace(note), nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return request, nil
+}
+
+// ExpireApprovals marks requests nobody decided in time as expired
+// it returns how many it marked
+func ExpireApprovals() (int64, error) {
+	return models.ExpireApprovalRequests(time.Now())
+}
+
+// pendingApproval locks a request inside tx and checks approverID may still decide it
+func pendingApproval(tx pgx.Tx, id, approverID int64) (*models.ApprovalRequest, error) {
+	request, err := models.LockApprovalRequestForUpdate(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	if request == nil {
+		return nil, ErrApprovalNotFound
+	}
+	if request.Status != models.ApprovalStatusPending {
+		return nil, ErrApprovalNotPending
+	}
+	// ExpireApprovals will mark it soon, until then it can't be decided either
+	if !request.ExpiresAt.After(time.Now()) {
+		return nil, ErrApprovalExpired
+	}
+	if request.RequestedBy == approverID {
+		return nil, ErrSelfApproval
+	}
+	return request, nil
+}
+
+// runApproved runs the operation of an approved request inside tx
+func runApproved(tx pgx.Tx, request *models.ApprovalRequest) (*models.Transaction, error) {
+	payload := request.Payload
+	switch request.Operation {
+	case models.ApprovalOperationTransfer:
+		return sendApproved(tx,
+			Party{UserID: *payload.FromUserID, AccountID: payload.FromAccountID},
+			Party{UserID: *payload.ToUserID, AccountID: payload.ToAccountID},
+			request.Amount, request.Currency,
+			Details{
+				Description:     payload.Description,
+				ClientReference: payload.ClientReference,
+				Metadata:        payload.Metadata,
+				ActedBy:         payload.ActedBy,
+			},
+		)
+	case models.ApprovalOperationSetBalance:
+		var account *models.Account
+		var err error
+		if payload.AccountID != nil {
+			account, err = lockUserAccount(tx, *payload.AccountID)
+		} else {
+			account, err = userAccount(tx, *payload.UserID, request.Currency)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return setBalance(tx, account, request.Amount, request.Currency)
+	}
+	return nil, errors.New("unknown approval operation " + string(request.Operation))
+}
@@ -0,0 +1,246 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/yigit-demirko/go-ledger/internal/database"
+	"github.com/yigit-demirko/go-ledger/internal/models"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// how many recipients one batch can pay at most
+const maxBatchLines = 1000
+
+// error messages for batches
+var (
+	ErrBatchEmpty         = errors.New("batch has no lines")
+	ErrBatchTooLarge      = fmt.Errorf("batch can't have more than %d lines", maxBatchLines)
+	ErrInvalidBatchMode   = errors.New("mode must be ALL_OR_NOTHING or BEST_EFFORT")
+	ErrBatchNeedsApproval = errors.New("batch adds up to more than the approval threshold, send it as single transfers")
+	errBatchLineFailed    = errors.New("a line of the batch failed")
+)
+
+// BatchLine is one recipient of a batch
+type BatchLine struct {
+	Line    int // where it was in the request, for the report
+	To      Party
+	Amount  money.Amount
+	Details Details // the batch's description if it has none
+}
+
+// LineError says what is wrong with one line of a batch
+type LineError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// BatchValidationError lists every line of a batch that can't be paid as it is
+// nothing of the batch ran when this is returned
+type BatchValidationError struct {
+	Lines []LineError
+}
+
+func (e *BatchValidationError) Error() string {
+	return fmt.Sprintf("%d lines of the batch are invalid", len(e.Lines))
+}
+
+// BatchRequest pays many recipients from one source account
+type BatchRequest struct {
+	From        Party
+	Currency    money.Currency
+	Mode        models.BatchMode
+	Description string
+	ActedBy     *int64 // the admin or delegate sending it for the sender
+	CreatedBy   int64
+	Lines       []BatchLine
+}
+
+// RunBatch checks every line of a batch and then pays them all
+// if any line is invalid nothing runs and a *BatchValidationError lists them;
+// otherwise every line is tried, and in ALL_OR_NOTHING mode one failed line
+// undoes all the others; the batch is saved with the result of every line
+func RunBatch(req BatchRequest) (*models.BatchTransfer, error) {
+	if !req.Mode.Valid() {
+		return nil, ErrInvalidBatchMode
+	}
+	if len(req.Lines) == 0 {
+		return nil, ErrBatchEmpty
+	}
+	if len(req.Lines) > maxBatchLines {
+		return nil, ErrBatchTooLarge
+	}
+	if !req.Currency.Valid() {
+		return nil, fmt.Errorf("%w: %q", money.ErrUnknownCurrency, string(req.Currency))
+	}
+	if err := checkParty(req.From, req.Currency); err != nil {
+		return nil, err
+	}
+
+	lines, total, err := checkBatchLines(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var batch *models.BatchTransfer
+	err = database.RunInTransactionWithRetry(func(tx pgx.Tx) error {
+		results, err := runBatchLines(tx, req, lines)
+		if err != nil {
+			return err
+		}
+
+		batch = &models.BatchTransfer{
+			FromUserID:    req.From.UserID,
+			FromAccountID: req.From.AccountID,
+			Currency:      req.Currency,
+			Mode:          req.Mode,
+			Description:   strings.TrimSpace(req.Description),
+			ActedBy:       req.ActedBy,
+			CreatedBy:     req.CreatedBy,
+			TotalAmount:   total,
+			PaidAmount:    req.Currency.Zero(),
+			LineCount:     len(results),
+			Lines:         results,
+		}
+		for _, line := range results {
+			if line.Status == models.BatchLineStatusSucceeded {
+				batch.SucceededCount++
+				batch.PaidAmount = batch.PaidAmount.Add(line.Amount)
+			} else if line.Status == models.BatchLineStatusFailed {
+				batch.FailedCount++
+			}
+		}
+		switch batch.SucceededCount {
+		case batch.LineCount:
+			batch.Status = models.BatchStatusCompleted
+		case 0:
+			batch.Status = models.BatchStatusFailed
+		default:
+			batch.Status = models.BatchStatusPartial
+		}
+
+		batch, err = models.CreateBatchTransfer(tx, *batch)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return batch, nil
+}
+
+// checkBatchLines checks every line of a batch before anything runs
+// it returns the lines the way they are paid and what they add up to
+func checkBatchLines(req BatchRequest) ([]BatchLine, money.Amount, error) {
+	total := req.Currency.Zero()
+	var lines []BatchLine
+	var invalid []LineError
+	var userIDs []int64
+
+	for _, line := range req.Lines {
+		if line.Details.Description == "" {
+			line.Details.Description = req.Description
+		}
+		line.Details.ActedBy = req.ActedBy
+
+		amount, details, err := checkTransfer(req.From, line.To, line.Amount, req.Currency, line.Details)
+		if err == nil {
+			err = checkParty(line.To, req.Currency)
+		}
+		if err != nil {
+			invalid = append(invalid, LineError{Line: line.Line, Error: err.Error()})
+			continue
+		}
+
+		line.Amount = amount
+		line.Details = details
+		lines = append(lines, line)
+		if total, err = total.AddChecked(amount); err != nil {
+			return nil, total, err
+		}
+		userIDs = append(userIDs, line.To.UserID)
+	}
+
+	// recipients that don't exist, in one query instead of one per line
+	existing, err := models.ExistingUserIDs(database.GetPool(), userIDs)
+	if err != nil {
+		return nil, total, err
+	}
+	for _, line := range lines {
+		if !existing[line.To.UserID] {
+			invalid = append(invalid, LineError{Line: line.Line, Error: models.ErrUserNotFound.Error()})
+		}
+	}
+
+	if len(invalid) > 0 {
+		return nil, total, &BatchValidationError{Lines: invalid}
+	}
+	// like a split, the whole batch leaves the sender at once: many lines just
+	// under the threshold must not add up to a big payout nobody approved
+	if NeedsApproval(total, req.Currency) {
+		return nil, total, ErrBatchNeedsApproval
+	}
+	return lines, total, nil
+}
+
+// runBatchLines pays every line of a checked batch inside tx
+// each line runs in its own savepoint, so a failed line leaves nothing behind;
+// in ALL_OR_NOTHING mode all lines also share one savepoint that is rolled
+// back when any of them failed
+func runBatchLines(tx pgx.Tx, req BatchRequest, lines []BatchLine) ([]models.BatchTransferLine, error) {
+	results := make([]models.BatchTransferLine, len(lines))
+	failed := false
+
+	err := database.RunInSavepoint(tx, func(tx pgx.Tx) error {
+		for i, line := range lines {
+			results[i] = models.BatchTransferLine{
+				Line:            line.Line,
+				ToUserID:        line.To.UserID,
+				ToAccountID:     line.To.AccountID,
+				Amount:          line.Amount,
+				Description:     line.Details.Description,
+				ClientReference: line.Details.ClientReference,
+				Metadata:        line.Details.Metadata,
+			}
+
+			var result *TransferResult
+			err := database.RunInSavepoint(tx, func(tx pgx.Tx) error {
+				var err error
+				result, err = transfer(tx, req.From, line.To, line.Amount, req.Currency, line.Details)
+				return err
+			})
+			if database.IsRetryable(err) {
+				return err
+			}
+			if err != nil {
+				failed = true
+				results[i].Status = models.BatchLineStatusFailed
+				results[i].Error = err.Error()
+				continue
+			}
+			results[i].Status = models.BatchLineStatusSucceeded
+			results[i].TransactionID = &result.Transaction.ID
+		}
+
+		if failed && req.Mode == models.BatchModeAllOrNothing {
+			return errBatchLineFailed
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errBatchLineFailed) {
+		return nil, err
+	}
+
+	// the savepoint is gone, and the transfers of the lines that worked with it
+	if err != nil {
+		for i := range results {
+			if results[i].Status == models.BatchLineStatusSucceeded {
+				results[i].Status = models.BatchLineStatusRolledBack
+				results[i].TransactionID = nil
+			}
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,47 @@
+package ledger
+
+import (
+	"log"
+	"time"
+
+	"github.com/yigit-demirko/go-ledger/internal/models"
+)
+
+const (
+	// a transaction that started before midnight can still commit postings dated
+	// before it for a little while, so a day's checkpoint waits this long
+	checkpointDelay = time.Hour
+	// how many checkpoints one pass of VerifyCheckpoints adds up again
+	verifyBatch = 500
+)
+
+// BuildCheckpoints saves the balance of every account that moved as of the
+// last midnight (UTC) that is at least checkpointDelay ago
+func BuildCheckpoints(now time.Time) (int64, error) {
+	settled := now.UTC().Add(-checkpointDelay)
+	asOf := time.Date(settled.Year(), settled.Month(), settled.Day(), 0, 0, 0, 0, time.UTC)
+	return models.CreateBalanceCheckpoints(asOf)
+}
+
+// VerifyCheckpoints checks a batch of checkpoints against their postings and
+// logs every one that no longer matches; those are skipped by historical
+// balances from then on
+// it returns the checkpoints that didn't match
+func VerifyCheckpoints() ([]models.BalanceCheckpoint, error) {
+	checked, err := models.VerifyBalanceCheckpoints(verifyBatch)
+	if err != nil {
+		return nil, err
+	}
+
+	var mismatched []models.BalanceCheckpoint
+	for _, checkpoint := range checked {
+		if checkpoint.MismatchAt == nil {
+			continue
+		}
+		log.Printf("Warning: checkpoint of account %d as of %s is %s %s but its postings add up to %s (off by %s)",
+			checkpoint.AccountID, checkpoint.AsOf.Format(time.RFC3339), checkpoint.Balance, checkpoint.Currency,
+			checkpoint.ExpectedBalance, checkpoint.Delta())
+		mismatched = append(mismatched, checkpoint)
+	}
+	return mismatched, nil
+}
@@ -0,0 +1,50 @@
+package ledger
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/yigit-demirko/go-ledger/internal/models"
+)
+
+// limits on what a client can save with a movement
+const (
+	maxClientReferenceLength = 255
+	maxMetadataBytes         = 4096
+)
+
+// error messages for details a client sent
+var (
+	ErrClientReferenceTooLong = fmt.Errorf("client_reference can't be longer than %d characters", maxClientReferenceLength)
+	ErrMetadataTooLarge       = fmt.Errorf("metadata can't be larger than %d bytes", maxMetadataBytes)
+)
+
+// Details is what a client tells about a transfer, deposit or withdrawal, and who asked for it
+// it is saved on the transaction as it is, so the movement can be found again
+type Details struct {
+	Description     string
+	ClientReference string          // the client's own id, like an order id
+	Metadata        models.Metadata // any JSON object
+	ActedBy         *int64          // who sent money for its owner, nil when the owner did
+}
+
+// check trims the details and makes sure they fit in the database
+func (d Details) check() (Details, error) {
+	d.Description = strings.TrimSpace(d.Description)
+	d.ClientReference = strings.TrimSpace(d.ClientReference)
+	if len(d.ClientReference) > maxClientReferenceLength {
+		return d, ErrClientReferenceTooLong
+	}
+
+	if len(d.Metadata) > 0 {
+		encoded, err := json.Marshal(d.Metadata)
+		if err != nil {
+			return d, err
+		}
+		if len(encoded) > maxMetadataBytes {
+			return d, ErrMetadataTooLarge
+		}
+	}
+	return d, nil
+}
@@ -0,0 +1,282 @@
+package ledger
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/yigit-demirko/go-ledger/internal/database"
+	"github.com/yigit-demirko/go-ledger/internal/models"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// error messages for escrows
+var (
+	ErrEscrowNotFound      = errors.New("escrow not found")
+	ErrEscrowNotFunded     = errors.New("escrow was already released or refunded")
+	ErrInvalidRefundAfter  = errors.New("refund_after must be in the future")
+	ErrEscrowNeedsApproval = errors.New("amount is above the approval threshold, send it as a single transfer")
+)
+
+const defaultEscrowTTL = 14 * 24 * time.Hour
+
+// EscrowTTL reads how long money stays in escrow when the buyer doesn't say,
+// from ESCROW_TTL (like "336h"); after that it goes back to the buyer
+func EscrowTTL() time.Duration {
+	if ttlStr := os.Getenv("ESCROW_TTL"); ttlStr != "" {
+		if ttl, err := time.ParseDuration(ttlStr); err == nil && ttl > 0 {
+			return ttl
+		}
+		log.Printf("Warning: invalid ESCROW_TTL %q, using %s", ttlStr, defaultEscrowTTL)
+	}
+	return defaultEscrowTTL
+}
+
+// EscrowRequest is a buyer parking money for a seller
+type EscrowRequest struct {
+	Buyer       Party
+	Seller      Party
+	Amount      money.Amount
+	Currency    money.Currency
+	RefundAfter time.Time // EscrowTTL from now if zero
+	Details     Details   // ActedBy is the admin or delegate funding it for the buyer
+	CreatedBy   int64
+}
+
+// FundEscrow takes money from the buyer and keeps it in the escrow account
+// until it is released to the seller or refunded
+func FundEscrow(req EscrowRequest) (*models.Escrow, error) {
+	amount, details, err := checkTransfer(req.Buyer, req.Seller, req.Amount, req.Currency, req.Details)
+	if err != nil {
+		return nil, err
+	}
+	// releasing it can't wait for a second person, so big amounts are sent as transfers
+	if NeedsApproval(amount, req.Currency) {
+		return nil, ErrEscrowNeedsApproval
+	}
+
+	refundAfter := req.RefundAfter
+	if refundAfter.IsZero() {
+		refundAfter = time.Now().Add(EscrowTTL())
+	}
+	if !refundAfter.After(time.Now()) {
+		return nil, ErrInvalidRefundAfter
+	}
+	if err := checkParty(req.Seller, req.Currency); err != nil {
+		return nil, err
+	}
+
+	var escrow *models.Escrow
+	err = database.RunInTransactionWithRetry(func(tx pgx.Tx) error {
+		buyerAccount, err := partyAccount(tx, req.Buyer, req.Currency)
+		if err != nil {
+			return err
+		}
+		escrowAccount, err := systemAccount(tx, models.SystemAccountEscrow, req.Currency)
+		if err != nil {
+			return err
+		}
+
+		escrow, err = models.CreateEscrow(tx, models.Escrow{
+			BuyerID:         req.Buyer.UserID,
+			BuyerAccountID:  buyerAccount.ID,
+			SellerID:        req.Seller.UserID,
+			SellerAccountID: req.Seller.AccountID,
+			Amount:          amount,
+			Currency:        req.Currency,
+			Description:     details.Description,
+			RefundAfter:     refundAfter,
+			ActedBy:         details.ActedBy,
+			CreatedBy:       req.CreatedBy,
+		})
+		if err != nil {
+			return err
+		}
+
+		transaction, _, err := post(tx, Entry{
+			Type:            models.TransactionTypeEscrowFund,
+			FromUserID:      &req.Buyer.UserID,
+			Amount:          amount,
+			Currency:        req.Currency,
+			Description:     details.Description,
+			ClientReference: details.ClientReference,
+			Metadata:        escrowMetadata(details.Metadata, escrow.ID),
+			ActedBy:         details.ActedBy,
+			Legs: []Leg{
+				{AccountID: buyerAccount.ID, Amount: amount.Neg(), Currency: req.Currency},
+				{AccountID: escrowAccount.ID, Amount: amount, Currency: req.Currency},
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		escrow.FundTransactionID = &transaction.ID
+		if err := escrow.Save(tx); err != nil {
+			return err
+		}
+		_, err = escrow.AddEvent(tx, models.EscrowEvent{
+			Status:        models.EscrowStatusFunded,
+			ActorID:       &req.CreatedBy,
+			TransactionID: transaction.ID,
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return escrow, nil
+}
+
+// ReleaseEscrow pays the money in escrow to the seller
+// actorID is who released it and reason why, both are kept in its events
+func ReleaseEscrow(id, actorID int64, reason models.EscrowReason, note string) (*models.Escrow, error) {
+	return settleEscrowByID(id, models.EscrowStatusReleased, &actorID, reason, note)
+}
+
+// RefundEscrow gives the money in escrow back to the buyer
+// actorID is who refunded it and reason why, both are kept in its events
+func RefundEscrow(id, actorID int64, reason models.EscrowReason, note string) (*models.Escrow, error) {
+	return settleEscrowByID(id, models.EscrowStatusRefunded, &actorID, reason, note)
+}
+
+// RefundDueEscrows gives the money of escrows nobody released before their
+// refund_after back to the buyers
+// each one is refunded in a savepoint: one that can't be, like when the buyer's
+// account is frozen, is logged and tried again on the next run
+// it returns how many it refunded, and is safe to run on several servers at once
+func RefundDueEscrows() (int, error) {
+	refunded := 0
+	err := database.RunInTransactionWithRetry(func(tx pgx.Tx) error {
+		refunded = 0
+		escrows, err := models.LockDueEscrows(tx, time.Now(), expireBatch)
+		if err != nil {
+			return err
+		}
+		for i := range escrows {
+			err := database.RunInSavepoint(tx, func(tx pgx.Tx) error {
+				return settleEscrow(tx, &escrows[i], models.EscrowStatusRefunded, nil, models.EscrowReasonDeadlinePassed, "")
+			})
+			if database.IsRetryable(err) {
+				return err
+			}
+			if err != nil {
+				log.Printf("Failed to refund escrow %d: %v", escrows[i].ID, err)
+				continue
+			}
+			refunded++
+		}
+		return nil
+	})
+	return refunded, err
+}
+
+// settleEscrowByID locks a funded escrow and releases or refunds it
+func settleEscrowByID(id int64, status models.EscrowStatus, actorID *int64, reason models.EscrowReason, note string) (*models.Escrow, error) {
+	var escrow *models.Escrow
+	err := database.RunInTransactionWithRetry(func(tx pgx.Tx) error {
+		var err error
+		escrow, err = models.LockEscrowForUpdate(tx, id)
+		if err != nil {
+			return err
+		}
+		if escrow == nil {
+			return ErrEscrowNotFound
+		}
+		if escrow.Status != models.EscrowStatusFunded {
+			return ErrEscrowNotFunded
+		}
+		return settleEscrow(tx, escrow, status, actorID, reason, strings.TrimSpace(note))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// read it again so the answer has every event, not only the new one
+	return models.GetEscrowByID(escrow.ID)
+}
+
+// settleEscrow moves the money of a locked, funded escrow to the seller
+// (RELEASED) or back to the buyer (REFUNDED) inside tx and writes down who did it
+func settleEscrow(tx pgx.Tx, escrow *models.Escrow, status models.EscrowStatus, actorID *int64, reason models.EscrowReason, note string) error {
+	escrowAccount, err := systemAccount(tx, models.SystemAccountEscrow, escrow.Currency)
+	if err != nil {
+		return err
+	}
+
+	entry := Entry{
+		Amount:      escrow.Amount,
+		Currency:    escrow.Currency,
+		Description: escrow.Description,
+		Metadata:    escrowMetadata(nil, escrow.ID),
+	}
+	var to *models.Account
+	if status == models.EscrowStatusReleased {
+		to, err = partyAccount(tx, Party{UserID: escrow.SellerID, AccountID: escrow.SellerAccountID}, escrow.Currency)
+		entry.Type = models.TransactionTypeEscrowRelease
+		entry.FromUserID = &escrow.BuyerID
+		entry.ToUserID = &escrow.SellerID
+	} else {
+		to, err = refundAccount(tx, escrow)
+		entry.Type = models.TransactionTypeEscrowRefund
+		entry.ToUserID = &escrow.BuyerID
+	}
+	if err != nil {
+		return err
+	}
+	entry.Legs = []Leg{
+		{AccountID: escrowAccount.ID, Amount: escrow.Amount.Neg(), Currency: escrow.Currency},
+		{AccountID: to.ID, Amount: escrow.Amount, Currency: escrow.Currency},
+	}
+
+	transaction, _, err := post(tx, entry)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	escrow.Status = status
+	escrow.SettleTransactionID = &transaction.ID
+	escrow.SettledBy = actorID
+	escrow.SettleReason = reason
+	escrow.SettledAt = &now
+	if err := escrow.Save(tx); err != nil {
+		return err
+	}
+	_, err = escrow.AddEvent(tx, models.EscrowEvent{
+		Status:        status,
+		Reason:        reason,
+		Note:          note,
+		ActorID:       actorID,
+		TransactionID: transaction.ID,
+	})
+	return err
+}
+
+// refundAccount finds where a refund goes: the account that funded the
+// escrow, or the buyer's default account in the currency if that one was closed since
+func refundAccount(tx pgx.Tx, escrow *models.Escrow) (*models.Account, error) {
+	account, err := models.GetAccountByID(tx, escrow.BuyerAccountID)
+	if err != nil {
+		return nil, err
+	}
+	if account == nil || account.Status == models.AccountStatusClosed {
+		return userAccount(tx, escrow.BuyerID, escrow.Currency)
+	}
+	return account, nil
+}
+
+// escrowMetadata is the metadata of an escrow's transactions: the client's own
+// keys plus escrow_id, so history can be filtered by it
+func escrowMetadata(metadata models.Metadata, escrowID int64) models.Metadata {
+	withID := models.Metadata{}
+	for key, value := range metadata {
+		withID[key] = value
+	}
+	withID["escrow_id"] = escrowID
+	return withID
+}
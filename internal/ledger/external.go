@@ -0,0 +1,117 @@
+package ledger
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/yigit-demirko/go-ledger/internal/database"
+	"github.com/yigit-demirko/go-ledger/internal/models"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// ErrMissingReference is returned for deposits and withdrawals that don't say where the money came from or went to
+var ErrMissingReference = errors.New("external_reference and source_system are required")
+
+// External tells which payment outside the ledger a deposit or withdrawal belongs to
+type External struct {
+	Reference string // id of the payment in the other system
+	Source    string // which system that is, like a bank or card processor
+	Pending   bool   // book it as PENDING until the other system confirms it, see PostPending
+	Details
+}
+
+// MovementResult has everything that changed after a deposit or withdrawal
+type MovementResult struct {
+	Account     *models.Account
+	Transaction *models.Transaction
+}
+
+// Deposit puts money from outside the ledger on a user's account
+// the money comes from the cash-in account, and the same reference can only
+// be deposited once per source system
+func Deposit(userID int64, amount money.Amount, currency money.Currency, external External) (*MovementResult, error) {
+	return moveExternal(models.TransactionTypeDeposit, userID, amount, currency, external)
+}
+
+// Withdraw takes money off a user's account and out of the ledger
+// the money goes to the cash-out account, the user can't go below zero
+func Withdraw(userID int64, amount money.Amount, currency money.Currency, external External) (*MovementResult, error) {
+	return moveExternal(models.TransactionTypeWithdraw, userID, amount, currency, external)
+}
+
+// moveExternal posts a deposit or withdrawal between a user and cash-in or cash-out
+func moveExternal(transactionType models.TransactionType, userID int64, amount money.Amount, currency money.Currency, external External) (*MovementResult, error) {
+	amount, err := positiveAmount(amount, currency)
+	if err != nil {
+		return nil, err
+	}
+	// admins can deposit to themselves too, so big amounts need a second person like any transfer
+	if err := checkApproval(amount, currency); err != nil {
+		return nil, err
+	}
+	external.Reference = strings.TrimSpace(external.Reference)
+	external.Source = strings.TrimSpace(external.Source)
+	if external.Reference == "" || external.Source == "" {
+		return nil, ErrMissingReference
+	}
+	external.Details, err = external.Details.check()
+	if err != nil {
+		return nil, err
+	}
+
+	var result *MovementResult
+	err = database.RunInTransactionWithRetry(func(tx pgx.Tx) error {
+		account, err := userAccount(tx, userID, currency)
+		if err != nil {
+			return err
+		}
+
+		entry := Entry{
+			Type:              transactionType,
+			Amount:            amount,
+			Currency:          currency,
+			Description:       external.Description,
+			ExternalReference: external.Reference,
+			SourceSystem:      external.Source,
+			ClientReference:   external.ClientReference,
+			Metadata:          external.Metadata,
+			ActedBy:           external.ActedBy,
+			Pending:           external.Pending,
+		}
+		if transactionType == models.TransactionTypeDeposit {
+			cashIn, err := systemAccount(tx, models.SystemAccountCashIn, currency)
+			if err != nil {
+				return err
+			}
+			entry.ToUserID = &userID
+			entry.Legs = []Leg{
+				{AccountID: cashIn.ID, Amount: amount.Neg(), Currency: currency},
+				{AccountID: account.ID, Amount: amount, Currency: currency},
+			}
+		} else {
+			cashOut, err := systemAccount(tx, models.SystemAccountCashOut, currency)
+			if err != nil {
+				return err
+			}
+			entry.FromUserID = &userID
+			entry.Legs = []Leg{
+				{AccountID: account.ID, Amount: amount.Neg(), Currency: currency},
+				{AccountID: cashOut.ID, Amount: amount, Currency: currency},
+			}
+		}
+
+		transaction, accounts, err := post(tx, entry)
+		if err != nil {
+			return err
+		}
+
+		result = &MovementResult{Account: accounts[account.ID], Transaction: transaction}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
@@ -0,0 +1,164 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/yigit-demirko/go-ledger/internal/database"
+	"github.com/yigit-demirko/go-ledger/internal/fx"
+	"github.com/yigit-demirko/go-ledger/internal/models"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// ErrQuoteNotFound is returned for quotes that don't exist, aren't the caller's, expired or were used
+var ErrQuoteNotFound = errors.New("quote not found, expired or already used")
+
+// ConversionResult has everything that changed after a conversion
+type ConversionResult struct {
+	FromAccount *models.Account
+	ToAccount   *models.Account
+	Transaction *models.Transaction
+	Conversion  *models.FXConversion
+}
+
+// QuoteConversion prices a conversion and keeps the price for createdBy until the quote expires
+func QuoteConversion(createdBy int64, amount money.Amount, from, to money.Currency) (*models.FXQuote, error) {
+	amount, err := positiveAmount(amount, from)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	price, err := fx.Price(database.GetPool(), from, to, amount, now)
+	if err != nil {
+		return nil, err
+	}
+
+	return models.CreateFXQuote(createdBy, *price, now.Add(fx.QuoteTTL()))
+}
+
+// Convert sends amount in one currency and gives the receiver the converted
+// amount in another, at the rate that applies right now
+// sender and receiver can be the same user, to change money between currencies
+func Convert(fromUserID, toUserID int64, amount money.Amount, from, to money.Currency, details Details) (*ConversionResult, error) {
+	amount, err := positiveAmount(amount, from)
+	if err != nil {
+		return nil, err
+	}
+
+	return convert(fromUserID, toUserID, nil, details, func(tx pgx.Tx) (*models.FXPrice, error) {
+		return fx.Price(tx, from, to, amount, time.Now())
+	})
+}
+
+// ConvertWithQuote is Convert at the price of a quote the caller got before
+// the quote is used up by the conversion, so it can only ever pay out once
+func ConvertWithQuote(fromUserID, toUserID, quoteID, callerID int64, details Details) (*ConversionResult, error) {
+	return convert(fromUserID, toUserID, &quoteID, details, func(tx pgx.Tx) (*models.FXPrice, error) {
+		quote, err := models.UseFXQuote(tx, quoteID, callerID, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		if quote == nil {
+			return nil, ErrQuoteNotFound
+		}
+		return &quote.FXPrice, nil
+	})
+}
+
+// convert posts a conversion as one journal entry with a leg in each currency
+//   - source currency: the sender pays the amount to our FX account
+//   - target currency: our FX account pays out what the amount is worth, the
+//     receiver gets it less the spread and the spread goes to FEES
+func convert(fromUserID, toUserID int64, quoteID *int64, details Details, priceIt func(tx pgx.Tx) (*models.FXPrice, error)) (*ConversionResult, error) {
+	details, err := details.check()
+	if err != nil {
+		return nil, err
+	}
+
+	var result *ConversionResult
+	err = database.RunInTransactionWithRetry(func(tx pgx.Tx) error {
+		price, err := priceIt(tx)
+		if err != nil {
+			return err
+		}
+		source, target := price.BaseCurrency, price.QuoteCurrency
+		// what the sender pays is checked, a quote could have been made before the threshold changed
+		if err := checkApproval(price.SourceAmount, source); err != nil {
+			return err
+		}
+
+		from, err := userAccount(tx, fromUserID, source)
+		if err != nil {
+			return err
+		}
+		to, err := userAccount(tx, toUserID, target)
+		if err != nil {
+			return err
+		}
+		fxIn, err := systemAccount(tx, models.SystemAccountFX, source)
+		if err != nil {
+			return err
+		}
+		fxOut, err := systemAccount(tx, models.SystemAccountFX, target)
+		if err != nil {
+			return err
+		}
+
+		worth := price.TargetAmount.Add(price.SpreadAmount)
+		legs := []Leg{
+			{AccountID: from.ID, Amount: price.SourceAmount.Neg(), Currency: source},
+			{AccountID: fxIn.ID, Amount: price.SourceAmount, Currency: source},
+			{AccountID: fxOut.ID, Amount: worth.Neg(), Currency: target},
+			{AccountID: to.ID, Amount: price.TargetAmount, Currency: target},
+		}
+		if price.SpreadAmount.IsPositive() {
+			fees, err := systemAccount(tx, models.SystemAccountFees, target)
+			if err != nil {
+				return err
+			}
+			legs = append(legs, Leg{AccountID: fees.ID, Amount: price.SpreadAmount, Currency: target})
+		}
+
+		description := details.Description
+		if description == "" {
+			description = fmt.Sprintf("%s %s to %s %s at %s", price.SourceAmount, source, price.TargetAmount, target, price.CustomerRate)
+		}
+
+		transaction, accounts, err := post(tx, Entry{
+			Type:            models.TransactionTypeConversion,
+			FromUserID:      &fromUserID,
+			ToUserID:        &toUserID,
+			Amount:          price.SourceAmount,
+			Currency:        source,
+			Description:     description,
+			ClientReference: details.ClientReference,
+			Metadata:        details.Metadata,
+			ActedBy:         details.ActedBy,
+			Legs:            legs,
+		})
+		if err != nil {
+			return err
+		}
+
+		conversion, err := models.CreateFXConversion(tx, transaction.ID, quoteID, *price)
+		if err != nil {
+			return err
+		}
+
+		result = &ConversionResult{
+			FromAccount: accounts[from.ID],
+			ToAccount:   accounts[to.ID],
+			Transaction: transaction,
+			Conversion:  conversion,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
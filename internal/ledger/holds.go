@@ -0,0 +1,270 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/yigit-demirko/go-ledger/internal/database"
+	"github.com/yigit-demirko/go-ledger/internal/models"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// error messages for holds
+var (
+	ErrHoldNotFound     = errors.New("hold not found")
+	ErrHoldNotActive    = errors.New("hold was already captured, voided or expired")
+	ErrHoldExpired      = errors.New("hold has expired")
+	ErrCaptureTooLarge  = errors.New("capture is more than the held amount")
+	ErrNoRecipient      = errors.New("to_user_id is required when the hold has no recipient")
+	ErrInvalidExpiresAt = errors.New("expires_at must be in the future")
+)
+
+const (
+	defaultHoldTTL = 7 * 24 * time.Hour // about as long as a card authorization lasts
+	expireBatch    = 100                // how many holds one pass of ExpireHolds handles at most
+)
+
+// HoldTTL reads how long holds last when they don't say, from HOLD_TTL (like "168h")
+func HoldTTL() time.Duration {
+	if ttlStr := os.Getenv("HOLD_TTL"); ttlStr != "" {
+		if ttl, err := time.ParseDuration(ttlStr); err == nil && ttl > 0 {
+			return ttl
+		}
+		log.Printf("Warning: invalid HOLD_TTL %q, using %s", ttlStr, defaultHoldTTL)
+	}
+	return defaultHoldTTL
+}
+
+// HoldRequest says how much to reserve on whose account
+type HoldRequest struct {
+	UserID          int64
+	RecipientUserID *int64 // who gets the money on capture, can also be given at capture
+	Amount          money.Amount
+	Currency        money.Currency
+	Description     string
+	ExpiresAt       time.Time // HoldTTL from now if zero
+}
+
+// CaptureResult has the finished hold and the transfer it made
+type CaptureResult struct {
+	Hold        *models.Hold
+	Transaction *models.Transaction
+}
+
+// PlaceHold reserves money on a user's account, it can't be spent until the
+// hold is captured, voided or expires
+func PlaceHold(req HoldRequest) (*models.Hold, error) {
+	amount, err := positiveAmount(req.Amount, req.Currency)
+	if err != nil {
+		return nil, err
+	}
+	// a capture pays the hold out with nobody approving it, so big holds are refused up front
+	if err := checkApproval(amount, req.Currency); err != nil {
+		return nil, err
+	}
+	if req.RecipientUserID != nil && *req.RecipientUserID == req.UserID {
+		return nil, ErrSameUser
+	}
+
+	expiresAt := req.ExpiresAt
+	if expiresAt.IsZero() {
+		expiresAt = time.Now().Add(HoldTTL())
+	}
+	if !expiresAt.After(time.Now()) {
+		return nil, ErrInvalidExpiresAt
+	}
+
+	var hold *models.Hold
+	err = database.RunInTransactionWithRetry(func(tx pgx.Tx) error {
+		found, err := userAccount(tx, req.UserID, req.Currency)
+		if err != nil {
+			return err
+		}
+
+		// lock it so a freeze can't slip in between the check and the hold
+		locked, err := models.LockAccountsForUpdate(tx, found.ID)
+		if err != nil {
+			return err
+		}
+		account := locked[found.ID]
+		if err := account.CheckStatus(amount.Neg()); err != nil {
+			return err
+		}
+		if err := account.Reserve(tx, amount); err != nil {
+			return err
+		}
+
+		hold, err = models.CreateHold(tx, account, req.RecipientUserID, amount, req.Description, expiresAt)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return hold, nil
+}
+
+// CaptureHold pays out all or part of a hold and releases the rest
+// the money goes to toUserID, or to the hold's recipient if that is nil
+func CaptureHold(holdID int64, amount *money.Amount, toUserID *int64, description string) (*CaptureResult, error) {
+	var result *CaptureResult
+	err := database.RunInTransactionWithRetry(func(tx pgx.Tx) error {
+		hold, err := activeHold(tx, holdID)
+		if err != nil {
+			return err
+		}
+
+		captured := hold.Amount
+		if amount != nil {
+			captured, err = positiveAmount(*amount, hold.Currency)
+			if err != nil {
+				return err
+			}
+			if captured.Cmp(hold.Amount) > 0 {
+				return ErrCaptureTooLarge
+			}
+		}
+		// checked again, the hold may be older than the threshold
+		if err := checkApproval(captured, hold.Currency); err != nil {
+			return err
+		}
+
+		if toUserID == nil {
+			toUserID = hold.RecipientUserID
+		}
+		if toUserID == nil {
+			return ErrNoRecipient
+		}
+		if *toUserID == hold.UserID {
+			return ErrSameUser
+		}
+
+		to, err := userAccount(tx, *toUserID, hold.Currency)
+		if err != nil {
+			return err
+		}
+
+		// lock both accounts in id order before touching either
+		accounts, err := models.LockAccountsForUpdate(tx, hold.AccountID, to.ID)
+		if err != nil {
+			return err
+		}
+		if err := accounts[hold.AccountID].Release(tx, hold.Amount); err != nil {
+			return err
+		}
+
+		if description == "" {
+			description = fmt.Sprintf("Capture of hold %d", hold.ID)
+		}
+		transaction, _, err := post(tx, Entry{
+			Type:        models.TransactionTypeTransfer,
+			FromUserID:  &hold.UserID,
+			ToUserID:    toUserID,
+			Amount:      captured,
+			Currency:    hold.Currency,
+			Description: description,
+			Legs: []Leg{
+				{AccountID: hold.AccountID, Amount: captured.Neg(), Currency: hold.Currency},
+				{AccountID: to.ID, Amount: captured, Currency: hold.Currency},
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := hold.Finish(tx, models.HoldStatusCaptured, &captured, &transaction.ID); err != nil {
+			return err
+		}
+
+		result = &CaptureResult{Hold: hold, Transaction: transaction}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// VoidHold cancels a hold and releases all of its money
+func VoidHold(holdID int64) (*models.Hold, error) {
+	var hold *models.Hold
+	err := database.RunInTransactionWithRetry(func(tx pgx.Tx) error {
+		var err error
+		hold, err = activeHold(tx, holdID)
+		if err != nil {
+			return err
+		}
+		return releaseHold(tx, hold, models.HoldStatusVoided)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return hold, nil
+}
+
+// ExpireHolds releases the money of holds nobody captured in time
+// it returns how many holds it expired, and is safe to run on several servers at once
+func ExpireHolds() (int, error) {
+	expired := 0
+	for {
+		count := 0
+		err := database.RunInTransactionWithRetry(func(tx pgx.Tx) error {
+			holds, err := models.LockExpiredHolds(tx, time.Now(), expireBatch)
+			if err != nil {
+				return err
+			}
+			for i := range holds {
+				if err := releaseHold(tx, &holds[i], models.HoldStatusExpired); err != nil {
+					return err
+				}
+			}
+			count = len(holds)
+			return nil
+		})
+		if err != nil {
+			return expired, err
+		}
+
+		expired += count
+		if count < expireBatch {
+			return expired, nil
+		}
+	}
+}
+
+// activeHold locks a hold inside tx and checks it can still be captured or voided
+func activeHold(tx pgx.Tx, holdID int64) (*models.Hold, error) {
+	hold, err := models.LockHoldForUpdate(tx, holdID)
+	if err != nil {
+		return nil, err
+	}
+	if hold == nil {
+		return nil, ErrHoldNotFound
+	}
+	if hold.Status != models.HoldStatusActive {
+		return nil, ErrHoldNotActive
+	}
+	// ExpireHolds will release it soon, until then it can't be used either
+	if !hold.ExpiresAt.After(time.Now()) {
+		return nil, ErrHoldExpired
+	}
+	return hold, nil
+}
+
+// releaseHold gives the whole held amount back to the account and closes the hold
+func releaseHold(tx pgx.Tx, hold *models.Hold, status models.HoldStatus) error {
+	accounts, err := models.LockAccountsForUpdate(tx, hold.AccountID)
+	if err != nil {
+		return err
+	}
+	if err := accounts[hold.AccountID].Release(tx, hold.Amount); err != nil {
+		return err
+	}
+	return hold.Finish(tx, status, nil, nil)
+}
@@ -0,0 +1,214 @@
+package ledger
+
+import (
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/yigit-demirko/go-ledger/internal/models"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// error messages for entries that can't be posted
+var (
+	ErrUnbalancedEntry  = errors.New("journal entry debits and credits are not equal")
+	ErrTooFewPostings   = errors.New("journal entry needs at least two postings")
+	ErrZeroPosting      = errors.New("journal entry has a posting of zero")
+	ErrAccountNotFound  = errors.New("account not found")
+	ErrCurrencyMismatch = errors.New("currency does not match the account")
+)
+
+// Leg is one posting we want to write: how much goes in or out of an account
+type Leg struct {
+	AccountID int64
+	Amount    money.Amount   // negative takes money out, positive puts money in
+	Currency  money.Currency // must be the currency of the account
+}
+
+// Entry is a journal entry before it is saved
+type Entry struct {
+	Type              models.TransactionType
+	FromUserID        *int64         // summary of who paid, for simple entries
+	ToUserID          *int64         // summary of who got paid, for simple entries
+	Amount            money.Amount   // summary of how much moved
+	Currency          money.Currency // currency of the summary amount
+	Description       string
+	ExternalReference string // for money from or to outside the ledger
+	SourceSystem      string // the outside system ExternalReference belongs to
+	ClientReference   string // the client's own id for the entry
+	Metadata          models.Metadata
+	ActedBy           *int64 // who sent it for the owner of the money, nil when the owner did
+	ReversesID        *int64 // for reversals, the transaction they give back
+	AllowNegative     bool   // let user accounts go below zero, only for what an admin forces
+	IgnoreStatus      bool   // book it on frozen accounts too, only for the ledger's own entries like interest
+	Pending           bool   // money in flight: book the legs as pending until the entry is posted
+	Legs              []Leg
+}
+
+// Validate checks that the entry is a proper double-entry record
+// debits and credits have to be equal in every currency on their own
+func (e Entry) Validate() error {
+	if len(e.Legs) < 2 {
+		return ErrTooFewPostings
+	}
+
+	totals := map[money.Currency]money.Amount{}
+	for _, leg := range e.Legs {
+		if leg.Amount.IsZero() {
+			return ErrZeroPosting
+		}
+		if _, err := leg.Currency.Normalize(leg.Amount); err != nil {
+			return err
+		}
+		total, err := totals[leg.Currency].AddChecked(leg.Amount)
+		if err != nil {
+			return err
+		}
+		totals[leg.Currency] = total
+	}
+	for _, total := range totals {
+		if !total.IsZero() {
+			return ErrUnbalancedEntry
+		}
+	}
+	return nil
+}
+
+// post writes a journal entry inside tx
+// it locks every account of the entry, moves the balances and saves the
+// transaction with its postings; user accounts can't go below zero and
+// frozen or closed accounts can't send (or receive) money
+// a pending entry saves pending postings instead, see PostPending
+func post(tx pgx.Tx, entry Entry) (*models.Transaction, map[int64]*models.Account, error) {
+	if err := entry.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	ids := make([]int64, 0, len(entry.Legs))
+	for _, leg := range entry.Legs {
+		ids = append(ids, leg.AccountID)
+	}
+
+	accounts, err := models.LockAccountsForUpdate(tx, ids...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// move the money on every account first, this also checks the balances
+	// pending entries only put the money aside, the balances move once they are posted
+	for _, leg := range entry.Legs {
+		account := accounts[leg.AccountID]
+		if account == nil {
+			return nil, nil, ErrAccountNotFound
+		}
+		if account.Currency != leg.Currency {
+			return nil, nil, ErrCurrencyMismatch
+		}
+		if !entry.IgnoreStatus {
+			if err := account.CheckStatus(leg.Amount); err != nil {
+				return nil, nil, err
+			}
+		}
+		if entry.Pending {
+			err = account.AddPending(tx, leg.Amount, entry.AllowNegative)
+		} else if entry.AllowNegative {
+			err = account.ForceUpdateBalance(tx, leg.Amount)
+		} else {
+			err = account.UpdateBalance(tx, leg.Amount)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	status := models.TransactionStatusPosted
+	if entry.Pending {
+		status = models.TransactionStatusPending
+	}
+
+	transaction, err := models.CreateTransaction(tx, models.Transaction{
+		FromUserID:            entry.FromUserID,
+		ToUserID:              entry.ToUserID,
+		Amount:                entry.Amount,
+		Currency:              entry.Currency,
+		TransactionType:       entry.Type,
+		Description:           entry.Description,
+		ExternalReference:     entry.ExternalReference,
+		SourceSystem:          entry.SourceSystem,
+		ClientReference:       entry.ClientReference,
+		Metadata:              entry.Metadata,
+		ActedBy:               entry.ActedBy,
+		ReversesTransactionID: entry.ReversesID,
+		Status:                status,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// every posting of an entry gets the same time as the entry itself
+	for _, leg := range entry.Legs {
+		if entry.Pending {
+			posting, err := models.CreatePendingPosting(tx, transaction.ID, leg.AccountID, leg.Amount, leg.Currency, transaction.CreatedAt)
+			if err != nil {
+				return nil, nil, err
+			}
+			transaction.PendingPostings = append(transaction.PendingPostings, *posting)
+			continue
+		}
+
+		posting, err := models.CreatePosting(tx, transaction.ID, leg.AccountID, leg.Amount, leg.Currency, transaction.CreatedAt)
+		if err != nil {
+			return nil, nil, err
+		}
+		transaction.Postings = append(transaction.Postings, *posting)
+	}
+
+	return transaction, accounts, nil
+}
+
+// userAccount finds the account of a user in a currency inside tx
+// a user who never held the currency gets an empty account, which is rolled
+// back with everything else if the entry can't be posted
+func userAccount(tx pgx.Tx, userID int64, currency money.Currency) (*models.Account, error) {
+	account, err := models.GetOrCreateUserAccount(tx, userID, currency)
+	if err != nil {
+		return nil, err
+	}
+	if account == nil {
+		return nil, models.ErrUserNotFound
+	}
+	return account, nil
+}
+
+// ownedAccount finds one account of a user inside tx
+// system accounts and accounts of other users are not found, so nobody can
+// tell them apart from accounts that don't exist
+func ownedAccount(tx pgx.Tx, userID, accountID int64) (*models.Account, error) {
+	account, err := models.GetAccountByID(tx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if account == nil || account.UserID == nil || *account.UserID != userID {
+		return nil, ErrAccountNotFound
+	}
+	return account, nil
+}
+
+// partyAccount finds the account one side of a transfer uses in a currency
+func partyAccount(tx pgx.Tx, party Party, currency money.Currency) (*models.Account, error) {
+	if party.AccountID == nil {
+		return userAccount(tx, party.UserID, currency)
+	}
+	account, err := ownedAccount(tx, party.UserID, *party.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	if account.Currency != currency {
+		return nil, ErrCurrencyMismatch
+	}
+	return account, nil
+}
+
+// systemAccount finds one of the ledger's own accounts in a currency inside tx
+func systemAccount(tx pgx.Tx, code string, currency money.Currency) (*models.Account, error) {
+	return models.GetOrCreateSystemAccount(tx, code, currency)
+}
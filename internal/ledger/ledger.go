@@ -0,0 +1,176 @@
+package ledger
+
+import (
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/yigit-demirko/go-ledger/internal/database"
+	"github.com/yigit-demirko/go-ledger/internal/models"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// error messages callers can check for
+var (
+	ErrInvalidAmount = errors.New("amount must be greater than zero")
+	ErrSameUser      = errors.New("cannot transfer to the same user")
+)
+
+// TransferResult has everything that changed after a transfer
+type TransferResult struct {
+	FromAccount *models.Account
+	ToAccount   *models.Account
+	Transaction *models.Transaction
+}
+
+// Party is one side of a transfer: a user's default account in the
+// currency, or one of their other accounts when AccountID is set
+type Party struct {
+	UserID    int64
+	AccountID *int64
+}
+
+// Transfer moves money from one user to another in one currency
+// the debit, the credit and the journal entry are saved in one database
+// transaction, so either all of them happen or none of them do
+// money between two accounts of the same user is a Move instead
+// amounts above the approval threshold go through RequestTransferApproval
+func Transfer(from, to Party, amount money.Amount, currency money.Currency, details Details) (*TransferResult, error) {
+	amount, details, err := checkTransfer(from, to, amount, currency, details)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkApproval(amount, currency); err != nil {
+		return nil, err
+	}
+
+	var result *TransferResult
+	err = database.RunInTransactionWithRetry(func(tx pgx.Tx) error {
+		var err error
+		result, err = transfer(tx, from, to, amount, currency, details)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// checkTransfer checks what can be checked about a transfer before it runs
+// it returns the amount and details the way they are saved
+func checkTransfer(from, to Party, amount money.Amount, currency money.Currency, details Details) (money.Amount, Details, error) {
+	amount, err := positiveAmount(amount, currency)
+	if err != nil {
+		return amount, details, err
+	}
+	if from.UserID == to.UserID {
+		return amount, details, ErrSameUser
+	}
+	details, err = details.check()
+	return amount, details, err
+}
+
+// transfer moves money checked by checkTransfer inside tx
+func transfer(tx pgx.Tx, from, to Party, amount money.Amount, currency money.Currency, details Details) (*TransferResult, error) {
+	fromAccount, err := partyAccount(tx, from, currency)
+	if err != nil {
+		return nil, err
+	}
+	toAccount, err := partyAccount(tx, to, currency)
+	if err != nil {
+		return nil, err
+	}
+
+	// take money from sender and give it to receiver
+	transaction, accounts, err := post(tx, Entry{
+		Type:            models.TransactionTypeTransfer,
+		FromUserID:      &from.UserID,
+		ToUserID:        &to.UserID,
+		Amount:          amount,
+		Currency:        currency,
+		Description:     details.Description,
+		ClientReference: details.ClientReference,
+		Metadata:        details.Metadata,
+		ActedBy:         details.ActedBy,
+		Legs: []Leg{
+			{AccountID: fromAccount.ID, Amount: amount.Neg(), Currency: currency},
+			{AccountID: toAccount.ID, Amount: amount, Currency: currency},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &TransferResult{
+		FromAccount: accounts[fromAccount.ID],
+		ToAccount:   accounts[toAccount.ID],
+		Transaction: transaction,
+	}, nil
+}
+
+// balanceAmount checks an amount a balance is set to, zero is fine
+func balanceAmount(amount money.Amount, currency money.Currency) (money.Amount, error) {
+	if amount.IsNegative() {
+		return money.Amount{}, ErrInvalidAmount
+	}
+	return currency.Normalize(amount)
+}
+
+// setBalance sets the balance of account to amount inside tx
+// the difference to the current balance is booked as a deposit from the
+// cash-in account (or a withdrawal to cash-out), so the journal still
+// explains every cent; it returns nil if the balance was already right
+func setBalance(tx pgx.Tx, account *models.Account, amount money.Amount, currency money.Currency) (*models.Transaction, error) {
+	userID := *account.UserID
+
+	// lock the account so the balance can't change while we look at it
+	locked, err := models.LockAccountsForUpdate(tx, account.ID)
+	if err != nil {
+		return nil, err
+	}
+	account = locked[account.ID]
+
+	change := amount.Sub(account.Balance)
+	if change.IsZero() {
+		return nil, nil
+	}
+
+	entry := Entry{Currency: currency, Description: "Initial balance"}
+	if change.IsPositive() {
+		cashIn, err := systemAccount(tx, models.SystemAccountCashIn, currency)
+		if err != nil {
+			return nil, err
+		}
+		entry.Type = models.TransactionTypeDeposit
+		entry.ToUserID = &userID
+		entry.Amount = change
+		entry.Legs = []Leg{
+			{AccountID: cashIn.ID, Amount: change.Neg(), Currency: currency},
+			{AccountID: account.ID, Amount: change, Currency: currency},
+		}
+	} else {
+		cashOut, err := systemAccount(tx, models.SystemAccountCashOut, currency)
+		if err != nil {
+			return nil, err
+		}
+		entry.Type = models.TransactionTypeWithdraw
+		entry.FromUserID = &userID
+		entry.Amount = change.Neg()
+		entry.Legs = []Leg{
+			{AccountID: account.ID, Amount: change, Currency: currency},
+			{AccountID: cashOut.ID, Amount: change.Neg(), Currency: currency},
+		}
+	}
+
+	transaction, _, err := post(tx, entry)
+	return transaction, err
+}
+
+// positiveAmount checks that amount is more than zero and fits the currency
+// it returns the amount written with the currency's decimal places
+func positiveAmount(amount money.Amount, currency money.Currency) (money.Amount, error) {
+	if !amount.IsPositive() {
+		return money.Amount{}, ErrInvalidAmount
+	}
+	return currency.Normalize(amount)
+}
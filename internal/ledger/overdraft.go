@@ -0,0 +1,141 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/yigit-demirko/go-ledger/internal/database"
+	"github.com/yigit-demirko/go-ledger/internal/models"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// error messages for credit lines
+var (
+	ErrInvalidLimit    = errors.New("overdraft limit can't be negative")
+	ErrInvalidInterest = errors.New("overdraft_interest_bps can't be negative")
+)
+
+// interest rates are yearly, we charge one day's worth at a time
+const daysPerYear = 365
+
+// OverdraftChange is what an admin wants a user's credit line in one currency to be
+type OverdraftChange struct {
+	UserID      int64
+	Currency    money.Currency
+	Limit       money.Amount // how far below zero the account may go, 0 ends the credit line
+	InterestBps int64        // yearly interest on a negative balance
+	Reason      string
+	ChangedBy   int64 // the admin making the change
+}
+
+// SetOverdraftLimit changes a user's credit line and records who changed it and why
+// a limit lower than what the user already owes is allowed, they just can't spend more
+func SetOverdraftLimit(change OverdraftChange) (*models.Account, *models.OverdraftLimitChange, error) {
+	if change.Limit.IsNegative() {
+		return nil, nil, ErrInvalidLimit
+	}
+	if change.InterestBps < 0 {
+		return nil, nil, ErrInvalidInterest
+	}
+	limit, err := change.Currency.Normalize(change.Limit)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var account *models.Account
+	var recorded *models.OverdraftLimitChange
+	err = database.RunInTransactionWithRetry(func(tx pgx.Tx) error {
+		found, err := userAccount(tx, change.UserID, change.Currency)
+		if err != nil {
+			return err
+		}
+
+		locked, err := models.LockAccountsForUpdate(tx, found.ID)
+		if err != nil {
+			return err
+		}
+		account = locked[found.ID]
+
+		recorded, err = account.SetOverdraft(tx, limit, change.InterestBps, change.Reason, change.ChangedBy)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return account, recorded, nil
+}
+
+// AccrueOverdraftInterest charges one day of interest to every account that
+// is below zero on day, as an INTEREST transaction paid to FEES
+// every account is charged at most once per day, however often this runs
+func AccrueOverdraftInterest(day time.Time) (int, error) {
+	day = time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+
+	ids, err := models.GetAccountIDsToAccrue(day)
+	if err != nil {
+		return 0, err
+	}
+
+	charged := 0
+	for _, id := range ids {
+		var transaction *models.Transaction
+		err := database.RunInTransactionWithRetry(func(tx pgx.Tx) error {
+			transaction = nil
+
+			claimed, err := models.ClaimOverdraftAccrual(tx, id, day)
+			if err != nil || !claimed {
+				return err
+			}
+
+			locked, err := models.LockAccountsForUpdate(tx, id)
+			if err != nil {
+				return err
+			}
+			account := locked[id]
+			if !account.Balance.IsNegative() || account.OverdraftInterestBps == 0 {
+				return nil
+			}
+
+			interest, err := account.Balance.Neg().MulFrac(account.OverdraftInterestBps, 10000*daysPerYear, account.Currency.Exponent(), money.RoundHalfEven)
+			if err != nil || interest.IsZero() {
+				return err
+			}
+
+			fees, err := systemAccount(tx, models.SystemAccountFees, account.Currency)
+			if err != nil {
+				return err
+			}
+
+			// interest is owed whatever the limit or a freeze, so it may take the account past it
+			transaction, _, err = post(tx, Entry{
+				Type:          models.TransactionTypeInterest,
+				FromUserID:    account.UserID,
+				Amount:        interest,
+				Currency:      account.Currency,
+				Description:   fmt.Sprintf("Overdraft interest for %s", day.Format("2006-01-02")),
+				AllowNegative: true,
+				IgnoreStatus:  true,
+				Legs: []Leg{
+					{AccountID: account.ID, Amount: interest.Neg(), Currency: account.Currency},
+					{AccountID: fees.ID, Amount: interest, Currency: account.Currency},
+				},
+			})
+			if err != nil {
+				return err
+			}
+
+			return models.SetOverdraftAccrualTransaction(tx, id, day, transaction.ID)
+		})
+		if err != nil {
+			return charged, err
+		}
+		if transaction != nil {
+			charged++
+		}
+	}
+
+	return charged, nil
+}
@@ -0,0 +1,181 @@
+package ledger
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/yigit-demirko/go-ledger/internal/database"
+	"github.com/yigit-demirko/go-ledger/internal/models"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// error messages for payment requests
+var (
+	ErrPaymentRequestNotFound   = errors.New("payment request not found")
+	ErrPaymentRequestNotPending = errors.New("payment request was already accepted, declined, cancelled or expired")
+	ErrPaymentRequestExpired    = errors.New("payment request has expired")
+	ErrRequestNeedsApproval     = errors.New("amount is above the approval threshold, ask for a single transfer instead")
+)
+
+const defaultPaymentRequestTTL = 7 * 24 * time.Hour
+
+// PaymentRequestTTL reads how long a payment request waits for the payer, from PAYMENT_REQUEST_TTL (like "168h")
+func PaymentRequestTTL() time.Duration {
+	if ttlStr := os.Getenv("PAYMENT_REQUEST_TTL"); ttlStr != "" {
+		if ttl, err := time.ParseDuration(ttlStr); err == nil && ttl > 0 {
+			return ttl
+		}
+		log.Printf("Warning: invalid PAYMENT_REQUEST_TTL %q, using %s", ttlStr, defaultPaymentRequestTTL)
+	}
+	return defaultPaymentRequestTTL
+}
+
+// PaymentRequestInput is one user asking another for money
+type PaymentRequestInput struct {
+	Requester Party // who gets paid, into their default account unless AccountID is set
+	PayerID   int64
+	Amount    money.Amount
+	Currency  money.Currency
+	Note      string // why, it becomes the description of the transfer
+}
+
+// RequestPayment saves a pending request for the payer to pay the requester
+// everything that can be checked now is, the payer's balance only when they accept
+func RequestPayment(input PaymentRequestInput) (*models.PaymentRequest, error) {
+	payer := Party{UserID: input.PayerID}
+	amount, details, err := checkTransfer(payer, input.Requester, input.Amount, input.Currency, Details{Description: input.Note})
+	if err != nil {
+		return nil, err
+	}
+	// accepting it can't wait for a second person, so big amounts are sent as transfers
+	if NeedsApproval(amount, input.Currency) {
+		return nil, ErrRequestNeedsApproval
+	}
+	if err := checkParty(input.Requester, input.Currency); err != nil {
+		return nil, err
+	}
+
+	return models.CreatePaymentRequest(database.GetPool(), models.PaymentRequest{
+		RequesterID:        input.Requester.UserID,
+		RequesterAccountID: input.Requester.AccountID,
+		PayerID:            input.PayerID,
+		Amount:             amount,
+		Currency:           input.Currency,
+		Note:               details.Description,
+		ExpiresAt:          time.Now().Add(PaymentRequestTTL()),
+	})
+}
+
+// AcceptPaymentRequest pays a pending request from the payer's money
+// the transfer and the new status are saved in one database transaction: if
+// the payer can't pay it, nothing changes and the request stays pending
+// fromAccountID picks another account of the payer, actedBy is the admin or
+// delegate accepting it for them
+func AcceptPaymentRequest(id int64, fromAccountID *int64, decidedBy int64, actedBy *int64) (*models.PaymentRequest, error) {
+	var request *models.PaymentRequest
+	err := database.RunInTransactionWithRetry(func(tx pgx.Tx) error {
+		var err error
+		request, err = pendingPaymentRequest(tx, id)
+		if err != nil {
+			return err
+		}
+		// the threshold may have changed since it was made
+		if NeedsApproval(request.Amount, request.Currency) {
+			return ErrRequestNeedsApproval
+		}
+
+		result, err := transfer(tx,
+			Party{UserID: request.PayerID, AccountID: fromAccountID},
+			Party{UserID: request.RequesterID, AccountID: request.RequesterAccountID},
+			request.Amount, request.Currency,
+			Details{
+				Description: request.Note,
+				Metadata:    models.Metadata{"payment_request_id": request.ID},
+				ActedBy:     actedBy,
+			},
+		)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		request.Status = models.PaymentRequestStatusAccepted
+		request.PayerAccountID = &result.FromAccount.ID
+		request.TransactionID = &result.Transaction.ID
+		request.DecidedBy = &decidedBy
+		request.AcceptedAt = &now
+		return request.Save(tx)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return request, nil
+}
+
+// DeclinePaymentRequest turns down a pending request for the payer, nothing moves
+func DeclinePaymentRequest(id, decidedBy int64, reason string) (*models.PaymentRequest, error) {
+	return answerPaymentRequest(id, func(request *models.PaymentRequest, now time.Time) {
+		request.Status = models.PaymentRequestStatusDeclined
+		request.DeclineReason = strings.TrimSpace(reason)
+		request.DecidedBy = &decidedBy
+		request.DeclinedAt = &now
+	})
+}
+
+// CancelPaymentRequest takes back a pending request for the requester, nothing moves
+func CancelPaymentRequest(id, decidedBy int64) (*models.PaymentRequest, error) {
+	return answerPaymentRequest(id, func(request *models.PaymentRequest, now time.Time) {
+		request.Status = models.PaymentRequestStatusCancelled
+		request.DecidedBy = &decidedBy
+		request.CancelledAt = &now
+	})
+}
+
+// ExpirePaymentRequests marks requests nobody answered in time as expired
+// it returns how many it marked
+func ExpirePaymentRequests() (int64, error) {
+	return models.ExpirePaymentRequests(time.Now())
+}
+
+// answerPaymentRequest locks a pending request, lets change set its new status and saves it
+func answerPaymentRequest(id int64, change func(request *models.PaymentRequest, now time.Time)) (*models.PaymentRequest, error) {
+	var request *models.PaymentRequest
+	err := database.RunInTransactionWithRetry(func(tx pgx.Tx) error {
+		var err error
+		request, err = pendingPaymentRequest(tx, id)
+		if err != nil {
+			return err
+		}
+		change(request, time.Now())
+		return request.Save(tx)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return request, nil
+}
+
+// pendingPaymentRequest locks a payment request inside tx and checks it can still be answered
+func pendingPaymentRequest(tx pgx.Tx, id int64) (*models.PaymentRequest, error) {
+	request, err := models.LockPaymentRequestForUpdate(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	if request == nil {
+		return nil, ErrPaymentRequestNotFound
+	}
+	if request.Status != models.PaymentRequestStatusPending {
+		return nil, ErrPaymentRequestNotPending
+	}
+	// ExpirePaymentRequests will mark it soon, until then it can't be answered either
+	if !request.ExpiresAt.After(time.Now()) {
+		return nil, ErrPaymentRequestExpired
+	}
+	return request, nil
+}
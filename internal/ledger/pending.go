@@ -0,0 +1,93 @@
+package ledger
+
+import (
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/yigit-demirko/go-ledger/internal/database"
+	"github.com/yigit-demirko/go-ledger/internal/models"
+)
+
+// PostPending finishes a pending transaction: its pending postings become
+// real postings, the balances move and it is POSTED
+// the money going out was already put aside, so no balance check can fail
+// here, but a frozen or closed account can
+func PostPending(transactionID int64) (*models.Transaction, error) {
+	return finishPending(transactionID, models.TransactionStatusPosted, "")
+}
+
+// FailPending gives back what a pending transaction put aside and marks it FAILED
+// nothing ever moved, its pending postings stay as a record of what was tried
+func FailPending(transactionID int64, reason string) (*models.Transaction, error) {
+	return finishPending(transactionID, models.TransactionStatusFailed, reason)
+}
+
+func finishPending(transactionID int64, status models.TransactionStatus, reason string) (*models.Transaction, error) {
+	var transaction *models.Transaction
+	err := database.RunInTransactionWithRetry(func(tx pgx.Tx) error {
+		// lock it first so it can only be finished once
+		var err error
+		transaction, err = models.LockTransactionForUpdate(tx, transactionID)
+		if err != nil {
+			return err
+		}
+		if transaction == nil {
+			return ErrTransactionNotFound
+		}
+		if !transaction.Status.CanBecome(status) {
+			return models.ErrInvalidTransition
+		}
+
+		ids := make([]int64, 0, len(transaction.PendingPostings))
+		for _, pending := range transaction.PendingPostings {
+			ids = append(ids, pending.AccountID)
+		}
+		accounts, err := models.LockAccountsForUpdate(tx, ids...)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		for _, pending := range transaction.PendingPostings {
+			account := accounts[pending.AccountID]
+			if err := account.RemovePending(tx, pending.Amount); err != nil {
+				return err
+			}
+			if status != models.TransactionStatusPosted {
+				continue
+			}
+
+			// an account frozen while the money was on its way stops it, the
+			// other system can still fail the transaction
+			if err := account.CheckStatus(pending.Amount); err != nil {
+				return err
+			}
+
+			if err := account.ForceUpdateBalance(tx, pending.Amount); err != nil {
+				return err
+			}
+			// the postings are dated when the money really moved
+			if _, err := models.CreatePosting(tx, transaction.ID, pending.AccountID, pending.Amount, pending.Currency, now); err != nil {
+				return err
+			}
+		}
+		if status == models.TransactionStatusPosted {
+			if err := models.DeletePendingPostings(tx, transaction.ID); err != nil {
+				return err
+			}
+		}
+
+		if err := transaction.SetStatus(tx, status, reason); err != nil {
+			return err
+		}
+
+		// read it again to get its new postings
+		transaction, err = models.LockTransactionForUpdate(tx, transactionID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return transaction, nil
+}
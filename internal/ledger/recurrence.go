@@ -0,0 +1,207 @@
+package ledger
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yigit-demirko/go-ledger/internal/models"
+)
+
+// error messages for recurrence rules
+var (
+	ErrInvalidFrequency = errors.New("frequency must be DAILY, WEEKLY, MONTHLY or CRON")
+	ErrInvalidInterval  = errors.New("interval must be greater than zero, and can't be used with CRON")
+	ErrInvalidCron      = errors.New("cron must have 5 fields: minute hour day-of-month month day-of-week")
+	ErrCronNotAllowed   = errors.New("cron can only be used with frequency CRON")
+	ErrInvalidEnd       = errors.New("end_at must be after start_at and max_occurrences greater than zero")
+	ErrNoOccurrences    = errors.New("the recurrence never runs before it ends")
+)
+
+// how far ahead a cron expression is searched before we give up,
+// so something like "0 0 31 2 *" (February 31st) doesn't loop forever
+const maxCronSearch = 5 * 366 * 24 * time.Hour
+
+// occurrence works out when the n-th run (counting from 0) of a standing order is
+// previous is when run n-1 was, it is only needed by cron rules
+// ok is false when the order has ended before run n
+func occurrence(order *models.StandingOrder, n int, previous *time.Time) (time.Time, bool) {
+	if order.MaxOccurrences != nil && n >= *order.MaxOccurrences {
+		return time.Time{}, false
+	}
+
+	start := order.StartAt.UTC()
+	var at time.Time
+	switch order.Frequency {
+	case models.FrequencyDaily:
+		at = start.AddDate(0, 0, n*order.Interval)
+	case models.FrequencyWeekly:
+		at = start.AddDate(0, 0, 7*n*order.Interval)
+	case models.FrequencyMonthly:
+		// counted from the start every time, so the 31st stays the 31st
+		// after a short month instead of sliding to the 28th
+		at = addMonths(start, n*order.Interval)
+	case models.FrequencyCron:
+		schedule, err := parseCron(order.Cron)
+		if err != nil {
+			return time.Time{}, false
+		}
+		after := start.Add(-time.Nanosecond) // the start itself can be the first run
+		if n > 0 && previous != nil {
+			after = previous.UTC()
+		}
+		var found bool
+		if at, found = schedule.next(after); !found {
+			return time.Time{}, false
+		}
+	default:
+		return time.Time{}, false
+	}
+
+	if order.EndAt != nil && at.After(*order.EndAt) {
+		return time.Time{}, false
+	}
+	return at, true
+}
+
+// addMonths moves t by months, landing on the last day of the month when
+// that month is too short for t's day
+func addMonths(t time.Time, months int) time.Time {
+	year, month, day := t.Date()
+	lastDay := time.Date(year, month+time.Month(months)+1, 0, 0, 0, 0, 0, t.Location()).Day()
+	if day > lastDay {
+		day = lastDay
+	}
+	return time.Date(year, month+time.Month(months), day, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+}
+
+// cronSchedule is a parsed 5 field cron expression, in UTC
+// each field says which values match, like minutes[30] for minute 30
+type cronSchedule struct {
+	minutes     [60]bool
+	hours       [24]bool
+	daysOfMonth [32]bool
+	months      [13]bool
+	daysOfWeek  [7]bool // 0 is Sunday, 7 is read as Sunday too
+	anyDOM      bool    // day-of-month was "*"
+	anyDOW      bool    // day-of-week was "*"
+}
+
+// parseCron reads "minute hour day-of-month month day-of-week", where every
+// field is "*", a number, a range "1-5", a step "*/15" or "1-20/5", or a list
+// of those separated by commas
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, ErrInvalidCron
+	}
+
+	var s cronSchedule
+	var daysOfWeek [8]bool
+	if err := parseCronField(fields[0], 0, 59, s.minutes[:]); err != nil {
+		return nil, err
+	}
+	if err := parseCronField(fields[1], 0, 23, s.hours[:]); err != nil {
+		return nil, err
+	}
+	if err := parseCronField(fields[2], 1, 31, s.daysOfMonth[:]); err != nil {
+		return nil, err
+	}
+	if err := parseCronField(fields[3], 1, 12, s.months[:]); err != nil {
+		return nil, err
+	}
+	if err := parseCronField(fields[4], 0, 7, daysOfWeek[:]); err != nil {
+		return nil, err
+	}
+	copy(s.daysOfWeek[:], daysOfWeek[:7])
+	if daysOfWeek[7] {
+		s.daysOfWeek[0] = true
+	}
+	s.anyDOM = fields[2] == "*"
+	s.anyDOW = fields[4] == "*"
+	return &s, nil
+}
+
+// parseCronField marks every value field matches in set, values go from min to max
+func parseCronField(field string, min, max int, set []bool) error {
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if base, stepStr, found := strings.Cut(part, "/"); found {
+			var err error
+			if step, err = strconv.Atoi(stepStr); err != nil || step <= 0 {
+				return ErrInvalidCron
+			}
+			part = base
+		}
+
+		from, to := min, max
+		if part != "*" {
+			fromStr, toStr, isRange := strings.Cut(part, "-")
+			var err error
+			if from, err = strconv.Atoi(fromStr); err != nil {
+				return ErrInvalidCron
+			}
+			to = from
+			if isRange {
+				if to, err = strconv.Atoi(toStr); err != nil {
+					return ErrInvalidCron
+				}
+			}
+		}
+		if from < min || to > max || from > to {
+			return ErrInvalidCron
+		}
+
+		for v := from; v <= to; v += step {
+			set[v] = true
+		}
+	}
+	return nil
+}
+
+// matchesDay checks the day fields like cron does: when both are restricted,
+// a day matching either one is enough
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	dom := s.daysOfMonth[t.Day()]
+	dow := s.daysOfWeek[t.Weekday()]
+	switch {
+	case s.anyDOM && s.anyDOW:
+		return true
+	case s.anyDOM:
+		return dow
+	case s.anyDOW:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// next finds the first whole minute after after that the schedule matches
+// it skips whole months, days and hours that can't match, so it never has to
+// look at every minute
+func (s *cronSchedule) next(after time.Time) (time.Time, bool) {
+	t := after.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(maxCronSearch)
+
+	for t.Before(limit) {
+		if !s.months[t.Month()] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !s.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !s.hours[t.Hour()] {
+			t = t.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+		if !s.minutes[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t, true
+	}
+	return time.Time{}, false
+}
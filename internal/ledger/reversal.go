@@ -0,0 +1,147 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/yigit-demirko/go-ledger/internal/database"
+	"github.com/yigit-demirko/go-ledger/internal/models"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// error messages for reversals that can't be made
+var (
+	ErrTransactionNotFound = errors.New("transaction not found")
+	ErrNotReversible       = errors.New("only transfers, moves, deposits and withdrawals between two accounts can be reversed")
+	ErrNotPosted           = errors.New("only posted transactions can be reversed, a pending one can be failed instead")
+	ErrAlreadyReversed     = errors.New("transaction was already fully reversed")
+	ErrReversalTooLarge    = errors.New("reversal is more than what is left of the original amount")
+	ErrReversalNoFunds     = errors.New("the original recipient no longer has the funds, an admin can force the reversal")
+)
+
+// Reversal says how much of a transaction to give back
+type Reversal struct {
+	TransactionID int64
+	Amount        *money.Amount // nil gives back everything that wasn't reversed yet
+	Description   string
+	Force         bool // let the recipient go below zero, only for admins
+}
+
+// ReversalResult has the new reversal and the original it points at
+type ReversalResult struct {
+	Reversal *models.Transaction
+	Original *models.Transaction
+}
+
+// Reverse gives back all or part of an earlier transaction with a new,
+// linked transaction that moves the money the other way
+// all reversals of a transaction together can't be more than its amount,
+// and the original becomes REVERSED when they add up to all of it
+func Reverse(reversal Reversal) (*ReversalResult, error) {
+	var result *ReversalResult
+	err := database.RunInTransactionWithRetry(func(tx pgx.Tx) error {
+		// lock the original so two reversals of it can't run at the same time
+		original, err := models.LockTransactionForUpdate(tx, reversal.TransactionID)
+		if err != nil {
+			return err
+		}
+		if original == nil {
+			return ErrTransactionNotFound
+		}
+		if original.Status == models.TransactionStatusPending || original.Status == models.TransactionStatusFailed {
+			return ErrNotPosted
+		}
+
+		debit, credit, err := reversibleLegs(original)
+		if err != nil {
+			return err
+		}
+
+		reversed, err := models.GetReversedAmount(tx, original.ID)
+		if err != nil {
+			return err
+		}
+		remaining := original.Amount.Sub(reversed)
+		if !remaining.IsPositive() {
+			return ErrAlreadyReversed
+		}
+
+		amount := remaining
+		if reversal.Amount != nil {
+			amount, err = positiveAmount(*reversal.Amount, original.Currency)
+			if err != nil {
+				return err
+			}
+			if amount.Cmp(remaining) > 0 {
+				return ErrReversalTooLarge
+			}
+		}
+
+		description := reversal.Description
+		if description == "" {
+			description = fmt.Sprintf("Reversal of transaction %d", original.ID)
+		}
+
+		// the money goes back the way it came
+		transaction, _, err := post(tx, Entry{
+			Type:          models.TransactionTypeReversal,
+			FromUserID:    original.ToUserID,
+			ToUserID:      original.FromUserID,
+			Amount:        amount,
+			Currency:      original.Currency,
+			Description:   description,
+			ReversesID:    &original.ID,
+			AllowNegative: reversal.Force,
+			Legs: []Leg{
+				{AccountID: credit.AccountID, Amount: amount.Neg(), Currency: original.Currency},
+				{AccountID: debit.AccountID, Amount: amount, Currency: original.Currency},
+			},
+		})
+		if errors.Is(err, models.ErrInsufficientBalance) {
+			return ErrReversalNoFunds
+		}
+		if err != nil {
+			return err
+		}
+
+		// once everything was given back the original is REVERSED
+		if amount.Cmp(remaining) == 0 {
+			if err := original.SetStatus(tx, models.TransactionStatusReversed, ""); err != nil {
+				return err
+			}
+		}
+
+		original.ReversalIDs = append(original.ReversalIDs, transaction.ID)
+		result = &ReversalResult{Reversal: transaction, Original: original}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// reversibleLegs finds the posting that paid and the one that got paid
+// only simple entries with one of each in one currency can be reversed,
+// reversals themselves and multi-currency entries can't
+func reversibleLegs(original *models.Transaction) (debit, credit models.Posting, err error) {
+	switch original.TransactionType {
+	case models.TransactionTypeTransfer, models.TransactionTypeMove, models.TransactionTypeDeposit, models.TransactionTypeWithdraw:
+	default:
+		return debit, credit, ErrNotReversible
+	}
+	if len(original.Postings) != 2 {
+		return debit, credit, ErrNotReversible
+	}
+
+	debit, credit = original.Postings[0], original.Postings[1]
+	if debit.Amount.IsPositive() {
+		debit, credit = credit, debit
+	}
+	if debit.Currency != original.Currency || credit.Currency != original.Currency {
+		return debit, credit, ErrNotReversible
+	}
+	return debit, credit, nil
+}
@@ -0,0 +1,341 @@
+package ledger
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/yigit-demirko/go-ledger/internal/database"
+	"github.com/yigit-demirko/go-ledger/internal/models"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// error messages for scheduled transfers
+var (
+	ErrScheduledTransferNotFound = errors.New("scheduled transfer not found")
+	ErrNotScheduled              = errors.New("scheduled transfer already ran, failed or was cancelled")
+	ErrInvalidExecuteAt          = errors.New("execute_at must be in the future")
+	ErrNoLongerAllowed           = errors.New("whoever scheduled the transfer can no longer send money for the sender")
+)
+
+const (
+	defaultScheduledTransferAttempts   = 3
+	defaultScheduledTransferRetryDelay = time.Hour
+)
+
+// failures that trying again later can't fix, the transfer fails right away
+var permanentTransferFailures = []error{
+	models.ErrUserNotFound,
+	models.ErrAccountClosed,
+	ErrAccountNotFound,
+	ErrCurrencyMismatch,
+	ErrNoLongerAllowed,
+	ErrNeedsApproval,
+}
+
+// ScheduledTransferAttempts reads how often a scheduled transfer is tried
+// before it fails, from SCHEDULED_TRANSFER_MAX_ATTEMPTS
+func ScheduledTransferAttempts() int {
+	if attemptsStr := os.Getenv("SCHEDULED_TRANSFER_MAX_ATTEMPTS"); attemptsStr != "" {
+		if attempts, err := strconv.Atoi(attemptsStr); err == nil && attempts > 0 {
+			return attempts
+		}
+		log.Printf("Warning: invalid SCHEDULED_TRANSFER_MAX_ATTEMPTS %q, using %d", attemptsStr, defaultScheduledTransferAttempts)
+	}
+	return defaultScheduledTransferAttempts
+}
+
+// ScheduledTransferRetryDelay reads how long to wait before trying a failed
+// scheduled transfer again, from SCHEDULED_TRANSFER_RETRY_DELAY (like "1h")
+func ScheduledTransferRetryDelay() time.Duration {
+	if delayStr := os.Getenv("SCHEDULED_TRANSFER_RETRY_DELAY"); delayStr != "" {
+		if delay, err := time.ParseDuration(delayStr); err == nil && delay > 0 {
+			return delay
+		}
+		log.Printf("Warning: invalid SCHEDULED_TRANSFER_RETRY_DELAY %q, using %s", delayStr, defaultScheduledTransferRetryDelay)
+	}
+	return defaultScheduledTransferRetryDelay
+}
+
+// ScheduledTransferRequest is a transfer to run later
+type ScheduledTransferRequest struct {
+	From      Party
+	To        Party
+	Amount    money.Amount
+	Currency  money.Currency
+	ExecuteAt time.Time
+	Details   Details // ActedBy is the admin or delegate scheduling it for the sender
+	CreatedBy int64
+}
+
+// ScheduledTransferChange is what to change about a scheduled transfer, nil keeps it
+type ScheduledTransferChange struct {
+	Amount          *money.Amount
+	ExecuteAt       *time.Time
+	Description     *string
+	ClientReference *string
+	Metadata        models.Metadata
+}
+
+// ScheduleTransfer saves a transfer to run at ExecuteAt
+// everything that can be checked now is, the balance is only checked when it runs
+func ScheduleTransfer(req ScheduledTransferRequest) (*models.ScheduledTransfer, error) {
+	amount, details, err := checkTransfer(req.From, req.To, req.Amount, req.Currency, req.Details)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkApproval(amount, req.Currency); err != nil {
+		return nil, err
+	}
+	if !req.ExecuteAt.After(time.Now()) {
+		return nil, ErrInvalidExecuteAt
+	}
+	if err := checkParty(req.From, req.Currency); err != nil {
+		return nil, err
+	}
+	if err := checkParty(req.To, req.Currency); err != nil {
+		return nil, err
+	}
+
+	return models.CreateScheduledTransfer(database.GetPool(), models.ScheduledTransfer{
+		FromUserID:      req.From.UserID,
+		FromAccountID:   req.From.AccountID,
+		ToUserID:        req.To.UserID,
+		ToAccountID:     req.To.AccountID,
+		Amount:          amount,
+		Currency:        req.Currency,
+		Description:     details.Description,
+		ClientReference: details.ClientReference,
+		Metadata:        details.Metadata,
+		ActedBy:         details.ActedBy,
+		CreatedBy:       req.CreatedBy,
+		ExecuteAt:       req.ExecuteAt,
+	})
+}
+
+// UpdateScheduledTransfer changes a transfer that didn't run yet
+// a new execute_at also starts the tries over
+func UpdateScheduledTransfer(id int64, change ScheduledTransferChange) (*models.ScheduledTransfer, error) {
+	var transfer *models.ScheduledTransfer
+	err := database.RunInTransactionWithRetry(func(tx pgx.Tx) error {
+		var err error
+		transfer, err = scheduledTransfer(tx, id)
+		if err != nil {
+			return err
+		}
+
+		if change.Amount != nil {
+			if transfer.Amount, err = positiveAmount(*change.Amount, transfer.Currency); err != nil {
+				return err
+			}
+			if err := checkApproval(transfer.Amount, transfer.Currency); err != nil {
+				return err
+			}
+		}
+		if change.ExecuteAt != nil {
+			if !change.ExecuteAt.After(time.Now()) {
+				return ErrInvalidExecuteAt
+			}
+			transfer.ExecuteAt = *change.ExecuteAt
+			transfer.NextAttemptAt = *change.ExecuteAt
+			transfer.Attempts = 0
+			transfer.FailureReason = ""
+		}
+
+		details := Details{
+			Description:     transfer.Description,
+			ClientReference: transfer.ClientReference,
+			Metadata:        transfer.Metadata,
+		}
+		if change.Description != nil {
+			details.Description = *change.Description
+		}
+		if change.ClientReference != nil {
+			details.ClientReference = *change.ClientReference
+		}
+		if change.Metadata != nil {
+			details.Metadata = change.Metadata
+		}
+		if details, err = details.check(); err != nil {
+			return err
+		}
+		transfer.Description = details.Description
+		transfer.ClientReference = details.ClientReference
+		transfer.Metadata = details.Metadata
+
+		return transfer.Save(tx)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return transfer, nil
+}
+
+// CancelScheduledTransfer calls off a transfer that didn't run yet
+func CancelScheduledTransfer(id int64) (*models.ScheduledTransfer, error) {
+	var transfer *models.ScheduledTransfer
+	err := database.RunInTransactionWithRetry(func(tx pgx.Tx) error {
+		var err error
+		transfer, err = scheduledTransfer(tx, id)
+		if err != nil {
+			return err
+		}
+		transfer.Status = models.ScheduledTransferStatusCancelled
+		return transfer.Save(tx)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return transfer, nil
+}
+
+// RunScheduledTransfers runs every scheduled transfer that is due
+// each one is locked, run and marked in its own database transaction, and
+// locked ones are skipped, so with several servers up every transfer still
+// runs once; it returns how many transfers it tried
+func RunScheduledTransfers() (int, error) {
+	tried := 0
+	for {
+		found := false
+		err := database.RunInTransactionWithRetry(func(tx pgx.Tx) error {
+			transfer, err := models.LockNextDueScheduledTransfer(tx, time.Now())
+			if err != nil || transfer == nil {
+				found = false
+				return err
+			}
+			found = true
+			return runScheduledTransfer(tx, transfer)
+		})
+		if err != nil {
+			return tried, err
+		}
+		if !found {
+			return tried, nil
+		}
+		tried++
+	}
+}
+
+// runScheduledTransfer tries a locked scheduled transfer once and writes down how it went
+// a failed transfer leaves nothing behind but the reason
+func runScheduledTransfer(tx pgx.Tx, scheduled *models.ScheduledTransfer) error {
+	scheduled.Attempts++
+
+	transaction, err := sendLater(tx,
+		Party{UserID: scheduled.FromUserID, AccountID: scheduled.FromAccountID},
+		Party{UserID: scheduled.ToUserID, AccountID: scheduled.ToAccountID},
+		scheduled.Amount, scheduled.Currency,
+		Details{
+			Description:     scheduled.Description,
+			ClientReference: scheduled.ClientReference,
+			Metadata:        scheduled.Metadata,
+			ActedBy:         scheduled.ActedBy,
+		},
+	)
+	if database.IsRetryable(err) {
+		return err
+	}
+
+	now := time.Now()
+	switch {
+	case err == nil:
+		scheduled.Status = models.ScheduledTransferStatusExecuted
+		scheduled.TransactionID = &transaction.ID
+		scheduled.ExecutedAt = &now
+		scheduled.FailureReason = ""
+	case isPermanentTransferFailure(err) || scheduled.Attempts >= ScheduledTransferAttempts():
+		scheduled.Status = models.ScheduledTransferStatusFailed
+		scheduled.FailureReason = err.Error()
+	default:
+		scheduled.NextAttemptAt = now.Add(ScheduledTransferRetryDelay())
+		scheduled.FailureReason = err.Error()
+	}
+	return scheduled.Save(tx)
+}
+
+// sendLater makes a transfer that was set up earlier, in a savepoint so a
+// failed one leaves nothing behind in tx
+// whoever set it up for the sender must still be allowed to send their money,
+// and it is checked against the approval threshold again, which may have been lowered since
+func sendLater(tx pgx.Tx, from, to Party, amount money.Amount, currency money.Currency, details Details) (*models.Transaction, error) {
+	if err := checkApproval(amount, currency); err != nil {
+		return nil, err
+	}
+	return sendApproved(tx, from, to, amount, currency, details)
+}
+
+// sendApproved is sendLater without the approval threshold, for transfers a second person approved
+func sendApproved(tx pgx.Tx, from, to Party, amount money.Amount, currency money.Currency, details Details) (*models.Transaction, error) {
+	var transaction *models.Transaction
+	err := database.RunInSavepoint(tx, func(tx pgx.Tx) error {
+		// delegations can be taken back after the transfer was set up
+		if details.ActedBy != nil {
+			allowed, err := models.CanActFor(tx, from.UserID, *details.ActedBy)
+			if err != nil {
+				return err
+			}
+			if !allowed {
+				return ErrNoLongerAllowed
+			}
+		}
+
+		result, err := transfer(tx, from, to, amount, currency, details)
+		if err != nil {
+			return err
+		}
+		transaction = result.Transaction
+		return nil
+	})
+	return transaction, err
+}
+
+// scheduledTransfer locks a scheduled transfer inside tx and checks it didn't run yet
+func scheduledTransfer(tx pgx.Tx, id int64) (*models.ScheduledTransfer, error) {
+	transfer, err := models.LockScheduledTransferForUpdate(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	if transfer == nil {
+		return nil, ErrScheduledTransferNotFound
+	}
+	if transfer.Status != models.ScheduledTransferStatusScheduled {
+		return nil, ErrNotScheduled
+	}
+	return transfer, nil
+}
+
+// checkParty checks that the account a party names belongs to them, is in
+// currency and isn't closed
+func checkParty(party Party, currency money.Currency) error {
+	if party.AccountID == nil {
+		return nil
+	}
+	account, err := UserAccount(*party.AccountID)
+	if err != nil {
+		return err
+	}
+	if *account.UserID != party.UserID {
+		return ErrAccountNotFound
+	}
+	if account.Currency != currency {
+		return ErrCurrencyMismatch
+	}
+	if account.Status == models.AccountStatusClosed {
+		return models.ErrAccountClosed
+	}
+	return nil
+}
+
+func isPermanentTransferFailure(err error) bool {
+	for _, permanent := range permanentTransferFailures {
+		if errors.Is(err, permanent) {
+			return true
+		}
+	}
+	return false
+}
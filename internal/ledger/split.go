@@ -0,0 +1,276 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/yigit-demirko/go-ledger/internal/database"
+	"github.com/yigit-demirko/go-ledger/internal/models"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// how many legs one split transfer can have at most, both sides together
+const maxSplitLegs = 100
+
+// error messages for split transfers
+var (
+	ErrSplitNoDebits        = errors.New("split transfer needs at least one debit leg")
+	ErrSplitNoCredits       = errors.New("split transfer needs at least one credit leg")
+	ErrSplitTooManyLegs     = fmt.Errorf("split transfer can't have more than %d legs", maxSplitLegs)
+	ErrSplitUnbalanced      = errors.New("debit and credit legs of a split transfer must add up to the same amount")
+	ErrSplitLegAmount       = errors.New("each leg needs either an amount or a share more than zero, not both")
+	ErrSplitSharesBothSides = errors.New("only the debit or the credit legs can use shares, not both")
+	ErrShareTooSmall        = errors.New("a share is too small to get any money")
+	ErrSplitSameAccount     = errors.New("an account can't be on both sides of a split transfer")
+	ErrSplitNeedsApproval   = errors.New("amount is above the approval threshold, send it as a single transfer")
+)
+
+// SplitLeg is one sender or receiver of a split transfer
+// it has a fixed Amount, or a Share of what the other side adds up to
+type SplitLeg struct {
+	Party  Party
+	Amount money.Amount
+	Share  int64 // like 90, 8 and 2 for 90%, 8% and 2%, see money.Amount.Allocate
+}
+
+// SplitRequest is one payment from several senders to several receivers
+type SplitRequest struct {
+	Currency money.Currency
+	Debits   []SplitLeg // who pays
+	Credits  []SplitLeg // who gets paid
+	Details  Details
+}
+
+// SplitLegResult is how one leg of a split transfer ended up
+type SplitLegResult struct {
+	UserID  int64
+	Amount  money.Amount // what the leg paid or got, shares turned into amounts
+	Account *models.Account
+}
+
+// SplitResult has everything that changed after a split transfer
+type SplitResult struct {
+	Debits      []SplitLegResult
+	Credits     []SplitLegResult
+	Transaction *models.Transaction
+}
+
+// SplitTransfer moves money from every debit leg to every credit leg in one
+// journal entry, so all participants see the same transaction in their history
+// either every leg moves or none of them does
+func SplitTransfer(req SplitRequest) (*SplitResult, error) {
+	debits, credits, details, err := checkSplit(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var result *SplitResult
+	err = database.RunInTransactionWithRetry(func(tx pgx.Tx) error {
+		var err error
+		result, err = splitTransfer(tx, debits, credits, req.Currency, details)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// checkSplit checks what can be checked about a split transfer before it runs
+// it returns the legs with every share turned into an amount
+func checkSplit(req SplitRequest) ([]SplitLeg, []SplitLeg, Details, error) {
+	if len(req.Debits) == 0 {
+		return nil, nil, req.Details, ErrSplitNoDebits
+	}
+	if len(req.Credits) == 0 {
+		return nil, nil, req.Details, ErrSplitNoCredits
+	}
+	if len(req.Debits)+len(req.Credits) > maxSplitLegs {
+		return nil, nil, req.Details, ErrSplitTooManyLegs
+	}
+	if !req.Currency.Valid() {
+		return nil, nil, req.Details, fmt.Errorf("%w: %q", money.ErrUnknownCurrency, string(req.Currency))
+	}
+
+	details, err := req.Details.check()
+	if err != nil {
+		return nil, nil, details, err
+	}
+
+	debits, debitTotal, debitShares, err := checkSplitLegs(req.Debits, req.Currency)
+	if err != nil {
+		return nil, nil, details, err
+	}
+	credits, creditTotal, creditShares, err := checkSplitLegs(req.Credits, req.Currency)
+	if err != nil {
+		return nil, nil, details, err
+	}
+
+	// the side with shares splits what is left of the other side's total
+	total := debitTotal
+	switch {
+	case debitShares && creditShares:
+		return nil, nil, details, ErrSplitSharesBothSides
+	case debitShares:
+		total = creditTotal
+		debits, err = allocateShares(debits, creditTotal, debitTotal)
+	case creditShares:
+		credits, err = allocateShares(credits, debitTotal, creditTotal)
+	case debitTotal.Cmp(creditTotal) != 0:
+		err = ErrSplitUnbalanced
+	}
+	if err != nil {
+		return nil, nil, details, err
+	}
+
+	// a split can't wait for approval, so big ones have to be sent one by one
+	if NeedsApproval(total, req.Currency) {
+		return nil, nil, details, ErrSplitNeedsApproval
+	}
+
+	for _, leg := range append(append([]SplitLeg{}, debits...), credits...) {
+		if err := checkParty(leg.Party, req.Currency); err != nil {
+			return nil, nil, details, err
+		}
+	}
+
+	return debits, credits, details, nil
+}
+
+// checkSplitLegs checks the legs of one side of a split transfer
+// it returns the legs with their amounts in the currency's decimal places,
+// what the legs with a fixed amount add up to and if any leg has a share
+func checkSplitLegs(legs []SplitLeg, currency money.Currency) ([]SplitLeg, money.Amount, bool, error) {
+	checked := make([]SplitLeg, len(legs))
+	total := currency.Zero()
+	hasShares := false
+
+	for i, leg := range legs {
+		if leg.Share < 0 || (leg.Share > 0 && !leg.Amount.IsZero()) || (leg.Share == 0 && leg.Amount.IsZero()) {
+			return nil, total, false, ErrSplitLegAmount
+		}
+		if leg.Share > 0 {
+			hasShares = true
+			checked[i] = leg
+			continue
+		}
+
+		amount, err := positiveAmount(leg.Amount, currency)
+		if err != nil {
+			return nil, total, false, err
+		}
+		leg.Amount = amount
+		checked[i] = leg
+		total, err = total.AddChecked(amount)
+		if err != nil {
+			return nil, total, false, err
+		}
+	}
+
+	return checked, total, hasShares, nil
+}
+
+// allocateShares gives the legs with a share their part of what is left of
+// total once fixed is taken out, without losing a cent
+func allocateShares(legs []SplitLeg, total, fixed money.Amount) ([]SplitLeg, error) {
+	rest, err := total.SubChecked(fixed)
+	if err != nil {
+		return nil, err
+	}
+	if !rest.IsPositive() {
+		return nil, ErrSplitUnbalanced
+	}
+
+	var shared []int
+	var ratios []int64
+	for i, leg := range legs {
+		if leg.Share > 0 {
+			shared = append(shared, i)
+			ratios = append(ratios, leg.Share)
+		}
+	}
+
+	parts, err := rest.Allocate(ratios...)
+	if err != nil {
+		return nil, err
+	}
+	for j, i := range shared {
+		if parts[j].IsZero() {
+			return nil, ErrShareTooSmall
+		}
+		legs[i].Amount = parts[j]
+		legs[i].Share = 0
+	}
+	return legs, nil
+}
+
+// splitTransfer moves money checked by checkSplit inside tx
+func splitTransfer(tx pgx.Tx, debits, credits []SplitLeg, currency money.Currency, details Details) (*SplitResult, error) {
+	var legs []Leg
+	debited := map[int64]bool{}
+	total := currency.Zero()
+
+	debitAccounts := make([]int64, len(debits))
+	for i, debit := range debits {
+		account, err := partyAccount(tx, debit.Party, currency)
+		if err != nil {
+			return nil, err
+		}
+		debitAccounts[i] = account.ID
+		debited[account.ID] = true
+		total = total.Add(debit.Amount)
+		legs = append(legs, Leg{AccountID: account.ID, Amount: debit.Amount.Neg(), Currency: currency})
+	}
+
+	creditAccounts := make([]int64, len(credits))
+	for i, credit := range credits {
+		account, err := partyAccount(tx, credit.Party, currency)
+		if err != nil {
+			return nil, err
+		}
+		if debited[account.ID] {
+			return nil, ErrSplitSameAccount
+		}
+		creditAccounts[i] = account.ID
+		legs = append(legs, Leg{AccountID: account.ID, Amount: credit.Amount, Currency: currency})
+	}
+
+	transaction, accounts, err := post(tx, Entry{
+		Type:            models.TransactionTypeSplit,
+		FromUserID:      onlyUser(debits),
+		ToUserID:        onlyUser(credits),
+		Amount:          total,
+		Currency:        currency,
+		Description:     details.Description,
+		ClientReference: details.ClientReference,
+		Metadata:        details.Metadata,
+		ActedBy:         details.ActedBy,
+		Legs:            legs,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &SplitResult{Transaction: transaction}
+	for i, debit := range debits {
+		result.Debits = append(result.Debits, SplitLegResult{UserID: debit.Party.UserID, Amount: debit.Amount, Account: accounts[debitAccounts[i]]})
+	}
+	for i, credit := range credits {
+		result.Credits = append(result.Credits, SplitLegResult{UserID: credit.Party.UserID, Amount: credit.Amount, Account: accounts[creditAccounts[i]]})
+	}
+	return result, nil
+}
+
+// onlyUser returns the user of all legs when they are the same, for the
+// summary of the transaction, and nil when several users are on that side
+func onlyUser(legs []SplitLeg) *int64 {
+	userID := legs[0].Party.UserID
+	for _, leg := range legs[1:] {
+		if leg.Party.UserID != userID {
+			return nil
+		}
+	}
+	return &userID
+}
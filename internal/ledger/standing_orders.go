@@ -0,0 +1,317 @@
+package ledger
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/yigit-demirko/go-ledger/internal/database"
+	"github.com/yigit-demirko/go-ledger/internal/models"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// error messages for standing orders
+var (
+	ErrStandingOrderNotFound  = errors.New("standing order not found")
+	ErrStandingOrderNotActive = errors.New("standing order isn't active")
+	ErrStandingOrderNotPaused = errors.New("standing order isn't paused")
+	ErrStandingOrderEnded     = errors.New("standing order already completed, failed or was cancelled")
+	ErrInvalidStartAt         = errors.New("start_at can't be in the past")
+	ErrInvalidFailurePolicy   = errors.New("on_insufficient_funds must be SKIP or RETRY")
+)
+
+// StandingOrderRequest is a transfer to send again and again
+type StandingOrderRequest struct {
+	From                Party
+	To                  Party
+	Amount              money.Amount
+	Currency            money.Currency
+	Details             Details // ActedBy is the admin or delegate setting it up for the sender
+	CreatedBy           int64
+	Frequency           models.Frequency
+	Interval            int    // 1 if zero
+	Cron                string // only for CRON
+	StartAt             time.Time
+	EndAt               *time.Time
+	MaxOccurrences      *int
+	OnInsufficientFunds models.FailurePolicy // SKIP if empty
+}
+
+// CreateStandingOrder checks a standing order and saves it, its first run is
+// at start_at or the first time the cron matches after it
+// the balance is only checked when a run is due
+func CreateStandingOrder(req StandingOrderRequest) (*models.StandingOrder, error) {
+	amount, details, err := checkTransfer(req.From, req.To, req.Amount, req.Currency, req.Details)
+	if err != nil {
+		return nil, err
+	}
+	// every run is a transfer nobody approves, so big ones are refused like scheduled transfers
+	if err := checkApproval(amount, req.Currency); err != nil {
+		return nil, err
+	}
+
+	order := models.StandingOrder{
+		FromUserID:          req.From.UserID,
+		FromAccountID:       req.From.AccountID,
+		ToUserID:            req.To.UserID,
+		ToAccountID:         req.To.AccountID,
+		Amount:              amount,
+		Currency:            req.Currency,
+		Description:         details.Description,
+		ClientReference:     details.ClientReference,
+		Metadata:            details.Metadata,
+		ActedBy:             details.ActedBy,
+		CreatedBy:           req.CreatedBy,
+		Frequency:           req.Frequency,
+		Interval:            req.Interval,
+		Cron:                strings.TrimSpace(req.Cron),
+		StartAt:             req.StartAt,
+		EndAt:               req.EndAt,
+		MaxOccurrences:      req.MaxOccurrences,
+		OnInsufficientFunds: req.OnInsufficientFunds,
+	}
+	if err := checkRecurrence(&order); err != nil {
+		return nil, err
+	}
+
+	first, ok := occurrence(&order, 0, nil)
+	if !ok {
+		return nil, ErrNoOccurrences
+	}
+	order.NextRunAt = &first
+
+	if err := checkParty(req.From, req.Currency); err != nil {
+		return nil, err
+	}
+	if err := checkParty(req.To, req.Currency); err != nil {
+		return nil, err
+	}
+
+	return models.CreateStandingOrder(database.GetPool(), order)
+}
+
+// PauseStandingOrder stops an active standing order from running until it is resumed
+func PauseStandingOrder(id int64) (*models.StandingOrder, error) {
+	return changeStandingOrder(id, func(order *models.StandingOrder) error {
+		if order.Status != models.StandingOrderStatusActive {
+			return ErrStandingOrderNotActive
+		}
+		order.Status = models.StandingOrderStatusPaused
+		return nil
+	})
+}
+
+// ResumeStandingOrder lets a paused standing order run again
+// runs that were due while it was paused are skipped, not paid late, and
+// still count towards max_occurrences
+func ResumeStandingOrder(id int64) (*models.StandingOrder, error) {
+	return changeStandingOrder(id, func(order *models.StandingOrder) error {
+		if order.Status != models.StandingOrderStatusPaused {
+			return ErrStandingOrderNotPaused
+		}
+		order.Status = models.StandingOrderStatusActive
+
+		now := time.Now()
+		for order.Status == models.StandingOrderStatusActive && order.NextRunAt.Before(now) {
+			nextOccurrence(order)
+		}
+		return nil
+	})
+}
+
+// CancelStandingOrder stops a standing order for good
+func CancelStandingOrder(id int64) (*models.StandingOrder, error) {
+	return changeStandingOrder(id, func(order *models.StandingOrder) error {
+		if order.Status != models.StandingOrderStatusActive && order.Status != models.StandingOrderStatusPaused {
+			return ErrStandingOrderEnded
+		}
+		order.Status = models.StandingOrderStatusCancelled
+		return nil
+	})
+}
+
+// RunStandingOrders pays every standing order run that is due
+// like RunScheduledTransfers, each one is locked, paid and written down in its
+// own database transaction, so with several servers up every run is paid once;
+// it returns how many runs it tried
+func RunStandingOrders() (int, error) {
+	tried := 0
+	for {
+		found := false
+		err := database.RunInTransactionWithRetry(func(tx pgx.Tx) error {
+			order, err := models.LockNextDueStandingOrder(tx, time.Now())
+			if err != nil || order == nil {
+				found = false
+				return err
+			}
+			found = true
+			return runStandingOrder(tx, order)
+		})
+		if err != nil {
+			return tried, err
+		}
+		if !found {
+			return tried, nil
+		}
+		tried++
+	}
+}
+
+// runStandingOrder tries the next run of a locked standing order once and
+// writes down how it went, in the order and in its run history
+// when the transfer fails:
+//   - a failure that can't pass, like a closed account, stops the whole order
+//   - with SKIP the run is given up and the order waits for its next run
+//   - with RETRY the run is tried again after the retry delay, and skipped
+//     once it is out of tries or the next run would come first
+func runStandingOrder(tx pgx.Tx, order *models.StandingOrder) error {
+	order.Attempts++
+	run := models.StandingOrderRun{
+		StandingOrderID: order.ID,
+		Occurrence:      order.Occurrences + 1,
+		ScheduledFor:    *order.NextRunAt,
+		Attempt:         order.Attempts,
+	}
+
+	transaction, err := sendLater(tx,
+		Party{UserID: order.FromUserID, AccountID: order.FromAccountID},
+		Party{UserID: order.ToUserID, AccountID: order.ToAccountID},
+		order.Amount, order.Currency,
+		Details{
+			Description:     order.Description,
+			ClientReference: order.ClientReference,
+			Metadata:        order.Metadata,
+			ActedBy:         order.ActedBy,
+		},
+	)
+	if database.IsRetryable(err) {
+		return err
+	}
+
+	retryAt := time.Now().Add(ScheduledTransferRetryDelay())
+	switch {
+	case err == nil:
+		run.Status = models.StandingOrderRunExecuted
+		run.TransactionID = &transaction.ID
+		order.FailureReason = ""
+		nextOccurrence(order)
+	case isPermanentTransferFailure(err):
+		run.Status = models.StandingOrderRunFailed
+		order.Status = models.StandingOrderStatusFailed
+		order.FailureReason = err.Error()
+	case order.OnInsufficientFunds == models.FailurePolicyRetry &&
+		order.Attempts < ScheduledTransferAttempts() && retryBeforeNextRun(order, retryAt):
+		run.Status = models.StandingOrderRunRetrying
+		order.NextAttemptAt = &retryAt
+		order.FailureReason = err.Error()
+	default:
+		run.Status = models.StandingOrderRunSkipped
+		order.FailureReason = err.Error()
+		nextOccurrence(order)
+	}
+	if err != nil {
+		run.FailureReason = err.Error()
+	}
+
+	if _, err := models.CreateStandingOrderRun(tx, run); err != nil {
+		return err
+	}
+	return order.Save(tx)
+}
+
+// nextOccurrence moves a standing order past its current run, and completes
+// it when that was the last one
+func nextOccurrence(order *models.StandingOrder) {
+	order.Occurrences++
+	order.Attempts = 0
+
+	next, ok := occurrence(order, order.Occurrences, order.NextRunAt)
+	if !ok {
+		order.Status = models.StandingOrderStatusCompleted
+		order.NextRunAt = nil
+		order.NextAttemptAt = nil
+		return
+	}
+	order.NextRunAt = &next
+	order.NextAttemptAt = &next
+}
+
+// retryBeforeNextRun checks that trying the current run again at retryAt
+// still comes before the order's next run, so two runs never pile up
+func retryBeforeNextRun(order *models.StandingOrder, retryAt time.Time) bool {
+	next, ok := occurrence(order, order.Occurrences+1, order.NextRunAt)
+	return !ok || retryAt.Before(next)
+}
+
+// checkRecurrence fills in the defaults of a new standing order and checks
+// its recurrence rule makes sense
+func checkRecurrence(order *models.StandingOrder) error {
+	if !order.Frequency.Valid() {
+		return ErrInvalidFrequency
+	}
+
+	if order.Frequency == models.FrequencyCron {
+		if order.Interval != 0 && order.Interval != 1 {
+			return ErrInvalidInterval
+		}
+		if _, err := parseCron(order.Cron); err != nil {
+			return err
+		}
+	} else if order.Cron != "" {
+		return ErrCronNotAllowed
+	}
+	if order.Interval == 0 {
+		order.Interval = 1
+	}
+	if order.Interval < 0 {
+		return ErrInvalidInterval
+	}
+
+	now := time.Now()
+	if order.StartAt.IsZero() {
+		order.StartAt = now
+	}
+	// a little slack, so "now" from a client with a slow clock still works
+	if order.StartAt.Before(now.Add(-time.Minute)) {
+		return ErrInvalidStartAt
+	}
+	if order.EndAt != nil && !order.EndAt.After(order.StartAt) {
+		return ErrInvalidEnd
+	}
+	if order.MaxOccurrences != nil && *order.MaxOccurrences <= 0 {
+		return ErrInvalidEnd
+	}
+
+	if order.OnInsufficientFunds == "" {
+		order.OnInsufficientFunds = models.FailurePolicySkip
+	}
+	if !order.OnInsufficientFunds.Valid() {
+		return ErrInvalidFailurePolicy
+	}
+	return nil
+}
+
+// changeStandingOrder locks a standing order, lets change update it and saves it
+func changeStandingOrder(id int64, change func(order *models.StandingOrder) error) (*models.StandingOrder, error) {
+	var order *models.StandingOrder
+	err := database.RunInTransactionWithRetry(func(tx pgx.Tx) error {
+		var err error
+		order, err = models.LockStandingOrderForUpdate(tx, id)
+		if err != nil {
+			return err
+		}
+		if order == nil {
+			return ErrStandingOrderNotFound
+		}
+		if err := change(order); err != nil {
+			return err
+		}
+		return order.Save(tx)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return order, nil
+}
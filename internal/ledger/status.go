@@ -0,0 +1,194 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/yigit-demirko/go-ledger/internal/database"
+	"github.com/yigit-demirko/go-ledger/internal/models"
+)
+
+// error messages for freezing and closing accounts
+var (
+	ErrInvalidAccountStatus = errors.New("status must be ACTIVE, FROZEN_DEBIT or FROZEN_ALL, accounts are closed with their own endpoint")
+	ErrMissingStatusReason  = errors.New("reason is required")
+	ErrAccountInUse         = errors.New("account has active holds or pending transactions")
+	ErrAccountOwes          = errors.New("account is below zero, it can't be closed until that is paid")
+	ErrAccountNotEmpty      = errors.New("account still has money, name an account to sweep it to")
+)
+
+// StatusChange is what an admin wants the status of an account to be
+type StatusChange struct {
+	AccountID int64
+	Status    models.AccountStatus
+	Reason    string
+	ChangedBy int64 // the admin making the change
+}
+
+// Closure says which account to close and where what is left on it goes
+type Closure struct {
+	AccountID        int64
+	SweepToAccountID *int64 // only needed when the account still has money
+	Reason           string
+	ChangedBy        int64 // the admin closing it
+}
+
+// ClosureResult has the closed account and the entry that swept it, if there was one
+type ClosureResult struct {
+	Account *models.Account
+	Change  *models.AccountStatusChange
+	Sweep   *models.Transaction
+}
+
+// SetAccountStatus freezes or unfreezes a user account and records who did it and why
+// closed accounts stay closed, and closing goes through CloseAccount
+func SetAccountStatus(change StatusChange) (*models.Account, *models.AccountStatusChange, error) {
+	switch change.Status {
+	case models.AccountStatusActive, models.AccountStatusFrozenDebit, models.AccountStatusFrozenAll:
+	default:
+		return nil, nil, ErrInvalidAccountStatus
+	}
+	change.Reason = strings.TrimSpace(change.Reason)
+	if change.Reason == "" {
+		return nil, nil, ErrMissingStatusReason
+	}
+
+	var account *models.Account
+	var recorded *models.AccountStatusChange
+	err := database.RunInTransactionWithRetry(func(tx pgx.Tx) error {
+		var err error
+		account, err = lockUserAccount(tx, change.AccountID)
+		if err != nil {
+			return err
+		}
+		if account.Status == models.AccountStatusClosed {
+			return models.ErrAccountClosed
+		}
+
+		recorded, err = account.SetStatus(tx, change.Status, change.Reason, change.ChangedBy, nil)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return account, recorded, nil
+}
+
+// CloseAccount closes a user account for good
+// the account can't have holds or pending transactions and can't owe money;
+// whatever is left on it is swept to SweepToAccountID first, in the same
+// database transaction, so the account is never closed with money on it
+// a frozen account can be closed and swept, the freeze only stops its owner
+func CloseAccount(closure Closure) (*ClosureResult, error) {
+	closure.Reason = strings.TrimSpace(closure.Reason)
+	if closure.Reason == "" {
+		return nil, ErrMissingStatusReason
+	}
+	if closure.SweepToAccountID != nil && *closure.SweepToAccountID == closure.AccountID {
+		return nil, ErrSameAccount
+	}
+
+	var result *ClosureResult
+	err := database.RunInTransactionWithRetry(func(tx pgx.Tx) error {
+		result = &ClosureResult{}
+
+		// lock both accounts at once, in id order like every entry does
+		ids := []int64{closure.AccountID}
+		if closure.SweepToAccountID != nil {
+			ids = append(ids, *closure.SweepToAccountID)
+		}
+		locked, err := models.LockAccountsForUpdate(tx, ids...)
+		if err != nil {
+			return err
+		}
+		account := locked[closure.AccountID]
+		if account == nil || account.UserID == nil {
+			return ErrAccountNotFound
+		}
+		if account.Status == models.AccountStatusClosed {
+			return models.ErrAccountClosed
+		}
+		if !account.Held.IsZero() || !account.PendingIn.IsZero() || !account.PendingOut.IsZero() {
+			return ErrAccountInUse
+		}
+		if account.Balance.IsNegative() {
+			return ErrAccountOwes
+		}
+
+		if account.Balance.IsPositive() {
+			if closure.SweepToAccountID == nil {
+				return ErrAccountNotEmpty
+			}
+			result.Sweep, err = sweep(tx, account, locked[*closure.SweepToAccountID], closure.ChangedBy)
+			if err != nil {
+				return err
+			}
+			account.Balance = account.Currency.Zero()
+		}
+
+		var sweepID *int64
+		if result.Sweep != nil {
+			sweepID = &result.Sweep.ID
+		}
+		result.Change, err = account.SetStatus(tx, models.AccountStatusClosed, closure.Reason, closure.ChangedBy, sweepID)
+		result.Account = account
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// sweep moves the whole balance of an account that is being closed to another
+// user account, as a move when both belong to the same user
+func sweep(tx pgx.Tx, from, to *models.Account, changedBy int64) (*models.Transaction, error) {
+	if to == nil || to.UserID == nil {
+		return nil, ErrAccountNotFound
+	}
+	if to.Currency != from.Currency {
+		return nil, ErrCurrencyMismatch
+	}
+	// the entry skips the freeze of the account being closed, not the one of where the money goes
+	if err := to.CheckStatus(from.Balance); err != nil {
+		return nil, err
+	}
+
+	transactionType := models.TransactionTypeTransfer
+	if *to.UserID == *from.UserID {
+		transactionType = models.TransactionTypeMove
+	}
+
+	transaction, _, err := post(tx, Entry{
+		Type:         transactionType,
+		FromUserID:   from.UserID,
+		ToUserID:     to.UserID,
+		Amount:       from.Balance,
+		Currency:     from.Currency,
+		Description:  fmt.Sprintf("Closing balance of account %d", from.ID),
+		ActedBy:      &changedBy,
+		IgnoreStatus: true,
+		Legs: []Leg{
+			{AccountID: from.ID, Amount: from.Balance.Neg(), Currency: from.Currency},
+			{AccountID: to.ID, Amount: from.Balance, Currency: from.Currency},
+		},
+	})
+	return transaction, err
+}
+
+// lockUserAccount finds and locks a user account inside tx
+func lockUserAccount(tx pgx.Tx, accountID int64) (*models.Account, error) {
+	locked, err := models.LockAccountsForUpdate(tx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	account := locked[accountID]
+	if account == nil || account.UserID == nil {
+		return nil, ErrAccountNotFound
+	}
+	return account, nil
+}
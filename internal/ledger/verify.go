@@ -0,0 +1,109 @@
+package ledger
+
+import (
+	"expvar"
+	"log"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/yigit-demirko/go-ledger/internal/database"
+	"github.com/yigit-demirko/go-ledger/internal/models"
+)
+
+// how many broken entries a report lists at most
+const maxUnbalancedEntries = 100
+
+// metrics about the last integrity check, admins see them at /api/v1/admin/metrics
+var (
+	integrityProblems  = expvar.NewInt("ledger_integrity_problems") // 0 when the books are right
+	integrityChecks    = expvar.NewInt("ledger_integrity_checks")
+	integrityCheckedAt = expvar.NewString("ledger_integrity_checked_at")
+)
+
+// IntegrityReport is what Verify found
+type IntegrityReport struct {
+	CheckedAt         time.Time                `json:"checked_at"`
+	Accounts          int64                    `json:"accounts"`           // how many accounts were checked
+	Drifts            []models.AccountDrift    `json:"drifts"`             // accounts whose balance isn't the sum of their postings
+	Totals            []models.CurrencyTotal   `json:"totals"`             // all money per currency, must be zero
+	UnbalancedEntries []models.UnbalancedEntry `json:"unbalanced_entries"` // entries that don't add up to zero
+}
+
+// Problems counts everything that is wrong, 0 means the books are right
+func (r *IntegrityReport) Problems() int {
+	problems := len(r.Drifts) + len(r.UnbalancedEntries)
+	for _, total := range r.Totals {
+		if !total.PostingTotal.IsZero() || !total.BalanceTotal.IsZero() {
+			problems++
+		}
+	}
+	return problems
+}
+
+// OK tells if nothing is wrong
+func (r *IntegrityReport) OK() bool {
+	return r.Problems() == 0
+}
+
+// Verify recomputes every balance from the journal and checks that no money
+// was created or destroyed, all from one snapshot so transfers running at the
+// same time can't look like drift
+func Verify() (*IntegrityReport, error) {
+	report := &IntegrityReport{CheckedAt: time.Now()}
+	err := database.RunInSnapshot(func(tx pgx.Tx) error {
+		var err error
+		if report.Accounts, err = models.CountAccounts(tx); err != nil {
+			return err
+		}
+		if report.Drifts, err = models.GetAccountDrifts(tx); err != nil {
+			return err
+		}
+		if report.Totals, err = models.GetCurrencyTotals(tx); err != nil {
+			return err
+		}
+		report.UnbalancedEntries, err = models.GetUnbalancedEntries(tx, maxUnbalancedEntries)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	integrityProblems.Set(int64(report.Problems()))
+	integrityChecks.Add(1)
+	integrityCheckedAt.Set(report.CheckedAt.Format(time.RFC3339))
+	return report, nil
+}
+
+// VerifyInterval reads how often the server checks the books from
+// LEDGER_VERIFY_INTERVAL (like "1h"), 0 means it doesn't
+func VerifyInterval() time.Duration {
+	intervalStr := os.Getenv("LEDGER_VERIFY_INTERVAL")
+	if intervalStr == "" {
+		return 0
+	}
+	interval, err := time.ParseDuration(intervalStr)
+	if err != nil || interval <= 0 {
+		log.Printf("Warning: invalid LEDGER_VERIFY_INTERVAL %q, the ledger won't be checked", intervalStr)
+		return 0
+	}
+	return interval
+}
+
+// LogReport writes everything wrong in a report to the log
+func LogReport(report *IntegrityReport) {
+	for _, drift := range report.Drifts {
+		log.Printf("Ledger drift: account %d (%s) balance %s, journal %s, off by %s",
+			drift.AccountID, drift.Currency, drift.Balance, drift.JournalBalance, drift.Delta)
+	}
+	for _, total := range report.Totals {
+		if !total.PostingTotal.IsZero() || !total.BalanceTotal.IsZero() {
+			log.Printf("Ledger not conserved: %s postings add up to %s, balances to %s",
+				total.Currency, total.PostingTotal, total.BalanceTotal)
+		}
+	}
+	for _, entry := range report.UnbalancedEntries {
+		log.Printf("Ledger entry %d is not balanced: %s %s over %d postings",
+			entry.TransactionID, entry.Total, entry.Currency, entry.PostingCount)
+	}
+}
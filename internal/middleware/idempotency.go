@@ -0,0 +1,163 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yigit-demirko/go-ledger/internal/auth"
+	"github.com/yigit-demirko/go-ledger/internal/models"
+)
+
+// settings for idempotency keys
+const (
+	IdempotencyHeader     = "Idempotency-Key"
+	defaultIdempotencyTTL = 24 * time.Hour
+	maxIdempotencyKeyLen  = 255
+	// how long a duplicate waits for the first request before giving up
+	idempotencyWaitTimeout = 5 * time.Second
+	idempotencyPollEvery   = 100 * time.Millisecond
+)
+
+// IdempotencyTTL reads how long keys are kept from IDEMPOTENCY_KEY_TTL (like "24h")
+func IdempotencyTTL() time.Duration {
+	if ttlStr := os.Getenv("IDEMPOTENCY_KEY_TTL"); ttlStr != "" {
+		if ttl, err := time.ParseDuration(ttlStr); err == nil && ttl > 0 {
+			return ttl
+		}
+		log.Printf("Warning: invalid IDEMPOTENCY_KEY_TTL %q, using %s", ttlStr, defaultIdempotencyTTL)
+	}
+	return defaultIdempotencyTTL
+}
+
+// recordingWriter keeps a copy of the response so we can replay it later
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Idempotency makes retried requests safe when the client sends an Idempotency-Key header
+//   - the first request runs and its response is saved
+//   - a retry with the same key and body gets the saved response back
+//   - the same key with a different body is rejected
+//   - a retry while the first one is still running waits for it, or gets a conflict
+//
+// requests without the header run normally; it must come after AuthMiddleware
+func Idempotency(ttl time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(IdempotencyHeader)
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key is too long"})
+			c.Abort()
+			return
+		}
+
+		userClaims, ok := c.MustGet("user").(*auth.Claims)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user claims"})
+			c.Abort()
+			return
+		}
+
+		// read the body and put it back so the handler can still read it
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			c.Abort()
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		hash := sha256.New()
+		hash.Write([]byte(c.Request.Method + " " + c.Request.URL.Path + "\n"))
+		hash.Write(body)
+		requestHash := hex.EncodeToString(hash.Sum(nil))
+
+		// try to claim the key, or wait until the request that has it is done
+		deadline := time.Now().Add(idempotencyWaitTimeout)
+		for {
+			claimed, existing, err := models.ClaimIdempotencyKey(userClaims.UserID, key, requestHash, ttl)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check idempotency key"})
+				c.Abort()
+				return
+			}
+			if claimed {
+				break
+			}
+
+			// existing is nil when the key was released in the meantime, then we just try again
+			if existing != nil {
+				if existing.RequestHash != requestHash {
+					c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key was already used for a different request"})
+					c.Abort()
+					return
+				}
+
+				if existing.Status == models.IdempotencyStatusCompleted {
+					c.Header("Idempotent-Replayed", "true")
+					c.Data(existing.ResponseCode, "application/json; charset=utf-8", existing.ResponseBody)
+					c.Abort()
+					return
+				}
+			}
+
+			if time.Now().After(deadline) {
+				c.JSON(http.StatusConflict, gin.H{"error": "A request with this Idempotency-Key is still in progress"})
+				c.Abort()
+				return
+			}
+			time.Sleep(idempotencyPollEvery)
+		}
+
+		// a panic skips everything after c.Next, so let go of the key before it
+		// reaches gin's recovery; otherwise retries would get a conflict until the key expires
+		defer func() {
+			if r := recover(); r != nil {
+				releaseIdempotencyKey(userClaims.UserID, key)
+				panic(r)
+			}
+		}()
+
+		// run the request and remember what it answered
+		writer := &recordingWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		c.Next()
+
+		// server errors mean nothing was saved, so let the client try again
+		if writer.Status() >= http.StatusInternalServerError {
+			releaseIdempotencyKey(userClaims.UserID, key)
+			return
+		}
+
+		if err := models.CompleteIdempotencyKey(userClaims.UserID, key, writer.Status(), writer.body.Bytes()); err != nil {
+			log.Printf("Error saving idempotent response: %v", err)
+		}
+	}
+}
+
+func releaseIdempotencyKey(userID int64, key string) {
+	if err := models.ReleaseIdempotencyKey(userID, key); err != nil {
+		log.Printf("Error releasing idempotency key: %v", err)
+	}
+}
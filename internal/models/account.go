@@ -0,0 +1,405 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/yigit-demirko/go-ledger/internal/database"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// what kind of accounts the ledger has
+type AccountType string
+
+const (
+	AccountTypeUser   AccountType = "USER"   // money that belongs to a user
+	AccountTypeSystem AccountType = "SYSTEM" // the ledger's own books, the other side of deposits, withdrawals and fees
+)
+
+// what a user keeps an account for
+type AccountKind string
+
+const (
+	AccountKindSpending AccountKind = "SPENDING" // everyday money, every default account is one
+	AccountKindSavings  AccountKind = "SAVINGS"  // money put away
+	AccountKindProject  AccountKind = "PROJECT"  // money for one thing, like a trip
+)
+
+// Valid tells if k is one of the kinds we know
+func (k AccountKind) Valid() bool {
+	switch k {
+	case AccountKindSpending, AccountKindSavings, AccountKindProject:
+		return true
+	}
+	return false
+}
+
+// codes of the system accounts we always have (one of each per currency)
+const (
+	SystemAccountCashIn  = "CASH_IN"  // where deposited money comes from
+	SystemAccountCashOut = "CASH_OUT" // where withdrawn money goes to
+	SystemAccountFees    = "FEES"     // fees we charge
+	SystemAccountEquity  = "EQUITY"   // opening balances and corrections
+	SystemAccountFX      = "FX"       // our position in each currency from conversions
+	SystemAccountEscrow  = "ESCROW"   // money in escrow, no longer the buyer's and not yet the seller's
+)
+
+// nice names for the system accounts
+var systemAccountNames = map[string]string{
+	SystemAccountCashIn:  "Cash in",
+	SystemAccountCashOut: "Cash out",
+	SystemAccountFees:    "Fees",
+	SystemAccountEquity:  "Equity",
+	SystemAccountFX:      "Foreign exchange",
+	SystemAccountEscrow:  "Escrow",
+}
+
+// Account is one balance in one currency, every posting belongs to an account
+// a user has a default account in each currency they use and can open more
+type Account struct {
+	ID          int64          `json:"id"`
+	UserID      *int64         `json:"user_id"` // null for system accounts
+	Code        *string        `json:"code"`    // only set for system accounts
+	Name        string         `json:"name"`
+	AccountType AccountType    `json:"account_type"`
+	Kind        AccountKind    `json:"kind,omitempty"` // only set for user accounts
+	IsDefault   bool           `json:"is_default"`     // the account the user-ID endpoints use for its currency
+	Status      AccountStatus  `json:"status"`         // if money may move in or out, see CheckStatus
+	Currency    money.Currency `json:"currency"`
+	Balance     money.Amount   `json:"balance"`
+	Held        money.Amount   `json:"held"`        // reserved by active holds, can't be spent
+	PendingIn   money.Amount   `json:"pending_in"`  // coming in with pending transactions, can't be spent yet
+	PendingOut  money.Amount   `json:"pending_out"` // going out with pending transactions, can't be spent
+
+	OverdraftLimit       money.Amount `json:"overdraft_limit"`        // how far below zero a user account may go
+	OverdraftInterestBps int64        `json:"overdraft_interest_bps"` // yearly interest on a negative balance, charged daily
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// all the columns we read for an account, in the order scanAccount expects
+const accountColumns = `id, user_id, code, name, account_type, COALESCE(kind, ''), is_default, status, currency, balance, held, pending_in, pending_out,
+	overdraft_limit, overdraft_interest_bps, created_at, updated_at`
+
+func scanAccount(row pgx.Row) (*Account, error) {
+	var account Account
+	err := row.Scan(
+		&account.ID,
+		&account.UserID,
+		&account.Code,
+		&account.Name,
+		&account.AccountType,
+		&account.Kind,
+		&account.IsDefault,
+		&account.Status,
+		&account.Currency,
+		&account.Balance,
+		&account.Held,
+		&account.PendingIn,
+		&account.PendingOut,
+		&account.OverdraftLimit,
+		&account.OverdraftInterestBps,
+		&account.CreatedAt,
+		&account.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	account.Balance = inCurrency(account.Balance, account.Currency)
+	account.Held = inCurrency(account.Held, account.Currency)
+	account.PendingIn = inCurrency(account.PendingIn, account.Currency)
+	account.PendingOut = inCurrency(account.PendingOut, account.Currency)
+	account.OverdraftLimit = inCurrency(account.OverdraftLimit, account.Currency)
+	return &account, nil
+}
+
+// Available is what can still be spent: the balance less what holds
+// reserved and pending transactions take out, plus the overdraft limit for credit lines
+func (a *Account) Available() money.Amount {
+	return a.Balance.Sub(a.Held).Sub(a.PendingOut).Add(a.OverdraftLimit)
+}
+
+// PendingBalance is what the balance will be once every pending transaction is posted
+func (a *Account) PendingBalance() money.Amount {
+	return a.Balance.Add(a.PendingIn).Sub(a.PendingOut)
+}
+
+// inCurrency writes an amount read from the database with the decimal places of its currency
+// the columns keep 3 decimal places for every currency, so 12.500 USD comes back as 12.50
+func inCurrency(amount money.Amount, currency money.Currency) money.Amount {
+	if normalized, err := currency.Normalize(amount); err == nil {
+		return normalized
+	}
+	return amount
+}
+
+// GetOrCreateUserAccount finds the user's default account in a currency, and opens it if they don't have one yet
+// it returns nil if the user doesn't exist
+func GetOrCreateUserAccount(q database.Querier, userID int64, currency money.Currency) (*Account, error) {
+	_, err := q.Exec(
+		context.Background(),
+		`INSERT INTO accounts (user_id, name, account_type, kind, is_default, currency, balance, created_at, updated_at)
+		SELECT id, name, $2::VARCHAR, $3::VARCHAR, true, $4::CHAR(3), 0, $5::TIMESTAMP, $5::TIMESTAMP FROM users WHERE id = $1
+		ON CONFLICT (user_id, currency) WHERE is_default DO NOTHING`,
+		userID, AccountTypeUser, AccountKindSpending, currency, time.Now(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return GetAccountByUserID(q, userID, currency)
+}
+
+// GetAccountByUserID finds the default account of a user in a currency
+func GetAccountByUserID(q database.Querier, userID int64, currency money.Currency) (*Account, error) {
+	account, err := scanAccount(q.QueryRow(
+		context.Background(),
+		`SELECT `+accountColumns+` FROM accounts WHERE user_id = $1 AND currency = $2 AND is_default`,
+		userID, currency,
+	))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	return account, err
+}
+
+// CreateUserAccount opens another account for a user, next to their default ones
+func CreateUserAccount(userID int64, name string, currency money.Currency, kind AccountKind) (*Account, error) {
+	now := time.Now()
+	account, err := scanAccount(database.GetPool().QueryRow(
+		context.Background(),
+		`INSERT INTO accounts (user_id, name, account_type, kind, is_default, currency, balance, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, false, $5, 0, $6, $6)
+		RETURNING `+accountColumns,
+		userID, name, AccountTypeUser, kind, currency, now,
+	))
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+		return nil, ErrUserNotFound
+	}
+	return account, err
+}
+
+// GetAccountByID finds any account by its ID, nil if there is none
+func GetAccountByID(q database.Querier, id int64) (*Account, error) {
+	account, err := scanAccount(q.QueryRow(
+		context.Background(),
+		`SELECT `+accountColumns+` FROM accounts WHERE id = $1`,
+		id,
+	))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	return account, err
+}
+
+// GetAccountsByUserIDs finds all accounts of the given users, ordered by user
+// and currency with the default account first
+func GetAccountsByUserIDs(q database.Querier, userIDs ...int64) ([]Account, error) {
+	rows, err := q.Query(
+		context.Background(),
+		`SELECT `+accountColumns+`
+		FROM accounts
+		WHERE user_id = ANY($1)
+		ORDER BY user_id, currency, is_default DESC, id`,
+		userIDs,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var accounts []Account
+	for rows.Next() {
+		account, err := scanAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, *account)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return accounts, nil
+}
+
+// GetOrCreateSystemAccount finds one of the ledger's own accounts by its code and currency
+// system accounts are opened the first time a currency needs them
+func GetOrCreateSystemAccount(q database.Querier, code string, currency money.Currency) (*Account, error) {
+	now := time.Now()
+	_, err := q.Exec(
+		context.Background(),
+		`INSERT INTO accounts (code, name, account_type, currency, balance, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, 0, $5, $5)
+		ON CONFLICT (code, currency) DO NOTHING`,
+		code, systemAccountNames[code], AccountTypeSystem, currency, now,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanAccount(q.QueryRow(
+		context.Background(),
+		`SELECT `+accountColumns+` FROM accounts WHERE code = $1 AND currency = $2`,
+		code, currency,
+	))
+}
+
+// LockAccountsForUpdate loads accounts and locks their rows until the transaction ends
+// rows are always locked in id order, so two entries touching the same
+// accounts can never wait on each other forever
+func LockAccountsForUpdate(tx pgx.Tx, ids ...int64) (map[int64]*Account, error) {
+	rows, err := tx.Query(
+		context.Background(),
+		`SELECT `+accountColumns+`
+		FROM accounts
+		WHERE id = ANY($1)
+		ORDER BY id
+		FOR UPDATE`,
+		ids,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := make(map[int64]*Account, len(ids))
+	for rows.Next() {
+		account, err := scanAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		accounts[account.ID] = account
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return accounts, nil
+}
+
+// UpdateBalance adds amount (which can be negative) to the account
+// user accounts can never spend more than their available balance (which
+// includes their overdraft limit), system accounts can
+// money coming in always posts, so an account past its limit can be paid back
+func (a *Account) UpdateBalance(q database.Querier, amount money.Amount) error {
+	return a.updateBalance(q, amount, false)
+}
+
+// ForceUpdateBalance is UpdateBalance that lets a user account go past its available balance
+// it is only for corrections an admin asked for, like a forced reversal
+func (a *Account) ForceUpdateBalance(q database.Querier, amount money.Amount) error {
+	return a.updateBalance(q, amount, true)
+}
+
+func (a *Account) updateBalance(q database.Querier, amount money.Amount, force bool) error {
+	err := q.QueryRow(
+		context.Background(),
+		`UPDATE accounts
+		SET balance = balance + $1, updated_at = $2
+		WHERE id = $3 AND ($5 OR account_type = $4 OR $1::DECIMAL >= 0 OR balance + $1 - held - pending_out + overdraft_limit >= 0)
+		RETURNING balance, updated_at`,
+		amount, time.Now(), a.ID, AccountTypeSystem, force,
+	).Scan(&a.Balance, &a.UpdatedAt)
+
+	if err == pgx.ErrNoRows {
+		return ErrInsufficientBalance
+	}
+	if err != nil {
+		return err
+	}
+
+	a.Balance = inCurrency(a.Balance, a.Currency)
+	return nil
+}
+
+// Reserve puts amount aside for a hold, it fails if the available balance is too small
+func (a *Account) Reserve(q database.Querier, amount money.Amount) error {
+	err := q.QueryRow(
+		context.Background(),
+		`UPDATE accounts
+		SET held = held + $1, updated_at = $2
+		WHERE id = $3 AND balance - held - pending_out + overdraft_limit - $1 >= 0
+		RETURNING held, updated_at`,
+		amount, time.Now(), a.ID,
+	).Scan(&a.Held, &a.UpdatedAt)
+
+	if err == pgx.ErrNoRows {
+		return ErrInsufficientBalance
+	}
+	if err != nil {
+		return err
+	}
+
+	a.Held = inCurrency(a.Held, a.Currency)
+	return nil
+}
+
+// Release gives back money a hold put aside, so it can be spent again
+func (a *Account) Release(q database.Querier, amount money.Amount) error {
+	err := q.QueryRow(
+		context.Background(),
+		`UPDATE accounts
+		SET held = held - $1, updated_at = $2
+		WHERE id = $3
+		RETURNING held, updated_at`,
+		amount, time.Now(), a.ID,
+	).Scan(&a.Held, &a.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	a.Held = inCurrency(a.Held, a.Currency)
+	return nil
+}
+
+// AddPending books amount (which can be negative) as in flight on the account
+// money going out is put aside like a hold, so user accounts can only send
+// what they could spend right now
+func (a *Account) AddPending(q database.Querier, amount money.Amount, force bool) error {
+	err := q.QueryRow(
+		context.Background(),
+		`UPDATE accounts
+		SET pending_in = pending_in + GREATEST($1::DECIMAL, 0), pending_out = pending_out + GREATEST(-$1::DECIMAL, 0), updated_at = $2
+		WHERE id = $3 AND ($5 OR account_type = $4 OR $1::DECIMAL >= 0 OR balance + $1 - held - pending_out + overdraft_limit >= 0)
+		RETURNING pending_in, pending_out, updated_at`,
+		amount, time.Now(), a.ID, AccountTypeSystem, force,
+	).Scan(&a.PendingIn, &a.PendingOut, &a.UpdatedAt)
+
+	if err == pgx.ErrNoRows {
+		return ErrInsufficientBalance
+	}
+	if err != nil {
+		return err
+	}
+
+	a.PendingIn = inCurrency(a.PendingIn, a.Currency)
+	a.PendingOut = inCurrency(a.PendingOut, a.Currency)
+	return nil
+}
+
+// RemovePending takes back what AddPending booked, when the transaction is posted or fails
+func (a *Account) RemovePending(q database.Querier, amount money.Amount) error {
+	err := q.QueryRow(
+		context.Background(),
+		`UPDATE accounts
+		SET pending_in = pending_in - GREATEST($1::DECIMAL, 0), pending_out = pending_out - GREATEST(-$1::DECIMAL, 0), updated_at = $2
+		WHERE id = $3
+		RETURNING pending_in, pending_out, updated_at`,
+		amount, time.Now(), a.ID,
+	).Scan(&a.PendingIn, &a.PendingOut, &a.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	a.PendingIn = inCurrency(a.PendingIn, a.Currency)
+	a.PendingOut = inCurrency(a.PendingOut, a.Currency)
+	return nil
+}
@@ -0,0 +1,132 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/yigit-demirko/go-ledger/internal/database"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// AccountStatus says if money may move in or out of an account
+type AccountStatus string
+
+const (
+	AccountStatusActive      AccountStatus = "ACTIVE"       // money moves both ways
+	AccountStatusFrozenDebit AccountStatus = "FROZEN_DEBIT" // money can come in but not go out
+	AccountStatusFrozenAll   AccountStatus = "FROZEN_ALL"   // no money moves at all
+	AccountStatusClosed      AccountStatus = "CLOSED"       // for good, the account is only kept for its history
+)
+
+// CheckStatus tells if amount (negative takes money out) may move on the account
+func (a *Account) CheckStatus(amount money.Amount) error {
+	switch a.Status {
+	case AccountStatusClosed:
+		return ErrAccountClosed
+	case AccountStatusFrozenAll:
+		return ErrAccountFrozen
+	case AccountStatusFrozenDebit:
+		if amount.IsNegative() {
+			return ErrAccountFrozen
+		}
+	}
+	return nil
+}
+
+// AccountStatusChange is one time an admin froze, unfroze or closed an account
+type AccountStatusChange struct {
+	ID                 int64         `json:"id"`
+	AccountID          int64         `json:"account_id"`
+	OldStatus          AccountStatus `json:"old_status"`
+	NewStatus          AccountStatus `json:"new_status"`
+	Reason             string        `json:"reason"`
+	SweepTransactionID *int64        `json:"sweep_transaction_id,omitempty"` // what moved the rest of the money away when it was closed
+	ChangedBy          int64         `json:"changed_by"`                     // the admin who made the change
+	CreatedAt          time.Time     `json:"created_at"`
+}
+
+// the columns of a status change, in the order scanAccountStatusChange expects
+const accountStatusChangeColumns = `id, account_id, old_status, new_status, reason, sweep_transaction_id, changed_by, created_at`
+
+func scanAccountStatusChange(row pgx.Row) (*AccountStatusChange, error) {
+	var change AccountStatusChange
+	err := row.Scan(
+		&change.ID,
+		&change.AccountID,
+		&change.OldStatus,
+		&change.NewStatus,
+		&change.Reason,
+		&change.SweepTransactionID,
+		&change.ChangedBy,
+		&change.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &change, nil
+}
+
+// SetStatus changes the status of an account and records the change
+// a closed account stops being the default one, so the user gets a new
+// default account in the currency the next time money comes in
+// lock the account first, so the old status in the history is right
+func (a *Account) SetStatus(q database.Querier, status AccountStatus, reason string, changedBy int64, sweepTransactionID *int64) (*AccountStatusChange, error) {
+	now := time.Now()
+	change, err := scanAccountStatusChange(q.QueryRow(
+		context.Background(),
+		`INSERT INTO account_status_changes (account_id, old_status, new_status, reason, sweep_transaction_id, changed_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING `+accountStatusChangeColumns,
+		a.ID, a.Status, status, reason, sweepTransactionID, changedBy, now,
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	err = q.QueryRow(
+		context.Background(),
+		`UPDATE accounts
+		SET status = $1, is_default = is_default AND $1::VARCHAR <> $2::VARCHAR, updated_at = $3
+		WHERE id = $4
+		RETURNING status, is_default, updated_at`,
+		status, AccountStatusClosed, now, a.ID,
+	).Scan(&a.Status, &a.IsDefault, &a.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return change, nil
+}
+
+// GetAccountStatusChanges lists the status changes of an account, newest first
+func GetAccountStatusChanges(accountID int64, limit, offset int) ([]AccountStatusChange, error) {
+	rows, err := database.GetPool().Query(
+		context.Background(),
+		`SELECT `+accountStatusChangeColumns+`
+		FROM account_status_changes
+		WHERE account_id = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2 OFFSET $3`,
+		accountID, limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []AccountStatusChange
+	for rows.Next() {
+		change, err := scanAccountStatusChange(rows)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, *change)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
@@ -0,0 +1,70 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/yigit-demirko/go-ledger/internal/database"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// these tests need a postgres database set up through the DB_* variables,
+// they are skipped when there is none
+func testDB(t *testing.T) {
+	t.Helper()
+	if os.Getenv("DB_PORT") == "" {
+		t.Skip("no database configured, set the DB_* variables to run this test")
+	}
+	if err := database.InitDB(); err != nil {
+		t.Skipf("database not reachable: %v", err)
+	}
+	t.Cleanup(database.CloseDB)
+	if err := database.CreateTables(); err != nil {
+		t.Fatalf("CreateTables: %v", err)
+	}
+}
+
+func TestUpdateBalanceRepaysAccountPastItsLimit(t *testing.T) {
+	testDB(t)
+
+	// everything happens in one transaction that is rolled back at the end
+	tx, err := database.GetPool().Begin(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(context.Background())
+
+	authUser, err := CreateAuthUser(tx, "repay-test-user", "secret123", RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := CreateUser(tx, "Repay Test", authUser.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, err := GetAccountByUserID(tx, user.ID, money.DefaultCurrency)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a forced correction takes the account past its (zero) overdraft limit
+	if err := account.ForceUpdateBalance(tx, money.MustParse("-100")); err != nil {
+		t.Fatalf("ForceUpdateBalance: %v", err)
+	}
+
+	// paying back only part of it still leaves the account past its limit,
+	// but it has to post
+	if err := account.UpdateBalance(tx, money.MustParse("30")); err != nil {
+		t.Fatalf("repaying an account past its limit: %v", err)
+	}
+	if account.Balance.Cmp(money.MustParse("-70")) != 0 {
+		t.Errorf("balance = %s, want -70", account.Balance)
+	}
+
+	// spending more is still blocked
+	if err := account.UpdateBalance(tx, money.MustParse("-1")); !errors.Is(err, ErrInsufficientBalance) {
+		t.Errorf("debit past the limit: err = %v, want ErrInsufficientBalance", err)
+	}
+}
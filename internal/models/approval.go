@@ -0,0 +1,195 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/yigit-demirko/go-ledger/internal/database"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// what an approval request runs once it is approved
+type ApprovalOperation string
+
+const (
+	ApprovalOperationTransfer   ApprovalOperation = "TRANSFER"    // a transfer above the approval threshold
+	ApprovalOperationSetBalance ApprovalOperation = "SET_BALANCE" // an admin setting a balance with initialize-balance
+)
+
+// where an approval request is in its life
+type ApprovalStatus string
+
+const (
+	ApprovalStatusPending  ApprovalStatus = "PENDING"  // waiting for a second person
+	ApprovalStatusApproved ApprovalStatus = "APPROVED" // approved and run
+	ApprovalStatusRejected ApprovalStatus = "REJECTED" // turned down, nothing ran
+	ApprovalStatusExpired  ApprovalStatus = "EXPIRED"  // nobody decided in time, nothing ran
+)
+
+// ApprovalPayload is everything needed to run the operation later
+// transfers use the From and To fields, balance changes UserID or AccountID
+type ApprovalPayload struct {
+	FromUserID      *int64   `json:"from_user_id,omitempty"`
+	FromAccountID   *int64   `json:"from_account_id,omitempty"`
+	ToUserID        *int64   `json:"to_user_id,omitempty"`
+	ToAccountID     *int64   `json:"to_account_id,omitempty"`
+	UserID          *int64   `json:"user_id,omitempty"`    // set the user's default account in the currency
+	AccountID       *int64   `json:"account_id,omitempty"` // or set this account
+	Description     string   `json:"description,omitempty"`
+	ClientReference string   `json:"client_reference,omitempty"`
+	Metadata        Metadata `json:"metadata,omitempty"`
+	ActedBy         *int64   `json:"acted_by,omitempty"` // the admin or delegate who sent money for its owner
+}
+
+// ApprovalRequest is an operation that waits for a second person before it runs
+type ApprovalRequest struct {
+	ID            int64             `json:"id"`
+	Operation     ApprovalOperation `json:"operation"`
+	Payload       ApprovalPayload   `json:"payload"`
+	Amount        money.Amount      `json:"amount"`
+	Currency      money.Currency    `json:"currency"`
+	RequestedBy   int64             `json:"requested_by"`
+	Status        ApprovalStatus    `json:"status"`
+	DecidedBy     *int64            `json:"decided_by"`
+	DecisionNote  string            `json:"decision_note,omitempty"`
+	TransactionID *int64            `json:"transaction_id"` // what it ran, null if a balance was already right
+	ExpiresAt     time.Time         `json:"expires_at"`
+	DecidedAt     *time.Time        `json:"decided_at,omitempty"`
+	CreatedAt     time.Time         `json:"created_at"`
+	UpdatedAt     time.Time         `json:"updated_at"`
+}
+
+// the columns of an approval request, in the order scanApprovalRequest expects
+const approvalRequestColumns = `id, operation, payload, amount, currency, requested_by, status, decided_by,
+	COALESCE(decision_note, ''), transaction_id, expires_at, decided_at, created_at, updated_at`
+
+func scanApprovalRequest(row pgx.Row) (*ApprovalRequest, error) {
+	var request ApprovalRequest
+	err := row.Scan(
+		&request.ID,
+		&request.Operation,
+		&request.Payload,
+		&request.Amount,
+		&request.Currency,
+		&request.RequestedBy,
+		&request.Status,
+		&request.DecidedBy,
+		&request.DecisionNote,
+		&request.TransactionID,
+		&request.ExpiresAt,
+		&request.DecidedAt,
+		&request.CreatedAt,
+		&request.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	request.Amount = inCurrency(request.Amount, request.Currency)
+	return &request, nil
+}
+
+// CreateApprovalRequest saves a new pending approval request
+func CreateApprovalRequest(q database.Querier, request ApprovalRequest) (*ApprovalRequest, error) {
+	now := time.Now()
+	return scanApprovalRequest(q.QueryRow(
+		context.Background(),
+		`INSERT INTO approval_requests (operation, payload, amount, currency, requested_by, status, expires_at, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $8)
+		RETURNING `+approvalRequestColumns,
+		request.Operation, request.Payload, request.Amount, request.Currency, request.RequestedBy,
+		ApprovalStatusPending, request.ExpiresAt, now,
+	))
+}
+
+// GetApprovalRequestByID finds an approval request, nil if it doesn't exist
+func GetApprovalRequestByID(id int64) (*ApprovalRequest, error) {
+	request, err := scanApprovalRequest(database.GetPool().QueryRow(
+		context.Background(),
+		`SELECT `+approvalRequestColumns+` FROM approval_requests WHERE id = $1`,
+		id,
+	))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	return request, err
+}
+
+// LockApprovalRequestForUpdate finds an approval request and locks it until tx ends, nil if it doesn't exist
+func LockApprovalRequestForUpdate(tx pgx.Tx, id int64) (*ApprovalRequest, error) {
+	request, err := scanApprovalRequest(tx.QueryRow(
+		context.Background(),
+		`SELECT `+approvalRequestColumns+` FROM approval_requests WHERE id = $1 FOR UPDATE`,
+		id,
+	))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	return request, err
+}
+
+// GetApprovalRequests lists approval requests in a status, oldest first so the
+// ones closest to expiring come first
+// pending requests that already expired are left out, even before ExpireApprovalRequests marked them
+func GetApprovalRequests(status ApprovalStatus, limit, offset int) ([]ApprovalRequest, error) {
+	rows, err := database.GetPool().Query(
+		context.Background(),
+		`SELECT `+approvalRequestColumns+`
+		FROM approval_requests
+		WHERE status = $1::VARCHAR AND ($1::VARCHAR <> $2::VARCHAR OR expires_at > $3)
+		ORDER BY created_at, id
+		LIMIT $4 OFFSET $5`,
+		string(status), string(ApprovalStatusPending), time.Now(), limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var requests []ApprovalRequest
+	for rows.Next() {
+		request, err := scanApprovalRequest(rows)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, *request)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return requests, nil
+}
+
+// Decide writes down who approved or rejected a request and what it ran
+// lock it first, so two people can't decide it at the same time
+func (r *ApprovalRequest) Decide(q database.Querier, status ApprovalStatus, decidedBy int64, note string, transactionID *int64) error {
+	decided, err := scanApprovalRequest(q.QueryRow(
+		context.Background(),
+		`UPDATE approval_requests
+		SET status = $2, decided_by = $3, decision_note = NULLIF($4, ''), transaction_id = $5, decided_at = $6, updated_at = $6
+		WHERE id = $1
+		RETURNING `+approvalRequestColumns,
+		r.ID, status, decidedBy, note, transactionID, time.Now(),
+	))
+	if err != nil {
+		return err
+	}
+	*r = *decided
+	return nil
+}
+
+// ExpireApprovalRequests marks pending requests nobody decided in time as expired
+// it returns how many it marked
+func ExpireApprovalRequests(now time.Time) (int64, error) {
+	result, err := database.GetPool().Exec(
+		context.Background(),
+		`UPDATE approval_requests SET status = $1, updated_at = $2 WHERE status = $3 AND expires_at <= $2`,
+		ApprovalStatusExpired, now, ApprovalStatusPending,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/yigit-demirko/go-ledger/internal/database"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -14,13 +15,20 @@ import (
 type UserRole string
 
 const (
-	RoleUser  UserRole = "USER"  // regular users
-	RoleAdmin UserRole = "ADMIN" // admins can do everything
+	RoleUser    UserRole = "USER"    // regular users
+	RoleAdmin   UserRole = "ADMIN"   // admins can do everything
+	RoleService UserRole = "SERVICE" // other systems that move money in and out, like a payment processor
 )
 
+// Valid tells if this is a role we have
+func (r UserRole) Valid() bool {
+	return r == RoleUser || r == RoleAdmin || r == RoleService
+}
+
 // AuthUser is for login and permissions
 type AuthUser struct {
 	ID           int64     `json:"id"`
+	UserID       int64     `json:"user_id"` // the ledger user this login belongs to
 	Username     string    `json:"username"`
 	PasswordHash string    `json:"-"` // we never show the password hash
 	Role         UserRole  `json:"role"`
@@ -28,8 +36,33 @@ type AuthUser struct {
 	UpdatedAt    time.Time `json:"updated_at"`
 }
 
-// CreateAuthUser makes a new user account
-func CreateAuthUser(username, password string, role UserRole) (*AuthUser, error) {
+// Register makes a login and the ledger user it belongs to, both or neither
+func Register(username, password, name string, role UserRole) (*AuthUser, *User, error) {
+	var authUser *AuthUser
+	var user *User
+	err := database.RunInTransaction(func(tx pgx.Tx) error {
+		var err error
+		authUser, err = CreateAuthUser(tx, username, password, role)
+		if err != nil {
+			return err
+		}
+
+		user, err = CreateUser(tx, name, authUser.ID)
+		if err != nil {
+			return err
+		}
+		authUser.UserID = user.ID
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return authUser, user, nil
+}
+
+// CreateAuthUser makes a new login, it still needs a ledger user (see Register)
+func CreateAuthUser(q database.Querier, username, password string, role UserRole) (*AuthUser, error) {
 	// make the password safe to store
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
@@ -40,7 +73,7 @@ func CreateAuthUser(username, password string, role UserRole) (*AuthUser, error)
 	now := time.Now()
 
 	// save the user in database
-	err = database.GetPool().QueryRow(
+	err = q.QueryRow(
 		context.Background(),
 		`INSERT INTO auth_users (username, password_hash, role, created_at, updated_at)
 		VALUES ($1, $2, $3, $4, $4)
@@ -55,6 +88,10 @@ func CreateAuthUser(username, password string, role UserRole) (*AuthUser, error)
 		&user.UpdatedAt,
 	)
 
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return nil, ErrUsernameTaken
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -62,16 +99,19 @@ func CreateAuthUser(username, password string, role UserRole) (*AuthUser, error)
 	return &user, nil
 }
 
-// GetAuthUserByUsername finds a user by their username
+// GetAuthUserByUsername finds a login by its username, together with its ledger user
+// it returns nil if there is no such login
 func GetAuthUserByUsername(username string) (*AuthUser, error) {
 	var user AuthUser
 	err := database.GetPool().QueryRow(
 		context.Background(),
-		`SELECT id, username, password_hash, role, created_at, updated_at
-		FROM auth_users WHERE username = $1`,
+		`SELECT a.id, u.id, a.username, a.password_hash, a.role, a.created_at, a.updated_at
+		FROM auth_users a JOIN users u ON u.auth_user_id = a.id
+		WHERE a.username = $1`,
 		username,
 	).Scan(
 		&user.ID,
+		&user.UserID,
 		&user.Username,
 		&user.PasswordHash,
 		&user.Role,
@@ -118,6 +158,12 @@ func (u *AuthUser) UpdatePassword(newPassword string) error {
 
 // error messages we might need
 var (
-	ErrInvalidCredentials = errors.New("invalid credentials")
-	ErrUserNotFound      = errors.New("user not found")
-) 
\ No newline at end of file
+	ErrInvalidCredentials  = errors.New("invalid credentials")
+	ErrUsernameTaken       = errors.New("username is already taken")
+	ErrUserNotFound        = errors.New("user not found")
+	ErrInsufficientBalance = errors.New("insufficient balance")
+	ErrDuplicateReference  = errors.New("external reference was already booked for this source system")
+	ErrInvalidTransition   = errors.New("transaction can't change to that status")
+	ErrAccountFrozen       = errors.New("account is frozen")
+	ErrAccountClosed       = errors.New("account is closed")
+)
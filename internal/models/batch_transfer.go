@@ -0,0 +1,237 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/yigit-demirko/go-ledger/internal/database"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// how a batch handles lines that fail
+type BatchMode string
+
+const (
+	BatchModeAllOrNothing BatchMode = "ALL_OR_NOTHING" // one failed line undoes the whole batch
+	BatchModeBestEffort   BatchMode = "BEST_EFFORT"    // every line that can be paid is paid
+)
+
+// Valid checks that m is one of the modes we know
+func (m BatchMode) Valid() bool {
+	return m == BatchModeAllOrNothing || m == BatchModeBestEffort
+}
+
+// how a batch went as a whole
+type BatchStatus string
+
+const (
+	BatchStatusCompleted BatchStatus = "COMPLETED" // every line was paid
+	BatchStatusPartial   BatchStatus = "PARTIAL"   // some lines were paid, only in BEST_EFFORT
+	BatchStatusFailed    BatchStatus = "FAILED"    // nothing was paid
+)
+
+// how one line of a batch went
+type BatchLineStatus string
+
+const (
+	BatchLineStatusSucceeded  BatchLineStatus = "SUCCEEDED"   // the money moved
+	BatchLineStatusFailed     BatchLineStatus = "FAILED"      // Error says why
+	BatchLineStatusRolledBack BatchLineStatus = "ROLLED_BACK" // it worked, but another line failed in an ALL_OR_NOTHING batch
+)
+
+// BatchTransfer pays many recipients from one source account at once
+type BatchTransfer struct {
+	ID             int64               `json:"id"`
+	FromUserID     int64               `json:"from_user_id"`
+	FromAccountID  *int64              `json:"from_account_id"` // the sender's default account in the currency if null
+	Currency       money.Currency      `json:"currency"`
+	Mode           BatchMode           `json:"mode"`
+	Status         BatchStatus         `json:"status"`
+	Description    string              `json:"description,omitempty"`
+	ActedBy        *int64              `json:"acted_by,omitempty"` // the admin or delegate who sent it for the sender
+	CreatedBy      int64               `json:"created_by"`
+	TotalAmount    money.Amount        `json:"total_amount"` // all lines together
+	PaidAmount     money.Amount        `json:"paid_amount"`  // the lines that were paid
+	LineCount      int                 `json:"line_count"`
+	SucceededCount int                 `json:"succeeded_count"`
+	FailedCount    int                 `json:"failed_count"`
+	CreatedAt      time.Time           `json:"created_at"`
+	Lines          []BatchTransferLine `json:"lines,omitempty"`
+}
+
+// BatchTransferLine is one recipient of a batch and how paying them went
+type BatchTransferLine struct {
+	ID              int64           `json:"id"`
+	BatchID         int64           `json:"batch_id"`
+	Line            int             `json:"line"` // where it was in the request, the line of the file for CSV
+	ToUserID        int64           `json:"to_user_id"`
+	ToAccountID     *int64          `json:"to_account_id"`
+	Amount          money.Amount    `json:"amount"`
+	Description     string          `json:"description,omitempty"`
+	ClientReference string          `json:"client_reference,omitempty"`
+	Metadata        Metadata        `json:"metadata,omitempty"`
+	Status          BatchLineStatus `json:"status"`
+	TransactionID   *int64          `json:"transaction_id"`
+	Error           string          `json:"error,omitempty"`
+}
+
+// the columns of a batch, in the order scanBatchTransfer expects
+const batchTransferColumns = `id, from_user_id, from_account_id, currency, mode, status, COALESCE(description, ''),
+	acted_by, created_by, total_amount, paid_amount, line_count, succeeded_count, failed_count, created_at`
+
+func scanBatchTransfer(row pgx.Row) (*BatchTransfer, error) {
+	var batch BatchTransfer
+	err := row.Scan(
+		&batch.ID,
+		&batch.FromUserID,
+		&batch.FromAccountID,
+		&batch.Currency,
+		&batch.Mode,
+		&batch.Status,
+		&batch.Description,
+		&batch.ActedBy,
+		&batch.CreatedBy,
+		&batch.TotalAmount,
+		&batch.PaidAmount,
+		&batch.LineCount,
+		&batch.SucceededCount,
+		&batch.FailedCount,
+		&batch.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	batch.TotalAmount = inCurrency(batch.TotalAmount, batch.Currency)
+	batch.PaidAmount = inCurrency(batch.PaidAmount, batch.Currency)
+	return &batch, nil
+}
+
+// CreateBatchTransfer saves a batch that already ran together with the result of every line
+func CreateBatchTransfer(q database.Querier, batch BatchTransfer) (*BatchTransfer, error) {
+	created, err := scanBatchTransfer(q.QueryRow(
+		context.Background(),
+		`INSERT INTO batch_transfers (from_user_id, from_account_id, currency, mode, status, description, acted_by, created_by,
+			total_amount, paid_amount, line_count, succeeded_count, failed_count, created_at)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7, $8, $9, $10, $11, $12, $13, $14)
+		RETURNING `+batchTransferColumns,
+		batch.FromUserID, batch.FromAccountID, batch.Currency, batch.Mode, batch.Status, batch.Description, batch.ActedBy, batch.CreatedBy,
+		batch.TotalAmount, batch.PaidAmount, batch.LineCount, batch.SucceededCount, batch.FailedCount, time.Now(),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range batch.Lines {
+		metadata := line.Metadata
+		if metadata == nil {
+			metadata = Metadata{}
+		}
+		line.BatchID = created.ID
+		err := q.QueryRow(
+			context.Background(),
+			`INSERT INTO batch_transfer_lines (batch_id, line, to_user_id, to_account_id, amount, description,
+				client_reference, metadata, status, transaction_id, error)
+			VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''), $8, $9, $10, NULLIF($11, ''))
+			RETURNING id`,
+			line.BatchID, line.Line, line.ToUserID, line.ToAccountID, line.Amount, line.Description,
+			line.ClientReference, metadata, line.Status, line.TransactionID, line.Error,
+		).Scan(&line.ID)
+		if err != nil {
+			return nil, err
+		}
+		created.Lines = append(created.Lines, line)
+	}
+
+	return created, nil
+}
+
+// GetBatchTransferByID finds a batch with all its lines, nil if it doesn't exist
+func GetBatchTransferByID(id int64) (*BatchTransfer, error) {
+	batch, err := scanBatchTransfer(database.GetPool().QueryRow(
+		context.Background(),
+		`SELECT `+batchTransferColumns+` FROM batch_transfers WHERE id = $1`,
+		id,
+	))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := database.GetPool().Query(
+		context.Background(),
+		`SELECT id, batch_id, line, to_user_id, to_account_id, amount, COALESCE(description, ''),
+			COALESCE(client_reference, ''), metadata, status, transaction_id, COALESCE(error, '')
+		FROM batch_transfer_lines
+		WHERE batch_id = $1
+		ORDER BY line, id`,
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var line BatchTransferLine
+		err := rows.Scan(
+			&line.ID,
+			&line.BatchID,
+			&line.Line,
+			&line.ToUserID,
+			&line.ToAccountID,
+			&line.Amount,
+			&line.Description,
+			&line.ClientReference,
+			&line.Metadata,
+			&line.Status,
+			&line.TransactionID,
+			&line.Error,
+		)
+		if err != nil {
+			return nil, err
+		}
+		line.Amount = inCurrency(line.Amount, batch.Currency)
+		batch.Lines = append(batch.Lines, line)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return batch, nil
+}
+
+// GetBatchTransfersByUserID lists the batches paid from a user's money, newest first, without their lines
+func GetBatchTransfersByUserID(userID int64, limit, offset int) ([]BatchTransfer, error) {
+	rows, err := database.GetPool().Query(
+		context.Background(),
+		`SELECT `+batchTransferColumns+`
+		FROM batch_transfers
+		WHERE from_user_id = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2 OFFSET $3`,
+		userID, limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batches []BatchTransfer
+	for rows.Next() {
+		batch, err := scanBatchTransfer(rows)
+		if err != nil {
+			return nil, err
+		}
+		batches = append(batches, *batch)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return batches, nil
+}
@@ -0,0 +1,171 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/yigit-demirko/go-ledger/internal/database"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// BalanceCheckpoint is the balance of an account from all postings before AsOf
+// historical balances start from the nearest checkpoint instead of adding up
+// every posting since the account was opened
+type BalanceCheckpoint struct {
+	AccountID    int64          `json:"account_id"`
+	Currency     money.Currency `json:"currency"`
+	AsOf         time.Time      `json:"as_of"`
+	Balance      money.Amount   `json:"balance"`
+	PostingCount int64          `json:"posting_count"` // how many postings the balance was built from
+	VerifiedAt   *time.Time     `json:"verified_at"`
+	// set once the postings before AsOf no longer add up to the checkpoint
+	MismatchAt           *time.Time    `json:"mismatch_at"`
+	ExpectedBalance      *money.Amount `json:"expected_balance"`
+	ExpectedPostingCount *int64        `json:"expected_posting_count"`
+	CreatedAt            time.Time     `json:"created_at"`
+}
+
+// Delta is how far the checkpoint is off from its postings, zero when it matches
+func (c *BalanceCheckpoint) Delta() money.Amount {
+	if c.ExpectedBalance == nil {
+		return c.Currency.Zero()
+	}
+	return c.Balance.Sub(*c.ExpectedBalance)
+}
+
+// the columns of a checkpoint, in the order scanBalanceCheckpoint expects
+const checkpointColumns = `c.account_id, a.currency, c.as_of, c.balance, c.posting_count, c.verified_at,
+	c.mismatch_at, c.expected_balance, c.expected_posting_count, c.created_at`
+
+func scanBalanceCheckpoint(row pgx.Row) (*BalanceCheckpoint, error) {
+	var checkpoint BalanceCheckpoint
+	err := row.Scan(
+		&checkpoint.AccountID,
+		&checkpoint.Currency,
+		&checkpoint.AsOf,
+		&checkpoint.Balance,
+		&checkpoint.PostingCount,
+		&checkpoint.VerifiedAt,
+		&checkpoint.MismatchAt,
+		&checkpoint.ExpectedBalance,
+		&checkpoint.ExpectedPostingCount,
+		&checkpoint.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	checkpoint.Balance = inCurrency(checkpoint.Balance, checkpoint.Currency)
+	if checkpoint.ExpectedBalance != nil {
+		expected := inCurrency(*checkpoint.ExpectedBalance, checkpoint.Currency)
+		checkpoint.ExpectedBalance = &expected
+	}
+	return &checkpoint, nil
+}
+
+// CreateBalanceCheckpoints adds a checkpoint at asOf for every account that had
+// postings since its last one, starting from that last checkpoint
+// accounts that already have a checkpoint at asOf are left alone
+func CreateBalanceCheckpoints(asOf time.Time) (int64, error) {
+	tag, err := database.GetPool().Exec(
+		context.Background(),
+		`INSERT INTO balance_checkpoints (account_id, as_of, balance, posting_count, created_at)
+		SELECT a.id, $1::TIMESTAMP,
+			COALESCE(prev.balance, 0) + delta.amount,
+			COALESCE(prev.posting_count, 0) + delta.count,
+			$2::TIMESTAMP
+		FROM accounts a
+		LEFT JOIN LATERAL (
+			SELECT as_of, balance, posting_count FROM balance_checkpoints
+			WHERE account_id = a.id AND as_of < $1 AND mismatch_at IS NULL
+			ORDER BY as_of DESC
+			LIMIT 1
+		) prev ON true
+		JOIN LATERAL (
+			SELECT COALESCE(SUM(p.amount), 0) AS amount, COUNT(*) AS count FROM postings p
+			WHERE p.account_id = a.id AND p.created_at < $1
+			AND (prev.as_of IS NULL OR p.created_at >= prev.as_of)
+		) delta ON delta.count > 0
+		ON CONFLICT (account_id, as_of) DO NOTHING`,
+		asOf, time.Now(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// VerifyBalanceCheckpoints adds up the postings behind up to limit checkpoints
+// again, the ones checked longest ago first, and marks the ones that are off
+// it returns the checkpoints it checked; checkpoints another server is checking are skipped
+func VerifyBalanceCheckpoints(limit int) ([]BalanceCheckpoint, error) {
+	rows, err := database.GetPool().Query(
+		context.Background(),
+		`WITH picked AS (
+			SELECT account_id, as_of FROM balance_checkpoints
+			WHERE mismatch_at IS NULL
+			ORDER BY verified_at NULLS FIRST, as_of
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		), actual AS (
+			SELECT picked.account_id, picked.as_of,
+				COALESCE(SUM(p.amount), 0) AS balance, COUNT(p.id) AS posting_count
+			FROM picked
+			LEFT JOIN postings p ON p.account_id = picked.account_id AND p.created_at < picked.as_of
+			GROUP BY picked.account_id, picked.as_of
+		), checked AS (
+			UPDATE balance_checkpoints c
+			SET verified_at = $2,
+				mismatch_at = CASE WHEN c.balance <> actual.balance OR c.posting_count <> actual.posting_count THEN $2::TIMESTAMP END,
+				expected_balance = actual.balance,
+				expected_posting_count = actual.posting_count
+			FROM actual
+			WHERE c.account_id = actual.account_id AND c.as_of = actual.as_of
+			RETURNING c.*
+		)
+		SELECT `+checkpointColumns+`
+		FROM checked c JOIN accounts a ON a.id = c.account_id
+		ORDER BY c.account_id, c.as_of`,
+		limit, time.Now(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return collectCheckpoints(rows)
+}
+
+// GetMismatchedCheckpoints lists checkpoints that no longer match their postings, newest first
+func GetMismatchedCheckpoints(limit, offset int) ([]BalanceCheckpoint, error) {
+	rows, err := database.GetPool().Query(
+		context.Background(),
+		`SELECT `+checkpointColumns+`
+		FROM balance_checkpoints c JOIN accounts a ON a.id = c.account_id
+		WHERE c.mismatch_at IS NOT NULL
+		ORDER BY c.mismatch_at DESC, c.account_id
+		LIMIT $1 OFFSET $2`,
+		limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return collectCheckpoints(rows)
+}
+
+func collectCheckpoints(rows pgx.Rows) ([]BalanceCheckpoint, error) {
+	defer rows.Close()
+
+	var checkpoints []BalanceCheckpoint
+	for rows.Next() {
+		checkpoint, err := scanBalanceCheckpoint(rows)
+		if err != nil {
+			return nil, err
+		}
+		checkpoints = append(checkpoints, *checkpoint)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return checkpoints, nil
+}
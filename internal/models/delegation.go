@@ -0,0 +1,145 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/yigit-demirko/go-ledger/internal/database"
+)
+
+// Delegation lets another user send money from a user's account for them
+type Delegation struct {
+	ID         int64      `json:"id"`
+	UserID     int64      `json:"user_id"`     // whose money it is
+	DelegateID int64      `json:"delegate_id"` // who may send it
+	CreatedBy  int64      `json:"created_by"`  // the user themselves or an admin
+	CreatedAt  time.Time  `json:"created_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// the columns of a delegation, in the order scanDelegation expects
+const delegationColumns = `id, user_id, delegate_id, created_by, created_at, revoked_at`
+
+func scanDelegation(row pgx.Row) (*Delegation, error) {
+	var delegation Delegation
+	err := row.Scan(
+		&delegation.ID,
+		&delegation.UserID,
+		&delegation.DelegateID,
+		&delegation.CreatedBy,
+		&delegation.CreatedAt,
+		&delegation.RevokedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &delegation, nil
+}
+
+// CreateDelegation lets delegateID send money for userID
+// if the delegate already may, the delegation they have is returned
+func CreateDelegation(userID, delegateID, createdBy int64) (*Delegation, error) {
+	_, err := database.GetPool().Exec(
+		context.Background(),
+		`INSERT INTO delegations (user_id, delegate_id, created_by, created_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, delegate_id) WHERE revoked_at IS NULL DO NOTHING`,
+		userID, delegateID, createdBy, time.Now(),
+	)
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return scanDelegation(database.GetPool().QueryRow(
+		context.Background(),
+		`SELECT `+delegationColumns+` FROM delegations
+		WHERE user_id = $1 AND delegate_id = $2 AND revoked_at IS NULL`,
+		userID, delegateID,
+	))
+}
+
+// RevokeDelegation stops delegateID from sending money for userID
+// it returns nil if they couldn't anyway
+func RevokeDelegation(userID, delegateID int64) (*Delegation, error) {
+	delegation, err := scanDelegation(database.GetPool().QueryRow(
+		context.Background(),
+		`UPDATE delegations SET revoked_at = $3
+		WHERE user_id = $1 AND delegate_id = $2 AND revoked_at IS NULL
+		RETURNING `+delegationColumns,
+		userID, delegateID, time.Now(),
+	))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	return delegation, err
+}
+
+// GetDelegationsByUserID lists who may send money for a user right now
+func GetDelegationsByUserID(userID int64) ([]Delegation, error) {
+	rows, err := database.GetPool().Query(
+		context.Background(),
+		`SELECT `+delegationColumns+` FROM delegations
+		WHERE user_id = $1 AND revoked_at IS NULL
+		ORDER BY created_at`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var delegations []Delegation
+	for rows.Next() {
+		delegation, err := scanDelegation(rows)
+		if err != nil {
+			return nil, err
+		}
+		delegations = append(delegations, *delegation)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return delegations, nil
+}
+
+// IsDelegate tells if delegateID may send money for userID
+func IsDelegate(userID, delegateID int64) (bool, error) {
+	var exists bool
+	err := database.GetPool().QueryRow(
+		context.Background(),
+		`SELECT EXISTS (
+			SELECT 1 FROM delegations
+			WHERE user_id = $1 AND delegate_id = $2 AND revoked_at IS NULL
+		)`,
+		userID, delegateID,
+	).Scan(&exists)
+	return exists, err
+}
+
+// CanActFor tells if actorID may still send money for userID: they are an
+// admin or one of the user's delegates
+func CanActFor(q database.Querier, userID, actorID int64) (bool, error) {
+	var allowed bool
+	err := q.QueryRow(
+		context.Background(),
+		`SELECT EXISTS (
+			SELECT 1 FROM delegations
+			WHERE user_id = $1 AND delegate_id = $2 AND revoked_at IS NULL
+		) OR EXISTS (
+			SELECT 1 FROM users u JOIN auth_users a ON a.id = u.auth_user_id
+			WHERE u.id = $2 AND a.role = $3
+		)`,
+		userID, actorID, RoleAdmin,
+	).Scan(&allowed)
+	return allowed, err
+}
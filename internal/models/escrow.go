@@ -0,0 +1,292 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/yigit-demirko/go-ledger/internal/database"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// where an escrow is in its life
+type EscrowStatus string
+
+const (
+	EscrowStatusFunded   EscrowStatus = "FUNDED"   // the buyer's money is in escrow
+	EscrowStatusReleased EscrowStatus = "RELEASED" // the seller got the money
+	EscrowStatusRefunded EscrowStatus = "REFUNDED" // the buyer got the money back
+)
+
+// why an escrow was released or refunded
+type EscrowReason string
+
+const (
+	EscrowReasonBuyerConfirmed EscrowReason = "BUYER_CONFIRMED" // the buyer said the trade went fine
+	EscrowReasonSellerRefunded EscrowReason = "SELLER_REFUNDED" // the seller gave the money back
+	EscrowReasonAdminDecision  EscrowReason = "ADMIN_DECISION"  // an admin settled it, like after a dispute
+	EscrowReasonDeadlinePassed EscrowReason = "DEADLINE_PASSED" // nobody released it before refund_after
+)
+
+// which escrows a user sees in their list
+type EscrowRole string
+
+const (
+	EscrowRoleBuyer  EscrowRole = "buyer"  // escrows the user paid into
+	EscrowRoleSeller EscrowRole = "seller" // escrows the user gets paid from
+)
+
+// Escrow is money a buyer parked for a seller until the trade is settled
+// it is released to the seller or refunded to the buyer, and every step is an EscrowEvent
+type Escrow struct {
+	ID                  int64          `json:"id"`
+	BuyerID             int64          `json:"buyer_id"`
+	BuyerAccountID      int64          `json:"buyer_account_id"` // where the money came from, and goes back to on a refund
+	SellerID            int64          `json:"seller_id"`
+	SellerAccountID     *int64         `json:"seller_account_id"` // the seller's default account in the currency if null
+	Amount              money.Amount   `json:"amount"`
+	Currency            money.Currency `json:"currency"`
+	Description         string         `json:"description,omitempty"`
+	Status              EscrowStatus   `json:"status"`
+	RefundAfter         time.Time      `json:"refund_after"`       // the buyer gets the money back if it is still in escrow then
+	ActedBy             *int64         `json:"acted_by,omitempty"` // the admin or delegate who funded it for the buyer
+	CreatedBy           int64          `json:"created_by"`
+	FundTransactionID   *int64         `json:"fund_transaction_id"`
+	SettleTransactionID *int64         `json:"settle_transaction_id"` // the release or the refund
+	SettledBy           *int64         `json:"settled_by,omitempty"`  // who released or refunded it, null for the refund job
+	SettleReason        EscrowReason   `json:"settle_reason,omitempty"`
+	SettledAt           *time.Time     `json:"settled_at,omitempty"`
+	CreatedAt           time.Time      `json:"created_at"`
+	UpdatedAt           time.Time      `json:"updated_at"`
+	Events              []EscrowEvent  `json:"events,omitempty"`
+}
+
+// EscrowEvent is one thing that happened to an escrow, who did it and the money it moved
+type EscrowEvent struct {
+	ID            int64        `json:"id"`
+	EscrowID      int64        `json:"escrow_id"`
+	Status        EscrowStatus `json:"status"`           // what the escrow became
+	Reason        EscrowReason `json:"reason,omitempty"` // for releases and refunds
+	Note          string       `json:"note,omitempty"`
+	ActorID       *int64       `json:"actor_id"` // null for the refund job
+	TransactionID int64        `json:"transaction_id"`
+	CreatedAt     time.Time    `json:"created_at"`
+}
+
+// the columns of an escrow, in the order scanEscrow expects
+const escrowColumns = `id, buyer_id, buyer_account_id, seller_id, seller_account_id, amount, currency,
+	COALESCE(description, ''), status, refund_after, acted_by, created_by, fund_transaction_id,
+	settle_transaction_id, settled_by, COALESCE(settle_reason, ''), settled_at, created_at, updated_at`
+
+func scanEscrow(row pgx.Row) (*Escrow, error) {
+	var escrow Escrow
+	err := row.Scan(
+		&escrow.ID,
+		&escrow.BuyerID,
+		&escrow.BuyerAccountID,
+		&escrow.SellerID,
+		&escrow.SellerAccountID,
+		&escrow.Amount,
+		&escrow.Currency,
+		&escrow.Description,
+		&escrow.Status,
+		&escrow.RefundAfter,
+		&escrow.ActedBy,
+		&escrow.CreatedBy,
+		&escrow.FundTransactionID,
+		&escrow.SettleTransactionID,
+		&escrow.SettledBy,
+		&escrow.SettleReason,
+		&escrow.SettledAt,
+		&escrow.CreatedAt,
+		&escrow.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	escrow.Amount = inCurrency(escrow.Amount, escrow.Currency)
+	return &escrow, nil
+}
+
+// CreateEscrow saves a new funded escrow, the transaction that funds it is added with Save
+// it returns ErrUserNotFound if the seller doesn't exist
+func CreateEscrow(q database.Querier, escrow Escrow) (*Escrow, error) {
+	now := time.Now()
+	created, err := scanEscrow(q.QueryRow(
+		context.Background(),
+		`INSERT INTO escrows (buyer_id, buyer_account_id, seller_id, seller_account_id, amount, currency, description,
+			status, refund_after, acted_by, created_by, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), $8, $9, $10, $11, $12, $12)
+		RETURNING `+escrowColumns,
+		escrow.BuyerID, escrow.BuyerAccountID, escrow.SellerID, escrow.SellerAccountID, escrow.Amount, escrow.Currency,
+		escrow.Description, EscrowStatusFunded, escrow.RefundAfter, escrow.ActedBy, escrow.CreatedBy, now,
+	))
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+		return nil, ErrUserNotFound
+	}
+	return created, err
+}
+
+// GetEscrowByID finds an escrow with everything that happened to it, nil if it doesn't exist
+func GetEscrowByID(id int64) (*Escrow, error) {
+	escrow, err := scanEscrow(database.GetPool().QueryRow(
+		context.Background(),
+		`SELECT `+escrowColumns+` FROM escrows WHERE id = $1`,
+		id,
+	))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := database.GetPool().Query(
+		context.Background(),
+		`SELECT id, escrow_id, status, COALESCE(reason, ''), COALESCE(note, ''), actor_id, transaction_id, created_at
+		FROM escrow_events
+		WHERE escrow_id = $1
+		ORDER BY created_at, id`,
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var event EscrowEvent
+		err := rows.Scan(
+			&event.ID,
+			&event.EscrowID,
+			&event.Status,
+			&event.Reason,
+			&event.Note,
+			&event.ActorID,
+			&event.TransactionID,
+			&event.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		escrow.Events = append(escrow.Events, event)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return escrow, nil
+}
+
+// LockEscrowForUpdate finds an escrow and locks it until tx ends, nil if it doesn't exist
+func LockEscrowForUpdate(tx pgx.Tx, id int64) (*Escrow, error) {
+	escrow, err := scanEscrow(tx.QueryRow(
+		context.Background(),
+		`SELECT `+escrowColumns+` FROM escrows WHERE id = $1 FOR UPDATE`,
+		id,
+	))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	return escrow, err
+}
+
+// LockDueEscrows finds up to limit funded escrows past their refund_after and locks them
+// escrows another transaction already locked are skipped, so several servers
+// can refund them at the same time and each one is refunded once
+func LockDueEscrows(tx pgx.Tx, now time.Time, limit int) ([]Escrow, error) {
+	rows, err := tx.Query(
+		context.Background(),
+		`SELECT `+escrowColumns+`
+		FROM escrows
+		WHERE status = $1 AND refund_after <= $2
+		ORDER BY refund_after, id
+		LIMIT $3
+		FOR UPDATE SKIP LOCKED`,
+		EscrowStatusFunded, now, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return collectEscrows(rows)
+}
+
+// GetEscrowsByUserID lists the escrows of a user, newest first, without their events
+// an empty role lists the ones they bought and sold in, an empty status lists them in every status
+func GetEscrowsByUserID(userID int64, role EscrowRole, status EscrowStatus, limit, offset int) ([]Escrow, error) {
+	rows, err := database.GetPool().Query(
+		context.Background(),
+		`SELECT `+escrowColumns+`
+		FROM escrows
+		WHERE (($2::VARCHAR <> 'seller' AND buyer_id = $1) OR ($2::VARCHAR <> 'buyer' AND seller_id = $1))
+			AND ($3::VARCHAR = '' OR status = $3::VARCHAR)
+		ORDER BY created_at DESC, id DESC
+		LIMIT $4 OFFSET $5`,
+		userID, string(role), string(status), limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return collectEscrows(rows)
+}
+
+func collectEscrows(rows pgx.Rows) ([]Escrow, error) {
+	defer rows.Close()
+
+	var escrows []Escrow
+	for rows.Next() {
+		escrow, err := scanEscrow(rows)
+		if err != nil {
+			return nil, err
+		}
+		escrows = append(escrows, *escrow)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return escrows, nil
+}
+
+// Save writes everything about an escrow that can change after it was made
+// lock it first, so it can't be released and refunded at the same time
+func (e *Escrow) Save(q database.Querier) error {
+	saved, err := scanEscrow(q.QueryRow(
+		context.Background(),
+		`UPDATE escrows
+		SET status = $2, fund_transaction_id = $3, settle_transaction_id = $4, settled_by = $5,
+			settle_reason = NULLIF($6, ''), settled_at = $7, updated_at = $8
+		WHERE id = $1
+		RETURNING `+escrowColumns,
+		e.ID, e.Status, e.FundTransactionID, e.SettleTransactionID, e.SettledBy,
+		string(e.SettleReason), e.SettledAt, time.Now(),
+	))
+	if err != nil {
+		return err
+	}
+	*e = *saved
+	return nil
+}
+
+// AddEvent writes down something that happened to an escrow
+func (e *Escrow) AddEvent(q database.Querier, event EscrowEvent) (*EscrowEvent, error) {
+	event.EscrowID = e.ID
+	err := q.QueryRow(
+		context.Background(),
+		`INSERT INTO escrow_events (escrow_id, status, reason, note, actor_id, transaction_id, created_at)
+		VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), $5, $6, $7)
+		RETURNING id, created_at`,
+		event.EscrowID, event.Status, string(event.Reason), event.Note, event.ActorID, event.TransactionID, time.Now(),
+	).Scan(&event.ID, &event.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	e.Events = append(e.Events, event)
+	return &event, nil
+}
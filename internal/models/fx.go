@@ -0,0 +1,246 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/yigit-demirko/go-ledger/internal/database"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// where an exchange rate came from
+type FXRateSource string
+
+const (
+	FXRateSourceAPI  FXRateSource = "API"  // published by an admin through the API
+	FXRateSourceFile FXRateSource = "FILE" // loaded from the rates file
+)
+
+// FXRate is an exchange rate that applies from EffectiveFrom until a newer one for the same pair
+type FXRate struct {
+	ID            int64          `json:"id"`
+	BaseCurrency  money.Currency `json:"base_currency"`
+	QuoteCurrency money.Currency `json:"quote_currency"`
+	Rate          money.Rate     `json:"rate"`       // mid rate, 1 base buys this much quote
+	SpreadBps     int64          `json:"spread_bps"` // what we keep, in basis points of the converted amount
+	EffectiveFrom time.Time      `json:"effective_from"`
+	Source        FXRateSource   `json:"source"`
+	CreatedBy     *int64         `json:"created_by"` // the admin who published it, null for files
+	CreatedAt     time.Time      `json:"created_at"`
+}
+
+// FXPrice is everything about one priced conversion
+type FXPrice struct {
+	RateID        int64          `json:"rate_id"`
+	BaseCurrency  money.Currency `json:"base_currency"`  // what the sender pays in
+	QuoteCurrency money.Currency `json:"quote_currency"` // what the receiver gets
+	MidRate       money.Rate     `json:"mid_rate"`
+	CustomerRate  money.Rate     `json:"customer_rate"` // mid rate less the spread
+	SpreadBps     int64          `json:"spread_bps"`
+	SourceAmount  money.Amount   `json:"source_amount"` // in the base currency
+	TargetAmount  money.Amount   `json:"target_amount"` // in the quote currency, what the receiver gets
+	SpreadAmount  money.Amount   `json:"spread_amount"` // in the quote currency, what we keep as revenue
+}
+
+// FXQuote locks a price for a short time so the client can show it before confirming
+type FXQuote struct {
+	ID        int64 `json:"id"`
+	CreatedBy int64 `json:"created_by"` // only this caller can use the quote
+	FXPrice
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// FXConversion records the price a conversion transaction was made at
+type FXConversion struct {
+	TransactionID int64  `json:"transaction_id"`
+	QuoteID       *int64 `json:"quote_id"`
+	FXPrice
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// the columns of an FXRate, in the order scanFXRate expects
+const fxRateColumns = `id, base_currency, quote_currency, rate, spread_bps, effective_from, source, created_by, created_at`
+
+func scanFXRate(row pgx.Row) (*FXRate, error) {
+	var rate FXRate
+	err := row.Scan(
+		&rate.ID,
+		&rate.BaseCurrency,
+		&rate.QuoteCurrency,
+		&rate.Rate,
+		&rate.SpreadBps,
+		&rate.EffectiveFrom,
+		&rate.Source,
+		&rate.CreatedBy,
+		&rate.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &rate, nil
+}
+
+// CreateFXRate publishes a rate, a rate for the same pair and time is left as it was
+// it returns nil if that rate already existed
+func CreateFXRate(q database.Querier, rate FXRate) (*FXRate, error) {
+	created, err := scanFXRate(q.QueryRow(
+		context.Background(),
+		`INSERT INTO fx_rates (base_currency, quote_currency, rate, spread_bps, effective_from, source, created_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (base_currency, quote_currency, effective_from) DO NOTHING
+		RETURNING `+fxRateColumns,
+		rate.BaseCurrency, rate.QuoteCurrency, rate.Rate, rate.SpreadBps, rate.EffectiveFrom, rate.Source, rate.CreatedBy, time.Now(),
+	))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	return created, err
+}
+
+// GetEffectiveFXRate finds the rate for a pair that applies at a time, nil if there is none
+func GetEffectiveFXRate(q database.Querier, base, quote money.Currency, at time.Time) (*FXRate, error) {
+	rate, err := scanFXRate(q.QueryRow(
+		context.Background(),
+		`SELECT `+fxRateColumns+`
+		FROM fx_rates
+		WHERE base_currency = $1 AND quote_currency = $2 AND effective_from <= $3
+		ORDER BY effective_from DESC
+		LIMIT 1`,
+		base, quote, at,
+	))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	return rate, err
+}
+
+// GetEffectiveFXRates lists the rate of every pair that applies at a time
+func GetEffectiveFXRates(at time.Time) ([]FXRate, error) {
+	rows, err := database.GetPool().Query(
+		context.Background(),
+		`SELECT DISTINCT ON (base_currency, quote_currency) `+fxRateColumns+`
+		FROM fx_rates
+		WHERE effective_from <= $1
+		ORDER BY base_currency, quote_currency, effective_from DESC`,
+		at,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rates []FXRate
+	for rows.Next() {
+		rate, err := scanFXRate(rows)
+		if err != nil {
+			return nil, err
+		}
+		rates = append(rates, *rate)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return rates, nil
+}
+
+// the columns of an FXPrice, in the order scanFXPrice expects
+const fxPriceColumns = `rate_id, base_currency, quote_currency, mid_rate, customer_rate, spread_bps, source_amount, target_amount, spread_amount`
+
+// fxPriceTargets gives Scan the fields of a price in the order of fxPriceColumns
+func fxPriceTargets(p *FXPrice) []any {
+	return []any{
+		&p.RateID,
+		&p.BaseCurrency,
+		&p.QuoteCurrency,
+		&p.MidRate,
+		&p.CustomerRate,
+		&p.SpreadBps,
+		&p.SourceAmount,
+		&p.TargetAmount,
+		&p.SpreadAmount,
+	}
+}
+
+// normalize writes the amounts of a price with the decimal places of their currencies
+func (p *FXPrice) normalize() {
+	p.SourceAmount = inCurrency(p.SourceAmount, p.BaseCurrency)
+	p.TargetAmount = inCurrency(p.TargetAmount, p.QuoteCurrency)
+	p.SpreadAmount = inCurrency(p.SpreadAmount, p.QuoteCurrency)
+}
+
+// the columns of an FXQuote, in the order scanFXQuote expects
+const fxQuoteColumns = `id, created_by, ` + fxPriceColumns + `, expires_at, used_at, created_at`
+
+func scanFXQuote(row pgx.Row) (*FXQuote, error) {
+	var quote FXQuote
+	targets := []any{&quote.ID, &quote.CreatedBy}
+	targets = append(targets, fxPriceTargets(&quote.FXPrice)...)
+	targets = append(targets, &quote.ExpiresAt, &quote.UsedAt, &quote.CreatedAt)
+	if err := row.Scan(targets...); err != nil {
+		return nil, err
+	}
+	quote.normalize()
+	return &quote, nil
+}
+
+// CreateFXQuote saves a price that the caller can use until expiresAt
+func CreateFXQuote(createdBy int64, price FXPrice, expiresAt time.Time) (*FXQuote, error) {
+	return scanFXQuote(database.GetPool().QueryRow(
+		context.Background(),
+		`INSERT INTO fx_quotes (created_by, `+fxPriceColumns+`, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		RETURNING `+fxQuoteColumns,
+		createdBy,
+		price.RateID, price.BaseCurrency, price.QuoteCurrency, price.MidRate, price.CustomerRate,
+		price.SpreadBps, price.SourceAmount, price.TargetAmount, price.SpreadAmount,
+		expiresAt, time.Now(),
+	))
+}
+
+// UseFXQuote marks a quote as used and returns it
+// it returns nil if the quote doesn't exist, belongs to someone else,
+// has expired or was already used, so a quote can only ever be used once
+func UseFXQuote(q database.Querier, id, createdBy int64, now time.Time) (*FXQuote, error) {
+	quote, err := scanFXQuote(q.QueryRow(
+		context.Background(),
+		`UPDATE fx_quotes
+		SET used_at = $3
+		WHERE id = $1 AND created_by = $2 AND used_at IS NULL AND expires_at > $3
+		RETURNING `+fxQuoteColumns,
+		id, createdBy, now,
+	))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	return quote, err
+}
+
+// CreateFXConversion saves the price a conversion transaction used
+func CreateFXConversion(q database.Querier, transactionID int64, quoteID *int64, price FXPrice) (*FXConversion, error) {
+	conversion := FXConversion{TransactionID: transactionID, QuoteID: quoteID}
+	targets := []any{&conversion.TransactionID, &conversion.QuoteID}
+	targets = append(targets, fxPriceTargets(&conversion.FXPrice)...)
+	targets = append(targets, &conversion.CreatedAt)
+
+	err := q.QueryRow(
+		context.Background(),
+		`INSERT INTO fx_conversions (transaction_id, quote_id, `+fxPriceColumns+`, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		RETURNING transaction_id, quote_id, `+fxPriceColumns+`, created_at`,
+		transactionID, quoteID,
+		price.RateID, price.BaseCurrency, price.QuoteCurrency, price.MidRate, price.CustomerRate,
+		price.SpreadBps, price.SourceAmount, price.TargetAmount, price.SpreadAmount,
+		time.Now(),
+	).Scan(targets...)
+	if err != nil {
+		return nil, err
+	}
+
+	conversion.normalize()
+	return &conversion, nil
+}
@@ -0,0 +1,178 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/yigit-demirko/go-ledger/internal/database"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// where a hold is in its life
+type HoldStatus string
+
+const (
+	HoldStatusActive   HoldStatus = "ACTIVE"   // the money is reserved
+	HoldStatusCaptured HoldStatus = "CAPTURED" // (part of) the money was paid out, the rest was released
+	HoldStatusVoided   HoldStatus = "VOIDED"   // cancelled, all of the money was released
+	HoldStatusExpired  HoldStatus = "EXPIRED"  // nobody captured it in time, all of the money was released
+)
+
+// Hold reserves money on a user's account before the final amount is known
+type Hold struct {
+	ID              int64          `json:"id"`
+	AccountID       int64          `json:"account_id"`
+	UserID          int64          `json:"user_id"`           // whose money is reserved
+	RecipientUserID *int64         `json:"recipient_user_id"` // who gets it on capture, unless the capture says otherwise
+	Amount          money.Amount   `json:"amount"`            // how much is reserved
+	CapturedAmount  *money.Amount  `json:"captured_amount"`   // how much was paid out, once captured
+	Currency        money.Currency `json:"currency"`
+	Status          HoldStatus     `json:"status"`
+	Description     string         `json:"description,omitempty"`
+	TransactionID   *int64         `json:"transaction_id"` // the transfer made by the capture
+	ExpiresAt       time.Time      `json:"expires_at"`
+	CreatedAt       time.Time      `json:"created_at"`
+	UpdatedAt       time.Time      `json:"updated_at"`
+}
+
+// the columns of a hold, in the order scanHold expects
+const holdColumns = `id, account_id, user_id, recipient_user_id, amount, captured_amount, currency, status,
+	COALESCE(description, ''), transaction_id, expires_at, created_at, updated_at`
+
+func scanHold(row pgx.Row) (*Hold, error) {
+	var hold Hold
+	err := row.Scan(
+		&hold.ID,
+		&hold.AccountID,
+		&hold.UserID,
+		&hold.RecipientUserID,
+		&hold.Amount,
+		&hold.CapturedAmount,
+		&hold.Currency,
+		&hold.Status,
+		&hold.Description,
+		&hold.TransactionID,
+		&hold.ExpiresAt,
+		&hold.CreatedAt,
+		&hold.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	hold.Amount = inCurrency(hold.Amount, hold.Currency)
+	if hold.CapturedAmount != nil {
+		captured := inCurrency(*hold.CapturedAmount, hold.Currency)
+		hold.CapturedAmount = &captured
+	}
+	return &hold, nil
+}
+
+// CreateHold saves a new active hold, reserve the money on the account in the same transaction
+func CreateHold(q database.Querier, account *Account, recipientUserID *int64, amount money.Amount, description string, expiresAt time.Time) (*Hold, error) {
+	now := time.Now()
+	return scanHold(q.QueryRow(
+		context.Background(),
+		`INSERT INTO holds (account_id, user_id, recipient_user_id, amount, currency, status, description, expires_at, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), $8, $9, $9)
+		RETURNING `+holdColumns,
+		account.ID, account.UserID, recipientUserID, amount, account.Currency, HoldStatusActive, description, expiresAt, now,
+	))
+}
+
+// GetHoldByID finds a hold, nil if it doesn't exist
+func GetHoldByID(id int64) (*Hold, error) {
+	hold, err := scanHold(database.GetPool().QueryRow(
+		context.Background(),
+		`SELECT `+holdColumns+` FROM holds WHERE id = $1`,
+		id,
+	))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	return hold, err
+}
+
+// LockHoldForUpdate finds a hold and locks it until tx ends, nil if it doesn't exist
+func LockHoldForUpdate(tx pgx.Tx, id int64) (*Hold, error) {
+	hold, err := scanHold(tx.QueryRow(
+		context.Background(),
+		`SELECT `+holdColumns+` FROM holds WHERE id = $1 FOR UPDATE`,
+		id,
+	))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	return hold, err
+}
+
+// GetHoldsByUserID lists the holds on a user's money, newest first
+// an empty status lists holds in every status
+func GetHoldsByUserID(userID int64, status HoldStatus, limit, offset int) ([]Hold, error) {
+	return queryHolds(
+		database.GetPool(),
+		`SELECT `+holdColumns+`
+		FROM holds
+		WHERE user_id = $1 AND ($2 = '' OR status = $2)
+		ORDER BY created_at DESC
+		LIMIT $3 OFFSET $4`,
+		userID, string(status), limit, offset,
+	)
+}
+
+// LockExpiredHolds finds active holds that ran out of time and locks them
+// holds another transaction already locked are skipped, so several servers
+// can expire holds at the same time without waiting on each other
+func LockExpiredHolds(tx pgx.Tx, now time.Time, limit int) ([]Hold, error) {
+	return queryHolds(
+		tx,
+		`SELECT `+holdColumns+`
+		FROM holds
+		WHERE status = $1 AND expires_at <= $2
+		ORDER BY expires_at
+		LIMIT $3
+		FOR UPDATE SKIP LOCKED`,
+		HoldStatusActive, now, limit,
+	)
+}
+
+func queryHolds(q database.Querier, sql string, args ...any) ([]Hold, error) {
+	rows, err := q.Query(context.Background(), sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var holds []Hold
+	for rows.Next() {
+		hold, err := scanHold(rows)
+		if err != nil {
+			return nil, err
+		}
+		holds = append(holds, *hold)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return holds, nil
+}
+
+// Finish moves an active hold to its final status
+// capturedAmount and transactionID are only set for captures
+func (h *Hold) Finish(q database.Querier, status HoldStatus, capturedAmount *money.Amount, transactionID *int64) error {
+	updated, err := scanHold(q.QueryRow(
+		context.Background(),
+		`UPDATE holds
+		SET status = $2, captured_amount = $3, transaction_id = $4, updated_at = $5
+		WHERE id = $1
+		RETURNING `+holdColumns,
+		h.ID, status, capturedAmount, transactionID, time.Now(),
+	))
+	if err != nil {
+		return err
+	}
+	*h = *updated
+	return nil
+}
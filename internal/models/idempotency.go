@@ -0,0 +1,125 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/yigit-demirko/go-ledger/internal/database"
+)
+
+// where an idempotent request is at
+type IdempotencyStatus string
+
+const (
+	IdempotencyStatusInProgress IdempotencyStatus = "IN_PROGRESS" // the first request is still running
+	IdempotencyStatusCompleted  IdempotencyStatus = "COMPLETED"   // we have the response to replay
+)
+
+// IdempotencyKey remembers a request sent with an Idempotency-Key header
+// so that a retry gets the first response back instead of running again
+type IdempotencyKey struct {
+	ID           int64
+	UserID       int64 // keys are per caller, two users can use the same key
+	Key          string
+	RequestHash  string // hash of method, path and body of the first request
+	Status       IdempotencyStatus
+	ResponseCode int
+	ResponseBody []byte
+	CreatedAt    time.Time
+	ExpiresAt    time.Time
+}
+
+// ClaimIdempotencyKey tries to reserve a key for a new request
+// if nobody used the key yet it returns claimed=true and the caller should
+// run the request; otherwise it returns the key as it was saved before
+func ClaimIdempotencyKey(userID int64, key, requestHash string, ttl time.Duration) (bool, *IdempotencyKey, error) {
+	ctx := context.Background()
+	now := time.Now()
+
+	// expired keys can be used again
+	_, err := database.GetPool().Exec(ctx,
+		`DELETE FROM idempotency_keys WHERE expires_at < $1`,
+		now,
+	)
+	if err != nil {
+		return false, nil, err
+	}
+
+	tag, err := database.GetPool().Exec(ctx,
+		`INSERT INTO idempotency_keys (user_id, idem_key, request_hash, status, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (user_id, idem_key) DO NOTHING`,
+		userID, key, requestHash, IdempotencyStatusInProgress, now, now.Add(ttl),
+	)
+	if err != nil {
+		return false, nil, err
+	}
+	if tag.RowsAffected() == 1 {
+		return true, nil, nil
+	}
+
+	existing, err := GetIdempotencyKey(userID, key)
+	if err != nil {
+		return false, nil, err
+	}
+	return false, existing, nil
+}
+
+// GetIdempotencyKey finds a saved key, nil if there isn't one
+func GetIdempotencyKey(userID int64, key string) (*IdempotencyKey, error) {
+	var k IdempotencyKey
+	var responseCode *int
+	err := database.GetPool().QueryRow(
+		context.Background(),
+		`SELECT id, user_id, idem_key, request_hash, status, response_code, response_body, created_at, expires_at
+		FROM idempotency_keys
+		WHERE user_id = $1 AND idem_key = $2`,
+		userID, key,
+	).Scan(
+		&k.ID,
+		&k.UserID,
+		&k.Key,
+		&k.RequestHash,
+		&k.Status,
+		&responseCode,
+		&k.ResponseBody,
+		&k.CreatedAt,
+		&k.ExpiresAt,
+	)
+
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if responseCode != nil {
+		k.ResponseCode = *responseCode
+	}
+	return &k, nil
+}
+
+// CompleteIdempotencyKey saves the response so retries can get it back
+func CompleteIdempotencyKey(userID int64, key string, responseCode int, responseBody []byte) error {
+	_, err := database.GetPool().Exec(
+		context.Background(),
+		`UPDATE idempotency_keys
+		SET status = $1, response_code = $2, response_body = $3
+		WHERE user_id = $4 AND idem_key = $5`,
+		IdempotencyStatusCompleted, responseCode, responseBody, userID, key,
+	)
+	return err
+}
+
+// ReleaseIdempotencyKey forgets a key so the request can be tried again
+// we use it when the request failed before anything was saved
+func ReleaseIdempotencyKey(userID int64, key string) error {
+	_, err := database.GetPool().Exec(
+		context.Background(),
+		`DELETE FROM idempotency_keys WHERE user_id = $1 AND idem_key = $2 AND status = $3`,
+		userID, key, IdempotencyStatusInProgress,
+	)
+	return err
+}
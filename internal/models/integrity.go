@@ -0,0 +1,151 @@
+package models
+
+import (
+	"context"
+
+	"github.com/yigit-demirko/go-ledger/internal/database"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// AccountDrift is an account whose stored balance isn't the sum of its postings
+type AccountDrift struct {
+	AccountID      int64          `json:"account_id"`
+	UserID         *int64         `json:"user_id"`
+	Code           *string        `json:"code"`
+	Currency       money.Currency `json:"currency"`
+	Balance        money.Amount   `json:"balance"`         // what the account says
+	JournalBalance money.Amount   `json:"journal_balance"` // what its postings add up to
+	Delta          money.Amount   `json:"delta"`           // balance - journal_balance
+}
+
+// CurrencyTotal is all the money in one currency, both ways of counting it must be zero
+// every posting has an opposite one, and system accounts hold the other side of user money
+type CurrencyTotal struct {
+	Currency     money.Currency `json:"currency"`
+	PostingTotal money.Amount   `json:"posting_total"` // sum of every posting
+	BalanceTotal money.Amount   `json:"balance_total"` // sum of every account balance
+}
+
+// UnbalancedEntry is a journal entry whose postings don't add up to zero in a currency
+type UnbalancedEntry struct {
+	TransactionID int64          `json:"transaction_id"`
+	Currency      money.Currency `json:"currency"`
+	Total         money.Amount   `json:"total"`
+	PostingCount  int64          `json:"posting_count"`
+}
+
+// CountAccounts tells how many accounts there are
+func CountAccounts(q database.Querier) (int64, error) {
+	var count int64
+	err := q.QueryRow(context.Background(), `SELECT COUNT(*) FROM accounts`).Scan(&count)
+	return count, err
+}
+
+// GetAccountDrifts recomputes every account's balance from its postings and
+// returns the accounts that don't match
+func GetAccountDrifts(q database.Querier) ([]AccountDrift, error) {
+	rows, err := q.Query(
+		context.Background(),
+		`SELECT a.id, a.user_id, a.code, a.currency, a.balance, COALESCE(SUM(p.amount), 0)
+		FROM accounts a
+		LEFT JOIN postings p ON p.account_id = a.id
+		GROUP BY a.id
+		HAVING a.balance <> COALESCE(SUM(p.amount), 0)
+		ORDER BY a.id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var drifts []AccountDrift
+	for rows.Next() {
+		var drift AccountDrift
+		err := rows.Scan(&drift.AccountID, &drift.UserID, &drift.Code, &drift.Currency, &drift.Balance, &drift.JournalBalance)
+		if err != nil {
+			return nil, err
+		}
+		drift.Balance = inCurrency(drift.Balance, drift.Currency)
+		drift.JournalBalance = inCurrency(drift.JournalBalance, drift.Currency)
+		drift.Delta = drift.Balance.Sub(drift.JournalBalance)
+		drifts = append(drifts, drift)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return drifts, nil
+}
+
+// GetCurrencyTotals adds up all postings and all balances per currency
+func GetCurrencyTotals(q database.Querier) ([]CurrencyTotal, error) {
+	rows, err := q.Query(
+		context.Background(),
+		`SELECT COALESCE(p.currency, b.currency), COALESCE(p.total, 0), COALESCE(b.total, 0)
+		FROM (SELECT currency, SUM(amount) AS total FROM postings GROUP BY currency) p
+		FULL JOIN (SELECT currency, SUM(balance) AS total FROM accounts GROUP BY currency) b
+		ON b.currency = p.currency
+		ORDER BY 1`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var totals []CurrencyTotal
+	for rows.Next() {
+		var total CurrencyTotal
+		if err := rows.Scan(&total.Currency, &total.PostingTotal, &total.BalanceTotal); err != nil {
+			return nil, err
+		}
+		total.PostingTotal = inCurrency(total.PostingTotal, total.Currency)
+		total.BalanceTotal = inCurrency(total.BalanceTotal, total.Currency)
+		totals = append(totals, total)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return totals, nil
+}
+
+// GetUnbalancedEntries finds posted journal entries that don't add up to zero
+// in a currency or have less than two postings, postgres refuses to commit
+// those so this should always be empty (pending and failed entries have no postings)
+func GetUnbalancedEntries(q database.Querier, limit int) ([]UnbalancedEntry, error) {
+	rows, err := q.Query(
+		context.Background(),
+		`SELECT t.id, COALESCE(p.currency, t.currency), COALESCE(SUM(p.amount), 0), COUNT(p.id)
+		FROM transactions t
+		LEFT JOIN postings p ON p.transaction_id = t.id
+		WHERE t.status IN ('POSTED', 'REVERSED')
+		GROUP BY t.id, COALESCE(p.currency, t.currency)
+		HAVING COALESCE(SUM(p.amount), 0) <> 0
+		OR (SELECT COUNT(*) FROM postings WHERE transaction_id = t.id) < 2
+		ORDER BY t.id
+		LIMIT $1`,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []UnbalancedEntry
+	for rows.Next() {
+		var entry UnbalancedEntry
+		if err := rows.Scan(&entry.TransactionID, &entry.Currency, &entry.Total, &entry.PostingCount); err != nil {
+			return nil, err
+		}
+		entry.Total = inCurrency(entry.Total, entry.Currency)
+		entries = append(entries, entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,173 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/yigit-demirko/go-ledger/internal/database"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// OverdraftLimitChange is one change an admin made to an account's credit line
+type OverdraftLimitChange struct {
+	ID             int64          `json:"id"`
+	AccountID      int64          `json:"account_id"`
+	UserID         int64          `json:"user_id"`
+	Currency       money.Currency `json:"currency"`
+	OldLimit       money.Amount   `json:"old_limit"`
+	NewLimit       money.Amount   `json:"new_limit"`
+	OldInterestBps int64          `json:"old_interest_bps"`
+	NewInterestBps int64          `json:"new_interest_bps"`
+	Reason         string         `json:"reason,omitempty"`
+	ChangedBy      int64          `json:"changed_by"` // the admin who made the change
+	CreatedAt      time.Time      `json:"created_at"`
+}
+
+// the columns of a limit change, in the order scanOverdraftLimitChange expects
+const overdraftLimitChangeColumns = `id, account_id, user_id, currency, old_limit, new_limit,
+	old_interest_bps, new_interest_bps, COALESCE(reason, ''), changed_by, created_at`
+
+func scanOverdraftLimitChange(row pgx.Row) (*OverdraftLimitChange, error) {
+	var change OverdraftLimitChange
+	err := row.Scan(
+		&change.ID,
+		&change.AccountID,
+		&change.UserID,
+		&change.Currency,
+		&change.OldLimit,
+		&change.NewLimit,
+		&change.OldInterestBps,
+		&change.NewInterestBps,
+		&change.Reason,
+		&change.ChangedBy,
+		&change.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	change.OldLimit = inCurrency(change.OldLimit, change.Currency)
+	change.NewLimit = inCurrency(change.NewLimit, change.Currency)
+	return &change, nil
+}
+
+// SetOverdraft changes the credit line of a user account and records the change
+// lock the account first, so the old values in the history are right
+func (a *Account) SetOverdraft(q database.Querier, limit money.Amount, interestBps int64, reason string, changedBy int64) (*OverdraftLimitChange, error) {
+	now := time.Now()
+	change, err := scanOverdraftLimitChange(q.QueryRow(
+		context.Background(),
+		`INSERT INTO overdraft_limit_changes (account_id, user_id, currency, old_limit, new_limit, old_interest_bps, new_interest_bps, reason, changed_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), $9, $10)
+		RETURNING `+overdraftLimitChangeColumns,
+		a.ID, a.UserID, a.Currency, a.OverdraftLimit, limit, a.OverdraftInterestBps, interestBps, reason, changedBy, now,
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	err = q.QueryRow(
+		context.Background(),
+		`UPDATE accounts
+		SET overdraft_limit = $1, overdraft_interest_bps = $2, updated_at = $3
+		WHERE id = $4
+		RETURNING overdraft_limit, overdraft_interest_bps, updated_at`,
+		limit, interestBps, now, a.ID,
+	).Scan(&a.OverdraftLimit, &a.OverdraftInterestBps, &a.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	a.OverdraftLimit = inCurrency(a.OverdraftLimit, a.Currency)
+	return change, nil
+}
+
+// GetOverdraftLimitChanges lists the credit line changes of a user, newest first
+func GetOverdraftLimitChanges(userID int64, limit, offset int) ([]OverdraftLimitChange, error) {
+	rows, err := database.GetPool().Query(
+		context.Background(),
+		`SELECT `+overdraftLimitChangeColumns+`
+		FROM overdraft_limit_changes
+		WHERE user_id = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2 OFFSET $3`,
+		userID, limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []OverdraftLimitChange
+	for rows.Next() {
+		change, err := scanOverdraftLimitChange(rows)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, *change)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+// GetAccountIDsToAccrue finds user accounts below zero that pay interest and
+// weren't charged for day yet
+func GetAccountIDsToAccrue(day time.Time) ([]int64, error) {
+	rows, err := database.GetPool().Query(
+		context.Background(),
+		`SELECT a.id
+		FROM accounts a
+		WHERE a.account_type = $1 AND a.balance < 0 AND a.overdraft_interest_bps > 0
+		AND NOT EXISTS (
+			SELECT 1 FROM overdraft_accruals oa
+			WHERE oa.account_id = a.id AND oa.accrual_date = $2
+		)
+		ORDER BY a.id`,
+		AccountTypeUser, day,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// ClaimOverdraftAccrual marks an account as charged for day
+// it returns false if it already was, so interest is never charged twice
+func ClaimOverdraftAccrual(q database.Querier, accountID int64, day time.Time) (bool, error) {
+	tag, err := q.Exec(
+		context.Background(),
+		`INSERT INTO overdraft_accruals (account_id, accrual_date, created_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (account_id, accrual_date) DO NOTHING`,
+		accountID, day, time.Now(),
+	)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// SetOverdraftAccrualTransaction links a day's charge to the transaction that booked it
+func SetOverdraftAccrualTransaction(q database.Querier, accountID int64, day time.Time, transactionID int64) error {
+	_, err := q.Exec(
+		context.Background(),
+		`UPDATE overdraft_accruals SET transaction_id = $3 WHERE account_id = $1 AND accrual_date = $2`,
+		accountID, day, transactionID,
+	)
+	return err
+}
@@ -0,0 +1,209 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/yigit-demirko/go-ledger/internal/database"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// where a payment request is in its life
+type PaymentRequestStatus string
+
+const (
+	PaymentRequestStatusPending   PaymentRequestStatus = "PENDING"   // waiting for the payer
+	PaymentRequestStatusAccepted  PaymentRequestStatus = "ACCEPTED"  // the payer paid it
+	PaymentRequestStatusDeclined  PaymentRequestStatus = "DECLINED"  // the payer said no, nothing moved
+	PaymentRequestStatusCancelled PaymentRequestStatus = "CANCELLED" // the requester took it back, nothing moved
+	PaymentRequestStatusExpired   PaymentRequestStatus = "EXPIRED"   // nobody answered in time, nothing moved
+)
+
+// which requests a user sees in their list
+type PaymentRequestDirection string
+
+const (
+	PaymentRequestsIncoming PaymentRequestDirection = "incoming" // requests the user is asked to pay
+	PaymentRequestsOutgoing PaymentRequestDirection = "outgoing" // requests the user made
+)
+
+// PaymentRequest is one user asking another for money
+// the requester gets paid and the payer pays once they accept it
+type PaymentRequest struct {
+	ID                 int64                `json:"id"`
+	RequesterID        int64                `json:"requester_id"`
+	RequesterAccountID *int64               `json:"requester_account_id"` // the requester's default account in the currency if null
+	PayerID            int64                `json:"payer_id"`
+	PayerAccountID     *int64               `json:"payer_account_id"` // the account it was paid from, once accepted
+	Amount             money.Amount         `json:"amount"`
+	Currency           money.Currency       `json:"currency"`
+	Note               string               `json:"note,omitempty"`
+	Status             PaymentRequestStatus `json:"status"`
+	DeclineReason      string               `json:"decline_reason,omitempty"`
+	DecidedBy          *int64               `json:"decided_by,omitempty"` // who accepted, declined or cancelled it
+	TransactionID      *int64               `json:"transaction_id"`       // the transfer it made, once accepted
+	ExpiresAt          time.Time            `json:"expires_at"`           // when it expires if nobody answers
+	AcceptedAt         *time.Time           `json:"accepted_at,omitempty"`
+	DeclinedAt         *time.Time           `json:"declined_at,omitempty"`
+	CancelledAt        *time.Time           `json:"cancelled_at,omitempty"`
+	ExpiredAt          *time.Time           `json:"expired_at,omitempty"`
+	CreatedAt          time.Time            `json:"created_at"`
+	UpdatedAt          time.Time            `json:"updated_at"`
+}
+
+// the columns of a payment request, in the order scanPaymentRequest expects
+const paymentRequestColumns = `id, requester_id, requester_account_id, payer_id, payer_account_id, amount, currency,
+	COALESCE(note, ''), status, COALESCE(decline_reason, ''), decided_by, transaction_id, expires_at,
+	accepted_at, declined_at, cancelled_at, expired_at, created_at, updated_at`
+
+func scanPaymentRequest(row pgx.Row) (*PaymentRequest, error) {
+	var request PaymentRequest
+	err := row.Scan(
+		&request.ID,
+		&request.RequesterID,
+		&request.RequesterAccountID,
+		&request.PayerID,
+		&request.PayerAccountID,
+		&request.Amount,
+		&request.Currency,
+		&request.Note,
+		&request.Status,
+		&request.DeclineReason,
+		&request.DecidedBy,
+		&request.TransactionID,
+		&request.ExpiresAt,
+		&request.AcceptedAt,
+		&request.DeclinedAt,
+		&request.CancelledAt,
+		&request.ExpiredAt,
+		&request.CreatedAt,
+		&request.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	request.Amount = inCurrency(request.Amount, request.Currency)
+	return &request, nil
+}
+
+// CreatePaymentRequest saves a new pending payment request
+// it returns ErrUserNotFound if the requester or the payer doesn't exist
+func CreatePaymentRequest(q database.Querier, request PaymentRequest) (*PaymentRequest, error) {
+	now := time.Now()
+	created, err := scanPaymentRequest(q.QueryRow(
+		context.Background(),
+		`INSERT INTO payment_requests (requester_id, requester_account_id, payer_id, amount, currency, note,
+			status, expires_at, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7, $8, $9, $9)
+		RETURNING `+paymentRequestColumns,
+		request.RequesterID, request.RequesterAccountID, request.PayerID, request.Amount, request.Currency, request.Note,
+		PaymentRequestStatusPending, request.ExpiresAt, now,
+	))
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+		return nil, ErrUserNotFound
+	}
+	return created, err
+}
+
+// GetPaymentRequestByID finds a payment request, nil if it doesn't exist
+func GetPaymentRequestByID(id int64) (*PaymentRequest, error) {
+	request, err := scanPaymentRequest(database.GetPool().QueryRow(
+		context.Background(),
+		`SELECT `+paymentRequestColumns+` FROM payment_requests WHERE id = $1`,
+		id,
+	))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	return request, err
+}
+
+// LockPaymentRequestForUpdate finds a payment request and locks it until tx ends, nil if it doesn't exist
+func LockPaymentRequestForUpdate(tx pgx.Tx, id int64) (*PaymentRequest, error) {
+	request, err := scanPaymentRequest(tx.QueryRow(
+		context.Background(),
+		`SELECT `+paymentRequestColumns+` FROM payment_requests WHERE id = $1 FOR UPDATE`,
+		id,
+	))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	return request, err
+}
+
+// GetPaymentRequestsByUserID lists the payment requests of a user, newest first
+// an empty direction lists the ones they made and the ones they are asked to
+// pay, an empty status lists them in every status; pending requests that
+// already expired are left out of the pending ones, even before
+// ExpirePaymentRequests marked them
+func GetPaymentRequestsByUserID(userID int64, direction PaymentRequestDirection, status PaymentRequestStatus, limit, offset int) ([]PaymentRequest, error) {
+	rows, err := database.GetPool().Query(
+		context.Background(),
+		`SELECT `+paymentRequestColumns+`
+		FROM payment_requests
+		WHERE (($2::VARCHAR <> 'outgoing' AND payer_id = $1) OR ($2::VARCHAR <> 'incoming' AND requester_id = $1))
+			AND ($3::VARCHAR = '' OR status = $3::VARCHAR)
+			AND ($3::VARCHAR <> $4::VARCHAR OR expires_at > $5)
+		ORDER BY created_at DESC, id DESC
+		LIMIT $6 OFFSET $7`,
+		userID, string(direction), string(status), string(PaymentRequestStatusPending), time.Now(), limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var requests []PaymentRequest
+	for rows.Next() {
+		request, err := scanPaymentRequest(rows)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, *request)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return requests, nil
+}
+
+// Save writes everything about a payment request that can change after it was made
+// lock it first, so the payer and the requester can't answer it at the same time
+func (r *PaymentRequest) Save(q database.Querier) error {
+	saved, err := scanPaymentRequest(q.QueryRow(
+		context.Background(),
+		`UPDATE payment_requests
+		SET payer_account_id = $2, status = $3, decline_reason = NULLIF($4, ''), decided_by = $5, transaction_id = $6,
+			accepted_at = $7, declined_at = $8, cancelled_at = $9, updated_at = $10
+		WHERE id = $1
+		RETURNING `+paymentRequestColumns,
+		r.ID, r.PayerAccountID, r.Status, r.DeclineReason, r.DecidedBy, r.TransactionID,
+		r.AcceptedAt, r.DeclinedAt, r.CancelledAt, time.Now(),
+	))
+	if err != nil {
+		return err
+	}
+	*r = *saved
+	return nil
+}
+
+// ExpirePaymentRequests marks pending requests nobody answered in time as expired
+// it returns how many it marked
+func ExpirePaymentRequests(now time.Time) (int64, error) {
+	result, err := database.GetPool().Exec(
+		context.Background(),
+		`UPDATE payment_requests SET status = $1, expired_at = $2, updated_at = $2 WHERE status = $3 AND expires_at <= $2`,
+		PaymentRequestStatusExpired, now, PaymentRequestStatusPending,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
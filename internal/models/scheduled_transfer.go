@@ -0,0 +1,218 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/yigit-demirko/go-ledger/internal/database"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// where a scheduled transfer is in its life
+type ScheduledTransferStatus string
+
+const (
+	ScheduledTransferStatusScheduled ScheduledTransferStatus = "SCHEDULED" // waiting for its time, or for another try
+	ScheduledTransferStatusExecuted  ScheduledTransferStatus = "EXECUTED"  // the money moved
+	ScheduledTransferStatusFailed    ScheduledTransferStatus = "FAILED"    // every try failed, FailureReason says why
+	ScheduledTransferStatusCancelled ScheduledTransferStatus = "CANCELLED" // called off before it ran
+)
+
+// ScheduledTransfer is a transfer that runs by itself at ExecuteAt
+type ScheduledTransfer struct {
+	ID              int64                   `json:"id"`
+	FromUserID      int64                   `json:"from_user_id"`
+	FromAccountID   *int64                  `json:"from_account_id"` // the sender's default account in the currency if null
+	ToUserID        int64                   `json:"to_user_id"`
+	ToAccountID     *int64                  `json:"to_account_id"` // the receiver's default account in the currency if null
+	Amount          money.Amount            `json:"amount"`
+	Currency        money.Currency          `json:"currency"`
+	Description     string                  `json:"description,omitempty"`
+	ClientReference string                  `json:"client_reference,omitempty"`
+	Metadata        Metadata                `json:"metadata,omitempty"`
+	ActedBy         *int64                  `json:"acted_by,omitempty"` // the admin or delegate who set it up for the sender
+	CreatedBy       int64                   `json:"created_by"`
+	ExecuteAt       time.Time               `json:"execute_at"`      // when the user wants it to run
+	NextAttemptAt   time.Time               `json:"next_attempt_at"` // when the job tries it next, later than ExecuteAt after a failed try
+	Attempts        int                     `json:"attempts"`
+	Status          ScheduledTransferStatus `json:"status"`
+	FailureReason   string                  `json:"failure_reason,omitempty"` // why the last try failed
+	TransactionID   *int64                  `json:"transaction_id"`           // the transfer it made, once executed
+	ExecutedAt      *time.Time              `json:"executed_at,omitempty"`
+	CreatedAt       time.Time               `json:"created_at"`
+	UpdatedAt       time.Time               `json:"updated_at"`
+}
+
+// the columns of a scheduled transfer, in the order scanScheduledTransfer expects
+const scheduledTransferColumns = `id, from_user_id, from_account_id, to_user_id, to_account_id, amount, currency,
+	COALESCE(description, ''), COALESCE(client_reference, ''), metadata, acted_by, created_by, execute_at,
+	next_attempt_at, attempts, status, COALESCE(failure_reason, ''), transaction_id, executed_at, created_at, updated_at`
+
+func scanScheduledTransfer(row pgx.Row) (*ScheduledTransfer, error) {
+	var transfer ScheduledTransfer
+	err := row.Scan(
+		&transfer.ID,
+		&transfer.FromUserID,
+		&transfer.FromAccountID,
+		&transfer.ToUserID,
+		&transfer.ToAccountID,
+		&transfer.Amount,
+		&transfer.Currency,
+		&transfer.Description,
+		&transfer.ClientReference,
+		&transfer.Metadata,
+		&transfer.ActedBy,
+		&transfer.CreatedBy,
+		&transfer.ExecuteAt,
+		&transfer.NextAttemptAt,
+		&transfer.Attempts,
+		&transfer.Status,
+		&transfer.FailureReason,
+		&transfer.TransactionID,
+		&transfer.ExecutedAt,
+		&transfer.CreatedAt,
+		&transfer.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	transfer.Amount = inCurrency(transfer.Amount, transfer.Currency)
+	return &transfer, nil
+}
+
+// CreateScheduledTransfer saves a new transfer to run at its ExecuteAt
+// it returns ErrUserNotFound if the sender or the receiver doesn't exist
+func CreateScheduledTransfer(q database.Querier, transfer ScheduledTransfer) (*ScheduledTransfer, error) {
+	metadata := transfer.Metadata
+	if metadata == nil {
+		metadata = Metadata{}
+	}
+
+	now := time.Now()
+	created, err := scanScheduledTransfer(q.QueryRow(
+		context.Background(),
+		`INSERT INTO scheduled_transfers (from_user_id, from_account_id, to_user_id, to_account_id, amount, currency,
+			description, client_reference, metadata, acted_by, created_by, execute_at, next_attempt_at, status, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), NULLIF($8, ''), $9, $10, $11, $12, $12, $13, $14, $14)
+		RETURNING `+scheduledTransferColumns,
+		transfer.FromUserID, transfer.FromAccountID, transfer.ToUserID, transfer.ToAccountID, transfer.Amount, transfer.Currency,
+		transfer.Description, transfer.ClientReference, metadata, transfer.ActedBy, transfer.CreatedBy, transfer.ExecuteAt,
+		ScheduledTransferStatusScheduled, now,
+	))
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+		return nil, ErrUserNotFound
+	}
+	return created, err
+}
+
+// GetScheduledTransferByID finds a scheduled transfer, nil if it doesn't exist
+func GetScheduledTransferByID(id int64) (*ScheduledTransfer, error) {
+	transfer, err := scanScheduledTransfer(database.GetPool().QueryRow(
+		context.Background(),
+		`SELECT `+scheduledTransferColumns+` FROM scheduled_transfers WHERE id = $1`,
+		id,
+	))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	return transfer, err
+}
+
+// LockScheduledTransferForUpdate finds a scheduled transfer and locks it until tx ends, nil if it doesn't exist
+func LockScheduledTransferForUpdate(tx pgx.Tx, id int64) (*ScheduledTransfer, error) {
+	transfer, err := scanScheduledTransfer(tx.QueryRow(
+		context.Background(),
+		`SELECT `+scheduledTransferColumns+` FROM scheduled_transfers WHERE id = $1 FOR UPDATE`,
+		id,
+	))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	return transfer, err
+}
+
+// LockNextDueScheduledTransfer finds the transfer that has waited longest to
+// run and locks it, nil if none is due
+// transfers another transaction already locked are skipped, so several
+// servers can run due transfers at the same time and each one runs only once
+func LockNextDueScheduledTransfer(tx pgx.Tx, now time.Time) (*ScheduledTransfer, error) {
+	transfer, err := scanScheduledTransfer(tx.QueryRow(
+		context.Background(),
+		`SELECT `+scheduledTransferColumns+`
+		FROM scheduled_transfers
+		WHERE status = $1 AND next_attempt_at <= $2
+		ORDER BY next_attempt_at, id
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED`,
+		ScheduledTransferStatusScheduled, now,
+	))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	return transfer, err
+}
+
+// GetScheduledTransfersByUserID lists the scheduled transfers paid from a user's money, soonest first
+// an empty status lists them in every status
+func GetScheduledTransfersByUserID(userID int64, status ScheduledTransferStatus, limit, offset int) ([]ScheduledTransfer, error) {
+	rows, err := database.GetPool().Query(
+		context.Background(),
+		`SELECT `+scheduledTransferColumns+`
+		FROM scheduled_transfers
+		WHERE from_user_id = $1 AND ($2 = '' OR status = $2)
+		ORDER BY execute_at, id
+		LIMIT $3 OFFSET $4`,
+		userID, string(status), limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var transfers []ScheduledTransfer
+	for rows.Next() {
+		transfer, err := scanScheduledTransfer(rows)
+		if err != nil {
+			return nil, err
+		}
+		transfers = append(transfers, *transfer)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return transfers, nil
+}
+
+// Save writes everything about a scheduled transfer that can change after it was made
+// lock it first, so two changes can't overwrite each other
+func (s *ScheduledTransfer) Save(q database.Querier) error {
+	metadata := s.Metadata
+	if metadata == nil {
+		metadata = Metadata{}
+	}
+
+	saved, err := scanScheduledTransfer(q.QueryRow(
+		context.Background(),
+		`UPDATE scheduled_transfers
+		SET amount = $2, description = NULLIF($3, ''), client_reference = NULLIF($4, ''), metadata = $5,
+			execute_at = $6, next_attempt_at = $7, attempts = $8, status = $9, failure_reason = NULLIF($10, ''),
+			transaction_id = $11, executed_at = $12, updated_at = $13
+		WHERE id = $1
+		RETURNING `+scheduledTransferColumns,
+		s.ID, s.Amount, s.Description, s.ClientReference, metadata,
+		s.ExecuteAt, s.NextAttemptAt, s.Attempts, s.Status, s.FailureReason,
+		s.TransactionID, s.ExecutedAt, time.Now(),
+	))
+	if err != nil {
+		return err
+	}
+	*s = *saved
+	return nil
+}
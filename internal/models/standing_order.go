@@ -0,0 +1,339 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/yigit-demirko/go-ledger/internal/database"
+	"github.com/yigit-demirko/go-ledger/internal/money"
+)
+
+// how often a standing order runs
+type Frequency string
+
+const (
+	FrequencyDaily   Frequency = "DAILY"   // every Interval days from StartAt
+	FrequencyWeekly  Frequency = "WEEKLY"  // every Interval weeks from StartAt
+	FrequencyMonthly Frequency = "MONTHLY" // every Interval months on StartAt's day, or the last day of shorter months
+	FrequencyCron    Frequency = "CRON"    // whenever Cron matches, in UTC
+)
+
+// Valid checks that f is one of the frequencies we know
+func (f Frequency) Valid() bool {
+	switch f {
+	case FrequencyDaily, FrequencyWeekly, FrequencyMonthly, FrequencyCron:
+		return true
+	}
+	return false
+}
+
+// what a standing order does when a run can't be paid, like when the balance is too low
+type FailurePolicy string
+
+const (
+	FailurePolicySkip  FailurePolicy = "SKIP"  // give up on this run and wait for the next one
+	FailurePolicyRetry FailurePolicy = "RETRY" // try the run again later, skip it if that doesn't work either
+)
+
+// Valid checks that p is one of the policies we know
+func (p FailurePolicy) Valid() bool {
+	return p == FailurePolicySkip || p == FailurePolicyRetry
+}
+
+// where a standing order is in its life
+type StandingOrderStatus string
+
+const (
+	StandingOrderStatusActive    StandingOrderStatus = "ACTIVE"    // runs when it is due
+	StandingOrderStatusPaused    StandingOrderStatus = "PAUSED"    // doesn't run until it is resumed
+	StandingOrderStatusCompleted StandingOrderStatus = "COMPLETED" // reached its end date or number of runs
+	StandingOrderStatusCancelled StandingOrderStatus = "CANCELLED" // called off
+	StandingOrderStatusFailed    StandingOrderStatus = "FAILED"    // stopped because it can never run again, FailureReason says why
+)
+
+// how one try of a standing order went
+type StandingOrderRunStatus string
+
+const (
+	StandingOrderRunExecuted StandingOrderRunStatus = "EXECUTED" // the money moved
+	StandingOrderRunRetrying StandingOrderRunStatus = "RETRYING" // it failed and will be tried again
+	StandingOrderRunSkipped  StandingOrderRunStatus = "SKIPPED"  // it failed and the order moved on to its next run
+	StandingOrderRunFailed   StandingOrderRunStatus = "FAILED"   // it failed and stopped the whole order
+)
+
+// StandingOrder sends the same transfer again and again, like rent on the 1st of every month
+type StandingOrder struct {
+	ID                  int64               `json:"id"`
+	FromUserID          int64               `json:"from_user_id"`
+	FromAccountID       *int64              `json:"from_account_id"` // the sender's default account in the currency if null
+	ToUserID            int64               `json:"to_user_id"`
+	ToAccountID         *int64              `json:"to_account_id"` // the receiver's default account in the currency if null
+	Amount              money.Amount        `json:"amount"`
+	Currency            money.Currency      `json:"currency"`
+	Description         string              `json:"description,omitempty"`
+	ClientReference     string              `json:"client_reference,omitempty"`
+	Metadata            Metadata            `json:"metadata,omitempty"`
+	ActedBy             *int64              `json:"acted_by,omitempty"` // the admin or delegate who set it up for the sender
+	CreatedBy           int64               `json:"created_by"`
+	Frequency           Frequency           `json:"frequency"`
+	Interval            int                 `json:"interval"`       // runs every Interval days, weeks or months, 1 for CRON
+	Cron                string              `json:"cron,omitempty"` // only for CRON
+	StartAt             time.Time           `json:"start_at"`
+	EndAt               *time.Time          `json:"end_at"`          // no runs after this, if set
+	MaxOccurrences      *int                `json:"max_occurrences"` // no more runs than this, if set
+	OnInsufficientFunds FailurePolicy       `json:"on_insufficient_funds"`
+	Status              StandingOrderStatus `json:"status"`
+	Occurrences         int                 `json:"occurrences"`     // how many runs are behind it, paid or skipped
+	NextRunAt           *time.Time          `json:"next_run_at"`     // when the next run is due, null once it ended
+	NextAttemptAt       *time.Time          `json:"next_attempt_at"` // when the job tries it next, later than NextRunAt after a failed try
+	Attempts            int                 `json:"attempts"`        // tries of the next run so far
+	FailureReason       string              `json:"failure_reason,omitempty"`
+	CreatedAt           time.Time           `json:"created_at"`
+	UpdatedAt           time.Time           `json:"updated_at"`
+}
+
+// StandingOrderRun is one try to pay one run of a standing order
+type StandingOrderRun struct {
+	ID              int64                  `json:"id"`
+	StandingOrderID int64                  `json:"standing_order_id"`
+	Occurrence      int                    `json:"occurrence"` // which run of the order, counting from 1
+	ScheduledFor    time.Time              `json:"scheduled_for"`
+	Attempt         int                    `json:"attempt"`
+	Status          StandingOrderRunStatus `json:"status"`
+	TransactionID   *int64                 `json:"transaction_id"` // the transfer it made, when it was paid
+	FailureReason   string                 `json:"failure_reason,omitempty"`
+	CreatedAt       time.Time              `json:"created_at"`
+}
+
+// the columns of a standing order, in the order scanStandingOrder expects
+const standingOrderColumns = `id, from_user_id, from_account_id, to_user_id, to_account_id, amount, currency,
+	COALESCE(description, ''), COALESCE(client_reference, ''), metadata, acted_by, created_by, frequency,
+	interval_count, COALESCE(cron, ''), start_at, end_at, max_occurrences, on_insufficient_funds, status,
+	occurrences, next_run_at, next_attempt_at, attempts, COALESCE(failure_reason, ''), created_at, updated_at`
+
+func scanStandingOrder(row pgx.Row) (*StandingOrder, error) {
+	var order StandingOrder
+	err := row.Scan(
+		&order.ID,
+		&order.FromUserID,
+		&order.FromAccountID,
+		&order.ToUserID,
+		&order.ToAccountID,
+		&order.Amount,
+		&order.Currency,
+		&order.Description,
+		&order.ClientReference,
+		&order.Metadata,
+		&order.ActedBy,
+		&order.CreatedBy,
+		&order.Frequency,
+		&order.Interval,
+		&order.Cron,
+		&order.StartAt,
+		&order.EndAt,
+		&order.MaxOccurrences,
+		&order.OnInsufficientFunds,
+		&order.Status,
+		&order.Occurrences,
+		&order.NextRunAt,
+		&order.NextAttemptAt,
+		&order.Attempts,
+		&order.FailureReason,
+		&order.CreatedAt,
+		&order.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	order.Amount = inCurrency(order.Amount, order.Currency)
+	return &order, nil
+}
+
+// CreateStandingOrder saves a new standing order, its first run is at NextRunAt
+// it returns ErrUserNotFound if the sender or the receiver doesn't exist
+func CreateStandingOrder(q database.Querier, order StandingOrder) (*StandingOrder, error) {
+	metadata := order.Metadata
+	if metadata == nil {
+		metadata = Metadata{}
+	}
+
+	now := time.Now()
+	created, err := scanStandingOrder(q.QueryRow(
+		context.Background(),
+		`INSERT INTO standing_orders (from_user_id, from_account_id, to_user_id, to_account_id, amount, currency,
+			description, client_reference, metadata, acted_by, created_by, frequency, interval_count, cron,
+			start_at, end_at, max_occurrences, on_insufficient_funds, status, next_run_at, next_attempt_at, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), NULLIF($8, ''), $9, $10, $11, $12, $13, NULLIF($14, ''),
+			$15, $16, $17, $18, $19, $20, $20, $21, $21)
+		RETURNING `+standingOrderColumns,
+		order.FromUserID, order.FromAccountID, order.ToUserID, order.ToAccountID, order.Amount, order.Currency,
+		order.Description, order.ClientReference, metadata, order.ActedBy, order.CreatedBy, order.Frequency, order.Interval, order.Cron,
+		order.StartAt, order.EndAt, order.MaxOccurrences, order.OnInsufficientFunds, StandingOrderStatusActive, order.NextRunAt, now,
+	))
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+		return nil, ErrUserNotFound
+	}
+	return created, err
+}
+
+// GetStandingOrderByID finds a standing order, nil if it doesn't exist
+func GetStandingOrderByID(id int64) (*StandingOrder, error) {
+	order, err := scanStandingOrder(database.GetPool().QueryRow(
+		context.Background(),
+		`SELECT `+standingOrderColumns+` FROM standing_orders WHERE id = $1`,
+		id,
+	))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	return order, err
+}
+
+// LockStandingOrderForUpdate finds a standing order and locks it until tx ends, nil if it doesn't exist
+func LockStandingOrderForUpdate(tx pgx.Tx, id int64) (*StandingOrder, error) {
+	order, err := scanStandingOrder(tx.QueryRow(
+		context.Background(),
+		`SELECT `+standingOrderColumns+` FROM standing_orders WHERE id = $1 FOR UPDATE`,
+		id,
+	))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	return order, err
+}
+
+// LockNextDueStandingOrder finds the active standing order that has waited
+// longest to run and locks it, nil if none is due
+// orders another transaction already locked are skipped, like with scheduled transfers
+func LockNextDueStandingOrder(tx pgx.Tx, now time.Time) (*StandingOrder, error) {
+	order, err := scanStandingOrder(tx.QueryRow(
+		context.Background(),
+		`SELECT `+standingOrderColumns+`
+		FROM standing_orders
+		WHERE status = $1 AND next_attempt_at <= $2
+		ORDER BY next_attempt_at, id
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED`,
+		StandingOrderStatusActive, now,
+	))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	return order, err
+}
+
+// GetStandingOrdersByUserID lists the standing orders paid from a user's money, newest first
+// an empty status lists them in every status
+func GetStandingOrdersByUserID(userID int64, status StandingOrderStatus, limit, offset int) ([]StandingOrder, error) {
+	rows, err := database.GetPool().Query(
+		context.Background(),
+		`SELECT `+standingOrderColumns+`
+		FROM standing_orders
+		WHERE from_user_id = $1 AND ($2::VARCHAR = '' OR status = $2::VARCHAR)
+		ORDER BY created_at DESC, id DESC
+		LIMIT $3 OFFSET $4`,
+		userID, string(status), limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orders []StandingOrder
+	for rows.Next() {
+		order, err := scanStandingOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, *order)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return orders, nil
+}
+
+// Save writes everything about a standing order that can change after it was made
+// lock it first, so two changes can't overwrite each other
+func (o *StandingOrder) Save(q database.Querier) error {
+	saved, err := scanStandingOrder(q.QueryRow(
+		context.Background(),
+		`UPDATE standing_orders
+		SET status = $2, occurrences = $3, next_run_at = $4, next_attempt_at = $5, attempts = $6,
+			failure_reason = NULLIF($7, ''), updated_at = $8
+		WHERE id = $1
+		RETURNING `+standingOrderColumns,
+		o.ID, o.Status, o.Occurrences, o.NextRunAt, o.NextAttemptAt, o.Attempts, o.FailureReason, time.Now(),
+	))
+	if err != nil {
+		return err
+	}
+	*o = *saved
+	return nil
+}
+
+// CreateStandingOrderRun writes down how one try of a standing order went
+func CreateStandingOrderRun(q database.Querier, run StandingOrderRun) (*StandingOrderRun, error) {
+	err := q.QueryRow(
+		context.Background(),
+		`INSERT INTO standing_order_runs (standing_order_id, occurrence, scheduled_for, attempt, status, transaction_id, failure_reason, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), $8)
+		RETURNING id, created_at`,
+		run.StandingOrderID, run.Occurrence, run.ScheduledFor, run.Attempt, run.Status, run.TransactionID, run.FailureReason, time.Now(),
+	).Scan(&run.ID, &run.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+// GetStandingOrderRuns lists every try of a standing order, newest first
+func GetStandingOrderRuns(orderID int64, limit, offset int) ([]StandingOrderRun, error) {
+	rows, err := database.GetPool().Query(
+		context.Background(),
+		`SELECT id, standing_order_id, occurrence, scheduled_for, attempt, status, transaction_id,
+			COALESCE(failure_reason, ''), created_at
+		FROM standing_order_runs
+		WHERE standing_order_id = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2 OFFSET $3`,
+		orderID, limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []StandingOrderRun
+	for rows.Next() {
+		var run StandingOrderRun
+		err := rows.Scan(
+			&run.ID,
+			&run.StandingOrderID,
+			&run.Occurrence,
+			&run.ScheduledFor,
+			&run.Attempt,
+			&run.Status,
+			&run.TransactionID,
+			&run.FailureReason,
+			&run.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return runs, nil
+}
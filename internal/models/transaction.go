@@ -2,165 +2,552 @@ package models
 
 import (
 	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/yigit-demirko/go-ledger/internal/database"
+	"github.com/yigit-demirko/go-ledger/internal/money"
 )
 
 // what kind of money movements we track
 type TransactionType string
 
 const (
-	TransactionTypeTransfer TransactionType = "TRANSFER" // when users send money to each other
-	TransactionTypeDeposit TransactionType = "DEPOSIT"  // when money comes in
-	TransactionTypeWithdraw TransactionType = "WITHDRAW" // when money goes out
+	TransactionTypeTransfer      TransactionType = "TRANSFER"       // when users send money to each other
+	TransactionTypeDeposit       TransactionType = "DEPOSIT"        // when money comes in (from the cash-in account)
+	TransactionTypeWithdraw      TransactionType = "WITHDRAW"       // when money goes out (to the cash-out account)
+	TransactionTypeAdjustment    TransactionType = "ADJUSTMENT"     // corrections booked against equity
+	TransactionTypeConversion    TransactionType = "CONVERSION"     // money sent in one currency and received in another
+	TransactionTypeReversal      TransactionType = "REVERSAL"       // gives back all or part of an earlier transaction
+	TransactionTypeInterest      TransactionType = "INTEREST"       // daily interest charged on a negative balance
+	TransactionTypeMove          TransactionType = "MOVE"           // money moved between two accounts of the same user
+	TransactionTypeSplit         TransactionType = "SPLIT"          // one payment split between several senders or receivers
+	TransactionTypeEscrowFund    TransactionType = "ESCROW_FUND"    // a buyer's money put in escrow
+	TransactionTypeEscrowRelease TransactionType = "ESCROW_RELEASE" // money in escrow paid to the seller
+	TransactionTypeEscrowRefund  TransactionType = "ESCROW_REFUND"  // money in escrow given back to the buyer
 )
 
-// Transaction keeps track of money movements
+// where a transaction is in its life
+type TransactionStatus string
+
+const (
+	TransactionStatusPending  TransactionStatus = "PENDING"  // money in flight, not in the balances yet
+	TransactionStatusPosted   TransactionStatus = "POSTED"   // the money moved
+	TransactionStatusFailed   TransactionStatus = "FAILED"   // it never happened, nothing moved
+	TransactionStatusReversed TransactionStatus = "REVERSED" // it moved, then all of it was given back
+)
+
+// which statuses a transaction can go to from each status, the others are final
+var transactionTransitions = map[TransactionStatus][]TransactionStatus{
+	TransactionStatusPending: {TransactionStatusPosted, TransactionStatusFailed},
+	TransactionStatusPosted:  {TransactionStatusReversed},
+}
+
+// CanBecome tells if a transaction in status s is allowed to go to next
+func (s TransactionStatus) CanBecome(next TransactionStatus) bool {
+	for _, allowed := range transactionTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// Transaction is one journal entry, the money it moved is in its postings
+// FromUserID and ToUserID are only a summary for simple two-party entries
 type Transaction struct {
-	ID              int64           `json:"id"`
-	FromUserID      *int64          `json:"from_user_id"`      // who sent the money (can be null for deposits)
-	ToUserID        *int64          `json:"to_user_id"`        // who got the money (can be null for withdrawals)
-	Amount          float64         `json:"amount"`            // how much money moved
-	TransactionType TransactionType `json:"transaction_type"`  // what kind of movement it was
-	CreatedAt       time.Time       `json:"created_at"`        // when it happened
+	ID                    int64             `json:"id"`
+	FromUserID            *int64            `json:"from_user_id"`                      // who sent the money (can be null for deposits)
+	ToUserID              *int64            `json:"to_user_id"`                        // who got the money (can be null for withdrawals)
+	Amount                money.Amount      `json:"amount"`                            // how much money moved
+	Currency              money.Currency    `json:"currency"`                          // which currency the amount is in
+	TransactionType       TransactionType   `json:"transaction_type"`                  // what kind of movement it was
+	Status                TransactionStatus `json:"status"`                            // POSTED unless the money is still in flight or never moved
+	Description           string            `json:"description,omitempty"`             // free text about the movement
+	ExternalReference     string            `json:"external_reference,omitempty"`      // id of the payment in the system it came from or went to
+	SourceSystem          string            `json:"source_system,omitempty"`           // which outside system that was, like a bank or card processor
+	ClientReference       string            `json:"client_reference,omitempty"`        // the client's own id for the movement, like an order id
+	Metadata              Metadata          `json:"metadata,omitempty"`                // anything else the client wants to keep with it
+	ActedBy               *int64            `json:"acted_by,omitempty"`                // who sent it for the owner of the money, an admin or delegate
+	ReversesTransactionID *int64            `json:"reverses_transaction_id,omitempty"` // for reversals, the transaction they give back
+	ReversalIDs           []int64           `json:"reversal_ids,omitempty"`            // the reversals of this transaction, oldest first
+	Postings              []Posting         `json:"postings,omitempty"`                // the debits and credits of the entry
+	PendingPostings       []Posting         `json:"pending_postings,omitempty"`        // what a pending (or failed) entry would write
+	FailureReason         string            `json:"failure_reason,omitempty"`          // why a failed transaction didn't happen
+	CreatedAt             time.Time         `json:"created_at"`                        // when it happened, or started to
+	PostedAt              *time.Time        `json:"posted_at,omitempty"`
+	FailedAt              *time.Time        `json:"failed_at,omitempty"`
+	ReversedAt            *time.Time        `json:"reversed_at,omitempty"`
 }
 
-// CreateTransaction saves a new money movement in the database
-func CreateTransaction(fromUserID, toUserID *int64, amount float64, transactionType TransactionType) (*Transaction, error) {
+// Metadata is a JSON object a client saves with a transaction, we don't look inside
+type Metadata map[string]any
+
+// Posting is one line of a journal entry
+// a negative amount takes money out of the account (debit), a positive one
+// puts money in (credit), and the postings of an entry always add up to zero
+type Posting struct {
+	ID            int64          `json:"id"`
+	TransactionID int64          `json:"transaction_id"`
+	AccountID     int64          `json:"account_id"`
+	Amount        money.Amount   `json:"amount"`
+	Currency      money.Currency `json:"currency"` // always the currency of the account
+	CreatedAt     time.Time      `json:"created_at"`
+}
+
+// the columns we read for a transaction, in the order scanTransaction expects
+const transactionColumns = `t.id, t.from_user_id, t.to_user_id, t.amount, t.currency, t.transaction_type,
+	COALESCE(t.description, ''), COALESCE(t.external_reference, ''), COALESCE(t.source_system, ''),
+	COALESCE(t.client_reference, ''), t.metadata, t.acted_by, t.reverses_transaction_id, t.status, COALESCE(t.failure_reason, ''),
+	t.created_at, t.posted_at, t.failed_at, t.reversed_at`
+
+func scanTransaction(row pgx.Row) (*Transaction, error) {
 	var transaction Transaction
-	err := database.GetPool().QueryRow(
-		context.Background(),
-		`INSERT INTO transactions (from_user_id, to_user_id, amount, transaction_type, created_at)
-		VALUES ($1, $2, $3, $4, $5)
-		RETURNING id, from_user_id, to_user_id, amount, transaction_type, created_at`,
-		fromUserID, toUserID, amount, transactionType, time.Now(),
-	).Scan(
+	err := row.Scan(
 		&transaction.ID,
 		&transaction.FromUserID,
 		&transaction.ToUserID,
 		&transaction.Amount,
+		&transaction.Currency,
 		&transaction.TransactionType,
+		&transaction.Description,
+		&transaction.ExternalReference,
+		&transaction.SourceSystem,
+		&transaction.ClientReference,
+		&transaction.Metadata,
+		&transaction.ActedBy,
+		&transaction.ReversesTransactionID,
+		&transaction.Status,
+		&transaction.FailureReason,
 		&transaction.CreatedAt,
+		&transaction.PostedAt,
+		&transaction.FailedAt,
+		&transaction.ReversedAt,
 	)
-
 	if err != nil {
 		return nil, err
 	}
-
+	transaction.Amount = inCurrency(transaction.Amount, transaction.Currency)
 	return &transaction, nil
 }
 
-// GetTransactionsByUserID finds all money movements for a user
-func GetTransactionsByUserID(userID int64, limit, offset int) ([]Transaction, error) {
-	rows, err := database.GetPool().Query(
+// CreateTransaction saves the header of a new journal entry, ID and CreatedAt are filled in
+// pass the same transaction that writes the postings, so both are saved together
+// it is POSTED unless Status says PENDING
+// the same external reference can only be booked once per source system, unless it failed
+func CreateTransaction(q database.Querier, transaction Transaction) (*Transaction, error) {
+	metadata := transaction.Metadata
+	if metadata == nil {
+		metadata = Metadata{}
+	}
+	status := transaction.Status
+	if status == "" {
+		status = TransactionStatusPosted
+	}
+	if status != TransactionStatusPosted && status != TransactionStatusPending {
+		return nil, ErrInvalidTransition
+	}
+
+	created, err := scanTransaction(q.QueryRow(
+		context.Background(),
+		`INSERT INTO transactions AS t (from_user_id, to_user_id, amount, currency, transaction_type, description,
+			external_reference, source_system, client_reference, metadata, acted_by, reverses_transaction_id, status, created_at, posted_at)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''), NULLIF($8, ''), NULLIF($9, ''), $10, $11, $12, $13, $14,
+			CASE WHEN $13::VARCHAR = 'POSTED' THEN $14::TIMESTAMP END)
+		RETURNING `+transactionColumns,
+		transaction.FromUserID, transaction.ToUserID, transaction.Amount, transaction.Currency, transaction.TransactionType,
+		transaction.Description, transaction.ExternalReference, transaction.SourceSystem, transaction.ClientReference,
+		metadata, transaction.ActedBy, transaction.ReversesTransactionID, status, time.Now(),
+	))
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == "idx_transactions_external_reference_live" {
+		return nil, ErrDuplicateReference
+	}
+	return created, err
+}
+
+// CreatePosting adds one line to a journal entry
+func CreatePosting(q database.Querier, transactionID, accountID int64, amount money.Amount, currency money.Currency, createdAt time.Time) (*Posting, error) {
+	return scanPosting(q.QueryRow(
+		context.Background(),
+		`INSERT INTO postings (transaction_id, account_id, amount, currency, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING `+postingColumns,
+		transactionID, accountID, amount, currency, createdAt,
+	))
+}
+
+// SetStatus moves the transaction to a new status and records when that happened
+// only the moves transactionTransitions allows are made, reason is saved for failures
+// it fails with ErrInvalidTransition if someone else changed the status first
+func (t *Transaction) SetStatus(q database.Querier, status TransactionStatus, reason string) error {
+	if !t.Status.CanBecome(status) {
+		return ErrInvalidTransition
+	}
+
+	err := q.QueryRow(
+		context.Background(),
+		`UPDATE transactions
+		SET status = $1::VARCHAR,
+			posted_at = CASE WHEN $1::VARCHAR = 'POSTED' THEN $2::TIMESTAMP ELSE posted_at END,
+			failed_at = CASE WHEN $1::VARCHAR = 'FAILED' THEN $2::TIMESTAMP ELSE failed_at END,
+			reversed_at = CASE WHEN $1::VARCHAR = 'REVERSED' THEN $2::TIMESTAMP ELSE reversed_at END,
+			failure_reason = CASE WHEN $1::VARCHAR = 'FAILED' THEN NULLIF($3, '') ELSE failure_reason END
+		WHERE id = $4 AND status = $5
+		RETURNING status, COALESCE(failure_reason, ''), posted_at, failed_at, reversed_at`,
+		status, time.Now(), reason, t.ID, t.Status,
+	).Scan(&t.Status, &t.FailureReason, &t.PostedAt, &t.FailedAt, &t.ReversedAt)
+
+	if err == pgx.ErrNoRows {
+		return ErrInvalidTransition
+	}
+	return err
+}
+
+// CreatePendingPosting saves a line a pending journal entry will write once it is posted
+func CreatePendingPosting(q database.Querier, transactionID, accountID int64, amount money.Amount, currency money.Currency, createdAt time.Time) (*Posting, error) {
+	return scanPosting(q.QueryRow(
 		context.Background(),
-		`SELECT id, from_user_id, to_user_id, amount, transaction_type, created_at
-		FROM transactions 
-		WHERE from_user_id = $1 OR to_user_id = $1
-		ORDER BY created_at DESC
-		LIMIT $2 OFFSET $3`,
-		userID, limit, offset,
+		`INSERT INTO pending_postings (transaction_id, account_id, amount, currency, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING `+postingColumns,
+		transactionID, accountID, amount, currency, createdAt,
+	))
+}
+
+// DeletePendingPostings removes the pending lines of an entry once they became real postings
+func DeletePendingPostings(q database.Querier, transactionID int64) error {
+	_, err := q.Exec(context.Background(), `DELETE FROM pending_postings WHERE transaction_id = $1`, transactionID)
+	return err
+}
+
+// the columns we read for a posting, in the order scanPosting expects
+const postingColumns = `id, transaction_id, account_id, amount, currency, created_at`
+
+func scanPosting(row pgx.Row) (*Posting, error) {
+	var posting Posting
+	err := row.Scan(
+		&posting.ID,
+		&posting.TransactionID,
+		&posting.AccountID,
+		&posting.Amount,
+		&posting.Currency,
+		&posting.CreatedAt,
 	)
 	if err != nil {
 		return nil, err
 	}
+	posting.Amount = inCurrency(posting.Amount, posting.Currency)
+	return &posting, nil
+}
+
+// TransactionFilter narrows down a user's history, empty fields don't filter anything
+type TransactionFilter struct {
+	StartTime       *time.Time
+	EndTime         *time.Time
+	Status          TransactionStatus
+	ClientReference string
+	AccountID       *int64 // only what moved money on this account of the user
+	// every key must have this value in the metadata, numbers and booleans
+	// match how they are written in JSON, like "42" or "true"
+	Metadata map[string]string
+}
+
+// GetTransactionsByUserID finds the money movements of a user that match filter, newest first
+func GetTransactionsByUserID(userID int64, filter TransactionFilter, limit, offset int) ([]Transaction, error) {
+	var args []any
+	arg := func(value any) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	// pending and failed transactions only have pending postings
+	owner := "a.user_id = " + arg(userID)
+	if filter.AccountID != nil {
+		owner += " AND a.id = " + arg(*filter.AccountID)
+	}
+	conditions := []string{`(EXISTS (
+		SELECT 1 FROM postings p JOIN accounts a ON a.id = p.account_id
+		WHERE p.transaction_id = t.id AND ` + owner + `
+	) OR EXISTS (
+		SELECT 1 FROM pending_postings p JOIN accounts a ON a.id = p.account_id
+		WHERE p.transaction_id = t.id AND ` + owner + `
+	))`}
+	if filter.StartTime != nil {
+		conditions = append(conditions, "t.created_at >= "+arg(*filter.StartTime))
+	}
+	if filter.EndTime != nil {
+		conditions = append(conditions, "t.created_at <= "+arg(*filter.EndTime))
+	}
+	if filter.Status != "" {
+		conditions = append(conditions, "t.status = "+arg(filter.Status))
+	}
+	if filter.ClientReference != "" {
+		conditions = append(conditions, "t.client_reference = "+arg(filter.ClientReference))
+	}
+
+	// sorted so the same filter always makes the same query
+	keys := make([]string, 0, len(filter.Metadata))
+	for key := range filter.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		conditions = append(conditions, "t.metadata ->> "+arg(key)+" = "+arg(filter.Metadata[key]))
+	}
+
+	sql := `SELECT ` + transactionColumns + `
+		FROM transactions t
+		WHERE ` + strings.Join(conditions, " AND ") + `
+		ORDER BY t.created_at DESC
+		LIMIT ` + arg(limit) + ` OFFSET ` + arg(offset)
+	return queryTransactions(sql, args...)
+}
+
+// queryTransactions runs a query that returns transactions and adds their postings
+func queryTransactions(sql string, args ...any) ([]Transaction, error) {
+	rows, err := database.GetPool().Query(context.Background(), sql, args...)
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
 
 	var transactions []Transaction
 	for rows.Next() {
-		var transaction Transaction
-		err := rows.Scan(
-			&transaction.ID,
-			&transaction.FromUserID,
-			&transaction.ToUserID,
-			&transaction.Amount,
-			&transaction.TransactionType,
-			&transaction.CreatedAt,
-		)
+		transaction, err := scanTransaction(rows)
 		if err != nil {
 			return nil, err
 		}
-		transactions = append(transactions, transaction)
+		transactions = append(transactions, *transaction)
 	}
 
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
 
+	if err := attachPostings(database.GetPool(), transactions); err != nil {
+		return nil, err
+	}
+	if err := attachReversals(database.GetPool(), transactions); err != nil {
+		return nil, err
+	}
+
 	return transactions, nil
 }
 
-// GetUserTransactionsInTimeRange finds money movements between two dates
-func GetUserTransactionsInTimeRange(userID int64, startTime, endTime time.Time, limit, offset int) ([]Transaction, error) {
-	rows, err := database.GetPool().Query(
+// attachPostings loads the postings (and pending postings) of all given transactions
+func attachPostings(q database.Querier, transactions []Transaction) error {
+	if len(transactions) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, len(transactions))
+	byID := make(map[int64]*Transaction, len(transactions))
+	for i := range transactions {
+		ids[i] = transactions[i].ID
+		byID[transactions[i].ID] = &transactions[i]
+	}
+
+	rows, err := q.Query(
 		context.Background(),
-		`SELECT id, from_user_id, to_user_id, amount, transaction_type, created_at
-		FROM transactions 
-		WHERE (from_user_id = $1 OR to_user_id = $1)
-		AND created_at BETWEEN $2 AND $3
-		ORDER BY created_at DESC
-		LIMIT $4 OFFSET $5`,
-		userID, startTime, endTime, limit, offset,
+		`SELECT `+postingColumns+`
+		FROM postings
+		WHERE transaction_id = ANY($1)
+		ORDER BY id`,
+		ids,
 	)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer rows.Close()
 
-	var transactions []Transaction
 	for rows.Next() {
-		var transaction Transaction
-		err := rows.Scan(
-			&transaction.ID,
-			&transaction.FromUserID,
-			&transaction.ToUserID,
-			&transaction.Amount,
-			&transaction.TransactionType,
-			&transaction.CreatedAt,
-		)
+		posting, err := scanPosting(rows)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		transactions = append(transactions, transaction)
+		transaction := byID[posting.TransactionID]
+		transaction.Postings = append(transaction.Postings, *posting)
 	}
-
 	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	return attachPendingPostings(q, ids, byID)
+}
+
+// attachPendingPostings loads the pending postings of the given transactions
+func attachPendingPostings(q database.Querier, ids []int64, byID map[int64]*Transaction) error {
+	rows, err := q.Query(
+		context.Background(),
+		`SELECT `+postingColumns+`
+		FROM pending_postings
+		WHERE transaction_id = ANY($1)
+		ORDER BY id`,
+		ids,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		posting, err := scanPosting(rows)
+		if err != nil {
+			return err
+		}
+		transaction := byID[posting.TransactionID]
+		transaction.PendingPostings = append(transaction.PendingPostings, *posting)
+	}
+
+	return rows.Err()
+}
+
+// attachReversals fills in which reversals each of the given transactions has
+func attachReversals(q database.Querier, transactions []Transaction) error {
+	if len(transactions) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, len(transactions))
+	byID := make(map[int64]*Transaction, len(transactions))
+	for i := range transactions {
+		ids[i] = transactions[i].ID
+		byID[transactions[i].ID] = &transactions[i]
+	}
+
+	rows, err := q.Query(
+		context.Background(),
+		`SELECT id, reverses_transaction_id
+		FROM transactions
+		WHERE reverses_transaction_id = ANY($1)
+		ORDER BY id`,
+		ids,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, reversesID int64
+		if err := rows.Scan(&id, &reversesID); err != nil {
+			return err
+		}
+		transaction := byID[reversesID]
+		transaction.ReversalIDs = append(transaction.ReversalIDs, id)
+	}
+
+	return rows.Err()
+}
+
+// GetTransactionByID finds one transaction with its postings and reversals, nil if it doesn't exist
+func GetTransactionByID(id int64) (*Transaction, error) {
+	return getTransaction(database.GetPool(), id, "")
+}
+
+// LockTransactionForUpdate is GetTransactionByID that also locks the row until tx ends
+// reversals lock the transaction they give back, so two of them can't both pass the checks
+func LockTransactionForUpdate(tx pgx.Tx, id int64) (*Transaction, error) {
+	return getTransaction(tx, id, "FOR UPDATE")
+}
+
+func getTransaction(q database.Querier, id int64, lock string) (*Transaction, error) {
+	transaction, err := scanTransaction(q.QueryRow(
+		context.Background(),
+		`SELECT `+transactionColumns+` FROM transactions t WHERE t.id = $1 `+lock,
+		id,
+	))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
 		return nil, err
 	}
 
-	return transactions, nil
+	transactions := []Transaction{*transaction}
+	if err := attachPostings(q, transactions); err != nil {
+		return nil, err
+	}
+	if err := attachReversals(q, transactions); err != nil {
+		return nil, err
+	}
+	return &transactions[0], nil
 }
 
-// GetBalanceAtTime calculates a user's balance at a specific point in time
-func GetBalanceAtTime(userID int64, targetTime time.Time) (float64, error) {
-	var balance float64
-	err := database.GetPool().QueryRow(
+// GetReversedAmount adds up how much of a transaction its reversals already gave back
+func GetReversedAmount(q database.Querier, id int64) (money.Amount, error) {
+	var reversed money.Amount
+	err := q.QueryRow(
 		context.Background(),
-		`WITH balance_changes AS (
-			SELECT 
-				CASE 
-					WHEN from_user_id = $1 THEN -amount
-					WHEN to_user_id = $1 THEN amount
-				END as change
-			FROM transactions
-			WHERE (from_user_id = $1 OR to_user_id = $1)
-			AND created_at <= $2
-		)
-		SELECT COALESCE(SUM(change), 0)
-		FROM balance_changes`,
-		userID, targetTime,
-	).Scan(&balance)
+		`SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE reverses_transaction_id = $1`,
+		id,
+	).Scan(&reversed)
+	return reversed, err
+}
+
+// GetBalanceAtTime calculates the balances of a user's default accounts at a specific point in time
+func GetBalanceAtTime(userID int64, targetTime time.Time) (Balances, error) {
+	return balancesAtTime(`a.user_id = $1 AND a.is_default`, userID, targetTime)
+}
+
+// GetAccountBalanceAtTime calculates the balance of one account at a specific point in time
+func GetAccountBalanceAtTime(accountID int64, targetTime time.Time) (Balances, error) {
+	return balancesAtTime(`a.id = $1`, accountID, targetTime)
+}
 
+// balancesAtTime calculates the balances of the accounts matching where ($1 is id)
+// every account starts from its newest checkpoint before that time and adds
+// only the postings made after the checkpoint, one sum per currency
+func balancesAtTime(where string, id int64, targetTime time.Time) (Balances, error) {
+	rows, err := database.GetPool().Query(
+		context.Background(),
+		`SELECT a.currency, COALESCE(cp.balance, 0) + delta.amount
+		FROM accounts a
+		LEFT JOIN LATERAL (
+			SELECT as_of, balance FROM balance_checkpoints
+			WHERE account_id = a.id AND as_of <= $2 AND mismatch_at IS NULL
+			ORDER BY as_of DESC
+			LIMIT 1
+		) cp ON true
+		JOIN LATERAL (
+			SELECT COALESCE(SUM(p.amount), 0) AS amount, COUNT(*) AS count FROM postings p
+			WHERE p.account_id = a.id AND p.created_at <= $2
+			AND (cp.as_of IS NULL OR p.created_at >= cp.as_of)
+		) delta ON cp.as_of IS NOT NULL OR delta.count > 0
+		WHERE `+where,
+		id, targetTime,
+	)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	defer rows.Close()
+
+	balances := Balances{}
+	for rows.Next() {
+		var currency money.Currency
+		var balance money.Amount
+		if err := rows.Scan(&currency, &balance); err != nil {
+			return nil, err
+		}
+		balances[currency] = inCurrency(balance, currency)
 	}
 
-	return balance, nil
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return balances, nil
 }
 
-// BalanceWithTimestamp represents a balance at a specific time
+// BalanceWithTimestamp represents balances at a specific time
 type BalanceWithTimestamp struct {
-	Balance   float64   `json:"balance"`
+	Balances  Balances  `json:"balances"`
 	Timestamp time.Time `json:"timestamp"`
-} 
\ No newline at end of file
+}
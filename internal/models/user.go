@@ -2,36 +2,50 @@ package models
 
 import (
 	"context"
-	"log"
 	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/yigit-demirko/go-ledger/internal/database"
+	"github.com/yigit-demirko/go-ledger/internal/money"
 )
 
+// Balances is how much money someone has in each currency
+type Balances map[money.Currency]money.Amount
+
 // User holds info about each user and their money
 type User struct {
-	ID        int64     `json:"id"`
-	Name      string    `json:"name"`
-	Balance   float64   `json:"balance"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID                int64     `json:"id"`
+	Name              string    `json:"name"`
+	Balances          Balances  `json:"balances"`           // the posted balance of the default account in each currency the user holds
+	PendingBalances   Balances  `json:"pending_balances"`   // what the balances will be once pending transactions are posted
+	AvailableBalances Balances  `json:"available_balances"` // what can be spent, the balances less active holds and pending payments
+	Accounts          []Account `json:"accounts"`           // every account of the user, default ones first in each currency
+	CreatedAt         time.Time `json:"created_at"`
+	UpdatedAt         time.Time `json:"updated_at"`
 }
 
-// CreateUser adds a new user to database
-func CreateUser(name string) (*User, error) {
+// CreateUser adds a new ledger user for a login together with an account in the default currency
+func CreateUser(q database.Querier, name string, authUserID int64) (*User, error) {
 	var user User
-	err := database.GetPool().QueryRow(
+	err := q.QueryRow(
 		context.Background(),
-		`INSERT INTO users (name, balance, created_at, updated_at)
+		`INSERT INTO users (name, auth_user_id, created_at, updated_at)
 		VALUES ($1, $2, $3, $3)
-		RETURNING id, name, balance, created_at, updated_at`,
-		name, 0.0, time.Now(),
-	).Scan(&user.ID, &user.Name, &user.Balance, &user.CreatedAt, &user.UpdatedAt)
+		RETURNING id, name, created_at, updated_at`,
+		name, authUserID, time.Now(),
+	).Scan(&user.ID, &user.Name, &user.CreatedAt, &user.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
 
+	account, err := GetOrCreateUserAccount(q, user.ID, money.DefaultCurrency)
 	if err != nil {
 		return nil, err
 	}
+
+	user.Balances = Balances{account.Currency: account.Balance}
+	user.PendingBalances = Balances{account.Currency: account.PendingBalance()}
+	user.AvailableBalances = Balances{account.Currency: account.Available()}
 	return &user, nil
 }
 
@@ -40,10 +54,10 @@ func GetUserByID(id int64) (*User, error) {
 	var user User
 	err := database.GetPool().QueryRow(
 		context.Background(),
-		`SELECT id, name, balance, created_at, updated_at
+		`SELECT id, name, created_at, updated_at
 		FROM users WHERE id = $1`,
 		id,
-	).Scan(&user.ID, &user.Name, &user.Balance, &user.CreatedAt, &user.UpdatedAt)
+	).Scan(&user.ID, &user.Name, &user.CreatedAt, &user.UpdatedAt)
 
 	if err == pgx.ErrNoRows {
 		return nil, nil
@@ -51,15 +65,48 @@ func GetUserByID(id int64) (*User, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &user, nil
+
+	users := []User{user}
+	if err := attachBalances(users); err != nil {
+		return nil, err
+	}
+	return &users[0], nil
+}
+
+// ExistingUserIDs tells which of ids belong to a user
+func ExistingUserIDs(q database.Querier, ids []int64) (map[int64]bool, error) {
+	rows, err := q.Query(
+		context.Background(),
+		`SELECT id FROM users WHERE id = ANY($1)`,
+		ids,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	existing := make(map[int64]bool, len(ids))
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		existing[id] = true
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return existing, nil
 }
 
 // GetAllUsers gets a list of all users
 func GetAllUsers() ([]User, error) {
 	rows, err := database.GetPool().Query(
 		context.Background(),
-		`SELECT id, name, balance, created_at, updated_at
-		FROM users 
+		`SELECT id, name, created_at, updated_at
+		FROM users
 		ORDER BY id`,
 	)
 	if err != nil {
@@ -70,7 +117,7 @@ func GetAllUsers() ([]User, error) {
 	var users []User
 	for rows.Next() {
 		var user User
-		err := rows.Scan(&user.ID, &user.Name, &user.Balance, &user.CreatedAt, &user.UpdatedAt)
+		err := rows.Scan(&user.ID, &user.Name, &user.CreatedAt, &user.UpdatedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -81,99 +128,43 @@ func GetAllUsers() ([]User, error) {
 		return nil, err
 	}
 
+	if err := attachBalances(users); err != nil {
+		return nil, err
+	}
 	return users, nil
 }
 
-// UpdateBalance changes how much money a user has
-func (u *User) UpdateBalance(amount float64) error {
-	return database.RunInTransaction(func(tx pgx.Tx) error {
-		var updatedBalance float64
-		err := tx.QueryRow(
-			context.Background(),
-			`UPDATE users
-			SET balance = balance + $1, updated_at = $2
-			WHERE id = $3 AND balance + $1 >= 0
-			RETURNING balance`,
-			amount, time.Now(), u.ID,
-		).Scan(&updatedBalance)
-
-		if err != nil {
-			return err
-		}
-
-		u.Balance = updatedBalance
+// attachBalances fills in the balances and accounts of all given users with one query
+// the balances are the ones of the default accounts, which the user-ID endpoints use
+func attachBalances(users []User) error {
+	if len(users) == 0 {
 		return nil
-	})
-}
-
-// GetUserWithBalance finds a user and checks if they have enough money
-func GetUserWithBalance(id int64, requiredBalance float64) (*User, error) {
-	var user User
-	err := database.GetPool().QueryRow(
-		context.Background(),
-		`SELECT id, name, balance, created_at, updated_at
-		FROM users 
-		WHERE id = $1 AND balance >= $2
-		FOR UPDATE`,
-		id, requiredBalance,
-	).Scan(&user.ID, &user.Name, &user.Balance, &user.CreatedAt, &user.UpdatedAt)
-
-	if err == pgx.ErrNoRows {
-		return nil, nil
 	}
-	if err != nil {
-		return nil, err
-	}
-	return &user, nil
-}
-
-// InitializeUserBalance sets a user's initial balance
-func InitializeUserBalance(userID int, amount float64) error {
-	// get database connection
-	db := database.GetPool()
-	ctx := context.Background()
 
-	// start transaction
-	tx, err := db.Begin(ctx)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		if err := tx.Rollback(ctx); err != nil && err != pgx.ErrTxClosed {
-			log.Printf("Error rolling back transaction: %v", err)
-		}
-	}()
-
-	// update user balance
-	_, err = tx.Exec(ctx, `
-		UPDATE users 
-		SET balance = $1, 
-			updated_at = CURRENT_TIMESTAMP 
-		WHERE id = $2`,
-		amount, userID)
-	if err != nil {
-		return err
+	ids := make([]int64, len(users))
+	byID := make(map[int64]*User, len(users))
+	for i := range users {
+		ids[i] = users[i].ID
+		users[i].Balances = Balances{}
+		users[i].PendingBalances = Balances{}
+		users[i].AvailableBalances = Balances{}
+		users[i].Accounts = []Account{}
+		byID[users[i].ID] = &users[i]
 	}
 
-	// create initial transaction
-	_, err = tx.Exec(ctx, `
-		INSERT INTO transactions (
-			from_user_id, 
-			to_user_id, 
-			amount,
-			transaction_type,
-			description,
-			created_at
-		) VALUES ($1, $2, $3, $4, $5, CURRENT_TIMESTAMP)`,
-		nil, userID, amount, TransactionTypeDeposit, "Initial balance")
+	accounts, err := GetAccountsByUserIDs(database.GetPool(), ids...)
 	if err != nil {
 		return err
 	}
 
-	// commit transaction
-	if err := tx.Commit(ctx); err != nil {
-		return err
+	for _, account := range accounts {
+		byID[*account.UserID].Accounts = append(byID[*account.UserID].Accounts, account)
+		if !account.IsDefault {
+			continue
+		}
+		byID[*account.UserID].Balances[account.Currency] = account.Balance
+		byID[*account.UserID].PendingBalances[account.Currency] = account.PendingBalance()
+		byID[*account.UserID].AvailableBalances[account.Currency] = account.Available()
 	}
-
 	return nil
-} 
\ No newline at end of file
+}
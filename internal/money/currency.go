@@ -0,0 +1,101 @@
+package money
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Currency is an ISO 4217 currency code like "USD"
+type Currency string
+
+// DefaultCurrency is used when a request doesn't say which currency it means
+const DefaultCurrency Currency = "USD"
+
+// ErrUnknownCurrency is returned for codes we don't support
+var ErrUnknownCurrency = errors.New("unknown currency")
+
+// how many decimal places each currency has (ISO 4217 minor units)
+var currencyExponents = map[Currency]int32{
+	"AUD": 2,
+	"BHD": 3,
+	"CAD": 2,
+	"CHF": 2,
+	"CNY": 2,
+	"CZK": 2,
+	"DKK": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"HKD": 2,
+	"INR": 2,
+	"JOD": 3,
+	"JPY": 0,
+	"KRW": 0,
+	"KWD": 3,
+	"MXN": 2,
+	"NOK": 2,
+	"NZD": 2,
+	"OMR": 3,
+	"PLN": 2,
+	"SEK": 2,
+	"SGD": 2,
+	"TND": 3,
+	"TRY": 2,
+	"USD": 2,
+	"ZAR": 2,
+}
+
+// ParseCurrency checks that code is a currency we know, "usd" is read as "USD"
+func ParseCurrency(code string) (Currency, error) {
+	currency := Currency(strings.ToUpper(code))
+	if _, ok := currencyExponents[currency]; !ok {
+		return "", fmt.Errorf("%w: %q", ErrUnknownCurrency, code)
+	}
+	return currency, nil
+}
+
+// Exponent tells how many decimal places amounts in this currency have
+func (c Currency) Exponent() int32 {
+	return currencyExponents[c]
+}
+
+// Valid tells if this is a currency we know
+func (c Currency) Valid() bool {
+	_, ok := currencyExponents[c]
+	return ok
+}
+
+// Zero is a zero amount written with the currency's decimal places
+func (c Currency) Zero() Amount {
+	return Amount{scale: c.Exponent()}
+}
+
+// Normalize checks that a fits the currency's precision and writes it with
+// exactly that many decimal places, so 12.5 USD becomes 12.50 and 1.234 USD is refused
+func (c Currency) Normalize(a Amount) (Amount, error) {
+	if !c.Valid() {
+		return Amount{}, fmt.Errorf("%w: %q", ErrUnknownCurrency, string(c))
+	}
+	normalized, err := a.Rescale(c.Exponent())
+	if errors.Is(err, ErrOutOfRange) {
+		return Amount{}, fmt.Errorf("%w: %s in %s", ErrOutOfRange, a, c)
+	}
+	if err != nil {
+		return Amount{}, fmt.Errorf("%w: %s allows at most %d", ErrTooPrecise, c, c.Exponent())
+	}
+	return normalized, nil
+}
+
+// UnmarshalText lets JSON requests use currency codes, they are checked on the way in
+func (c *Currency) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*c = ""
+		return nil
+	}
+	currency, err := ParseCurrency(string(text))
+	if err != nil {
+		return err
+	}
+	*c = currency
+	return nil
+}
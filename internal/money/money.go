@@ -0,0 +1,380 @@
+package money
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// MaxScale is the most decimal places any currency has (BHD, KWD and friends have 3)
+// the currency of an amount decides how many it may really have, see Currency.Normalize
+const MaxScale = 3
+
+// we keep at most this many digits so the value always fits in an int64
+const maxDigits = 18
+
+// the biggest units an amount can have, maxDigits nines
+const maxUnits = 999999999999999999
+
+// error messages we might need
+var (
+	ErrInvalidAmount = errors.New("invalid amount")
+	ErrTooPrecise    = errors.New("amount has too many decimal places")
+	ErrOutOfRange    = errors.New("amount is out of range")
+	ErrInvalidRatios = errors.New("ratios must not be negative and at least one must be more than zero")
+)
+
+// powers of ten we use to line up scales
+var pow10 = [...]int64{
+	1, 10, 100, 1000, 10000, 100000, 1000000, 10000000, 100000000,
+	1000000000, 10000000000, 100000000000, 1000000000000, 10000000000000,
+	100000000000000, 1000000000000000, 10000000000000000, 100000000000000000,
+	1000000000000000000,
+}
+
+// Amount is an exact amount of money
+// it is stored as a whole number of minor units (like cents) plus how many
+// decimal places those units have, so we never round through a float
+// the zero value is a valid zero amount
+type Amount struct {
+	units int64 // the value without the decimal point, 12.50 is 1250
+	scale int32 // how many digits are after the decimal point
+}
+
+// New makes an amount from minor units, New(1250, 2) is 12.50
+func New(units int64, scale int32) Amount {
+	return Amount{units: units, scale: scale}
+}
+
+// Parse reads an amount like "12.50" with at most MaxScale decimal places
+func Parse(s string) (Amount, error) {
+	return ParseWithScale(s, MaxScale)
+}
+
+// ParseWithScale reads an amount and rejects it if it has more than maxScale decimal places
+// only plain decimals are accepted: no exponents, no spaces, no "+" sign
+func ParseWithScale(s string, maxScale int32) (Amount, error) {
+	negative := strings.HasPrefix(s, "-")
+	digits := strings.TrimPrefix(s, "-")
+
+	whole, frac, hasPoint := strings.Cut(digits, ".")
+	if whole == "" || (hasPoint && frac == "") || !isDigits(whole) || !isDigits(frac) {
+		return Amount{}, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+	}
+	if int32(len(frac)) > maxScale {
+		return Amount{}, fmt.Errorf("%w: %q allows at most %d", ErrTooPrecise, s, maxScale)
+	}
+
+	// drop leading zeros so they don't count against the digit limit
+	whole = strings.TrimLeft(whole, "0")
+	if len(whole)+len(frac) > maxDigits {
+		return Amount{}, fmt.Errorf("%w: %q", ErrOutOfRange, s)
+	}
+
+	units, err := strconv.ParseInt("0"+whole+frac, 10, 64)
+	if err != nil {
+		return Amount{}, fmt.Errorf("%w: %q", ErrOutOfRange, s)
+	}
+	if negative {
+		units = -units
+	}
+
+	return Amount{units: units, scale: int32(len(frac))}, nil
+}
+
+// MustParse is like Parse but panics on bad input, only use it for constants
+func MustParse(s string) Amount {
+	a, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Scale tells how many decimal places the amount has
+func (a Amount) Scale() int32 {
+	return a.scale
+}
+
+// Rescale writes the amount with exactly scale decimal places
+// it fails instead of rounding, so 12.50 can become 12.5 but 12.55 can't,
+// and with ErrOutOfRange if the extra places make it too long
+func (a Amount) Rescale(scale int32) (Amount, error) {
+	switch {
+	case scale == a.scale:
+		return a, nil
+	case scale > a.scale:
+		// 184467440737095517 can't get two more places without wrapping around
+		units, ok := mul10(a.units, scale-a.scale)
+		if !ok {
+			return Amount{}, ErrOutOfRange
+		}
+		return Amount{units: units, scale: scale}, nil
+	}
+
+	if a.scale-scale > maxDigits {
+		return Amount{}, ErrTooPrecise
+	}
+	factor := pow10[a.scale-scale]
+	if a.units%factor != 0 {
+		return Amount{}, ErrTooPrecise
+	}
+	return Amount{units: a.units / factor, scale: scale}, nil
+}
+
+// Add returns a + b
+// it panics if the sum doesn't fit in an Amount instead of wrapping around,
+// use AddChecked for anything a client sent
+func (a Amount) Add(b Amount) Amount {
+	sum, err := a.AddChecked(b)
+	if err != nil {
+		panic(err)
+	}
+	return sum
+}
+
+// Sub returns a - b, it panics like Add
+func (a Amount) Sub(b Amount) Amount {
+	return a.Add(b.Neg())
+}
+
+// AddChecked returns a + b, or ErrOutOfRange if that has more than maxDigits digits
+func (a Amount) AddChecked(b Amount) (Amount, error) {
+	x, y, scale, ok := align(a, b)
+	if !ok {
+		return Amount{}, ErrOutOfRange
+	}
+	sum := x + y
+	// adding two numbers with the same sign can't change it, unless it wrapped
+	if (y > 0 && sum < x) || (y < 0 && sum > x) || sum > maxUnits || sum < -maxUnits {
+		return Amount{}, ErrOutOfRange
+	}
+	return Amount{units: sum, scale: scale}, nil
+}
+
+// SubChecked returns a - b, or ErrOutOfRange if that doesn't fit in an Amount
+func (a Amount) SubChecked(b Amount) (Amount, error) {
+	return a.AddChecked(b.Neg())
+}
+
+// Neg returns -a
+func (a Amount) Neg() Amount {
+	return Amount{units: -a.units, scale: a.scale}
+}
+
+// Cmp returns -1 if a < b, 0 if they are equal and 1 if a > b
+func (a Amount) Cmp(b Amount) int {
+	x, y, _, ok := align(a, b)
+	if !ok {
+		// one side is too big to line up, so compare them exactly
+		scale := max(a.scale, b.scale)
+		return a.bigAt(scale).Cmp(b.bigAt(scale))
+	}
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// Sign returns -1, 0 or 1
+func (a Amount) Sign() int {
+	switch {
+	case a.units < 0:
+		return -1
+	case a.units > 0:
+		return 1
+	}
+	return 0
+}
+
+// IsZero tells if the amount is zero
+func (a Amount) IsZero() bool { return a.units == 0 }
+
+// IsPositive tells if the amount is greater than zero
+func (a Amount) IsPositive() bool { return a.units > 0 }
+
+// IsNegative tells if the amount is less than zero
+func (a Amount) IsNegative() bool { return a.units < 0 }
+
+// Allocate splits the amount into parts that follow ratios, like 90:8:2
+// the parts keep the amount's decimal places and always add up to it exactly:
+// the cents that don't divide evenly go one by one to the parts that lost the
+// most by rounding down, the earlier part first when that is a tie
+func (a Amount) Allocate(ratios ...int64) ([]Amount, error) {
+	total := new(big.Int)
+	for _, ratio := range ratios {
+		if ratio < 0 {
+			return nil, ErrInvalidRatios
+		}
+		total.Add(total, big.NewInt(ratio))
+	}
+	if total.Sign() == 0 {
+		return nil, ErrInvalidRatios
+	}
+
+	// work with the size of the amount and put the sign back at the end
+	units := a.units
+	if units < 0 {
+		units = -units
+	}
+
+	parts := make([]Amount, len(ratios))
+	remainders := make([]*big.Int, len(ratios))
+	left := units
+	for i, ratio := range ratios {
+		// units * ratio can be too big for an int64, so big.Int does the math
+		share, remainder := new(big.Int).QuoRem(
+			new(big.Int).Mul(big.NewInt(units), big.NewInt(ratio)), total, new(big.Int),
+		)
+		parts[i] = Amount{units: share.Int64(), scale: a.scale}
+		remainders[i] = remainder
+		left -= share.Int64()
+	}
+
+	// there are fewer cents left than parts, so each part gets at most one
+	order := make([]int, len(ratios))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(x, y int) bool {
+		return remainders[order[x]].Cmp(remainders[order[y]]) > 0
+	})
+	for _, i := range order[:left] {
+		parts[i].units++
+	}
+
+	if a.units < 0 {
+		for i := range parts {
+			parts[i].units = -parts[i].units
+		}
+	}
+	return parts, nil
+}
+
+// align puts both amounts on the same scale so their units can be compared
+// ok is false if that makes one of them too big for an Amount
+func align(a, b Amount) (int64, int64, int32, bool) {
+	switch {
+	case a.scale < b.scale:
+		x, ok := mul10(a.units, b.scale-a.scale)
+		return x, b.units, b.scale, ok
+	case a.scale > b.scale:
+		y, ok := mul10(b.units, a.scale-b.scale)
+		return a.units, y, a.scale, ok
+	}
+	return a.units, b.units, a.scale, true
+}
+
+// mul10 returns units * 10^n, ok is false if that has more than maxDigits digits
+func mul10(units int64, n int32) (int64, bool) {
+	if n < 0 || n > maxDigits {
+		return 0, false
+	}
+	factor := pow10[n]
+	if units > maxUnits/factor || units < -maxUnits/factor {
+		return 0, false
+	}
+	return units * factor, true
+}
+
+// bigAt writes the units of the amount at a bigger scale, where they can be any size
+func (a Amount) bigAt(scale int32) *big.Int {
+	factor := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale-a.scale)), nil)
+	return factor.Mul(factor, big.NewInt(a.units))
+}
+
+// String prints the amount with all of its decimal places, like "12.50"
+func (a Amount) String() string {
+	units := a.units
+	sign := ""
+	if units < 0 {
+		sign = "-"
+		units = -units
+	}
+
+	digits := strconv.FormatInt(units, 10)
+	if a.scale <= 0 {
+		return sign + digits
+	}
+
+	// pad with zeros so there is always a digit before the point
+	if len(digits) <= int(a.scale) {
+		digits = strings.Repeat("0", int(a.scale)-len(digits)+1) + digits
+	}
+	point := len(digits) - int(a.scale)
+	return sign + digits[:point] + "." + digits[point:]
+}
+
+// MarshalJSON writes the amount as a string, so clients never parse it as a float
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.String())
+}
+
+// UnmarshalJSON reads "12.50" or 12.50 without ever turning it into a float
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+
+	text := string(data)
+	if strings.HasPrefix(text, `"`) {
+		if err := json.Unmarshal(data, &text); err != nil {
+			return err
+		}
+	}
+
+	parsed, err := Parse(text)
+	if err != nil {
+		return err
+	}
+	*a = parsed
+	return nil
+}
+
+// ScanNumeric lets pgx read a NUMERIC column straight into an Amount
+func (a *Amount) ScanNumeric(n pgtype.Numeric) error {
+	if !n.Valid {
+		return fmt.Errorf("cannot scan NULL into money.Amount")
+	}
+	if n.NaN || n.InfinityModifier != pgtype.Finite {
+		return fmt.Errorf("%w: not a finite number", ErrInvalidAmount)
+	}
+
+	units := new(big.Int).Set(n.Int)
+	scale := -n.Exp
+	if scale < 0 {
+		// postgres sent something like 12e3, turn it into plain units
+		units.Mul(units, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(-scale)), nil))
+		scale = 0
+	}
+	if !units.IsInt64() {
+		return ErrOutOfRange
+	}
+
+	*a = Amount{units: units.Int64(), scale: scale}
+	return nil
+}
+
+// NumericValue lets pgx send an Amount as a NUMERIC parameter
+func (a Amount) NumericValue() (pgtype.Numeric, error) {
+	return pgtype.Numeric{Int: big.NewInt(a.units), Exp: -a.scale, Valid: true}, nil
+}
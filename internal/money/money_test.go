@@ -0,0 +1,337 @@
+package money
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in    string
+		units int64
+		scale int32
+		err   error
+	}{
+		{"0", 0, 0, nil},
+		{"12.50", 1250, 2, nil},
+		{"-0.001", -1, 3, nil},
+		{"007.5", 75, 1, nil},
+		{"999999999999999999", 999999999999999999, 0, nil},
+		{"1.2345", 0, 0, ErrTooPrecise},
+		{"1000000000000000000", 0, 0, ErrOutOfRange},
+		{"", 0, 0, ErrInvalidAmount},
+		{"12.", 0, 0, ErrInvalidAmount},
+		{".5", 0, 0, ErrInvalidAmount},
+		{"+1", 0, 0, ErrInvalidAmount},
+		{"1e3", 0, 0, ErrInvalidAmount},
+		{" 1", 0, 0, ErrInvalidAmount},
+	}
+
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("Parse(%q) error = %v, want %v", tt.in, err, tt.err)
+			continue
+		}
+		if err == nil && (got.units != tt.units || got.scale != tt.scale) {
+			t.Errorf("Parse(%q) = %d scale %d, want %d scale %d", tt.in, got.units, got.scale, tt.units, tt.scale)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		in   Amount
+		want string
+	}{
+		{New(1250, 2), "12.50"},
+		{New(-5, 3), "-0.005"},
+		{New(7, 0), "7"},
+		{Amount{}, "0"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.in.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		err  bool
+	}{
+		{`"12.50"`, "12.50", false},
+		{`12.50`, "12.50", false},
+		{`0.1`, "0.1", false},
+		{`null`, "0", false},
+		{`"1.2345"`, "", true},
+		{`1e2`, "", true},
+		{`"abc"`, "", true},
+	}
+
+	for _, tt := range tests {
+		var a Amount
+		err := json.Unmarshal([]byte(tt.in), &a)
+		if (err != nil) != tt.err {
+			t.Errorf("Unmarshal(%s) error = %v, want error %v", tt.in, err, tt.err)
+			continue
+		}
+		if err == nil && a.String() != tt.want {
+			t.Errorf("Unmarshal(%s) = %s, want %s", tt.in, a, tt.want)
+		}
+	}
+
+	data, err := json.Marshal(struct {
+		Amount Amount `json:"amount"`
+	}{MustParse("-3.10")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"amount":"-3.10"}` {
+		t.Errorf("Marshal = %s, want the amount as a string", data)
+	}
+}
+
+func TestNumeric(t *testing.T) {
+	tests := []struct {
+		in   pgtype.Numeric
+		want string
+		err  bool
+	}{
+		{pgtype.Numeric{Int: big.NewInt(1250), Exp: -2, Valid: true}, "12.50", false},
+		{pgtype.Numeric{Int: big.NewInt(12), Exp: 3, Valid: true}, "12000", false},
+		{pgtype.Numeric{Int: big.NewInt(-1), Exp: -3, Valid: true}, "-0.001", false},
+		{pgtype.Numeric{}, "", true},
+		{pgtype.Numeric{NaN: true, Valid: true}, "", true},
+		{pgtype.Numeric{Int: new(big.Int).Lsh(big.NewInt(1), 70), Valid: true}, "", true},
+	}
+
+	for _, tt := range tests {
+		var a Amount
+		err := a.ScanNumeric(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("ScanNumeric(%v) error = %v, want error %v", tt.in, err, tt.err)
+			continue
+		}
+		if err == nil && a.String() != tt.want {
+			t.Errorf("ScanNumeric(%v) = %s, want %s", tt.in, a, tt.want)
+		}
+	}
+
+	// what we send is read back as the same amount
+	for _, s := range []string{"12.50", "-0.001", "0", "999999999999999999"} {
+		n, err := MustParse(s).NumericValue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var a Amount
+		if err := a.ScanNumeric(n); err != nil {
+			t.Fatal(err)
+		}
+		if a.String() != s {
+			t.Errorf("NumericValue then ScanNumeric of %s = %s", s, a)
+		}
+	}
+}
+
+func TestRescale(t *testing.T) {
+	tests := []struct {
+		in    string
+		scale int32
+		want  string
+		err   error
+	}{
+		{"12.5", 2, "12.50", nil},
+		{"12.50", 1, "12.5", nil},
+		{"12.50", 2, "12.50", nil},
+		{"12.55", 1, "", ErrTooPrecise},
+		{"-7", 3, "-7.000", nil},
+		// 184467440737095517 * 100 wraps around to 84 in an int64
+		{"184467440737095517", 2, "", ErrOutOfRange},
+		{"-184467440737095517", 2, "", ErrOutOfRange},
+		{"99999999999999999.9", 2, "", ErrOutOfRange},
+		{"9999999999999999.99", 3, "", ErrOutOfRange},
+		{"999999999999999.99", 3, "999999999999999.990", nil},
+	}
+
+	for _, tt := range tests {
+		got, err := MustParse(tt.in).Rescale(tt.scale)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("Rescale(%s, %d) error = %v, want %v", tt.in, tt.scale, err, tt.err)
+			continue
+		}
+		if err == nil && got.String() != tt.want {
+			t.Errorf("Rescale(%s, %d) = %s, want %s", tt.in, tt.scale, got, tt.want)
+		}
+	}
+}
+
+func TestAddChecked(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want string
+		err  error
+	}{
+		{"12.50", "0.005", "12.505", nil},
+		{"1", "-1.00", "0.00", nil},
+		{"99999999999999999.9", "0.01", "", ErrOutOfRange},
+		{"-0.1", "-0.02", "-0.12", nil},
+		// lining up the scales would need more digits than an amount has
+		{"999999999999999999", "0.1", "", ErrOutOfRange},
+		{"0.1", "999999999999999999", "", ErrOutOfRange},
+		// the scales line up but the sum has too many digits
+		{"999999999999999999", "1", "", ErrOutOfRange},
+		{"-999999999999999999", "-999999999999999999", "", ErrOutOfRange},
+		{"999999999999999999", "-1", "999999999999999998", nil},
+	}
+
+	for _, tt := range tests {
+		got, err := MustParse(tt.a).AddChecked(MustParse(tt.b))
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s + %s error = %v, want %v", tt.a, tt.b, err, tt.err)
+			continue
+		}
+		if err == nil && got.String() != tt.want {
+			t.Errorf("%s + %s = %s, want %s", tt.a, tt.b, got, tt.want)
+		}
+	}
+
+	if _, err := MustParse("-999999999999999999").SubChecked(MustParse("999999999999999999")); !errors.Is(err, ErrOutOfRange) {
+		t.Errorf("SubChecked error = %v, want %v", err, ErrOutOfRange)
+	}
+}
+
+func TestAddPanicsInsteadOfWrapping(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Add didn't panic on overflow")
+		}
+	}()
+	MustParse("999999999999999999").Add(MustParse("0.1"))
+}
+
+func TestCmp(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"12.5", "12.50", 0},
+		{"12.49", "12.5", -1},
+		{"-1", "-1.001", 1},
+		// too big to line up, still compared exactly
+		{"999999999999999999", "0.1", 1},
+		{"-999999999999999999", "0.1", -1},
+		{"0.1", "999999999999999999", -1},
+		{"0.001", "-999999999999999999", 1},
+	}
+
+	for _, tt := range tests {
+		if got := MustParse(tt.a).Cmp(MustParse(tt.b)); got != tt.want {
+			t.Errorf("Cmp(%s, %s) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		in       string
+		currency Currency
+		want     string
+		err      error
+	}{
+		{"12.5", "USD", "12.50", nil},
+		{"12", "JPY", "12", nil},
+		{"1.5", "JPY", "", ErrTooPrecise},
+		{"1.234", "KWD", "1.234", nil},
+		{"1", "XXX", "", ErrUnknownCurrency},
+		// the transfer that used to be booked as 0.84
+		{"184467440737095517", "USD", "", ErrOutOfRange},
+	}
+
+	for _, tt := range tests {
+		got, err := tt.currency.Normalize(MustParse(tt.in))
+		if !errors.Is(err, tt.err) {
+			t.Errorf("Normalize(%s %s) error = %v, want %v", tt.in, tt.currency, err, tt.err)
+			continue
+		}
+		if err == nil && got.String() != tt.want {
+			t.Errorf("Normalize(%s %s) = %s, want %s", tt.in, tt.currency, got, tt.want)
+		}
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	tests := []struct {
+		amount string
+		ratios []int64
+		want   []string
+	}{
+		{"100.00", []int64{1, 1}, []string{"50.00", "50.00"}},
+		// the cent left over goes to the earlier part on a tie
+		{"100.00", []int64{1, 1, 1}, []string{"33.34", "33.33", "33.33"}},
+		{"0.05", []int64{1, 1, 1}, []string{"0.02", "0.02", "0.01"}},
+		// it goes to the part that lost the most by rounding down, not the first one
+		{"1.00", []int64{1, 2}, []string{"0.33", "0.67"}},
+		{"10.00", []int64{90, 8, 2}, []string{"9.00", "0.80", "0.20"}},
+		{"0.10", []int64{3, 3, 1}, []string{"0.04", "0.04", "0.02"}},
+		// a zero ratio gets nothing
+		{"5", []int64{0, 1, 0}, []string{"0", "5", "0"}},
+		// more parts than cents, the smallest parts are zero but never negative
+		{"0.02", []int64{1, 1, 1, 1}, []string{"0.01", "0.01", "0.00", "0.00"}},
+		// negative amounts are split by size and keep their sign
+		{"-100.00", []int64{1, 1, 1}, []string{"-33.34", "-33.33", "-33.33"}},
+		// amount * ratio doesn't fit in an int64
+		{"999999999999999.999", []int64{1000000, 1}, []string{"999999000000999.998", "999999000.001"}},
+	}
+
+	for _, tt := range tests {
+		amount := MustParse(tt.amount)
+		parts, err := amount.Allocate(tt.ratios...)
+		if err != nil {
+			t.Errorf("Allocate(%s, %v) error = %v", tt.amount, tt.ratios, err)
+			continue
+		}
+		if len(parts) != len(tt.want) {
+			t.Errorf("Allocate(%s, %v) = %v, want %v", tt.amount, tt.ratios, parts, tt.want)
+			continue
+		}
+
+		sum := Amount{scale: amount.scale}
+		for i, part := range parts {
+			if part.String() != tt.want[i] {
+				t.Errorf("Allocate(%s, %v) part %d = %s, want %s", tt.amount, tt.ratios, i, part, tt.want[i])
+			}
+			if part.Sign()*amount.Sign() < 0 {
+				t.Errorf("Allocate(%s, %v) part %d = %s has the wrong sign", tt.amount, tt.ratios, i, part)
+			}
+			sum = sum.Add(part)
+		}
+		if sum.Cmp(amount) != 0 {
+			t.Errorf("Allocate(%s, %v) adds up to %s", tt.amount, tt.ratios, sum)
+		}
+
+		// the same input always splits the same way
+		again, _ := amount.Allocate(tt.ratios...)
+		for i := range parts {
+			if again[i] != parts[i] {
+				t.Errorf("Allocate(%s, %v) isn't deterministic: %v then %v", tt.amount, tt.ratios, parts, again)
+				break
+			}
+		}
+	}
+}
+
+func TestAllocateInvalidRatios(t *testing.T) {
+	for _, ratios := range [][]int64{nil, {0}, {0, 0}, {1, -1}} {
+		if _, err := MustParse("1.00").Allocate(ratios...); !errors.Is(err, ErrInvalidRatios) {
+			t.Errorf("Allocate(1.00, %v) error = %v, want %v", ratios, err, ErrInvalidRatios)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package money
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// RateScale is how many decimal places an exchange rate can have
+const RateScale = 8
+
+// ErrInvalidRate is returned for rates that are zero, negative or badly written
+var ErrInvalidRate = errors.New("invalid exchange rate")
+
+// Rounding tells how to drop the decimal places a result can't keep
+type Rounding int
+
+const (
+	RoundHalfEven Rounding = iota // to the nearest, ties go to the even digit (banker's rounding)
+	RoundDown                     // towards zero, we never give away a fraction of a cent
+)
+
+// Rate is an exchange rate: how much of the quote currency one unit of the base currency buys
+// it is an exact decimal like Amount, just with more decimal places
+type Rate struct {
+	value Amount
+}
+
+// ParseRate reads a rate like "1.0825" with at most RateScale decimal places
+func ParseRate(s string) (Rate, error) {
+	value, err := ParseWithScale(s, RateScale)
+	if err != nil {
+		return Rate{}, fmt.Errorf("%w: %v", ErrInvalidRate, err)
+	}
+	if !value.IsPositive() {
+		return Rate{}, fmt.Errorf("%w: %q must be more than zero", ErrInvalidRate, s)
+	}
+	return Rate{value: value}, nil
+}
+
+// String prints the rate with all of its decimal places
+func (r Rate) String() string {
+	return r.value.String()
+}
+
+// IsZero tells if the rate was never set
+func (r Rate) IsZero() bool {
+	return r.value.IsZero()
+}
+
+// rat gives the exact value of an amount as a fraction
+func (a Amount) rat() *big.Rat {
+	return new(big.Rat).SetFrac(big.NewInt(a.units), new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(a.scale)), nil))
+}
+
+// fromRat rounds an exact fraction to scale decimal places
+func fromRat(x *big.Rat, scale int32, rounding Rounding) (Amount, error) {
+	shifted := new(big.Rat).Mul(x, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale)), nil)))
+
+	quotient, remainder := new(big.Int).QuoRem(shifted.Num(), shifted.Denom(), new(big.Int))
+	if rounding == RoundHalfEven && remainder.Sign() != 0 {
+		// compare twice the remainder with the denominator to see which side of .5 we are on
+		twice := new(big.Int).Mul(new(big.Int).Abs(remainder), big.NewInt(2))
+		cmp := twice.Cmp(shifted.Denom())
+		if cmp > 0 || (cmp == 0 && quotient.Bit(0) == 1) {
+			quotient.Add(quotient, big.NewInt(int64(remainder.Sign())))
+		}
+	}
+
+	if !quotient.IsInt64() {
+		return Amount{}, ErrOutOfRange
+	}
+	return Amount{units: quotient.Int64(), scale: scale}, nil
+}
+
+// MulFrac gives num/den of an amount with scale decimal places, like the 5/365 of a yearly charge
+func (a Amount) MulFrac(num, den int64, scale int32, rounding Rounding) (Amount, error) {
+	if den == 0 {
+		return Amount{}, ErrInvalidAmount
+	}
+	return fromRat(new(big.Rat).Mul(a.rat(), big.NewRat(num, den)), scale, rounding)
+}
+
+// Convert turns an amount of the base currency into the quote currency
+// the result has the decimal places of the quote currency
+func (r Rate) Convert(a Amount, to Currency, rounding Rounding) (Amount, error) {
+	product := new(big.Rat).Mul(a.rat(), r.value.rat())
+	return fromRat(product, to.Exponent(), rounding)
+}
+
+// LessSpread takes a spread in basis points off the rate, 50 bps of 1.10 is 1.0945
+// it rounds down so the customer rate is never better than the published one
+func (r Rate) LessSpread(spreadBps int64) (Rate, error) {
+	factor := big.NewRat(10000-spreadBps, 10000)
+	value, err := fromRat(new(big.Rat).Mul(r.value.rat(), factor), RateScale, RoundDown)
+	if err != nil {
+		return Rate{}, err
+	}
+	if !value.IsPositive() {
+		return Rate{}, ErrInvalidRate
+	}
+	return Rate{value: value}, nil
+}
+
+// Inverse gives the rate the other way around, so EUR/USD from USD/EUR
+func (r Rate) Inverse() (Rate, error) {
+	value, err := fromRat(new(big.Rat).Inv(r.value.rat()), RateScale, RoundHalfEven)
+	if err != nil {
+		return Rate{}, err
+	}
+	if !value.IsPositive() {
+		return Rate{}, ErrInvalidRate
+	}
+	return Rate{value: value}, nil
+}
+
+// MarshalJSON writes the rate as a string, like amounts
+func (r Rate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+// UnmarshalJSON reads "1.0825" or 1.0825 without ever turning it into a float
+func (r *Rate) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+
+	text := string(data)
+	if strings.HasPrefix(text, `"`) {
+		if err := json.Unmarshal(data, &text); err != nil {
+			return err
+		}
+	}
+
+	parsed, err := ParseRate(text)
+	if err != nil {
+		return err
+	}
+	*r = parsed
+	return nil
+}
+
+// ScanNumeric lets pgx read a NUMERIC column into a Rate
+func (r *Rate) ScanNumeric(n pgtype.Numeric) error {
+	return r.value.ScanNumeric(n)
+}
+
+// NumericValue lets pgx send a Rate as a NUMERIC parameter
+func (r Rate) NumericValue() (pgtype.Numeric, error) {
+	return r.value.NumericValue()
+}
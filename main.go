@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
 	"os"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 	"github.com/yigit-demirko/go-ledger/internal/api"
 	"github.com/yigit-demirko/go-ledger/internal/database"
+	"github.com/yigit-demirko/go-ledger/internal/fx"
+	"github.com/yigit-demirko/go-ledger/internal/jobs"
+	"github.com/yigit-demirko/go-ledger/internal/ledger"
 )
 
 func main() {
@@ -20,7 +26,7 @@ func main() {
 	if err := database.InitDB(); err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
-	
+
 	// make sure we close database when done
 	defer database.CloseDB()
 
@@ -29,6 +35,98 @@ func main() {
 		log.Fatalf("Failed to create tables: %v", err)
 	}
 
+	// "ledger verify" checks the books and exits instead of starting the server
+	// it runs after the tables are made, so it also works on a new or older database
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		code := runVerify(os.Args[2:])
+		database.CloseDB()
+		os.Exit(code)
+	}
+
+	// load exchange rates from the rates file, if there is one
+	if loaded, err := fx.LoadRatesFromEnv(); err == nil {
+		log.Printf("Loaded %d new exchange rates", loaded)
+	} else if !errors.Is(err, fx.ErrNoRatesFile) {
+		log.Fatalf("Failed to load exchange rates: %v", err)
+	}
+
+	// run background jobs until the server stops
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	go jobs.Every(jobsCtx, "expire-holds", time.Minute, func() error {
+		expired, err := ledger.ExpireHolds()
+		if expired > 0 {
+			log.Printf("Expired %d holds", expired)
+		}
+		return err
+	})
+	go jobs.Every(jobsCtx, "scheduled-transfers", time.Minute, func() error {
+		tried, err := ledger.RunScheduledTransfers()
+		if tried > 0 {
+			log.Printf("Ran %d scheduled transfers", tried)
+		}
+		return err
+	})
+	go jobs.Every(jobsCtx, "standing-orders", time.Minute, func() error {
+		tried, err := ledger.RunStandingOrders()
+		if tried > 0 {
+			log.Printf("Ran %d standing order payments", tried)
+		}
+		return err
+	})
+	go jobs.Every(jobsCtx, "expire-approvals", time.Minute, func() error {
+		expired, err := ledger.ExpireApprovals()
+		if expired > 0 {
+			log.Printf("Expired %d approval requests", expired)
+		}
+		return err
+	})
+	go jobs.Every(jobsCtx, "expire-payment-requests", time.Minute, func() error {
+		expired, err := ledger.ExpirePaymentRequests()
+		if expired > 0 {
+			log.Printf("Expired %d payment requests", expired)
+		}
+		return err
+	})
+	go jobs.Every(jobsCtx, "refund-escrows", time.Minute, func() error {
+		refunded, err := ledger.RefundDueEscrows()
+		if refunded > 0 {
+			log.Printf("Refunded %d escrows", refunded)
+		}
+		return err
+	})
+	go jobs.Every(jobsCtx, "accrue-overdraft-interest", time.Hour, func() error {
+		charged, err := ledger.AccrueOverdraftInterest(time.Now())
+		if charged > 0 {
+			log.Printf("Charged overdraft interest on %d accounts", charged)
+		}
+		return err
+	})
+	go jobs.Every(jobsCtx, "balance-checkpoints", time.Hour, func() error {
+		created, err := ledger.BuildCheckpoints(time.Now())
+		if err != nil {
+			return err
+		}
+		if created > 0 {
+			log.Printf("Saved %d balance checkpoints", created)
+		}
+		_, err = ledger.VerifyCheckpoints()
+		return err
+	})
+	if interval := ledger.VerifyInterval(); interval > 0 {
+		go jobs.Every(jobsCtx, "verify-ledger", interval, func() error {
+			report, err := ledger.Verify()
+			if err != nil {
+				return err
+			}
+			if !report.OK() {
+				log.Printf("Warning: ledger check found %d problems", report.Problems())
+				ledger.LogReport(report)
+			}
+			return nil
+		})
+	}
+
 	// create a new web server
 	r := gin.Default()
 
@@ -46,4 +144,4 @@ func main() {
 	if err := r.Run(":" + port); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
-} 
\ No newline at end of file
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/yigit-demirko/go-ledger/internal/ledger"
+)
+
+// exit codes of "ledger verify"
+const (
+	verifyOK       = 0 // the books are right
+	verifyProblems = 1 // something doesn't add up
+	verifyFailed   = 2 // the check itself couldn't run
+)
+
+// runVerify recomputes every balance from the journal and prints what is wrong
+func runVerify(args []string) int {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print the full report as JSON")
+	if err := flags.Parse(args); err != nil {
+		return verifyFailed
+	}
+
+	report, err := ledger.Verify()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "verify failed: %v\n", err)
+		return verifyFailed
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			fmt.Fprintf(os.Stderr, "verify failed: %v\n", err)
+			return verifyFailed
+		}
+	} else {
+		printReport(report)
+	}
+
+	if !report.OK() {
+		return verifyProblems
+	}
+	return verifyOK
+}
+
+// printReport writes a report for people to read
+func printReport(report *ledger.IntegrityReport) {
+	fmt.Printf("Checked %d accounts at %s\n", report.Accounts, report.CheckedAt.Format("2006-01-02 15:04:05"))
+
+	for _, total := range report.Totals {
+		status := "ok"
+		if !total.PostingTotal.IsZero() || !total.BalanceTotal.IsZero() {
+			status = "NOT CONSERVED"
+		}
+		fmt.Printf("  %s: postings %s, balances %s (%s)\n", total.Currency, total.PostingTotal, total.BalanceTotal, status)
+	}
+
+	if len(report.Drifts) > 0 {
+		fmt.Printf("%d accounts drifted from the journal:\n", len(report.Drifts))
+		for _, drift := range report.Drifts {
+			owner := "system"
+			if drift.UserID != nil {
+				owner = fmt.Sprintf("user %d", *drift.UserID)
+			} else if drift.Code != nil {
+				owner = *drift.Code
+			}
+			fmt.Printf("  account %d (%s, %s): balance %s, journal %s, delta %s\n",
+				drift.AccountID, owner, drift.Currency, drift.Balance, drift.JournalBalance, drift.Delta)
+		}
+	}
+
+	if len(report.UnbalancedEntries) > 0 {
+		fmt.Printf("%d journal entries are not balanced:\n", len(report.UnbalancedEntries))
+		for _, entry := range report.UnbalancedEntries {
+			fmt.Printf("  transaction %d: %s %s over %d postings\n", entry.TransactionID, entry.Total, entry.Currency, entry.PostingCount)
+		}
+	}
+
+	if report.OK() {
+		fmt.Println("Ledger is consistent")
+	} else {
+		fmt.Printf("Ledger has %d problems\n", report.Problems())
+	}
+}